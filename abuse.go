@@ -0,0 +1,202 @@
+// abuse.go - Katzenpost provider client abuse counters.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/internal/tokenbucket"
+	"github.com/op/go-logging"
+)
+
+type abuseKind int
+
+const (
+	abuseProtocolViolation abuseKind = iota
+	abuseMalformedCommand
+	abuseExcessivePolling
+
+	nrAbuseKinds
+)
+
+func (k abuseKind) String() string {
+	switch k {
+	case abuseProtocolViolation:
+		return "ProtocolViolations"
+	case abuseMalformedCommand:
+		return "MalformedCommands"
+	case abuseExcessivePolling:
+		return "ExcessivePolling"
+	default:
+		return "[Unknown]"
+	}
+}
+
+type abuseCounters struct {
+	counts      [nrAbuseKinds]uint64
+	strikes     int
+	bannedUntil time.Time
+	pollLimit   *tokenbucket.Bucket
+}
+
+// abuseTracker counts the misbehavior of each client account, and optionally
+// throttles and temporarily bans offenders.
+type abuseTracker struct {
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	accounts map[string]*abuseCounters
+}
+
+func (t *abuseTracker) account(u []byte) *abuseCounters {
+	a, ok := t.accounts[string(u)]
+	if !ok {
+		rate := float64(t.s.cfg.Debug.ClientPollRate)
+		if p := t.s.provider; p != nil {
+			rate = float64(p.pollRate(u))
+		}
+		a = &abuseCounters{pollLimit: tokenbucket.New(rate, 2*rate)}
+		t.accounts[string(u)] = a
+	}
+	return a
+}
+
+// setPollRate changes the spool retrieval rate limit of the client u.
+func (t *abuseTracker) setPollRate(u []byte, rate int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if a, ok := t.accounts[string(u)]; ok {
+		a.pollLimit = tokenbucket.New(float64(rate), 2*float64(rate))
+	}
+}
+
+// onAbuse records misbehavior by the client u, and returns true iff the
+// client is now banned.
+func (t *abuseTracker) onAbuse(u []byte, kind abuseKind) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.doAbuse(u, kind)
+}
+
+func (t *abuseTracker) doAbuse(u []byte, kind abuseKind) bool {
+	a := t.account(u)
+	a.counts[kind]++
+	a.strikes++
+
+	threshold := t.s.cfg.Debug.ClientBanThreshold
+	if threshold <= 0 || a.strikes < threshold {
+		return false
+	}
+
+	banDuration := time.Duration(t.s.cfg.Debug.ClientBanDuration) * time.Millisecond
+	a.strikes = 0
+	a.bannedUntil = time.Now().Add(banDuration)
+	user := utils.ASCIIBytesToPrintString(u)
+	t.log.Warningf("Banning client '%v' for %v (%v).", t.s.logRedactor.user(u), banDuration, kind)
+	t.s.events.emit(&Event{Type: EventClientBanned, Reason: user})
+	return true
+}
+
+// onPoll records a spool retrieval by the client u, and returns how long the
+// retrieval should be delayed by, and if the client is now banned.
+func (t *abuseTracker) onPoll(u []byte) (time.Duration, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	// When throttling, excessive polls go into debt so that they are
+	// delayed till they conform to the rate limit.
+	var delay time.Duration
+	pollLimit := t.account(u).pollLimit
+	if t.s.cfg.Debug.ThrottleAbusiveClients {
+		if delay = pollLimit.Take(1); delay <= 0 {
+			return 0, false
+		}
+	} else if pollLimit.Allow(1) {
+		return 0, false
+	}
+	return delay, t.doAbuse(u, abuseExcessivePolling)
+}
+
+func (t *abuseTracker) isBanned(u []byte) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	a, ok := t.accounts[string(u)]
+	return ok && time.Now().Before(a.bannedUntil)
+}
+
+func (t *abuseTracker) onMgmtAbuseList(c *thwack.Conn, l string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	users := make([]string, 0, len(t.accounts))
+	for u := range t.accounts {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	now := time.Now()
+	for _, u := range users {
+		a := t.accounts[u]
+		var banned time.Duration
+		if now.Before(a.bannedUntil) {
+			banned = a.bannedUntil.Sub(now).Truncate(time.Second)
+		}
+		if err := c.Writer().PrintfLine("%v-User:%v %v:%v %v:%v %v:%v Banned:%v", thwack.StatusOk, utils.ASCIIBytesToPrintString([]byte(u)),
+			abuseProtocolViolation, a.counts[abuseProtocolViolation],
+			abuseMalformedCommand, a.counts[abuseMalformedCommand],
+			abuseExcessivePolling, a.counts[abuseExcessivePolling], banned); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (t *abuseTracker) onMgmtAbuseReset(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("ABUSE_RESET invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.accounts[sp[1]]; !ok {
+		c.Log().Errorf("No abuse counters for user '%v'", sp[1])
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	delete(t.accounts, sp[1])
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newAbuseTracker(s *Server) *abuseTracker {
+	t := new(abuseTracker)
+	t.s = s
+	t.log = s.newLogger("abuse")
+	t.accounts = make(map[string]*abuseCounters)
+	return t
+}
@@ -0,0 +1,201 @@
+// accountexpiry.go - Katzenpost provider idle account expiry.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/userdb"
+	"github.com/op/go-logging"
+)
+
+const accountExpiryInterval = 1 * time.Hour
+
+// accountExpiry implements the provider idle account expiry policy, that
+// disables and eventually deletes the accounts of users that have not
+// authenticated or received messages for a long time.
+type accountExpiry struct {
+	p   *provider
+	log *logging.Logger
+	cfg *config.AccountExpiry
+}
+
+func (e *accountExpiry) isDisabled(u []byte) bool {
+	b, err := e.p.userDB.GetMetadata(u, userdb.MetadataDisabled)
+	return err == nil && b != nil
+}
+
+func metadataTime(m map[string][]byte, key string) time.Time {
+	if b, ok := m[key]; ok {
+		if t, err := userdb.DecodeTime(b); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// lastActive returns the time the user was last active, or the zero time if
+// there is no record of any activity.
+func lastActive(m map[string][]byte) time.Time {
+	var last time.Time
+	for _, k := range []string{userdb.MetadataCreated, userdb.MetadataLastSeen, userdb.MetadataLastSpooled} {
+		if t := metadataTime(m, k); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+func (e *accountExpiry) worker() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-e.p.HaltCh():
+			return
+		case <-timer.C:
+		}
+		e.sweep()
+		timer.Reset(accountExpiryInterval)
+	}
+}
+
+func (e *accountExpiry) sweep() {
+	const day = 24 * time.Hour
+
+	users, err := e.p.userDB.Users()
+	if err != nil {
+		e.log.Warningf("Failed to enumerate users: %v", err)
+		return
+	}
+
+	disableAfter := time.Duration(e.cfg.DisableAfter) * day
+	deleteAfter := time.Duration(e.cfg.DeleteAfter) * day
+	warnAfter := disableAfter - time.Duration(e.cfg.WarnBefore)*day
+
+	now := time.Now()
+	nrDisabled, nrDeleted := 0, 0
+	for _, u := range users {
+		select {
+		case <-e.p.HaltCh():
+			return
+		default:
+		}
+
+		m, err := e.p.userDB.Metadata(u)
+		if err != nil {
+			continue
+		}
+		last := lastActive(m)
+		if last.IsZero() {
+			// Users that predate the activity tracking start out as active.
+			e.p.userDB.SetMetadata(u, userdb.MetadataLastSeen, userdb.EncodeTime(now))
+			continue
+		}
+
+		idle := now.Sub(last)
+		switch {
+		case deleteAfter > 0 && idle >= deleteAfter:
+			if err = e.p.removeUser(u); err != nil {
+				e.log.Warningf("Failed to delete idle user '%v': %v", e.p.s.logRedactor.user(u), err)
+				continue
+			}
+			nrDeleted++
+		case idle >= disableAfter:
+			if _, ok := m[userdb.MetadataDisabled]; ok {
+				continue
+			}
+			if err = e.p.userDB.SetMetadata(u, userdb.MetadataDisabled, userdb.EncodeTime(now)); err != nil {
+				e.log.Warningf("Failed to disable idle user '%v': %v", e.p.s.logRedactor.user(u), err)
+				continue
+			}
+			nrDisabled++
+		case e.cfg.WarnBefore > 0 && idle >= warnAfter:
+			// Warn once per idle period.
+			if metadataTime(m, userdb.MetadataExpiryWarned).After(last) {
+				continue
+			}
+			if err = e.p.userDB.SetMetadata(u, userdb.MetadataExpiryWarned, userdb.EncodeTime(now)); err != nil {
+				continue
+			}
+			e.log.Debugf("Idle user '%v' will be disabled in: %v", e.p.s.logRedactor.user(u), disableAfter-idle)
+			e.queueWarning(u, last.Add(disableAfter))
+			e.p.s.events.emit(&Event{Type: EventAccountExpiring, Reason: utils.ASCIIBytesToPrintString(u)})
+		}
+	}
+	if nrDisabled > 0 || nrDeleted > 0 {
+		e.log.Noticef("Idle accounts: %v disabled, %v deleted.", nrDisabled, nrDeleted)
+	}
+}
+
+// queueWarning queues a notice in the user's spool, warning that the account
+// will be disabled at the time t unless it is used.
+func (e *accountExpiry) queueWarning(u []byte, t time.Time) {
+	b, err := spool.EncodeNotice(&spool.Notice{
+		Type: spool.NoticeAccountExpiring,
+		Time: t,
+		Text: "This account will be disabled for inactivity, unless it is used before then.",
+	}, u, e.p.s.identityKey)
+	if err == nil {
+		// Note: This bypasses provider.onSpooled, so that the notice does
+		// not count as activity.
+		err = e.p.spool.StoreMessage(u, b)
+	}
+	if err != nil {
+		e.log.Warningf("Failed to queue the expiry warning for '%v': %v", e.p.s.logRedactor.user(u), err)
+	}
+}
+
+func (e *accountExpiry) onMgmtEnableUser(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("ENABLE_USER invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Re-enabled users start a fresh idle period.
+	u := []byte(sp[1])
+	if err := e.p.userDB.SetMetadata(u, userdb.MetadataDisabled, nil); err != nil {
+		c.Log().Errorf("Failed to enable user '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	if err := e.p.userDB.SetMetadata(u, userdb.MetadataLastSeen, userdb.EncodeTime(time.Now())); err != nil {
+		c.Log().Errorf("Failed to enable user '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newAccountExpiry(p *provider) *accountExpiry {
+	e := new(accountExpiry)
+	e.p = p
+	e.log = p.s.newLogger("account expiry")
+	e.cfg = p.s.cfg.Provider.AccountExpiry
+
+	if p.s.cfg.Management.Enable {
+		const cmdEnableUser = "ENABLE_USER"
+		p.s.management.RegisterCommand(cmdEnableUser, e.onMgmtEnableUser)
+	}
+
+	return e
+}
@@ -0,0 +1,502 @@
+// accounting.go - Katzenpost server persistent traffic accounting.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+const (
+	accountingFile          = "accounting.db"
+	accountingBucket        = "epochs"
+	accountingFlushInterval = 1 * time.Minute
+)
+
+type dropReason int
+
+const (
+	dropUnwrapFailed dropReason = iota
+	dropInvalidCommands
+	dropInvalidPacket
+	dropQueueFull
+	dropInvalidNextHop
+	dropDeadlineBlown
+	dropForwardingPaused
+	dropNoConnection
+	dropSendFailed
+	dropInvalidRecipient
+	dropForwardCap
+	dropUndecryptable
+	dropProviderQueueFull
+	dropSURBReplay
+	dropSpoolFull
+	dropMisSized
+	dropLowDiskSpace
+	dropDelistedNextHop
+	dropParkingExpired
+	dropDelayOutOfBounds
+	dropReplayWarmup
+
+	nrDropReasons
+)
+
+func (r dropReason) String() string {
+	switch r {
+	case dropUnwrapFailed:
+		return "UnwrapFailed"
+	case dropInvalidCommands:
+		return "InvalidCommands"
+	case dropInvalidPacket:
+		return "InvalidPacket"
+	case dropQueueFull:
+		return "QueueFull"
+	case dropInvalidNextHop:
+		return "InvalidNextHop"
+	case dropDeadlineBlown:
+		return "DeadlineBlown"
+	case dropForwardingPaused:
+		return "ForwardingPaused"
+	case dropNoConnection:
+		return "NoConnection"
+	case dropSendFailed:
+		return "SendFailed"
+	case dropInvalidRecipient:
+		return "InvalidRecipient"
+	case dropForwardCap:
+		return "ForwardCap"
+	case dropUndecryptable:
+		return "Undecryptable"
+	case dropProviderQueueFull:
+		return "ProviderQueueFull"
+	case dropSURBReplay:
+		return "SURBReplay"
+	case dropSpoolFull:
+		return "SpoolFull"
+	case dropMisSized:
+		return "MisSized"
+	case dropLowDiskSpace:
+		return "LowDiskSpace"
+	case dropDelistedNextHop:
+		return "DelistedNextHop"
+	case dropParkingExpired:
+		return "ParkingExpired"
+	case dropDelayOutOfBounds:
+		return "DelayOutOfBounds"
+	case dropReplayWarmup:
+		return "ReplayWarmup"
+	default:
+		return "[Unknown]"
+	}
+}
+
+// accountingRecord is the persisted traffic accounting for an epoch.
+type accountingRecord struct {
+	PktsIn   uint64
+	BytesIn  uint64
+	PktsOut  uint64
+	BytesOut uint64
+
+	Drops  map[string]uint64                `json:",omitempty"`
+	Peers  map[string]*accountingPeerRecord `json:",omitempty"`
+	Events map[string]uint64                `json:",omitempty"`
+}
+
+type accountingPeerRecord struct {
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+func (r *accountingRecord) add(d *accountingRecord) {
+	r.PktsIn += d.PktsIn
+	r.BytesIn += d.BytesIn
+	r.PktsOut += d.PktsOut
+	r.BytesOut += d.BytesOut
+	for k, v := range d.Drops {
+		if r.Drops == nil {
+			r.Drops = make(map[string]uint64)
+		}
+		r.Drops[k] += v
+	}
+	for k, v := range d.Peers {
+		if r.Peers == nil {
+			r.Peers = make(map[string]*accountingPeerRecord)
+		}
+		p, ok := r.Peers[k]
+		if !ok {
+			p = new(accountingPeerRecord)
+			r.Peers[k] = p
+		}
+		p.BytesIn += v.BytesIn
+		p.BytesOut += v.BytesOut
+	}
+	for k, v := range d.Events {
+		if r.Events == nil {
+			r.Events = make(map[string]uint64)
+		}
+		r.Events[k] += v
+	}
+}
+
+func (r *accountingRecord) nrDrops() uint64 {
+	var n uint64
+	for _, v := range r.Drops {
+		n += v
+	}
+	return n
+}
+
+// accounting maintains cumulative per-epoch traffic statistics and event
+// counts, that are periodically persisted to the DataDir, so that they
+// survive restarts.  The counts roll over to a new record at each epoch
+// boundary.  The per-peer byte counts are derived from the peer statistics,
+// and the event counts from the event bus.
+type accounting struct {
+	// Note: The counters are first to guarantee 64 bit alignment.
+
+	// Counters since the last flush, MUST be accessed via sync/atomic.
+	pktsIn   uint64
+	bytesIn  uint64
+	pktsOut  uint64
+	bytesOut uint64
+	drops    [nrDropReasons]uint64
+
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+	db  *bolt.DB
+	wg  sync.WaitGroup
+
+	epoch        uint64
+	lastFlush    time.Time
+	lastPeerSent map[[constants.NodeIDLength]byte]uint64
+	lastPeerRecv map[[constants.NodeIDLength]byte]uint64
+}
+
+func (ac *accounting) onReceived(n int) {
+	atomic.AddUint64(&ac.pktsIn, 1)
+	atomic.AddUint64(&ac.bytesIn, uint64(n))
+}
+
+func (ac *accounting) onSent(n int) {
+	atomic.AddUint64(&ac.pktsOut, 1)
+	atomic.AddUint64(&ac.bytesOut, uint64(n))
+}
+
+func (ac *accounting) onDrop(r dropReason) {
+	atomic.AddUint64(&ac.drops[r], 1)
+}
+
+// collect returns the counts accumulated since the last call.  It MUST be
+// called with the lock held.
+func (ac *accounting) collect() *accountingRecord {
+	r := &accountingRecord{
+		PktsIn:   atomic.SwapUint64(&ac.pktsIn, 0),
+		BytesIn:  atomic.SwapUint64(&ac.bytesIn, 0),
+		PktsOut:  atomic.SwapUint64(&ac.pktsOut, 0),
+		BytesOut: atomic.SwapUint64(&ac.bytesOut, 0),
+	}
+	for i := range ac.drops {
+		if n := atomic.SwapUint64(&ac.drops[i], 0); n > 0 {
+			if r.Drops == nil {
+				r.Drops = make(map[string]uint64)
+			}
+			r.Drops[dropReason(i).String()] = n
+		}
+	}
+	for t, n := range ac.s.events.collectCounts() {
+		if n == 0 {
+			continue
+		}
+		if r.Events == nil {
+			r.Events = make(map[string]uint64)
+		}
+		r.Events[EventType(t).String()] = n
+	}
+	for id, pc := range ac.s.peerStats.snapshot() {
+		sent, recv := pc.bytesSent-ac.lastPeerSent[id], pc.bytesRecv-ac.lastPeerRecv[id]
+		ac.lastPeerSent[id], ac.lastPeerRecv[id] = pc.bytesSent, pc.bytesRecv
+		if sent == 0 && recv == 0 {
+			continue
+		}
+		if r.Peers == nil {
+			r.Peers = make(map[string]*accountingPeerRecord)
+		}
+		r.Peers[nodeIDToPrintString(&id)] = &accountingPeerRecord{BytesIn: recv, BytesOut: sent}
+	}
+	return r
+}
+
+func epochToKey(epoch uint64) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], epoch)
+	return k[:]
+}
+
+func (ac *accounting) store(epoch uint64, d *accountingRecord) error {
+	return ac.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(accountingBucket))
+
+		r := new(accountingRecord)
+		k := epochToKey(epoch)
+		if b := bkt.Get(k); b != nil {
+			if err := json.Unmarshal(b, r); err != nil {
+				return err
+			}
+		}
+		r.add(d)
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err = bkt.Put(k, b); err != nil {
+			return err
+		}
+
+		// Prune the records past the retention period.
+		keep := uint64(ac.s.cfg.Debug.AccountingRetention)
+		if epoch < keep {
+			return nil
+		}
+		var stale [][]byte
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= epoch-keep; k, _ = c.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		for _, k := range stale {
+			if err = bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// flush persists the counts accumulated since the last flush.  If async is
+// set, the database write is done in a separate go routine.
+func (ac *accounting) flush(async bool) {
+	ac.Lock()
+	defer ac.Unlock()
+
+	epoch, d := ac.epoch, ac.collect()
+	ac.lastFlush = time.Now()
+	if now, _, _ := ac.s.epochNow(); now != ac.epoch {
+		ac.epoch = now
+	}
+
+	fn := func() {
+		if err := ac.store(epoch, d); err != nil {
+			ac.log.Warningf("Failed to persist accounting for epoch %v: %v", epoch, err)
+		}
+	}
+	if !async {
+		fn()
+		return
+	}
+	ac.wg.Add(1)
+	go func() {
+		defer ac.wg.Done()
+		fn()
+	}()
+}
+
+func (ac *accounting) onTick(now time.Time) {
+	ac.Lock()
+	epoch, lastFlush := ac.epoch, ac.lastFlush
+	ac.Unlock()
+
+	if e, _, _ := ac.s.epochNow(); e != epoch || now.Sub(lastFlush) >= accountingFlushInterval {
+		ac.flush(true)
+	}
+}
+
+func (ac *accounting) load(epoch uint64) (*accountingRecord, error) {
+	r := new(accountingRecord)
+	err := ac.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(accountingBucket)).Get(epochToKey(epoch))
+		if b == nil {
+			return fmt.Errorf("no accounting for epoch %v", epoch)
+		}
+		return json.Unmarshal(b, r)
+	})
+	return r, err
+}
+
+func (ac *accounting) onMgmtAccounting(c *thwack.Conn, l string) error {
+	sp := strings.Fields(l)
+	switch len(sp) {
+	case 1:
+		return ac.doMgmtList(c)
+	case 2:
+		if sp[1] == "TOTAL" {
+			return ac.doMgmtTotal(c)
+		}
+		epoch, err := strconv.ParseUint(sp[1], 10, 64)
+		if err != nil {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		return ac.doMgmtEpoch(c, epoch)
+	default:
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+}
+
+func (ac *accounting) doMgmtList(c *thwack.Conn) error {
+	var lines []string
+	if err := ac.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(accountingBucket)).ForEach(func(k, v []byte) error {
+			r := new(accountingRecord)
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("Epoch:%v PktsIn:%v BytesIn:%v PktsOut:%v BytesOut:%v Drops:%v", binary.BigEndian.Uint64(k), r.PktsIn, r.BytesIn, r.PktsOut, r.BytesOut, r.nrDrops()))
+			return nil
+		})
+	}); err != nil {
+		c.Log().Errorf("Failed to query accounting: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	for _, v := range lines {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (ac *accounting) doMgmtEpoch(c *thwack.Conn, epoch uint64) error {
+	r, err := ac.load(epoch)
+	if err != nil {
+		c.Log().Debugf("Failed to query accounting: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return writeAccountingRecord(c, fmt.Sprintf("Epoch:%v", epoch), r)
+}
+
+// doMgmtTotal reports the cumulative accounting over all of the retained
+// epochs, including the counts that have yet to be flushed.
+func (ac *accounting) doMgmtTotal(c *thwack.Conn) error {
+	ac.flush(false)
+
+	total := new(accountingRecord)
+	nrEpochs := 0
+	if err := ac.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(accountingBucket)).ForEach(func(k, v []byte) error {
+			r := new(accountingRecord)
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			total.add(r)
+			nrEpochs++
+			return nil
+		})
+	}); err != nil {
+		c.Log().Errorf("Failed to query accounting: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return writeAccountingRecord(c, fmt.Sprintf("Epochs:%v", nrEpochs), total)
+}
+
+func writeAccountingRecord(c *thwack.Conn, label string, r *accountingRecord) error {
+	if err := c.Writer().PrintfLine("%v-%v PktsIn:%v BytesIn:%v PktsOut:%v BytesOut:%v", thwack.StatusOk, label, r.PktsIn, r.BytesIn, r.PktsOut, r.BytesOut); err != nil {
+		return err
+	}
+	reasons := make([]string, 0, len(r.Drops))
+	for k := range r.Drops {
+		reasons = append(reasons, k)
+	}
+	sort.Strings(reasons)
+	for _, k := range reasons {
+		if err := c.Writer().PrintfLine("%v-Drop %v:%v", thwack.StatusOk, k, r.Drops[k]); err != nil {
+			return err
+		}
+	}
+	events := make([]string, 0, len(r.Events))
+	for k := range r.Events {
+		events = append(events, k)
+	}
+	sort.Strings(events)
+	for _, k := range events {
+		if err := c.Writer().PrintfLine("%v-Event %v:%v", thwack.StatusOk, k, r.Events[k]); err != nil {
+			return err
+		}
+	}
+	ids := make([]string, 0, len(r.Peers))
+	for k := range r.Peers {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	for _, k := range ids {
+		p := r.Peers[k]
+		if err := c.Writer().PrintfLine("%v-Peer %v BytesIn:%v BytesOut:%v", thwack.StatusOk, k, p.BytesIn, p.BytesOut); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (ac *accounting) halt() {
+	ac.wg.Wait()
+	ac.flush(false)
+	ac.db.Sync()
+	ac.db.Close()
+}
+
+func newAccounting(s *Server) (*accounting, error) {
+	ac := new(accounting)
+	ac.s = s
+	ac.log = s.newLogger("accounting")
+	ac.epoch, _, _ = s.epochNow()
+	ac.lastFlush = time.Now()
+	ac.lastPeerSent = make(map[[constants.NodeIDLength]byte]uint64)
+	ac.lastPeerRecv = make(map[[constants.NodeIDLength]byte]uint64)
+
+	var err error
+	f := filepath.Join(s.dataDir(), accountingFile)
+	if ac.db, err = bolt.Open(f, 0600, nil); err != nil {
+		return nil, err
+	}
+	if err = ac.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(accountingBucket))
+		return err
+	}); err != nil {
+		ac.db.Close()
+		return nil, err
+	}
+
+	if s.cfg.Management.Enable {
+		const cmdAccounting = "ACCOUNTING"
+		s.management.RegisterCommand(cmdAccounting, ac.onMgmtAccounting)
+	}
+
+	return ac, nil
+}
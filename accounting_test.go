@@ -0,0 +1,157 @@
+// accounting_test.go - Katzenpost server traffic accounting tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAccounting(t *testing.T, dir string) *accounting {
+	require := require.New(t)
+
+	s := &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				AccountingRetention: 2,
+			},
+		},
+		peerStats: &peerStats{
+			peers: make(map[[constants.NodeIDLength]byte]*peerCounters),
+		},
+	}
+	ac := new(accounting)
+	ac.s = s
+	ac.log = logging.MustGetLogger("accounting")
+	ac.epoch, _, _ = s.epochNow()
+	ac.lastPeerSent = make(map[[constants.NodeIDLength]byte]uint64)
+	ac.lastPeerRecv = make(map[[constants.NodeIDLength]byte]uint64)
+
+	var err error
+	ac.db, err = bolt.Open(filepath.Join(dir, accountingFile), 0600, nil)
+	require.NoError(err, "bolt.Open()")
+	err = ac.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(accountingBucket))
+		return err
+	})
+	require.NoError(err, "CreateBucketIfNotExists()")
+	return ac
+}
+
+func TestAccountingRollover(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "server_accounting_test")
+	require.NoError(err, "ioutil.TempDir()")
+	defer os.RemoveAll(dir)
+
+	ac := newTestAccounting(t, dir)
+	defer ac.db.Close()
+
+	// Pretend that the current epoch started during the previous one.
+	epoch := ac.epoch
+	ac.epoch = epoch - 1
+
+	var id [constants.NodeIDLength]byte
+	id[0] = 1
+	pc := ac.s.peerStats.get(&id)
+	pc.bytesSent, pc.bytesRecv = 10, 20
+	ac.onReceived(100)
+	ac.onReceived(100)
+	ac.onSent(50)
+	for i := 0; i < 3; i++ {
+		ac.onDrop(dropQueueFull)
+	}
+	ac.onDrop(dropSURBReplay)
+	ac.s.events.emit(&Event{Type: EventPeerBanned})
+
+	// The first flush is attributed to the epoch the counts started in,
+	// and rolls the accounting over to the current epoch.
+	ac.flush(false)
+	assert.Equal(epoch, ac.epoch, "epoch: rolled over")
+	r, err := ac.load(epoch - 1)
+	require.NoError(err, "load(): previous epoch")
+	assert.Equal(uint64(2), r.PktsIn, "PktsIn")
+	assert.Equal(uint64(200), r.BytesIn, "BytesIn")
+	assert.Equal(uint64(1), r.PktsOut, "PktsOut")
+	assert.Equal(uint64(50), r.BytesOut, "BytesOut")
+	assert.Equal(map[string]uint64{"QueueFull": 3, "SURBReplay": 1}, r.Drops, "Drops")
+	assert.Equal(uint64(4), r.nrDrops(), "nrDrops()")
+	assert.Equal(map[string]uint64{EventPeerBanned.String(): 1}, r.Events, "Events")
+	assert.Equal(map[string]*accountingPeerRecord{
+		nodeIDToPrintString(&id): {BytesIn: 20, BytesOut: 10},
+	}, r.Peers, "Peers")
+	_, err = ac.load(epoch)
+	assert.Error(err, "load(): current epoch, before the flush")
+
+	// Only the counts since the last flush are attributed to the current
+	// epoch.
+	pc.bytesSent = 15
+	ac.onDrop(dropQueueFull)
+	ac.flush(false)
+	r, err = ac.load(epoch)
+	require.NoError(err, "load(): current epoch")
+	assert.Zero(r.PktsIn, "PktsIn: current epoch")
+	assert.Equal(map[string]uint64{"QueueFull": 1}, r.Drops, "Drops: current epoch")
+	assert.Equal(map[string]*accountingPeerRecord{
+		nodeIDToPrintString(&id): {BytesIn: 0, BytesOut: 5},
+	}, r.Peers, "Peers: current epoch")
+	r, err = ac.load(epoch - 1)
+	require.NoError(err, "load(): previous epoch, after the rollover")
+	assert.Equal(uint64(2), r.PktsIn, "PktsIn: previous epoch, after the rollover")
+}
+
+func TestAccountingStore(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "server_accounting_test")
+	require.NoError(err, "ioutil.TempDir()")
+	defer os.RemoveAll(dir)
+
+	ac := newTestAccounting(t, dir)
+	defer ac.db.Close()
+
+	// Records for the same epoch are added together.
+	d := &accountingRecord{PktsIn: 1, Drops: map[string]uint64{"QueueFull": 1}}
+	require.NoError(ac.store(10, d), "store()")
+	require.NoError(ac.store(10, d), "store(): again")
+	r, err := ac.load(10)
+	require.NoError(err, "load()")
+	assert.Equal(uint64(2), r.PktsIn, "PktsIn: accumulated")
+	assert.Equal(map[string]uint64{"QueueFull": 2}, r.Drops, "Drops: accumulated")
+
+	// Only the records within the retention period are kept.
+	require.NoError(ac.store(11, d), "store(): next epoch")
+	require.NoError(ac.store(12, d), "store(): epoch after the retention period")
+	_, err = ac.load(10)
+	assert.Error(err, "load(): expired epoch")
+	for _, epoch := range []uint64{11, 12} {
+		_, err = ac.load(epoch)
+		assert.NoError(err, "load(): retained epoch")
+	}
+}
@@ -0,0 +1,178 @@
+// alert.go - Katzenpost server alerting hooks.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/katzenpost/core/worker"
+	"github.com/op/go-logging"
+)
+
+const (
+	alertTimeout   = 30 * time.Second
+	alertQueueSize = 64
+)
+
+// alert is the JSON object delivered to the alerting webhook and command.
+type alert struct {
+	Node       string    `json:"node"`
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Epoch      uint64    `json:"epoch,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Suppressed int       `json:"suppressed,omitempty"`
+}
+
+type alertState struct {
+	lastSent   time.Time
+	suppressed int
+}
+
+// alerter delivers the high severity server events to the configured
+// webhook and or command.  Repeated alerts are rate limited per event type
+// and reason, so that a persistent condition does not page the operator
+// once per occurrence.
+type alerter struct {
+	worker.Worker
+
+	s   *Server
+	log *logging.Logger
+	sub *EventSubscription
+
+	client *http.Client
+	states map[string]*alertState
+}
+
+func isAlertEvent(t EventType) bool {
+	switch t {
+	case EventDegraded, EventAttackSuspected, EventOverloaded:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *alerter) worker() {
+	for {
+		var ev *Event
+		var ok bool
+		select {
+		case <-a.HaltCh():
+			return
+		case ev, ok = <-a.sub.Events():
+			if !ok {
+				return
+			}
+		}
+		if isAlertEvent(ev.Type) {
+			a.onEvent(ev)
+		}
+	}
+}
+
+func (a *alerter) onEvent(ev *Event) {
+	key := ev.Type.String() + "/" + ev.Reason
+	st, ok := a.states[key]
+	if !ok {
+		st = new(alertState)
+		a.states[key] = st
+	}
+	minInterval := time.Duration(a.s.cfg.Alerting.MinInterval) * time.Millisecond
+	if !st.lastSent.IsZero() && ev.Time.Sub(st.lastSent) < minInterval {
+		st.suppressed++
+		return
+	}
+
+	al := &alert{
+		Node:       a.s.cfg.Server.Identifier,
+		Time:       ev.Time,
+		Type:       ev.Type.String(),
+		Epoch:      ev.Epoch,
+		Reason:     ev.Reason,
+		Suppressed: st.suppressed,
+	}
+	st.lastSent = ev.Time
+	st.suppressed = 0
+
+	b, err := json.Marshal(al)
+	if err != nil {
+		a.log.Errorf("Failed to serialize alert: %v", err)
+		return
+	}
+	a.log.Noticef("Alerting: %v %v", al.Type, al.Reason)
+	if a.s.cfg.Alerting.WebhookURL != "" {
+		if err = a.doWebhook(b); err != nil {
+			a.log.Warningf("Failed to deliver alert to the webhook: %v", err)
+		}
+	}
+	if a.s.cfg.Alerting.Command != "" {
+		if err = a.doCommand(b); err != nil {
+			a.log.Warningf("Failed to deliver alert to the command: %v", err)
+		}
+	}
+}
+
+func (a *alerter) doWebhook(b []byte) error {
+	resp, err := a.client.Post(a.s.cfg.Alerting.WebhookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	return nil
+}
+
+func (a *alerter) doCommand(b []byte) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancelFn()
+
+	cmd := exec.CommandContext(ctx, a.s.cfg.Alerting.Command, a.s.cfg.Alerting.Args...)
+	cmd.Stdin = bytes.NewReader(b)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) > 0 {
+			a.log.Debugf("Command output: %s", out)
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *alerter) halt() {
+	a.Halt()
+	a.sub.Close()
+}
+
+func newAlerter(s *Server) *alerter {
+	a := &alerter{
+		s:      s,
+		log:    s.newLogger("alerting"),
+		sub:    s.SubscribeEvents(alertQueueSize),
+		client: &http.Client{Timeout: alertTimeout},
+		states: make(map[string]*alertState),
+	}
+	a.Go(s.superviseOptional("alerting", a.worker))
+	return a
+}
@@ -0,0 +1,225 @@
+// attackdetect.go - Katzenpost server attack heuristics.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+const (
+	attackCheckInterval  = 1 * time.Minute
+	attackWarmupWindows  = 10
+	attackEWMAWeight     = 0.1
+	attackRateFactor     = 4.0
+	attackMinPackets     = 100
+	attackSourceShare    = 0.8
+	attackDecoyLossRatio = 0.2
+	attackMinDecoyLoops  = 10
+)
+
+type attackAlarm int
+
+const (
+	alarmFlood attackAlarm = iota
+	alarmStarvation
+	alarmSourceConcentration
+	alarmDecoyLoss
+
+	nrAttackAlarms
+)
+
+func (a attackAlarm) String() string {
+	switch a {
+	case alarmFlood:
+		return "Flood"
+	case alarmStarvation:
+		return "Starvation"
+	case alarmSourceConcentration:
+		return "SourceConcentration"
+	case alarmDecoyLoss:
+		return "DecoyLoss"
+	default:
+		return "[Unknown]"
+	}
+}
+
+// attackDetector applies simple heuristics to the traffic seen by the node
+// to detect active (n-1, blending, flooding) attacks.  Each check interval
+// the following are examined:
+//
+//   - The inbound packet rate, against a moving average.  An attacker that
+//     floods the node, or that blocks all other traffic to isolate a target
+//     packet, will cause a sharp change.
+//   - The share of the inbound mix traffic from the busiest peer.
+//   - The ratio of decoy loops that fail to return.
+//
+// Alarms are edge triggered, and are logged, emitted as events, and counted.
+type attackDetector struct {
+	inbound uint64 // MUST be accessed via sync/atomic.
+
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	lastCheck         time.Time
+	lastInbound       uint64
+	lastPeerRecv      map[[constants.NodeIDLength]byte]uint64
+	lastDecoyReceived uint64
+	lastDecoyLost     uint64
+	nrWindows         int
+
+	rate        float64
+	avgRate     float64
+	sourceShare float64
+	decoyLoss   float64
+
+	active [nrAttackAlarms]bool
+	raised [nrAttackAlarms]uint64
+}
+
+func (ad *attackDetector) onInbound() {
+	atomic.AddUint64(&ad.inbound, 1)
+}
+
+func (ad *attackDetector) onTick(now time.Time) {
+	ad.Lock()
+	defer ad.Unlock()
+
+	if now.Sub(ad.lastCheck) < attackCheckInterval {
+		return
+	}
+	ad.lastCheck = now
+
+	ad.checkRate()
+	ad.checkSources()
+	ad.checkDecoys()
+}
+
+func (ad *attackDetector) checkRate() {
+	inbound := atomic.LoadUint64(&ad.inbound)
+	ad.rate = float64(inbound - ad.lastInbound)
+	ad.lastInbound = inbound
+
+	isWarm := ad.nrWindows >= attackWarmupWindows && ad.avgRate >= attackMinPackets
+	isFlood := isWarm && ad.rate > ad.avgRate*attackRateFactor
+	isStarved := isWarm && ad.rate < ad.avgRate/attackRateFactor
+	ad.setAlarm(alarmFlood, isFlood, fmt.Sprintf("%.0f pkts/interval, average %.0f", ad.rate, ad.avgRate))
+	ad.setAlarm(alarmStarvation, isStarved, fmt.Sprintf("%.0f pkts/interval, average %.0f", ad.rate, ad.avgRate))
+
+	// Don't let an ongoing attack become the baseline.
+	switch {
+	case isFlood || isStarved:
+	case ad.nrWindows == 0:
+		ad.avgRate = ad.rate
+	default:
+		ad.avgRate += attackEWMAWeight * (ad.rate - ad.avgRate)
+	}
+	ad.nrWindows++
+}
+
+func (ad *attackDetector) checkSources() {
+	var total, top uint64
+	m := ad.s.peerStats.snapshot()
+	for id, pc := range m {
+		delta := pc.pktsRecv - ad.lastPeerRecv[id]
+		ad.lastPeerRecv[id] = pc.pktsRecv
+		total += delta
+		if delta > top {
+			top = delta
+		}
+	}
+
+	// A single incoming peer is not suspicious in of itself.
+	ad.sourceShare = 0
+	if total > 0 {
+		ad.sourceShare = float64(top) / float64(total)
+	}
+	isConcentrated := len(m) > 1 && total >= attackMinPackets && ad.sourceShare > attackSourceShare
+	ad.setAlarm(alarmSourceConcentration, isConcentrated, fmt.Sprintf("busiest peer sent %.0f%% of %v pkts", ad.sourceShare*100, total))
+}
+
+func (ad *attackDetector) checkDecoys() {
+	d := ad.s.decoy
+	if d == nil {
+		return
+	}
+	received, lost := atomic.LoadUint64(&d.received), atomic.LoadUint64(&d.lost)
+	nrReceived, nrLost := received-ad.lastDecoyReceived, lost-ad.lastDecoyLost
+	ad.lastDecoyReceived, ad.lastDecoyLost = received, lost
+
+	n := nrReceived + nrLost
+	if n < attackMinDecoyLoops {
+		// Too few loops to say anything meaningful, retain the old state.
+		return
+	}
+	ad.decoyLoss = float64(nrLost) / float64(n)
+	ad.setAlarm(alarmDecoyLoss, ad.decoyLoss > attackDecoyLossRatio, fmt.Sprintf("%v of %v loops lost", nrLost, n))
+}
+
+func (ad *attackDetector) setAlarm(a attackAlarm, isActive bool, detail string) {
+	if isActive == ad.active[a] {
+		return
+	}
+	ad.active[a] = isActive
+	if !isActive {
+		ad.log.Noticef("Attack heuristic cleared: %v", a)
+		return
+	}
+
+	ad.raised[a]++
+	reason := fmt.Sprintf("%v (%v)", a, detail)
+	ad.log.Warningf("Attack heuristic triggered: %v", reason)
+	ad.s.events.emit(&Event{Type: EventAttackSuspected, Reason: reason})
+}
+
+func (ad *attackDetector) onMgmtAttackStatus(c *thwack.Conn, l string) error {
+	ad.Lock()
+	defer ad.Unlock()
+
+	if err := c.Writer().PrintfLine("%v-Rate:%.0f AverageRate:%.0f SourceShare:%.3f DecoyLoss:%.3f", thwack.StatusOk, ad.rate, ad.avgRate, ad.sourceShare, ad.decoyLoss); err != nil {
+		return err
+	}
+	for a := attackAlarm(0); a < nrAttackAlarms; a++ {
+		if err := c.Writer().PrintfLine("%v-%v Active:%v Raised:%v", thwack.StatusOk, a, ad.active[a], ad.raised[a]); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newAttackDetector(s *Server) *attackDetector {
+	ad := new(attackDetector)
+	ad.s = s
+	ad.log = s.newLogger("attack")
+	ad.lastCheck = time.Now()
+	ad.lastPeerRecv = make(map[[constants.NodeIDLength]byte]uint64)
+
+	if s.cfg.Management.Enable {
+		const cmdAttackStatus = "ATTACK_STATUS"
+		s.management.RegisterCommand(cmdAttackStatus, ad.onMgmtAttackStatus)
+	}
+
+	return ad
+}
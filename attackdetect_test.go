@@ -0,0 +1,133 @@
+// attackdetect_test.go - Katzenpost server attack heuristics tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAttackDetector() *attackDetector {
+	s := &Server{
+		peerStats: &peerStats{
+			peers: make(map[[constants.NodeIDLength]byte]*peerCounters),
+		},
+	}
+	ad := new(attackDetector)
+	ad.s = s
+	ad.log = logging.MustGetLogger("attack")
+	ad.lastPeerRecv = make(map[[constants.NodeIDLength]byte]uint64)
+	return ad
+}
+
+func runTestAttackWindow(ad *attackDetector, nrPackets uint64) {
+	ad.inbound += nrPackets
+	ad.checkRate()
+}
+
+func TestAttackDetectorRate(t *testing.T) {
+	assert := assert.New(t)
+
+	ad := newTestAttackDetector()
+
+	// Nothing is flagged till the baseline is established.
+	for i := 0; i < attackWarmupWindows; i++ {
+		runTestAttackWindow(ad, 200)
+	}
+	assert.Equal(float64(200), ad.avgRate, "avgRate: warmed up")
+	assert.False(ad.active[alarmFlood], "Flood: steady rate")
+	assert.False(ad.active[alarmStarvation], "Starvation: steady rate")
+
+	// A flood raises the alarm once, and does not become the baseline.
+	runTestAttackWindow(ad, 1000)
+	runTestAttackWindow(ad, 1000)
+	assert.True(ad.active[alarmFlood], "Flood: flooded")
+	assert.Equal(uint64(1), ad.raised[alarmFlood], "Flood: edge triggered")
+	assert.Equal(uint64(1), ad.s.events.counts[EventAttackSuspected], "Flood: event")
+	assert.Equal(float64(200), ad.avgRate, "avgRate: flooded")
+
+	// The alarm clears once the rate is back to normal.
+	runTestAttackWindow(ad, 200)
+	assert.False(ad.active[alarmFlood], "Flood: cleared")
+
+	// As does a sudden drop in traffic.
+	runTestAttackWindow(ad, 10)
+	assert.True(ad.active[alarmStarvation], "Starvation: starved")
+	assert.Equal(float64(200), ad.avgRate, "avgRate: starved")
+	runTestAttackWindow(ad, 200)
+	assert.False(ad.active[alarmStarvation], "Starvation: cleared")
+
+	// Nodes that see hardly any traffic are not flagged.
+	ad = newTestAttackDetector()
+	for i := 0; i < attackWarmupWindows; i++ {
+		runTestAttackWindow(ad, 10)
+	}
+	runTestAttackWindow(ad, 1000)
+	assert.False(ad.active[alarmFlood], "Flood: idle node")
+}
+
+func TestAttackDetectorSources(t *testing.T) {
+	assert := assert.New(t)
+
+	ad := newTestAttackDetector()
+	var a, b [constants.NodeIDLength]byte
+	a[0], b[0] = 1, 2
+	pa, pb := ad.s.peerStats.get(&a), ad.s.peerStats.get(&b)
+
+	// Evenly split traffic is fine.
+	pa.pktsRecv, pb.pktsRecv = 100, 100
+	ad.checkSources()
+	assert.False(ad.active[alarmSourceConcentration], "SourceConcentration: even")
+
+	// Traffic concentrated on a single peer is not.
+	pa.pktsRecv, pb.pktsRecv = 1100, 110
+	ad.checkSources()
+	assert.True(ad.active[alarmSourceConcentration], "SourceConcentration: concentrated")
+	assert.InDelta(1000.0/1010.0, ad.sourceShare, 0.001, "sourceShare")
+
+	// Too few packets to tell.
+	pa.pktsRecv, pb.pktsRecv = 1150, 110
+	ad.checkSources()
+	assert.False(ad.active[alarmSourceConcentration], "SourceConcentration: too few packets")
+}
+
+func TestAttackDetectorDecoys(t *testing.T) {
+	assert := assert.New(t)
+
+	ad := newTestAttackDetector()
+	d := newTestDecoy()
+	ad.s.decoy = d
+
+	// Too few loops to tell.
+	d.received, d.lost = 5, 0
+	ad.checkDecoys()
+	assert.False(ad.active[alarmDecoyLoss], "DecoyLoss: too few loops")
+
+	// Only the loops since the last check count.
+	d.received, d.lost = 10, 5
+	ad.checkDecoys()
+	assert.True(ad.active[alarmDecoyLoss], "DecoyLoss: lossy")
+	assert.Equal(0.5, ad.decoyLoss, "decoyLoss: lossy")
+
+	d.received, d.lost = 30, 5
+	ad.checkDecoys()
+	assert.False(ad.active[alarmDecoyLoss], "DecoyLoss: cleared")
+	assert.Zero(ad.decoyLoss, "decoyLoss: cleared")
+}
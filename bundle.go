@@ -0,0 +1,164 @@
+// bundle.go - Katzenpost server support bundles.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+// supportBundleLogTail is the amount of the most recent log included in a
+// support bundle.
+const supportBundleLogTail = 1 << 20
+
+// writeSupportBundle writes a gzipped tarball of sanitized diagnostics (the
+// status snapshot, the redacted config, a goroutine dump and the tail of the
+// log with anything resembling key material redacted) to the DataDir, and
+// returns the file name.
+//
+// Note: The log and status still contain peer addresses and node
+// identifiers, operators should review bundles before sharing them.
+func (s *Server) writeSupportBundle() (string, error) {
+	var files []string
+	contents := make(map[string][]byte)
+	add := func(name string, b []byte) {
+		files = append(files, name)
+		contents[name] = b
+	}
+
+	b, err := json.MarshalIndent(s.statusSnapshot(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	add("status.json", b)
+
+	cfg, err := s.cfg.Redacted()
+	if err != nil {
+		return "", err
+	}
+	if b, err = json.MarshalIndent(cfg, "", "  "); err != nil {
+		return "", err
+	}
+	add("config.json", b)
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	add("goroutines.txt", redactSecrets(buf))
+
+	if b, err = s.logTail(supportBundleLogTail); err != nil {
+		b = []byte(fmt.Sprintf("The log is unavailable: %v\n", err))
+	}
+	add("server.log", redactSecrets(b))
+
+	name := fmt.Sprintf("support-bundle-%v.tar.gz", time.Now().Unix())
+	f, err := os.OpenFile(filepath.Join(s.dataDir(), name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	now := time.Now()
+	for _, fn := range files {
+		hdr := &tar.Header{
+			Name:    fn,
+			Mode:    0600,
+			Size:    int64(len(contents[fn])),
+			ModTime: now,
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+		if _, err = tw.Write(contents[fn]); err != nil {
+			return "", err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return "", err
+	}
+	if err = zw.Close(); err != nil {
+		return "", err
+	}
+	return name, f.Sync()
+}
+
+// logTail returns up to the last n bytes of the log file, starting at a line
+// boundary.
+func (s *Server) logTail(n int64) ([]byte, error) {
+	if s.logRotator == nil {
+		return nil, fmt.Errorf("not logging to a file")
+	}
+	s.logRotator.Lock()
+	p := s.logRotator.path
+	s.logRotator.Unlock()
+	if p == "" {
+		return nil, fmt.Errorf("the log file is outside of the chroot")
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	off := fi.Size() - n
+	if off < 0 {
+		off = 0
+	}
+	if _, err = f.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, io.LimitReader(f, n)); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	if off > 0 {
+		if idx := bytes.IndexByte(b, '\n'); idx >= 0 {
+			b = b[idx+1:]
+		}
+	}
+	return b, nil
+}
+
+func (s *Server) onMgmtSupportBundle(c *thwack.Conn, l string) error {
+	name, err := s.writeSupportBundle()
+	if err != nil {
+		c.Log().Errorf("SUPPORT_BUNDLE failed: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.log.Noticef("Wrote support bundle: %v", name)
+	if err = c.Writer().PrintfLine("%v-Path:%v", thwack.StatusOk, filepath.Join(s.dataDir(), name)); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
@@ -0,0 +1,202 @@
+// chaos.go - Katzenpost server chaos testing hooks.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+// chaos implements the Debug hooks that allow integration tests to
+// deterministically exercise the epoch related time window edge cases, by
+// skewing the server's notion of time, forcing epoch transitions, and
+// refusing to talk to specific peers.
+type chaos struct {
+	offset int64 // MUST be accessed via sync/atomic.
+
+	sync.RWMutex
+
+	s   *Server
+	log *logging.Logger
+
+	droppedPeers map[[constants.NodeIDLength]byte]bool
+	lastAdvance  time.Time
+}
+
+// epochNow returns the current epoch, the time elapsed since the start of
+// the epoch, and the time till the next epoch, with the chaos time offset
+// applied if any.  All epoch calculations SHOULD use this instead of
+// epochtime.Now.
+func (s *Server) epochNow() (uint64, time.Duration, time.Duration) {
+	epoch, elapsed, till := epochtime.Now()
+	if s.chaos == nil {
+		return epoch, elapsed, till
+	}
+	return s.chaos.adjust(epoch, elapsed)
+}
+
+func (ch *chaos) adjust(epoch uint64, elapsed time.Duration) (uint64, time.Duration, time.Duration) {
+	elapsed += time.Duration(atomic.LoadInt64(&ch.offset))
+	n := int64(elapsed / epochtime.Period)
+	elapsed -= time.Duration(n) * epochtime.Period
+	if elapsed < 0 {
+		elapsed += epochtime.Period
+		n--
+	}
+	return uint64(int64(epoch) + n), elapsed, epochtime.Period - elapsed
+}
+
+func (ch *chaos) skew(d time.Duration) {
+	atomic.AddInt64(&ch.offset, int64(d))
+
+	// Re-evaluate the outgoing connections with the new time.
+	if co := ch.s.connector; co != nil {
+		co.forceUpdate()
+	}
+}
+
+func (ch *chaos) advanceEpochs(n int) {
+	// Advance to just past the start of the n-th next epoch, so that
+	// repeated advances do not accumulate drift.
+	_, elapsed, _ := ch.s.epochNow()
+	ch.skew(time.Duration(n)*epochtime.Period - elapsed)
+	epoch, _, _ := ch.s.epochNow()
+	ch.log.Warningf("Forced epoch transition to: %v", epoch)
+}
+
+func (ch *chaos) onTick(now time.Time) {
+	ival := time.Duration(ch.s.cfg.Debug.ChaosEpochInterval) * time.Millisecond
+	if ival <= 0 || now.Sub(ch.lastAdvance) < ival {
+		return
+	}
+	ch.lastAdvance = now
+	ch.advanceEpochs(1)
+}
+
+func (ch *chaos) isPeerDropped(id *[constants.NodeIDLength]byte) bool {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return ch.droppedPeers[*id]
+}
+
+func (ch *chaos) setPeerDropped(id *[constants.NodeIDLength]byte, isDropped bool) {
+	ch.Lock()
+	if isDropped {
+		ch.droppedPeers[*id] = true
+	} else {
+		delete(ch.droppedPeers, *id)
+	}
+	ch.Unlock()
+
+	if co := ch.s.connector; co != nil {
+		co.forceUpdate()
+	}
+}
+
+func parseNodeID(s string) (*[constants.NodeIDLength]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != constants.NodeIDLength {
+		return nil, fmt.Errorf("invalid node ID length: %v", len(b))
+	}
+	id := new([constants.NodeIDLength]byte)
+	copy(id[:], b)
+	return id, nil
+}
+
+func (ch *chaos) onMgmtAdvanceEpoch(c *thwack.Conn, l string) error {
+	n := 1
+	if sp := strings.Fields(l); len(sp) == 2 {
+		var err error
+		if n, err = strconv.Atoi(sp[1]); err != nil || n <= 0 {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+	} else if len(sp) != 1 {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	ch.advanceEpochs(n)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (ch *chaos) onMgmtSkewClock(c *thwack.Conn, l string) error {
+	sp := strings.Fields(l)
+	if len(sp) != 2 {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	ms, err := strconv.ParseInt(sp[1], 10, 64)
+	if err != nil {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	d := time.Duration(ms) * time.Millisecond
+	ch.skew(d)
+	ch.log.Warningf("Skewed clock by: %v", d)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (ch *chaos) doMgmtDropPeer(c *thwack.Conn, l string, isDropped bool) error {
+	sp := strings.Fields(l)
+	if len(sp) != 2 {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	id, err := parseNodeID(sp[1])
+	if err != nil {
+		c.Log().Debugf("Invalid node ID: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	ch.setPeerDropped(id, isDropped)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (ch *chaos) onMgmtDropPeer(c *thwack.Conn, l string) error {
+	return ch.doMgmtDropPeer(c, l, true)
+}
+
+func (ch *chaos) onMgmtUndropPeer(c *thwack.Conn, l string) error {
+	return ch.doMgmtDropPeer(c, l, false)
+}
+
+func newChaos(s *Server) (*chaos, error) {
+	ch := new(chaos)
+	ch.s = s
+	ch.log = s.newLogger("chaos")
+	ch.offset = int64(time.Duration(s.cfg.Debug.ChaosClockSkew) * time.Millisecond)
+	ch.droppedPeers = make(map[[constants.NodeIDLength]byte]bool)
+	ch.lastAdvance = time.Now()
+	for _, v := range s.cfg.Debug.ChaosDropPeers {
+		id, err := parseNodeID(v)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid ChaosDropPeers entry '%v': %v", v, err)
+		}
+		ch.droppedPeers[*id] = true
+	}
+
+	ch.log.Warningf("Chaos testing hooks are enabled, DO NOT USE IN PRODUCTION.")
+	return ch, nil
+}
@@ -0,0 +1,199 @@
+// check.go - Katzenpost server configuration check.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/config"
+)
+
+// CheckError is the error returned by Check, listing every problem found
+// with the configuration.
+type CheckError struct {
+	Errors []error
+}
+
+// Error returns the string representation of the CheckError.
+func (e *CheckError) Error() string {
+	s := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		s = append(s, err.Error())
+	}
+	return fmt.Sprintf("server: configuration check failed:\n\t%v", strings.Join(s, "\n\t"))
+}
+
+type configChecker struct {
+	cfg  *config.Config
+	errs []error
+}
+
+func (c *configChecker) errorf(format string, a ...interface{}) {
+	c.errs = append(c.errs, fmt.Errorf(format, a...))
+}
+
+func (c *configChecker) checkDataDir() {
+	c.checkDir("DataDir", c.cfg.Server.DataDir)
+	if d := c.cfg.Server.MixKeyDir; d != "" {
+		c.checkDir("MixKeyDir", d)
+	}
+}
+
+func (c *configChecker) checkDir(name, d string) {
+	const dirMode = os.ModeDir | 0700
+
+	fi, err := os.Lstat(d)
+	switch {
+	case os.IsNotExist(err):
+		// The directory will be created, so the parent must exist.
+		if _, err = os.Stat(filepath.Dir(d)); err != nil {
+			c.errorf("%v '%v' can not be created: %v", name, d, err)
+		}
+	case err != nil:
+		c.errorf("failed to stat() %v: %v", name, err)
+	case !fi.IsDir():
+		c.errorf("%v '%v' is not a directory", name, d)
+	case c.cfg.Server.ContainerMode:
+		// Mounted volumes only need to not be world writable.
+		if fi.Mode().Perm()&0002 != 0 {
+			c.errorf("%v '%v' is world writable", name, d)
+		}
+	case fi.Mode() != dirMode:
+		c.errorf("%v '%v' has invalid permissions '%v'", name, d, fi.Mode())
+	}
+}
+
+func (c *configChecker) checkAddresses() {
+	addrs := append([]string{}, c.cfg.Server.Addresses...)
+	if pCfg := c.cfg.Provider; pCfg != nil && pCfg.WebSocket != nil {
+		addrs = append(addrs, pCfg.WebSocket.Addresses...)
+	}
+	if nCfg := c.cfg.PKI.Nonvoting; nCfg != nil {
+		addrs = append(addrs, nCfg.Address)
+	}
+	if sCfg := c.cfg.Logging.Syslog; sCfg != nil && sCfg.Address != "" {
+		addrs = append(addrs, sCfg.Address)
+	}
+	for _, addr := range addrs {
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			c.errorf("failed to resolve address '%v': %v", addr, err)
+		}
+	}
+}
+
+func (c *configChecker) checkKeys() {
+	// Only existing keys are loaded, since loading a missing key will
+	// generate a new one, and checking should have no side effects.
+	exists := func(f string) bool {
+		_, err := os.Lstat(f)
+		return err == nil
+	}
+
+	if keyStr := c.cfg.Debug.ForceIdentityKey; keyStr != "" {
+		raw, err := hex.DecodeString(strings.TrimSpace(keyStr))
+		if err == nil {
+			k := new(eddsa.PrivateKey)
+			err = k.FromBytes(raw)
+			k.Reset()
+			utils.ExplicitBzero(raw)
+		}
+		if err != nil {
+			c.errorf("invalid ForceIdentityKey: %v", err)
+		}
+	} else {
+		privFile := filepath.Join(c.cfg.Server.DataDir, "identity.private.pem")
+		pubFile := filepath.Join(c.cfg.Server.DataDir, "identity.public.pem")
+		if exists(privFile) && exists(pubFile) {
+			if k, err := eddsa.Load(privFile, pubFile, rand.Reader); err != nil {
+				c.errorf("failed to load identity key: %v", err)
+			} else {
+				k.Reset()
+			}
+		}
+	}
+
+	if linkFile := filepath.Join(c.cfg.Server.DataDir, "link.private.pem"); exists(linkFile) {
+		if k, err := ecdh.Load(linkFile, rand.Reader); err != nil {
+			c.errorf("failed to load link key: %v", err)
+		} else {
+			k.Reset()
+		}
+	}
+
+	if nCfg := c.cfg.PKI.Nonvoting; nCfg != nil {
+		if err := new(eddsa.PublicKey).FromString(nCfg.PublicKey); err != nil {
+			c.errorf("invalid PKI authority public key: %v", err)
+		}
+	}
+}
+
+func (c *configChecker) checkFiles() {
+	if pCfg := c.cfg.Provider; pCfg != nil && pCfg.WebSocket != nil && pCfg.WebSocket.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(pCfg.WebSocket.TLSCertFile, pCfg.WebSocket.TLSKeyFile); err != nil {
+			c.errorf("failed to load WebSocket TLS certificate: %v", err)
+		}
+	}
+	if sCfg := c.cfg.Logging.Syslog; sCfg != nil && sCfg.TLSCAFile != "" {
+		if _, err := loadCertPool(sCfg.TLSCAFile); err != nil {
+			c.errorf("failed to load syslog TLS CA: %v", err)
+		}
+	}
+}
+
+func (c *configChecker) checkSandbox() {
+	if sbCfg := c.cfg.Sandbox; sbCfg != nil && sbCfg.User != "" {
+		if _, _, err := lookupUser(sbCfg.User, sbCfg.Group); err != nil {
+			c.errorf("failed to look up sandbox user: %v", err)
+		}
+	}
+}
+
+func (c *configChecker) checkTransports() {
+	s := &Server{cfg: c.cfg}
+	if err := s.validateTransports(); err != nil {
+		c.errorf("%v", err)
+	}
+}
+
+// Check performs a thorough check of a configuration, that has already been
+// validated by one of the config Load variants, without starting the
+// server.  In addition to the basic validation, addresses are resolved, the
+// DataDir permissions are checked, and the existing keys are loaded.
+func Check(cfg *config.Config) error {
+	c := &configChecker{cfg: cfg}
+	c.checkDataDir()
+	c.checkAddresses()
+	c.checkKeys()
+	c.checkFiles()
+	c.checkSandbox()
+	c.checkTransports()
+
+	if len(c.errs) > 0 {
+		return &CheckError{Errors: c.errs}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// clockskew.go - Katzenpost server clock skew detection.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/sntp"
+	"github.com/op/go-logging"
+)
+
+const (
+	clockSkewCheckInterval = 15 * time.Minute
+	clockSkewQueryTimeout  = 10 * time.Second
+)
+
+// clockSkew periodically measures the local clock against a time server,
+// by default the one on the PKI authority's host, since the epoch (and
+// therefore the PKI and mix key) handling depends on the local clock being
+// accurate.
+//
+// Note: Neither the PKI responses nor the link handshakes carry timestamps,
+// so an explicit time query is required.
+type clockSkew struct {
+	offset      int64  // MUST be accessed via sync/atomic.
+	isDangerous uint32 // MUST be accessed via sync/atomic.
+
+	worker.Worker
+	sync.Mutex
+
+	s      *Server
+	log    *logging.Logger
+	server string
+
+	rtt       time.Duration
+	lastCheck time.Time
+	lastErr   error
+	isSkewed  bool
+}
+
+// isDangerousSkew returns true iff the last measured clock skew makes epoch
+// related decisions unreliable.
+func (s *Server) isDangerousSkew() bool {
+	if s.clockSkew == nil {
+		return false
+	}
+	return atomic.LoadUint32(&s.clockSkew.isDangerous) != 0
+}
+
+func (cs *clockSkew) check() {
+	ctx, cancelFn := context.WithTimeout(context.Background(), clockSkewQueryTimeout)
+	defer cancelFn()
+	r, err := sntp.Query(ctx, cs.server)
+
+	cs.Lock()
+	defer cs.Unlock()
+	cs.lastCheck = time.Now()
+	cs.lastErr = err
+	if err != nil {
+		cs.log.Warningf("Failed to query '%v': %v", cs.server, err)
+		return
+	}
+	cs.rtt = r.RTT
+	atomic.StoreInt64(&cs.offset, int64(r.Offset))
+
+	skew := r.Offset
+	if skew < 0 {
+		skew = -skew
+	}
+	threshold := time.Duration(cs.s.cfg.Debug.ClockSkewThreshold) * time.Millisecond
+	dangerous := time.Duration(cs.s.cfg.Debug.DangerousClockSkew) * time.Millisecond
+
+	wasSkewed := cs.isSkewed
+	cs.isSkewed = skew > threshold
+	switch {
+	case cs.isSkewed && !wasSkewed:
+		cs.log.Warningf("Clock skew of %v exceeds the threshold, check the time synchronization.", r.Offset)
+		cs.s.emitDegradedEvent("clock skew")
+	case !cs.isSkewed && wasSkewed:
+		cs.log.Noticef("Clock skew of %v is within the threshold again.", r.Offset)
+	default:
+		cs.log.Debugf("Clock skew: %v (RTT: %v)", r.Offset, r.RTT)
+	}
+
+	isDangerous := uint32(0)
+	if skew > dangerous {
+		isDangerous = 1
+		cs.log.Errorf("Clock skew of %v is dangerous, epoch related decisions are unreliable.", r.Offset)
+	}
+	atomic.StoreUint32(&cs.isDangerous, isDangerous)
+}
+
+func (cs *clockSkew) worker() {
+	ticker := time.NewTicker(clockSkewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		cs.check()
+		select {
+		case <-cs.HaltCh():
+			cs.log.Debugf("Terminating gracefully.")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cs *clockSkew) onMgmtClockSkew(c *thwack.Conn, l string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	offset := time.Duration(atomic.LoadInt64(&cs.offset))
+	if err := c.Writer().PrintfLine("%v-Server:%v Offset:%v RTT:%v Dangerous:%v LastCheck:%v LastError:%v", thwack.StatusOk, cs.server, offset, cs.rtt, atomic.LoadUint32(&cs.isDangerous) != 0, cs.lastCheck.Format(time.RFC3339), cs.lastErr); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newClockSkew(s *Server) *clockSkew {
+	cs := new(clockSkew)
+	cs.s = s
+	cs.log = s.newLogger("clockskew")
+
+	cs.server = s.cfg.Debug.ClockSkewServer
+	if cs.server == "" && s.cfg.PKI.Nonvoting != nil {
+		cs.server, _, _ = net.SplitHostPort(s.cfg.PKI.Nonvoting.Address)
+	}
+	if cs.server == "" {
+		cs.log.Warningf("No time server to compare the clock against, disabling.")
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(cs.server); err != nil {
+		cs.server = net.JoinHostPort(cs.server, strconv.Itoa(sntp.Port))
+	}
+
+	if s.cfg.Management.Enable {
+		const cmdClockSkew = "CLOCK_SKEW"
+		s.management.RegisterCommand(cmdClockSkew, cs.onMgmtClockSkew)
+	}
+
+	cs.Go(s.superviseOptional("clockskew", cs.worker))
+	return cs
+}
@@ -0,0 +1,145 @@
+// builder.go - Katzenpost server configuration builder.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+// Builder constructs a Config programmatically, for embedders and test
+// harnesses that would otherwise have to round trip through TOML.  The
+// setters may be chained, and Build applies the defaults and validates the
+// result.  A Builder MUST NOT be reused after Build is called.
+type Builder struct {
+	cfg *Config
+}
+
+// NewBuilder returns a new Builder for a node with the specified human
+// readable identifier, that stores its state in dataDir.
+func NewBuilder(identifier, dataDir string) *Builder {
+	return &Builder{
+		cfg: &Config{
+			Server: &Server{
+				Identifier: identifier,
+				DataDir:    dataDir,
+			},
+			PKI:   &PKI{},
+			Debug: &Debug{},
+		},
+	}
+}
+
+// Addresses sets the addresses the node binds to.
+func (b *Builder) Addresses(addrs ...string) *Builder {
+	b.cfg.Server.Addresses = append([]string{}, addrs...)
+	return b
+}
+
+// Server sets fn to modify the Server section, for the less common options.
+func (b *Builder) Server(fn func(*Server)) *Builder {
+	fn(b.cfg.Server)
+	return b
+}
+
+// Provider makes the node a Provider, with the Provider section pCfg, or the
+// defaults if pCfg is nil.
+func (b *Builder) Provider(pCfg *Provider) *Builder {
+	if pCfg == nil {
+		pCfg = &Provider{}
+	}
+	b.cfg.Server.IsProvider = true
+	b.cfg.Provider = pCfg
+	return b
+}
+
+// NonvotingPKI sets the non-voting directory authority's address and Base64
+// or Base16 encoded public key.
+func (b *Builder) NonvotingPKI(address, publicKey string) *Builder {
+	b.cfg.PKI.Nonvoting = &Nonvoting{
+		Address:   address,
+		PublicKey: publicKey,
+	}
+	return b
+}
+
+// Logging sets the Logging section.
+func (b *Builder) Logging(lCfg *Logging) *Builder {
+	b.cfg.Logging = lCfg
+	return b
+}
+
+// LogLevel sets the log level, keeping the rest of the Logging section.
+func (b *Builder) LogLevel(level string) *Builder {
+	if b.cfg.Logging == nil {
+		l := defaultLogging
+		b.cfg.Logging = &l
+	}
+	b.cfg.Logging.Level = level
+	return b
+}
+
+// Management enables the management interface on the specified socket
+// path, or the default path if empty.
+func (b *Builder) Management(path string) *Builder {
+	b.cfg.Management = &Management{
+		Enable: true,
+		Path:   path,
+	}
+	return b
+}
+
+// Sandbox sets the Sandbox section.
+func (b *Builder) Sandbox(sbCfg *Sandbox) *Builder {
+	b.cfg.Sandbox = sbCfg
+	return b
+}
+
+// NAT sets the NAT section.
+func (b *Builder) NAT(nCfg *NAT) *Builder {
+	b.cfg.NAT = nCfg
+	return b
+}
+
+// Tracing sets the Tracing section.
+func (b *Builder) Tracing(tCfg *Tracing) *Builder {
+	b.cfg.Tracing = tCfg
+	return b
+}
+
+// Alerting sets the Alerting section.
+func (b *Builder) Alerting(aCfg *Alerting) *Builder {
+	b.cfg.Alerting = aCfg
+	return b
+}
+
+// PeerOverrides sets the PeerOverrides section.
+func (b *Builder) PeerOverrides(oCfg *PeerOverrides) *Builder {
+	b.cfg.PeerOverrides = oCfg
+	return b
+}
+
+// Debug sets fn to modify the Debug section.
+func (b *Builder) Debug(fn func(*Debug)) *Builder {
+	fn(b.cfg.Debug)
+	return b
+}
+
+// Build applies the defaults to and validates the Config, and returns it.
+// On failure, the returned error is a ValidationErrors holding all of the
+// problems found.
+func (b *Builder) Build() (*Config, error) {
+	if err := b.cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return b.cfg, nil
+}
@@ -0,0 +1,195 @@
+// builder_test.go - Katzenpost server configuration builder tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testAuthorityKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+
+func TestBuilder(t *testing.T) {
+	require := require.New(t)
+
+	cfg, err := NewBuilder("katzenpost.example.com", "/var/lib/katzenpost").
+		Addresses("127.0.0.1:29483").
+		NonvotingPKI("127.0.0.1:6999", testAuthorityKey).
+		Provider(nil).
+		LogLevel("DEBUG").
+		Debug(func(d *Debug) { d.NumSphinxWorkers = 2 }).
+		Build()
+	require.NoError(err, "Build()")
+	require.True(cfg.Server.IsProvider)
+	require.Equal("DEBUG", cfg.Logging.Level)
+	require.Equal(2, cfg.Debug.NumSphinxWorkers)
+	require.Equal("bolt", cfg.Provider.UserDBBackend, "Provider defaults")
+	require.NotZero(cfg.Debug.ConnectTimeout, "Debug defaults")
+	require.Equal("NOTICE", defaultLogging.Level, "LogLevel() modified the defaults")
+}
+
+func TestValidateAllErrors(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewBuilder("", "relative/path").
+		Addresses("127.0.0.1:29483").
+		NonvotingPKI("127.0.0.1:6999", testAuthorityKey).
+		NAT(&NAT{Gateway: "192.168.1.1"}).
+		Tracing(&Tracing{OTLPEndpoint: "ftp://collector.example.com"}).
+		Debug(func(d *Debug) { d.ForwardCapAction = "bogus" }).
+		Build()
+	require.Error(err, "Build() with an invalid config")
+	errs, ok := err.(ValidationErrors)
+	require.True(ok, "Build() error type")
+	require.Len(errs, 4, "Build() errors: %v", err)
+
+	// FixupAndValidate still only reports the first problem.
+	cfg := &Config{
+		Server: &Server{Identifier: "", DataDir: "relative/path"},
+		PKI:    &PKI{},
+	}
+	err = cfg.FixupAndValidate()
+	require.Error(err, "FixupAndValidate() with an invalid config")
+	_, ok = err.(ValidationErrors)
+	require.False(ok, "FixupAndValidate() error type")
+}
+
+func TestPeerOverrides(t *testing.T) {
+	require := require.New(t)
+
+	const testLinkKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	newBuilder := func() *Builder {
+		return NewBuilder("katzenpost.example.com", "/var/lib/katzenpost").
+			Addresses("127.0.0.1:29483").
+			NonvotingPKI("127.0.0.1:6999", testAuthorityKey)
+	}
+	cfg, err := newBuilder().PeerOverrides(&PeerOverrides{
+		Allow: []*AllowedPeer{
+			{
+				Name:        "onboarding",
+				IdentityKey: testAuthorityKey,
+				LinkKey:     testLinkKey,
+				Addresses:   []string{"127.0.0.1:29484"},
+			},
+		},
+		Deny: []string{testAuthorityKey},
+	}).Build()
+	require.NoError(err, "Build() with PeerOverrides")
+	require.Len(cfg.PeerOverrides.Allow, 1)
+
+	raw, err := DecodeLinkKey(testLinkKey)
+	require.NoError(err, "DecodeLinkKey(Base16)")
+	raw2, err := DecodeLinkKey("ASNFZ4mrze8BI0VniavN7wEjRWeJq83vASNFZ4mrze8=")
+	require.NoError(err, "DecodeLinkKey(Base64)")
+	require.Equal(raw, raw2)
+
+	_, err = newBuilder().PeerOverrides(&PeerOverrides{
+		Allow: []*AllowedPeer{
+			{
+				Name:        "truncated",
+				IdentityKey: testAuthorityKey,
+				LinkKey:     testLinkKey[:62],
+			},
+		},
+	}).Build()
+	require.Error(err, "Build() with an invalid LinkKey")
+}
+
+func TestAccountExpiry(t *testing.T) {
+	require := require.New(t)
+
+	build := func(pCfg *Provider) error {
+		_, err := NewBuilder("katzenpost.example.com", "/var/lib/katzenpost").
+			Addresses("127.0.0.1:29483").
+			NonvotingPKI("127.0.0.1:6999", testAuthorityKey).
+			Provider(pCfg).
+			Build()
+		return err
+	}
+
+	err := build(&Provider{AccountExpiry: &AccountExpiry{DisableAfter: 365, DeleteAfter: 730, WarnBefore: 30}})
+	require.NoError(err, "Build() with AccountExpiry")
+
+	err = build(&Provider{AccountExpiry: &AccountExpiry{DisableAfter: 365, DeleteAfter: 30}})
+	require.Error(err, "Build() with DeleteAfter before DisableAfter")
+
+	err = build(&Provider{AccountExpiry: &AccountExpiry{DisableAfter: 30, WarnBefore: 30}})
+	require.Error(err, "Build() with WarnBefore not before DisableAfter")
+
+	err = build(&Provider{
+		UserDBBackend: "extern",
+		Extern:        &ExternUserDB{ProviderURL: "http://localhost:8080"},
+		AccountExpiry: &AccountExpiry{DisableAfter: 365},
+	})
+	require.Error(err, "Build() with AccountExpiry and the extern backend")
+}
+
+func TestTiers(t *testing.T) {
+	require := require.New(t)
+
+	build := func(pCfg *Provider) error {
+		_, err := NewBuilder("katzenpost.example.com", "/var/lib/katzenpost").
+			Addresses("127.0.0.1:29483").
+			NonvotingPKI("127.0.0.1:6999", testAuthorityKey).
+			Provider(pCfg).
+			Build()
+		return err
+	}
+
+	err := build(&Provider{
+		MaxUserSpoolMessages: 1000,
+		Tiers: []*Tier{
+			{Name: "free", MaxSpoolMessages: 100, SendRate: 2},
+			{Name: "paid", PollRate: 64},
+		},
+		DefaultTier: "free",
+	})
+	require.NoError(err, "Build() with Tiers")
+
+	err = build(&Provider{Tiers: []*Tier{{Name: "free"}}, DefaultTier: "paid"})
+	require.Error(err, "Build() with an unknown DefaultTier")
+
+	err = build(&Provider{Tiers: []*Tier{{Name: "free"}, {Name: "free"}}})
+	require.Error(err, "Build() with a duplicate Tier")
+
+	err = build(&Provider{MaxUserSpoolMessages: 10, Tiers: []*Tier{{Name: "free", MaxSpoolMessages: 100}}})
+	require.Error(err, "Build() with a Tier exceeding MaxUserSpoolMessages")
+}
+
+func TestResourceBudget(t *testing.T) {
+	require := require.New(t)
+
+	build := func(fn func(*Debug)) error {
+		_, err := NewBuilder("katzenpost.example.com", "/var/lib/katzenpost").
+			Addresses("127.0.0.1:29483").
+			NonvotingPKI("127.0.0.1:6999", testAuthorityKey).
+			Debug(fn).
+			Build()
+		return err
+	}
+
+	err := build(func(d *Debug) {
+		d.MaxRSS = 512
+		d.TargetCPU = 80
+	})
+	require.NoError(err, "Build() with a resource budget")
+
+	err = build(func(d *Debug) { d.TargetCPU = 150 })
+	require.Error(err, "Build() with TargetCPU exceeding 100")
+}
@@ -18,12 +18,17 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/katzenpost/core/crypto/eddsa"
@@ -31,23 +36,71 @@ import (
 	"github.com/pelletier/go-toml"
 )
 
+const (
+	// RoleClient is the role of listener addresses that only accept
+	// connections from clients.
+	RoleClient = "client"
+
+	// RoleMix is the role of listener addresses that only accept
+	// connections from mixes.
+	RoleMix = "mix"
+)
+
 const (
 	defaultAddress          = ":3219"
 	defaultLogLevel         = "NOTICE"
-	defaultSchedulerSlack   = 10        // 10 ms.
-	defaultSendSlack        = 50        // 50 ms.
-	defaultConnectTimeout   = 60 * 1000 // 60 sec.
-	defaultHandshakeTimeout = 30 * 1000 // 30 sec.
-	defaultReauthInterval   = 30 * 1000 // 30 sec.
+	defaultSchedulerSlack   = 10         // 10 ms.
+	defaultSendSlack        = 50         // 50 ms.
+	defaultConnectTimeout   = 60 * 1000  // 60 sec.
+	defaultAttemptDelay     = 250        // 250 ms.
+	defaultDialInterval     = 50         // 50 ms.
+	defaultHandshakeTimeout = 30 * 1000  // 30 sec.
+	defaultFirstCmdTimeout  = 120 * 1000 // 2 min.
+	defaultReauthInterval   = 30 * 1000  // 30 sec.
+	defaultKeepAliveIval    = 30 * 1000  // 30 sec.
+	defaultKeepAliveTimeout = 15 * 1000  // 15 sec.
+	defaultTCPKeepAlive     = 180 * 1000 // 3 min.
+	defaultDrainTimeout     = 5 * 1000   // 5 sec.
+	defaultListenerDrain    = 30 * 1000  // 30 sec.
+	defaultShutdownTimeout  = 60 * 1000  // 60 sec.
+	defaultTermDrain        = 25 * 1000  // 25 sec.
+	defaultRetryMinDelay    = 15 * 1000  // 15 sec.
+	defaultRetryMaxDelay    = 120 * 1000 // 120 sec.
+	defaultClockSkewThresh  = 10 * 1000  // 10 sec.
+	defaultDangerousSkew    = 60 * 1000  // 60 sec.
+	defaultLowDiskWarning   = 1024       // 1 GiB.
+	defaultLowDiskSpool     = 256        // 256 MiB.
+	defaultLowDiskDegraded  = 64         // 64 MiB.
+	defaultSendQueueSize    = 64
+	defaultParkingQueueSize = 1024
+	defaultOutgoingLinks    = 1
+	defaultProviderWorkers  = 1
+	defaultIncomingLinks    = 4
+	defaultMaxPendingDials  = 8
+	defaultMaxIncomingConns = 4096
+	defaultMaxConnsPerIP    = 32
+	defaultNewConnRate      = 64
+	defaultLogMaxBackups    = 5
+	defaultMaxWorkerRestart = 3
+	defaultAcctRetention    = 8 * 90 // 90 days.
+	defaultSpoolWindow      = 60 * 60 * 1000
+	defaultClientBanTime    = 15 * 60 * 1000
+	defaultPeerBanTime      = 60 * 1000
+	defaultAlertInterval    = 15 * 60 * 1000
+	defaultClientPollRate   = 16
 	defaultUserDB           = "users.db"
 	defaultSpoolDB          = "spool.db"
 	defaultManagementSocket = "management_sock"
+	defaultSyslogTag        = "katzenpost"
+	defaultSyslogFacility   = "daemon"
+	defaultServiceName      = "katzenpost-server"
 )
 
 var defaultLogging = Logging{
-	Disable: false,
-	File:    "",
-	Level:   defaultLogLevel,
+	Disable:    false,
+	File:       "",
+	Level:      defaultLogLevel,
+	MaxBackups: defaultLogMaxBackups,
 }
 
 // Server is the Katzenpost server configuration.
@@ -56,31 +109,114 @@ type Server struct {
 	Identifier string
 
 	// Addresses are the IP address/port combinations that the server will bind
-	// to for incoming connections.
+	// to for incoming connections.  IPv6 addresses are written bracketed, eg:
+	// "[2001:db8::1]:3219".  If left unset, a single external IPv4 address
+	// is guessed, so IPv6 addresses must always be listed explicitly.
+	//
+	// A DNS name may be used in place of the IP address, eg: for nodes with
+	// a dynamic IP address.  Such addresses are bound on all interfaces,
+	// and advertised as is, leaving peers to resolve the name when dialing.
 	Addresses []string
 
+	// ClientOnlyAddresses is the subset of Addresses that will only accept
+	// connections from clients (Providers only).  Since the descriptor has
+	// no way to express address roles, these addresses are not published
+	// and must be provided to clients out of band.
+	ClientOnlyAddresses []string
+
+	// MixOnlyAddresses is the subset of Addresses that will only accept
+	// connections from mixes.
+	MixOnlyAddresses []string
+
+	// ACL is the optional access control list applied to incoming
+	// connections on all listeners, prior to the handshake.
+	ACL *ACL
+
+	// AddressACLs are optional per listener address (including WebSocket
+	// addresses) access control lists, that are used instead of ACL.
+	AddressACLs map[string]*ACL
+
 	// DataDir is the absolute path to the server's state files.
 	DataDir string
 
+	// MixKeyDir is the optional absolute path to the directory holding the
+	// mix keys and their replay filters, which are written to for every
+	// packet and benefit from fast local storage.  If left unset, the
+	// DataDir is used.  The provider's user and spool databases, and the
+	// log file, have their own path settings.
+	MixKeyDir string
+
 	// IsProvider specifies if the server is a provider (vs a mix).
 	IsProvider bool
+
+	// AddressTransports optionally maps listener addresses to the name of
+	// the pluggable transport that incoming connections to the address use.
+	AddressTransports map[string]string
+
+	// PeerTransports optionally maps peer addresses to the name of the
+	// pluggable transport used to connect to the address.  Since the
+	// descriptor has no way to advertise transports, this must be
+	// coordinated with the peer's operator.
+	PeerTransports map[string]string
+
+	// LinkTLS enables wrapping outgoing link layer connections in TLS 1.3,
+	// with the peer's certificate pinned to its identity key.  All of the
+	// peers must support this.  Incoming connections are accepted with or
+	// without TLS regardless.
+	LinkTLS bool
+
+	// AddressPreference is the address family policy used when dialing
+	// peers that advertise both IPv6 and IPv4 addresses, one of
+	// "PreferIPv6" (the default), "PreferIPv4", "IPv6Only", or "IPv4Only".
+	// Connection attempts to both families are raced unless restricted to
+	// a single family.
+	AddressPreference string
+
+	// ContainerMode adapts the server to running in a container, by
+	// relaxing the DataDir and MixKeyDir permission checks for volumes
+	// mounted by the container runtime, and defaulting to structured
+	// logging to stdout.
+	ContainerMode bool
 }
 
+// The supported Server.AddressPreference values.
+const (
+	PreferIPv6 = "PreferIPv6"
+	PreferIPv4 = "PreferIPv4"
+	IPv6Only   = "IPv6Only"
+	IPv4Only   = "IPv4Only"
+)
+
 func (sCfg *Server) validate() error {
 	if sCfg.Identifier == "" {
 		return fmt.Errorf("config: Server: Identifier is not set")
 	}
 
 	if sCfg.Addresses != nil {
+		ports := make(map[string]string)
 		for _, v := range sCfg.Addresses {
-			if err := utils.EnsureAddrIPPort(v); err != nil {
+			if err := EnsureAddrHostPort(v); err != nil {
 				return fmt.Errorf("config: Server: Address '%v' is invalid: %v", v, err)
 			}
+
+			// Addresses with a DNS name are bound on all interfaces, so
+			// their port can not be shared with any other address.
+			host, port, _ := net.SplitHostPort(v)
+			isName := net.ParseIP(host) == nil
+			if other, ok := ports[port]; ok {
+				if isName || net.ParseIP(other) == nil {
+					return fmt.Errorf("config: Server: Address '%v' conflicts with '%v'", v, net.JoinHostPort(other, port))
+				}
+			} else {
+				ports[port] = host
+			}
 		}
 	} else {
 		// Try to guess a "suitable" external IPv4 address.  If people want
 		// to do loopback testing, they can manually specify one.  If people
-		// want to use IPng, they can manually specify that as well.
+		// want to use IPng, they can manually specify that as well, as
+		// interface enumeration can not tell the stable IPv6 addresses
+		// apart from the temporary privacy addresses that come and go.
 		addr, err := utils.GetExternalIPv4Address()
 		if err != nil {
 			return err
@@ -91,9 +227,110 @@ func (sCfg *Server) validate() error {
 	if !filepath.IsAbs(sCfg.DataDir) {
 		return fmt.Errorf("config: Server: DataDir '%v' is not an absolute path", sCfg.DataDir)
 	}
+	if sCfg.MixKeyDir != "" && !filepath.IsAbs(sCfg.MixKeyDir) {
+		return fmt.Errorf("config: Server: MixKeyDir '%v' is not an absolute path", sCfg.MixKeyDir)
+	}
+	if err := sCfg.validateRoles(); err != nil {
+		return err
+	}
+	switch sCfg.AddressPreference {
+	case "":
+		sCfg.AddressPreference = PreferIPv6
+	case PreferIPv6, PreferIPv4, IPv6Only, IPv4Only:
+	default:
+		return fmt.Errorf("config: Server: AddressPreference '%v' is invalid", sCfg.AddressPreference)
+	}
+	if sCfg.ACL != nil {
+		if err := sCfg.ACL.validate(); err != nil {
+			return err
+		}
+	}
+	for addr, acl := range sCfg.AddressACLs {
+		if acl == nil {
+			return fmt.Errorf("config: Server: ACL for Address '%v' is empty", addr)
+		}
+		if err := acl.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ACL is an IP address based access control list.
+type ACL struct {
+	// Allow is the list of networks in CIDR notation that are allowed to
+	// connect.  If left empty, all networks not in Deny are allowed.
+	Allow []string
+
+	// Deny is the list of networks in CIDR notation that are not allowed
+	// to connect, and takes precedence over Allow.
+	Deny []string
+}
+
+func (aCfg *ACL) validate() error {
+	for _, v := range append(append([]string{}, aCfg.Allow...), aCfg.Deny...) {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("config: Server: ACL network '%v' is invalid: %v", v, err)
+		}
+	}
 	return nil
 }
 
+// AddressACL returns the access control list for the listener address addr,
+// or nil if none is configured.
+func (sCfg *Server) AddressACL(addr string) *ACL {
+	if acl, ok := sCfg.AddressACLs[addr]; ok {
+		return acl
+	}
+	return sCfg.ACL
+}
+
+func (sCfg *Server) validateRoles() error {
+	isAddr := make(map[string]bool)
+	for _, v := range sCfg.Addresses {
+		isAddr[v] = true
+	}
+
+	isClientOnly := make(map[string]bool)
+	if len(sCfg.ClientOnlyAddresses) > 0 && !sCfg.IsProvider {
+		return fmt.Errorf("config: Server: ClientOnlyAddresses set when not a Provider")
+	}
+	for _, v := range sCfg.ClientOnlyAddresses {
+		if !isAddr[v] {
+			return fmt.Errorf("config: Server: ClientOnlyAddress '%v' is not in Addresses", v)
+		}
+		isClientOnly[v] = true
+	}
+	for _, v := range sCfg.MixOnlyAddresses {
+		if !isAddr[v] {
+			return fmt.Errorf("config: Server: MixOnlyAddress '%v' is not in Addresses", v)
+		}
+		if isClientOnly[v] {
+			return fmt.Errorf("config: Server: Address '%v' is both client and mix only", v)
+		}
+	}
+	if len(isClientOnly) == len(isAddr) {
+		return fmt.Errorf("config: Server: No Addresses that accept connections from mixes")
+	}
+	return nil
+}
+
+// AddressRole returns the role of the listener address addr, one of
+// RoleClient, RoleMix, or "" if the address accepts both.
+func (sCfg *Server) AddressRole(addr string) string {
+	for _, v := range sCfg.ClientOnlyAddresses {
+		if v == addr {
+			return RoleClient
+		}
+	}
+	for _, v := range sCfg.MixOnlyAddresses {
+		if v == addr {
+			return RoleMix
+		}
+	}
+	return ""
+}
+
 // Debug is the Katzenpost server debug configuration.
 type Debug struct {
 	// ForceIdentityKey specifies a hex encoded identity private key.
@@ -108,6 +345,32 @@ type Debug struct {
 	// as unlimited.
 	SchedulerQueueSize int
 
+	// UnknownDestAction specifies what happens to packets whose next hop
+	// is not a valid forward destination, either "drop" (the default), or
+	// "park" to hold them for up to an epoch in case the destination is
+	// (re)listed, to smooth over topology churn.
+	UnknownDestAction string
+
+	// ParkingQueueSize is the maximum number of packets held when
+	// UnknownDestAction is "park".
+	ParkingQueueSize int
+
+	// DisableQueuePersistence disables saving the packets held by the
+	// scheduler (and the in-memory send queues, iff disk spillover is
+	// enabled) on graceful shutdown, to be resumed on restart.
+	DisableQueuePersistence bool
+
+	// NumProviderWorkers specifies the number of worker instances to use
+	// for processing packets destined to the provider's users and services,
+	// separately from the processing of packets being relayed.
+	NumProviderWorkers int
+
+	// ProviderQueueSize is the maximum allowed provider queue size before
+	// packets destined to the provider start getting dropped, so that a
+	// slow spool can not consume unbounded memory.  A value <= 0 is treated
+	// as unlimited.
+	ProviderQueueSize int
+
 	// SchedulerSlack is the maximum allowed scheduler slack due to queueing
 	// and or processing in milliseconds.
 	SchedulerSlack int
@@ -116,18 +379,325 @@ type Debug struct {
 	// or congestion in milliseconds.
 	SendSlack int
 
+	// SendQueueSize is the maximum number of packets that will be buffered
+	// in memory for each outgoing peer.
+	SendQueueSize int
+
+	// SendQueueDiskSize is the maximum number of packets that will be
+	// spilled to disk for each outgoing peer once the in-memory send queue
+	// is full.  A value <= 0 disables disk spillover.
+	SendQueueDiskSize int
+
+	// SendQueueMaxAge is the maximum time a packet can be buffered while
+	// the link to the peer is down in milliseconds.  Packets queued while
+	// the link is up are always subject to SendSlack, and a value <=
+	// SendSlack disables buffering across link outages.
+	SendQueueMaxAge int
+
+	// PeerEgressRateLimit is the maximum rate at which packets will be sent
+	// to each outgoing peer in bytes per second.  A value <= 0 is treated
+	// as unlimited.
+	PeerEgressRateLimit int
+
 	// ConnectTimeout specifies the maximum time a connection can take to
 	// establish a TCP/IP connection in milliseconds.
 	ConnectTimeout int
 
+	// ConnectAttemptDelay specifies the delay between starting connection
+	// attempts to each of a peer's addresses in milliseconds, as per RFC
+	// 8305 ("Happy Eyeballs").
+	ConnectAttemptDelay int
+
+	// MaxPendingDials specifies the maximum number of outgoing connections
+	// that may be in the process of being established (TCP/IP connection
+	// and link protocol handshake) at any given time.
+	MaxPendingDials int
+
+	// DialInterval specifies the minimum interval between starting
+	// outgoing connection attempts in milliseconds, so that a newly
+	// published PKI document does not result in every peer being dialed
+	// at once.
+	DialInterval int
+
+	// NumOutgoingLinks specifies the number of parallel connections that
+	// will be maintained to each outgoing peer.  Packets are split across
+	// the established connections, favoring the least loaded ones.  Peers
+	// that refuse additional connections will have the excess connections
+	// retried with backoff.  The same number is used for every peer, as
+	// the MixDescriptor has no field for a node to advertise how many
+	// connections it is willing to accept.
+	NumOutgoingLinks int
+
+	// MaxIncomingLinks specifies the maximum number of concurrent connections
+	// that will be accepted from any given mix.  Clients are always limited
+	// to a single connection.
+	MaxIncomingLinks int
+
+	// DisableTCPNoDelay disables setting TCP_NODELAY on link layer
+	// connections, allowing Nagle's algorithm to coalesce writes.
+	DisableTCPNoDelay bool
+
+	// TCPSendBufferSize specifies the size of the link layer connection
+	// socket send buffer in bytes, 0 leaves it up to the OS.
+	TCPSendBufferSize int
+
+	// TCPReceiveBufferSize specifies the size of the link layer connection
+	// socket receive buffer in bytes, 0 leaves it up to the OS.
+	TCPReceiveBufferSize int
+
+	// TCPUserTimeout specifies the maximum time transmitted data may remain
+	// unacknowledged before a link layer connection is forcibly closed in
+	// milliseconds (TCP_USER_TIMEOUT, Linux only), 0 leaves it up to the OS.
+	TCPUserTimeout int
+
+	// TCPKeepAliveInterval specifies the TCP keepalive interval of link
+	// layer connections in milliseconds.
+	TCPKeepAliveInterval int
+
+	// UnixSocketListener specifies the absolute path of a unix domain socket
+	// to listen on for connections from co-located components.  Peers on
+	// the socket are NOT authenticated, and are treated as trusted mixes.
+	// If left empty (the default), no unix domain socket listener is used.
+	UnixSocketListener string
+
+	// MaxIncomingConns specifies the maximum number of concurrent incoming
+	// connections across all listeners.
+	MaxIncomingConns int
+
+	// MaxIncomingConnsPerIP specifies the maximum number of concurrent
+	// incoming connections from any given IP address.
+	MaxIncomingConnsPerIP int
+
+	// NewConnRate specifies the maximum rate at which new incoming
+	// connections will be accepted across all listeners, in connections per
+	// second.
+	NewConnRate int
+
+	// NewConnBurst specifies the maximum burst of new incoming connections
+	// that will be accepted in excess of NewConnRate.
+	NewConnBurst int
+
+	// ListenerDrainTimeout specifies the maximum time that will be spent
+	// waiting for the existing connections to close when a listener is
+	// removed at runtime or on graceful shutdown, before forcibly closing
+	// them in milliseconds.
+	ListenerDrainTimeout int
+
+	// ShutdownTimeout specifies the maximum time that will be spent on a
+	// graceful shutdown in milliseconds, after which the remaining
+	// components are abandoned.
+	ShutdownTimeout int
+
+	// TerminationDrainTimeout specifies the deadline in milliseconds for
+	// draining the server when it is asked to terminate (eg: on SIGTERM by
+	// a container orchestrator), within which new connections are refused,
+	// the packets already scheduled are sent where possible, the state is
+	// flushed, and the server is shut down.  It should be shorter than the
+	// orchestrator's termination grace period.
+	TerminationDrainTimeout int
+
+	// MaxWorkerRestarts specifies the number of times a long running worker
+	// (eg: the scheduler, crypto workers) will be restarted after a panic,
+	// before the server is shut down.  A negative value disables restarts.
+	MaxWorkerRestarts int
+
+	// ReusePort binds the TCP listeners with SO_REUSEPORT, so that a new
+	// server process can bind the same addresses before the old one exits
+	// (Linux only).
+	ReusePort bool
+
 	// HandshakeTimeout specifies the maximum time a connection can take for a
 	// link protocol handshake in milliseconds.
 	HandshakeTimeout int
 
+	// FirstCommandTimeout specifies the maximum time an incoming connection
+	// can take to send the first command after the link protocol handshake
+	// in milliseconds.
+	FirstCommandTimeout int
+
 	// ReauthInterval specifies the interval at which a connection will be
 	// reauthenticated in milliseconds.
 	ReauthInterval int
 
+	// LinkKeepAliveInterval specifies the interval of inactivity after which
+	// a keepalive will be sent on an outgoing connection in milliseconds.
+	// Incoming connections respond to at most one keepalive per half of the
+	// interval, so it should not vary wildly across the network.
+	LinkKeepAliveInterval int
+
+	// LinkKeepAliveTimeout specifies the maximum time a peer can take to
+	// respond to a keepalive before the connection is considered dead in
+	// milliseconds.
+	LinkKeepAliveTimeout int
+
+	// LinkPaddingRate specifies the constant rate in packets per second at
+	// which each outgoing link will send, with dummy packets being sent
+	// when nothing is queued, to hide traffic bursts from network observers.
+	// The dummy packets are discarded by peers that are running a version
+	// that supports padding, and fail to unwrap on older ones.  Setting this
+	// to 0 (the default) disables padding.
+	LinkPaddingRate int
+
+	// ClientPaddingInterval specifies the mean interval in milliseconds at
+	// which a provider will send NoOp commands on idle client links, with
+	// exponentially distributed spacing (a Poisson process), so that idle
+	// clients are not trivially distinguishable from active ones by link
+	// silence.  Setting this to 0 (the default) disables client padding.
+	ClientPaddingInterval int
+
+	// LinkDrainTimeout specifies the maximum time that will be spent sending
+	// already queued packets to a peer that is no longer listed in the PKI
+	// before disconnecting in milliseconds.
+	LinkDrainTimeout int
+
+	// RetryMinDelay specifies the initial delay before an outgoing connection
+	// that failed will be reattempted in milliseconds.  The delay is doubled
+	// after each consecutive failure, up to RetryMaxDelay, and is only reset
+	// once a connection has stayed up for at least RetryMinDelay.
+	RetryMinDelay int
+
+	// RetryMaxDelay specifies the maximum delay between outgoing connection
+	// attempts in milliseconds.
+	RetryMaxDelay int
+
+	// RetryJitter specifies the maximum random jitter added to each outgoing
+	// connection retry delay in milliseconds.
+	RetryJitter int
+
+	// RetryMaxAttempts specifies the number of consecutive failed outgoing
+	// connection attempts after which a peer will be given up on till the
+	// next connector sweep.  As the sweep happens every few minutes and
+	// starts over with a fresh backoff, this caps the length of each burst
+	// of retries rather than giving up on the peer for good.  A value <= 0
+	// is treated as unlimited.
+	RetryMaxAttempts int
+
+	// AccountingRetention specifies the number of epochs for which the
+	// persisted traffic accounting is retained.
+	AccountingRetention int
+
+	// SendDecoyTraffic enables sending decoy loop traffic, that traverses
+	// the network and returns to this node, at the rate specified by the
+	// PKI document.  Loops that fail to return are attributed to the nodes
+	// along their path, and reported via the management interface.
+	SendDecoyTraffic bool
+
+	// SelfTestPackets is the number of loop packets sent through random
+	// paths once the first PKI document is available, to verify that the
+	// node is able to send and receive traffic.  The result is reported via
+	// the management interface.  A value <= 0 disables the self-test.
+	SelfTestPackets int
+
+	// DisableAttackDetection disables the traffic heuristics that raise
+	// alarms on suspected active (n-1, flooding) attacks.
+	DisableAttackDetection bool
+
+	// DecommissionSpoolWindow specifies the time in milliseconds that a
+	// decommissioning provider keeps serving spool retrievals after it is
+	// no longer published, before shutting down.
+	DecommissionSpoolWindow int
+
+	// MaxForwardPerEpoch specifies the maximum number of packets forwarded
+	// per epoch.  A value <= 0 disables the cap.
+	MaxForwardPerEpoch int
+
+	// ForwardCapAction specifies what happens once MaxForwardPerEpoch is
+	// reached, either "drop" (the default) to drop packets for the rest of
+	// the epoch, or "withhold" to keep forwarding but not publish the
+	// descriptor for the next epoch.
+	ForwardCapAction string
+
+	// InboundHighWaterMark specifies the inbound (pre Sphinx processing)
+	// queue depth in packets above which the node is considered overloaded,
+	// and new client connections are rejected till the depth drops below
+	// half the mark.  A value <= 0 disables the check.
+	InboundHighWaterMark int
+
+	// SchedulerHighWaterMark specifies the scheduler queue depth in packets
+	// above which the node is considered overloaded, as with
+	// InboundHighWaterMark.  A value <= 0 disables the check.
+	SchedulerHighWaterMark int
+
+	// ClientPollRate specifies the rate in spool retrievals per second that
+	// a client may poll at (with a burst of twice that), before the polls
+	// are counted as excessive (Providers only).
+	ClientPollRate int
+
+	// ThrottleAbusiveClients delays excessive spool retrievals till they
+	// conform to ClientPollRate, instead of only counting them.
+	ThrottleAbusiveClients bool
+
+	// ClientBanThreshold specifies the number of protocol violations,
+	// malformed commands and excessive polls after which a client is
+	// temporarily banned.  A value <= 0 disables banning.
+	ClientBanThreshold int
+
+	// ClientBanDuration specifies the time in milliseconds that clients
+	// are banned for.
+	ClientBanDuration int
+
+	// PeerBanThreshold specifies the number of link layer violations
+	// (handshake failures, framing errors, and protocol violations by
+	// mixes) after which a remote IP address is temporarily banned from
+	// connecting.  Network failures do not count as violations, and each
+	// violation is forgiven after 10 minutes without one.  A value <= 0
+	// disables banning.
+	PeerBanThreshold int
+
+	// PeerBanDuration specifies the time in milliseconds that peers are
+	// banned for the first time, with each subsequent ban lasting twice as
+	// long as the previous one.
+	PeerBanDuration int
+
+	// PeerBanOutgoing extends the peer bans to the outgoing connections to
+	// the peers listed in the PKI document, which are otherwise always
+	// dialed, as refusing to do so drops the traffic routed via them.
+	PeerBanOutgoing bool
+
+	// DisableReachabilityCheck disables connecting to each of the
+	// advertised addresses prior to publishing the descriptor.
+	DisableReachabilityCheck bool
+
+	// RequireReachability makes the descriptor publication fail instead of
+	// logging a warning, if any of the advertised addresses is unreachable.
+	RequireReachability bool
+
+	// DisableClockSkewCheck disables periodically measuring the local
+	// clock's skew against the ClockSkewServer.
+	DisableClockSkewCheck bool
+
+	// ClockSkewServer is the (S)NTP server that the local clock is
+	// compared against.  If omitted, the PKI authority's host is used.
+	ClockSkewServer string
+
+	// ClockSkewThreshold specifies the clock skew in milliseconds above
+	// which a warning is logged, and the node is considered degraded.
+	ClockSkewThreshold int
+
+	// DangerousClockSkew specifies the clock skew in milliseconds above
+	// which epoch related decisions are considered unreliable.
+	DangerousClockSkew int
+
+	// RefuseOnDangerousClockSkew disables the peer authentication clock
+	// skew tolerance, while the clock skew is dangerous.
+	RefuseOnDangerousClockSkew bool
+
+	// LowDiskWarning specifies the free space in MiB on the filesystems
+	// backing the DataDir, mix keys and spool below which a warning is
+	// logged.  A value < 0 disables the check.
+	LowDiskWarning int
+
+	// LowDiskRefuseSpool specifies the free space in MiB below which new
+	// messages are no longer written to the spool (Providers only).  A
+	// value < 0 disables the check.
+	LowDiskRefuseSpool int
+
+	// LowDiskDegraded specifies the free space in MiB below which the node
+	// is considered degraded, and the descriptor for the next epoch is
+	// withheld so that it drops out of the topology before the replay
+	// filters fail.  A value < 0 disables the check.
+	LowDiskDegraded int
+
 	// DisableKeyRotation disables the mix key rotation.
 	DisableKeyRotation bool
 
@@ -137,11 +707,87 @@ type Debug struct {
 	// GenerateOnly halts and cleans up the server right after long term
 	// key generation.
 	GenerateOnly bool
+
+	// PacketTraceFraction specifies the fraction (0.0 to 1.0) of the packets
+	// whose journey through the server will be written to the packet trace
+	// file.  A value <= 0 disables tracing.
+	PacketTraceFraction float64
+
+	// PacketTraceFile specifies the packet trace file, relative to the
+	// DataDir if not absolute.  If omitted "packet_trace.log" will be used.
+	PacketTraceFile string
+
+	// ChaosHooks enables the chaos testing hooks, including the CHAOS_*
+	// management commands, for integration tests.
+	ChaosHooks bool
+
+	// ChaosClockSkew specifies the initial skew applied to the epoch
+	// calculations in milliseconds, if ChaosHooks is set.
+	ChaosClockSkew int
+
+	// ChaosEpochInterval specifies the interval at which an epoch
+	// transition is forced in milliseconds, if ChaosHooks is set.  A value
+	// <= 0 disables forced transitions.
+	ChaosEpochInterval int
+
+	// ChaosDropPeers specifies the hex encoded node IDs of the peers that
+	// all connections will be refused with, if ChaosHooks is set.
+	ChaosDropPeers []string
+
+	// LoadGenRate enables the synthetic load generator, which injects
+	// Sphinx packets addressed to this node's own mix keys at the specified
+	// rate in packets per second, for benchmarking.  The generated packets
+	// are unwrapped and scheduled like any other, but are discarded instead
+	// of being forwarded.  A value <= 0 (the default) disables it.
+	LoadGenRate int
+
+	// ReplayRestoreGap enables detecting mix keys restored from a backup,
+	// by treating a key whose replay filter was last flushed more than the
+	// specified number of milliseconds ago while the key was in use as
+	// restored.  Packets for a restored key are dropped for the
+	// ReplayWarmup period, as the tags seen after the backup point are
+	// unknown.  Note that downtime longer than the gap is indistinguishable
+	// from a restore.  A value <= 0 (the default) disables detection.
+	ReplayRestoreGap int
+
+	// ReplayWarmup specifies the period in milliseconds that packets for a
+	// restored mix key are dropped for.  A value <= 0 (the default) drops
+	// them till the key's epoch has ended.
+	ReplayWarmup int
+
+	// ReplayJournal enables journaling the mix key replay tags seen since
+	// the last flush of the write-back cache, so that a crash does not open
+	// a replay window.  This costs a fsync() per unwrapped packet.
+	ReplayJournal bool
+
+	// MaxRSS specifies the resident memory budget of the process in MiB.
+	// Past it the caches are shrunk and new client connections are shed,
+	// so that the node degrades gracefully instead of being killed by the
+	// OOM killer.  A value <= 0 (the default) disables the budget.
+	MaxRSS int
+
+	// TargetCPU specifies the target CPU utilization of the process, as a
+	// percentage (1 to 100) of all of the CPUs.  Past it new client
+	// connections are shed.  A value <= 0 (the default) disables the
+	// target.
+	TargetCPU int
 }
 
+// The supported Debug.UnknownDestAction values.
+const (
+	UnknownDestDrop = "drop"
+	UnknownDestPark = "park"
+)
+
+// The supported Debug.ForwardCapAction values.
+const (
+	ForwardCapDrop     = "drop"
+	ForwardCapWithhold = "withhold"
+)
+
 // IsUnsafe returns true iff any debug options that destroy security are set.
 func (dCfg *Debug) IsUnsafe() bool {
-	return dCfg.ForceIdentityKey != "" || dCfg.DisableKeyRotation || dCfg.DisableMixAuthentication
+	return dCfg.ForceIdentityKey != "" || dCfg.DisableKeyRotation || dCfg.DisableMixAuthentication || dCfg.ChaosHooks || dCfg.PacketTraceFraction > 0 || dCfg.LoadGenRate > 0
 }
 
 func (dCfg *Debug) applyDefaults() {
@@ -152,6 +798,9 @@ func (dCfg *Debug) applyDefaults() {
 		// the AES-NI unit is a per-core resource.
 		dCfg.NumSphinxWorkers = runtime.NumCPU()
 	}
+	if dCfg.NumProviderWorkers <= 0 {
+		dCfg.NumProviderWorkers = defaultProviderWorkers
+	}
 	if dCfg.SchedulerSlack < defaultSchedulerSlack {
 		// TODO/perf: Tune this.
 		dCfg.SchedulerSlack = defaultSchedulerSlack
@@ -161,15 +810,132 @@ func (dCfg *Debug) applyDefaults() {
 		// networking conditions.
 		dCfg.SendSlack = defaultSendSlack
 	}
+	if dCfg.SendQueueSize <= 0 {
+		dCfg.SendQueueSize = defaultSendQueueSize
+	}
+	if dCfg.ParkingQueueSize <= 0 {
+		dCfg.ParkingQueueSize = defaultParkingQueueSize
+	}
+	if dCfg.ConnectAttemptDelay <= 0 {
+		dCfg.ConnectAttemptDelay = defaultAttemptDelay
+	}
+	if dCfg.MaxPendingDials <= 0 {
+		dCfg.MaxPendingDials = defaultMaxPendingDials
+	}
+	if dCfg.DialInterval <= 0 {
+		dCfg.DialInterval = defaultDialInterval
+	}
+	if dCfg.NumOutgoingLinks <= 0 {
+		dCfg.NumOutgoingLinks = defaultOutgoingLinks
+	}
+	if dCfg.MaxIncomingLinks <= 0 {
+		dCfg.MaxIncomingLinks = defaultIncomingLinks
+	}
 	if dCfg.ConnectTimeout <= 0 {
 		dCfg.ConnectTimeout = defaultConnectTimeout
 	}
+	if dCfg.TCPSendBufferSize < 0 {
+		dCfg.TCPSendBufferSize = 0
+	}
+	if dCfg.TCPReceiveBufferSize < 0 {
+		dCfg.TCPReceiveBufferSize = 0
+	}
+	if dCfg.TCPUserTimeout < 0 {
+		dCfg.TCPUserTimeout = 0
+	}
+	if dCfg.TCPKeepAliveInterval <= 0 {
+		dCfg.TCPKeepAliveInterval = defaultTCPKeepAlive
+	}
+	if dCfg.MaxIncomingConns <= 0 {
+		dCfg.MaxIncomingConns = defaultMaxIncomingConns
+	}
+	if dCfg.MaxIncomingConnsPerIP <= 0 {
+		dCfg.MaxIncomingConnsPerIP = defaultMaxConnsPerIP
+	}
+	if dCfg.NewConnRate <= 0 {
+		dCfg.NewConnRate = defaultNewConnRate
+	}
+	if dCfg.NewConnBurst < dCfg.NewConnRate {
+		dCfg.NewConnBurst = dCfg.NewConnRate
+	}
+	if dCfg.ListenerDrainTimeout <= 0 {
+		dCfg.ListenerDrainTimeout = defaultListenerDrain
+	}
+	if dCfg.ShutdownTimeout <= 0 {
+		dCfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if dCfg.TerminationDrainTimeout <= 0 {
+		dCfg.TerminationDrainTimeout = defaultTermDrain
+	}
+	if dCfg.MaxWorkerRestarts == 0 {
+		dCfg.MaxWorkerRestarts = defaultMaxWorkerRestart
+	}
+	if dCfg.AccountingRetention <= 0 {
+		dCfg.AccountingRetention = defaultAcctRetention
+	}
+	if dCfg.DecommissionSpoolWindow <= 0 {
+		dCfg.DecommissionSpoolWindow = defaultSpoolWindow
+	}
+	if dCfg.ClientPollRate <= 0 {
+		dCfg.ClientPollRate = defaultClientPollRate
+	}
+	if dCfg.ClientBanDuration <= 0 {
+		dCfg.ClientBanDuration = defaultClientBanTime
+	}
+	if dCfg.PeerBanDuration <= 0 {
+		dCfg.PeerBanDuration = defaultPeerBanTime
+	}
+	if dCfg.ClockSkewThreshold <= 0 {
+		dCfg.ClockSkewThreshold = defaultClockSkewThresh
+	}
+	if dCfg.DangerousClockSkew <= 0 {
+		dCfg.DangerousClockSkew = defaultDangerousSkew
+	}
+	if dCfg.LowDiskWarning == 0 {
+		dCfg.LowDiskWarning = defaultLowDiskWarning
+	}
+	if dCfg.LowDiskRefuseSpool == 0 {
+		dCfg.LowDiskRefuseSpool = defaultLowDiskSpool
+	}
+	if dCfg.LowDiskDegraded == 0 {
+		dCfg.LowDiskDegraded = defaultLowDiskDegraded
+	}
 	if dCfg.HandshakeTimeout <= 0 {
 		dCfg.HandshakeTimeout = defaultHandshakeTimeout
 	}
+	if dCfg.FirstCommandTimeout <= 0 {
+		dCfg.FirstCommandTimeout = defaultFirstCmdTimeout
+	}
 	if dCfg.ReauthInterval <= 0 {
 		dCfg.ReauthInterval = defaultReauthInterval
 	}
+	if dCfg.LinkKeepAliveInterval <= 0 {
+		dCfg.LinkKeepAliveInterval = defaultKeepAliveIval
+	}
+	if dCfg.LinkKeepAliveTimeout <= 0 {
+		dCfg.LinkKeepAliveTimeout = defaultKeepAliveTimeout
+	}
+	if dCfg.LinkPaddingRate < 0 {
+		dCfg.LinkPaddingRate = 0
+	}
+	if dCfg.ClientPaddingInterval < 0 {
+		dCfg.ClientPaddingInterval = 0
+	}
+	if dCfg.LinkDrainTimeout <= 0 {
+		dCfg.LinkDrainTimeout = defaultDrainTimeout
+	}
+	if dCfg.RetryMinDelay <= 0 {
+		dCfg.RetryMinDelay = defaultRetryMinDelay
+	}
+	if dCfg.RetryMaxDelay <= 0 {
+		dCfg.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if dCfg.RetryMaxDelay < dCfg.RetryMinDelay {
+		dCfg.RetryMaxDelay = dCfg.RetryMinDelay
+	}
+	if dCfg.RetryJitter < 0 {
+		dCfg.RetryJitter = 0
+	}
 }
 
 // Logging is the Katzenpost server logging configuration.
@@ -180,38 +946,397 @@ type Logging struct {
 	// File specifies the log file, if omitted stdout will be used.
 	File string
 
-	// Level specifies the log level.
-	Level string
+	// Format specifies the format of the logs written to stdout, one of
+	// "text" (the default), or "json" for one JSON object per line, which
+	// log collectors can parse.  The default is "json" in ContainerMode.
+	Format string
+
+	// Level specifies the log level.
+	Level string
+
+	// MaxSize is the size in MiB after which the log file is rotated, 0
+	// disables size based rotation.
+	MaxSize int
+
+	// MaxAge is the interval in hours after which the log file is rotated,
+	// 0 disables age based rotation.
+	MaxAge int
+
+	// MaxBackups is the number of rotated log files to retain, if 0 a
+	// default of 5 will be used, if negative none will be kept.
+	MaxBackups int
+
+	// Syslog is the optional syslog configuration, if set logs will be sent
+	// to a syslog daemon instead of File.
+	Syslog *Syslog
+
+	// Journald sends logs to the systemd journal instead of File.
+	Journald bool
+
+	// PrefixIdentifier prefixes the log module names with the server
+	// Identifier, to tell apart the logs of multiple servers running in
+	// the same process.
+	PrefixIdentifier bool
+
+	// RedactClients is the policy applied to client IP addresses and user
+	// identifiers in log output, for data-minimization requirements.  It
+	// is one of "hash" (a keyed hash, stable till the server restarts),
+	// "truncate" (the network prefix, and the start of the identifier), or
+	// empty to log them as is.  They are kept intact in memory, for rate
+	// limiting and banning.
+	RedactClients string
+}
+
+// The supported Logging.Format values.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The supported Logging.RedactClients values.
+const (
+	RedactHash     = "hash"
+	RedactTruncate = "truncate"
+)
+
+// Syslog is the Katzenpost server syslog configuration.
+type Syslog struct {
+	// Network is the network used to reach a remote syslog daemon, one of
+	// `udp`, `tcp` or `tls`.  If omitted, the local syslog daemon will be
+	// used.
+	Network string
+
+	// Address is the address of the remote syslog daemon.
+	Address string
+
+	// Tag is the tag attached to each message, if omitted `katzenpost` will
+	// be used.
+	Tag string
+
+	// Facility is the syslog facility, if omitted `daemon` will be used.
+	Facility string
+
+	// TLSCAFile is the optional path to a PEM encoded CA certificate bundle
+	// used to verify the remote syslog daemon for the `tls` network.  If
+	// omitted the system certificate pool will be used.
+	TLSCAFile string
+}
+
+func (sCfg *Syslog) applyDefaults() {
+	if sCfg.Tag == "" {
+		sCfg.Tag = defaultSyslogTag
+	}
+	if sCfg.Facility == "" {
+		sCfg.Facility = defaultSyslogFacility
+	}
+}
+
+func (sCfg *Syslog) validate() error {
+	switch sCfg.Network {
+	case "":
+		if sCfg.Address != "" {
+			return errors.New("config: Logging: Syslog: Address set without a Network")
+		}
+	case "udp", "tcp", "tls":
+		if sCfg.Address == "" {
+			return fmt.Errorf("config: Logging: Syslog: Network '%v' requires an Address", sCfg.Network)
+		}
+		if _, _, err := net.SplitHostPort(sCfg.Address); err != nil {
+			return fmt.Errorf("config: Logging: Syslog: Address '%v' is invalid: %v", sCfg.Address, err)
+		}
+	default:
+		return fmt.Errorf("config: Logging: Syslog: Network '%v' is invalid", sCfg.Network)
+	}
+	if sCfg.TLSCAFile != "" {
+		if sCfg.Network != "tls" {
+			return errors.New("config: Logging: Syslog: TLSCAFile set without the tls Network")
+		}
+		if !filepath.IsAbs(sCfg.TLSCAFile) {
+			return fmt.Errorf("config: Logging: Syslog: TLSCAFile '%v' is not an absolute path", sCfg.TLSCAFile)
+		}
+	}
+	switch sCfg.Facility {
+	case "kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp":
+	case "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7":
+	default:
+		return fmt.Errorf("config: Logging: Syslog: Facility '%v' is invalid", sCfg.Facility)
+	}
+	return nil
+}
+
+func (lCfg *Logging) validate() error {
+	lvl := strings.ToUpper(lCfg.Level)
+	switch lvl {
+	case "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG":
+	case "":
+		lCfg.Level = defaultLogLevel
+	default:
+		return fmt.Errorf("config: Logging: Level '%v' is invalid", lCfg.Level)
+	}
+	lCfg.Level = lvl // Force uppercase.
+	if lCfg.MaxSize < 0 {
+		return fmt.Errorf("config: Logging: MaxSize %v is invalid", lCfg.MaxSize)
+	}
+	if lCfg.MaxAge < 0 {
+		return fmt.Errorf("config: Logging: MaxAge %v is invalid", lCfg.MaxAge)
+	}
+	if lCfg.MaxBackups == 0 {
+		lCfg.MaxBackups = defaultLogMaxBackups
+	}
+	if lCfg.Syslog != nil {
+		if lCfg.File != "" || lCfg.Journald {
+			return errors.New("config: Logging: Syslog is mutually exclusive with File and Journald")
+		}
+		lCfg.Syslog.applyDefaults()
+		if err := lCfg.Syslog.validate(); err != nil {
+			return err
+		}
+	}
+	if lCfg.Journald && lCfg.File != "" {
+		return errors.New("config: Logging: Journald is mutually exclusive with File")
+	}
+	switch lCfg.Format {
+	case "":
+		lCfg.Format = LogFormatText
+	case LogFormatText:
+	case LogFormatJSON:
+		if lCfg.File != "" || lCfg.Syslog != nil || lCfg.Journald {
+			return errors.New("config: Logging: Format json is mutually exclusive with File, Syslog and Journald")
+		}
+	default:
+		return fmt.Errorf("config: Logging: Format '%v' is invalid", lCfg.Format)
+	}
+	switch lCfg.RedactClients {
+	case "", RedactHash, RedactTruncate:
+	default:
+		return fmt.Errorf("config: Logging: RedactClients '%v' is invalid", lCfg.RedactClients)
+	}
+	return nil
+}
+
+// Provider is the Katzenpost provider configuration.
+type Provider struct {
+	// UserDBBackend selects the userdb backend to be used. If left empty
+	// the boltuserdb implementation will be used.
+	UserDBBackend string
+
+	// Bolt DB Backed katzenpost user db
+	Bolt *BoltUserDB
+
+	// Externally defined katzenpost user db
+	Extern *ExternUserDB
+
+	// SpoolDB is the path to the user message spool.  If left empty, it will
+	// use `spool.db` under the DataDir.
+	SpoolDB string
+
+	// SpoolKeyFile is the path to the PEM encoded master key used to encrypt
+	// the user message spool at rest.  If left empty, messages are spooled
+	// in the clear, and if the file does not exist, a new key is generated.
+	// The key should be stored separately from the spool (eg: on removable
+	// or tmpfs backed storage).  Once a spool has been encrypted, the server
+	// will refuse to start without the key.
+	SpoolKeyFile string
+
+	// MaxUserSpoolMessages is the maximum number of messages that will be
+	// stored in each user's spool.  Messages for users with a full spool
+	// are dropped without a SURB-ACK, so that the sender retransmits.  A
+	// value <= 0 is treated as unlimited.
+	MaxUserSpoolMessages int
+
+	// WebSocket is the optional WebSocket client listener configuration.
+	WebSocket *WebSocket
+
+	// AccountExpiry is the optional idle account expiry policy.
+	AccountExpiry *AccountExpiry
+
+	// Tiers is the list of account service tiers, that users can be
+	// assigned to via the management interface.
+	Tiers []*Tier
+
+	// DefaultTier is the name of the tier of the users that are not
+	// assigned to one.  If left empty, such users are only subject to the
+	// global limits.
+	DefaultTier string
+
+	// Kaetzchen is the list of built-in provider auto-responder services.
+	Kaetzchen []*Kaetzchen
+}
+
+const (
+	// KaetzchenLoop is the capability of the loop (echo) service.
+	KaetzchenLoop = "loop"
+
+	// KaetzchenNotary is the capability of the timestamping notary
+	// service, which returns a signed timestamp over a client supplied hash.
+	KaetzchenNotary = "notary"
+
+	// KaetzchenParamEndpoint is the advertised parameter holding the
+	// service's endpoint.
+	KaetzchenParamEndpoint = "endpoint"
+
+	// KaetzchenParamVersion is the advertised parameter holding the
+	// service's protocol version.
+	KaetzchenParamVersion = "version"
+)
+
+// Kaetzchen is a Katzenpost provider auto-responder service configuration.
+type Kaetzchen struct {
+	// Capability is the service to run (`loop`, `notary`).
+	Capability string
+
+	// Endpoint is the recipient that the service is reachable at.  If left
+	// empty it will use `+` followed by the Capability.
+	Endpoint string
+
+	// Parameters are additional operator specified parameters that are
+	// advertised along with the service (eg: a description).
+	Parameters map[string]string
+
+	// Disable disables the service.
+	Disable bool
+}
+
+func (kCfg *Kaetzchen) applyDefaults() {
+	if kCfg.Endpoint == "" {
+		kCfg.Endpoint = "+" + kCfg.Capability
+	}
+}
+
+func (kCfg *Kaetzchen) validate() error {
+	switch kCfg.Capability {
+	case KaetzchenLoop, KaetzchenNotary:
+	default:
+		return fmt.Errorf("config: Provider: Kaetzchen: Capability '%v' is invalid", kCfg.Capability)
+	}
+	for k := range kCfg.Parameters {
+		switch k {
+		case "":
+			return fmt.Errorf("config: Provider: Kaetzchen: '%v' has an empty Parameter name", kCfg.Capability)
+		case KaetzchenParamEndpoint, KaetzchenParamVersion:
+			return fmt.Errorf("config: Provider: Kaetzchen: '%v' Parameter '%v' is reserved", kCfg.Capability, k)
+		}
+	}
+	return nil
+}
+
+// WebSocket is the Katzenpost provider WebSocket listener configuration,
+// which allows clients on restrictive networks to tunnel the wire protocol
+// over WebSocket, optionally over TLS.
+type WebSocket struct {
+	// Addresses are the IP address/port combinations that the server will
+	// bind to for incoming WebSocket connections.
+	Addresses []string
+
+	// Path is the HTTP request path that WebSocket connections will be
+	// accepted on.  If left empty it will use `/`.
+	Path string
+
+	// TLSCertFile is the path to the PEM encoded TLS certificate (chain).
+	// If left empty, TLS will not be used.
+	TLSCertFile string
+
+	// TLSKeyFile is the path to the PEM encoded TLS private key.
+	TLSKeyFile string
+}
+
+func (wCfg *WebSocket) applyDefaults() {
+	if wCfg.Path == "" {
+		wCfg.Path = "/"
+	}
+}
+
+func (wCfg *WebSocket) validate() error {
+	if len(wCfg.Addresses) == 0 {
+		return fmt.Errorf("config: Provider: WebSocket: No Addresses specified")
+	}
+	for _, v := range wCfg.Addresses {
+		if err := utils.EnsureAddrIPPort(v); err != nil {
+			return fmt.Errorf("config: Provider: WebSocket: Address '%v' is invalid: %v", v, err)
+		}
+	}
+	if !strings.HasPrefix(wCfg.Path, "/") {
+		return fmt.Errorf("config: Provider: WebSocket: Path '%v' is not absolute", wCfg.Path)
+	}
+	if (wCfg.TLSCertFile == "") != (wCfg.TLSKeyFile == "") {
+		return fmt.Errorf("config: Provider: WebSocket: TLSCertFile and TLSKeyFile must be set together")
+	}
+	for _, v := range []string{wCfg.TLSCertFile, wCfg.TLSKeyFile} {
+		if v != "" && !filepath.IsAbs(v) {
+			return fmt.Errorf("config: Provider: WebSocket: '%v' is not an absolute path", v)
+		}
+	}
+	return nil
+}
+
+// Tier is a Katzenpost provider account service tier.
+type Tier struct {
+	// Name is the name of the tier.
+	Name string
+
+	// MaxSpoolMessages is the maximum number of messages that will be
+	// stored in the spool of each user in the tier.  If left as 0, the
+	// Provider MaxUserSpoolMessages is used, which this may not exceed.
+	MaxSpoolMessages int
+
+	// PollRate is the rate in spool retrievals per second that users in
+	// the tier are allowed.  If left as 0, the Debug ClientPollRate is used.
+	PollRate int
+
+	// SendRate is the rate in packets per second that users in the tier are
+	// allowed to send.  Packets sent faster are delayed.  If left as 0, the
+	// send rate is unlimited.
+	SendRate int
 }
 
-func (lCfg *Logging) validate() error {
-	lvl := strings.ToUpper(lCfg.Level)
-	switch lvl {
-	case "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG":
-	case "":
-		lCfg.Level = defaultLogLevel
-	default:
-		return fmt.Errorf("config: Logging: Level '%v' is invalid", lCfg.Level)
+func (tCfg *Tier) validate(pCfg *Provider) error {
+	if tCfg.Name == "" {
+		return errors.New("config: Provider: Tier has no Name")
+	}
+	if tCfg.MaxSpoolMessages < 0 || (pCfg.MaxUserSpoolMessages > 0 && tCfg.MaxSpoolMessages > pCfg.MaxUserSpoolMessages) {
+		return fmt.Errorf("config: Provider: Tier '%v': MaxSpoolMessages %v is invalid", tCfg.Name, tCfg.MaxSpoolMessages)
+	}
+	if tCfg.PollRate < 0 {
+		return fmt.Errorf("config: Provider: Tier '%v': PollRate %v is invalid", tCfg.Name, tCfg.PollRate)
+	}
+	if tCfg.SendRate < 0 {
+		return fmt.Errorf("config: Provider: Tier '%v': SendRate %v is invalid", tCfg.Name, tCfg.SendRate)
 	}
-	lCfg.Level = lvl // Force uppercase.
 	return nil
 }
 
-// Provider is the Katzenpost provider configuration.
-type Provider struct {
-	// UserDBBackend selects the userdb backend to be used. If left empty
-	// the boltuserdb implementation will be used.
-	UserDBBackend string
+// AccountExpiry is the Katzenpost provider idle account expiry policy.  An
+// account is idle while the user neither authenticates nor has messages
+// stored in their spool.
+type AccountExpiry struct {
+	// DisableAfter is the number of days an account may be idle before it
+	// is disabled.  Disabled users can not authenticate, and messages for
+	// them are dropped.
+	DisableAfter int
 
-	// Bolt DB Backed katzenpost user db
-	Bolt *BoltUserDB
+	// DeleteAfter is the number of days an account may be idle before it
+	// and the user's spool are deleted.  If left as 0, disabled accounts
+	// are never deleted.
+	DeleteAfter int
 
-	// Externally defined katzenpost user db
-	Extern *ExternUserDB
+	// WarnBefore is the number of days before an account is disabled that
+	// a spool.NoticeAccountExpiring notice is queued in its spool, and the
+	// AccountExpiring event is emitted for it.  If left as 0, no warning is
+	// given.
+	WarnBefore int
+}
 
-	// SpoolDB is the path to the user message spool.  If left empty, it will
-	// use `spool.db` under the DataDir.
-	SpoolDB string
+func (eCfg *AccountExpiry) validate() error {
+	if eCfg.DisableAfter <= 0 {
+		return fmt.Errorf("config: Provider: AccountExpiry: DisableAfter %v is invalid", eCfg.DisableAfter)
+	}
+	if eCfg.DeleteAfter != 0 && eCfg.DeleteAfter <= eCfg.DisableAfter {
+		return fmt.Errorf("config: Provider: AccountExpiry: DeleteAfter %v is not after DisableAfter", eCfg.DeleteAfter)
+	}
+	if eCfg.WarnBefore < 0 || eCfg.WarnBefore >= eCfg.DisableAfter {
+		return fmt.Errorf("config: Provider: AccountExpiry: WarnBefore %v is invalid", eCfg.WarnBefore)
+	}
+	return nil
 }
 
 // BoltUserDB is the bolt implementation of userdb
@@ -231,9 +1356,11 @@ type ExternUserDB struct {
 func (pCfg *Provider) applyDefaults(sCfg *Server) {
 	if pCfg.UserDBBackend == "" {
 		pCfg.UserDBBackend = "bolt"
-		pCfg.Bolt = &BoltUserDB{}
 	}
 	if pCfg.UserDBBackend == "bolt" {
+		if pCfg.Bolt == nil {
+			pCfg.Bolt = &BoltUserDB{}
+		}
 		if pCfg.Bolt.UserDB == "" {
 			pCfg.Bolt.UserDB = filepath.Join(sCfg.DataDir, defaultUserDB)
 		}
@@ -241,6 +1368,12 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 	if pCfg.SpoolDB == "" {
 		pCfg.SpoolDB = filepath.Join(sCfg.DataDir, defaultSpoolDB)
 	}
+	if pCfg.WebSocket != nil {
+		pCfg.WebSocket.applyDefaults()
+	}
+	for _, v := range pCfg.Kaetzchen {
+		v.applyDefaults()
+	}
 }
 
 func (pCfg *Provider) validate() error {
@@ -252,6 +1385,9 @@ func (pCfg *Provider) validate() error {
 	if !filepath.IsAbs(pCfg.SpoolDB) {
 		return fmt.Errorf("config: Provider: SpoolDB '%v' is not an absolute path", pCfg.SpoolDB)
 	}
+	if pCfg.SpoolKeyFile != "" && !filepath.IsAbs(pCfg.SpoolKeyFile) {
+		return fmt.Errorf("config: Provider: SpoolKeyFile '%v' is not an absolute path", pCfg.SpoolKeyFile)
+	}
 	if pCfg.UserDBBackend == "extern" {
 		if pCfg.Extern == nil {
 			return fmt.Errorf("config: Provider: Extern section should be defined")
@@ -268,6 +1404,54 @@ func (pCfg *Provider) validate() error {
 			return fmt.Errorf("config: Provider: ProviderURL should be of http schema")
 		}
 	}
+	if pCfg.WebSocket != nil {
+		if err := pCfg.WebSocket.validate(); err != nil {
+			return err
+		}
+	}
+	tiers := make(map[string]bool)
+	for _, v := range pCfg.Tiers {
+		if err := v.validate(pCfg); err != nil {
+			return err
+		}
+		if tiers[v.Name] {
+			return fmt.Errorf("config: Provider: Tier '%v' is specified more than once", v.Name)
+		}
+		tiers[v.Name] = true
+	}
+	if pCfg.DefaultTier != "" && !tiers[pCfg.DefaultTier] {
+		return fmt.Errorf("config: Provider: DefaultTier '%v' is not a Tier", pCfg.DefaultTier)
+	}
+	if len(pCfg.Tiers) > 0 && pCfg.UserDBBackend != "bolt" {
+		// The tier assignments are stored in the user metadata.
+		return fmt.Errorf("config: Provider: Tiers require the bolt UserDBBackend")
+	}
+	if pCfg.AccountExpiry != nil {
+		if pCfg.UserDBBackend != "bolt" {
+			// The external backend has no way to track activity.
+			return fmt.Errorf("config: Provider: AccountExpiry requires the bolt UserDBBackend")
+		}
+		if err := pCfg.AccountExpiry.validate(); err != nil {
+			return err
+		}
+	}
+	endpoints, capabilities := make(map[string]bool), make(map[string]bool)
+	for _, v := range pCfg.Kaetzchen {
+		if err := v.validate(); err != nil {
+			return err
+		}
+		if endpoints[v.Endpoint] {
+			return fmt.Errorf("config: Provider: Kaetzchen: Endpoint '%v' is specified more than once", v.Endpoint)
+		}
+		endpoints[v.Endpoint] = true
+		if v.Disable {
+			continue
+		}
+		if capabilities[v.Capability] {
+			return fmt.Errorf("config: Provider: Kaetzchen: Capability '%v' is enabled more than once", v.Capability)
+		}
+		capabilities[v.Capability] = true
+	}
 	return nil
 }
 
@@ -339,86 +1523,554 @@ func (mCfg *Management) validate() error {
 	return nil
 }
 
+// Sandbox is the Katzenpost server process sandboxing configuration.
+type Sandbox struct {
+	// User is the user that the server will switch to once the listeners
+	// are bound and the DataDir is opened, when started as root.  The
+	// contents of the DataDir will be handed over to the user.
+	User string
+
+	// Group is the group that the server will switch to, if omitted the
+	// User's primary group will be used.
+	Group string
+
+	// Chroot confines the server to the DataDir after switching users.
+	// Anything outside the DataDir (eg: a log File elsewhere, Kaetzchen
+	// plugins) will be inaccessible.
+	Chroot bool
+
+	// LockAllMemory locks all of the server's memory, so that no secret
+	// material is ever written to swap.  This requires a RLIMIT_MEMLOCK
+	// large enough for the replay filters (64 MiB per mix key).  The
+	// private keys are locked in memory regardless, on a best effort basis.
+	LockAllMemory bool
+
+	// DisableCoreDumps sets RLIMIT_CORE to 0, and makes the server log
+	// panics with anything resembling key material redacted from the
+	// stack trace, for hosting environments where core dumps and logs may
+	// be exposed to third parties.
+	DisableCoreDumps bool
+
+	// SyscallFilter restricts the system calls available to the server once
+	// it is initialized, using seccomp-bpf (Linux amd64/arm64) or
+	// pledge/unveil (OpenBSD).  Kaetzchen plugins can not be restarted with
+	// the filter in place.
+	SyscallFilter bool
+
+	// SyscallFilterLogOnly makes the syscall filter log violations instead
+	// of blocking them, to debug the filter.
+	SyscallFilterLogOnly bool
+}
+
+func (sbCfg *Sandbox) validate() error {
+	if sbCfg.User == "" {
+		if sbCfg.Group != "" {
+			return errors.New("config: Sandbox: Group set without a User")
+		}
+		if sbCfg.Chroot {
+			return errors.New("config: Sandbox: Chroot set without a User")
+		}
+	}
+	if sbCfg.SyscallFilterLogOnly && !sbCfg.SyscallFilter {
+		return errors.New("config: Sandbox: SyscallFilterLogOnly set without SyscallFilter")
+	}
+	return nil
+}
+
+// NAT is the Katzenpost server NAT traversal configuration.
+type NAT struct {
+	// PortMapping enables mapping the ports of the listeners on private
+	// IPv4 addresses through the Gateway via NAT-PMP, and discovering the
+	// external address from it.
+	PortMapping bool
+
+	// Gateway is the address of the NAT-PMP gateway (usually the router),
+	// with an optional port.
+	Gateway string
+
+	// STUNServer is the optional address of a STUN server used to discover
+	// the external address, when PortMapping is disabled.  The listener
+	// ports must be forwarded manually.
+	STUNServer string
+}
+
+func (nCfg *NAT) validate() error {
+	if nCfg.PortMapping {
+		if nCfg.Gateway == "" {
+			return errors.New("config: NAT: PortMapping set without a Gateway")
+		}
+		if nCfg.STUNServer != "" {
+			return errors.New("config: NAT: STUNServer set with PortMapping")
+		}
+	} else if nCfg.Gateway != "" {
+		return errors.New("config: NAT: Gateway set without PortMapping")
+	}
+	if nCfg.STUNServer != "" {
+		if _, _, err := net.SplitHostPort(nCfg.STUNServer); err != nil {
+			return fmt.Errorf("config: NAT: STUNServer '%v' is invalid: %v", nCfg.STUNServer, err)
+		}
+	}
+	return nil
+}
+
+// Tracing is the Katzenpost server OpenTelemetry tracing configuration.
+// Only coarse grained operations (PKI fetches, descriptor publication and
+// outgoing connection establishment) are traced, never individual packets.
+type Tracing struct {
+	// OTLPEndpoint is the URL of the collector's OTLP/HTTP traces endpoint
+	// (eg: `http://localhost:4318/v1/traces`).  Spans are sent using the
+	// JSON encoding.
+	OTLPEndpoint string
+
+	// ServiceName is the `service.name` resource attribute.  If left empty
+	// it will use `katzenpost-server`.
+	ServiceName string
+}
+
+func (tCfg *Tracing) applyDefaults() {
+	if tCfg.ServiceName == "" {
+		tCfg.ServiceName = defaultServiceName
+	}
+}
+
+func (tCfg *Tracing) validate() error {
+	u, err := url.Parse(tCfg.OTLPEndpoint)
+	if err != nil {
+		return fmt.Errorf("config: Tracing: OTLPEndpoint '%v' is invalid: %v", tCfg.OTLPEndpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("config: Tracing: OTLPEndpoint '%v' is not a http(s) URL", tCfg.OTLPEndpoint)
+	}
+	return nil
+}
+
+// Alerting is the Katzenpost server alerting configuration.  High severity
+// events (degraded operation, suspected attacks, overload) are delivered to
+// the webhook and or command as a JSON object, so that operators can be
+// paged without a metrics stack.
+type Alerting struct {
+	// WebhookURL is the URL that the alerts are POSTed to.
+	WebhookURL string
+
+	// Command is the absolute path to an executable that is run once per
+	// alert, with the alert on stdin.  The Command must be reachable from
+	// within the Sandbox Chroot if one is used.
+	Command string
+
+	// Args is the list of arguments passed to the Command.
+	Args []string
+
+	// MinInterval is the minimum interval in milliseconds between alerts
+	// with the same event type and reason.  If left as 0 it will use 15
+	// minutes.
+	MinInterval int
+}
+
+func (aCfg *Alerting) applyDefaults() {
+	if aCfg.MinInterval <= 0 {
+		aCfg.MinInterval = defaultAlertInterval
+	}
+}
+
+func (aCfg *Alerting) validate() error {
+	if aCfg.WebhookURL == "" && aCfg.Command == "" {
+		return errors.New("config: Alerting: Neither WebhookURL nor Command set")
+	}
+	if aCfg.WebhookURL != "" {
+		u, err := url.Parse(aCfg.WebhookURL)
+		if err != nil {
+			return fmt.Errorf("config: Alerting: WebhookURL '%v' is invalid: %v", aCfg.WebhookURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("config: Alerting: WebhookURL '%v' is not a http(s) URL", aCfg.WebhookURL)
+		}
+	}
+	if aCfg.Command != "" && !filepath.IsAbs(aCfg.Command) {
+		return fmt.Errorf("config: Alerting: Command '%v' is not an absolute path", aCfg.Command)
+	}
+	return nil
+}
+
+// PeerOverrides is the Katzenpost server peer link override configuration,
+// for allowing or refusing links with specific peers regardless of the PKI
+// document.  This is intended for the staged onboarding of new peers, and
+// the emergency isolation of hostile ones.
+type PeerOverrides struct {
+	// Allow is the list of peers that links are allowed with even if they
+	// are not listed in the PKI document.
+	Allow []*AllowedPeer
+
+	// Deny is the list of identity keys in Base64 or Base16 format of the
+	// peers that all links are refused with, even if they are listed in the
+	// PKI document.  Deny takes precedence over Allow.
+	Deny []string
+}
+
+// AllowedPeer is a peer that links are allowed with regardless of the PKI
+// document.
+type AllowedPeer struct {
+	// Name is the peer's name, used for logging.
+	Name string
+
+	// IdentityKey is the peer's identity key in Base64 or Base16 format.
+	IdentityKey string
+
+	// LinkKey is the peer's link key in Base64 or Base16 format.
+	LinkKey string
+
+	// Addresses is the list of IP/port combinations that outgoing links to
+	// the peer are made to.  If left empty, only incoming links from the
+	// peer are allowed.
+	Addresses []string
+}
+
+func (oCfg *PeerOverrides) validate() error {
+	for i, v := range oCfg.Allow {
+		if v == nil {
+			return fmt.Errorf("config: PeerOverrides: Allow entry %v is empty", i)
+		}
+		var pubKey eddsa.PublicKey
+		if err := pubKey.FromString(v.IdentityKey); err != nil {
+			return fmt.Errorf("config: PeerOverrides: Allow '%v': Invalid IdentityKey: %v", v.Name, err)
+		}
+		if _, err := DecodeLinkKey(v.LinkKey); err != nil {
+			return fmt.Errorf("config: PeerOverrides: Allow '%v': Invalid LinkKey: %v", v.Name, err)
+		}
+		for _, addr := range v.Addresses {
+			if err := utils.EnsureAddrIPPort(addr); err != nil {
+				return fmt.Errorf("config: PeerOverrides: Allow '%v': Address '%v' is invalid: %v", v.Name, addr, err)
+			}
+		}
+	}
+	for _, v := range oCfg.Deny {
+		var pubKey eddsa.PublicKey
+		if err := pubKey.FromString(v); err != nil {
+			return fmt.Errorf("config: PeerOverrides: Invalid Deny entry '%v': %v", v, err)
+		}
+	}
+	return nil
+}
+
+// EnsureAddrHostPort returns nil iff addr is a valid "host:port"
+// combination, where host is either an IP address or a DNS name.
+func EnsureAddrHostPort(addr string) error {
+	if err := utils.EnsureAddrIPPort(addr); err == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isDNSName(host) {
+		return fmt.Errorf("'%v' is not an IP address or DNS name", host)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port '%v'", port)
+	}
+	return nil
+}
+
+func isDNSName(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+	}
+
+	// An all numeric top level label is a mistyped IP address, not a name.
+	_, err := strconv.ParseUint(labels[len(labels)-1], 10, 64)
+	return err != nil
+}
+
+// DecodeLinkKey decodes a Base64 or Base16 format link public key, and
+// returns the raw key.
+func DecodeLinkKey(s string) ([]byte, error) {
+	const linkKeyLength = 32
+
+	// A Base64 encoded key is never 64 characters long, so try Base16 first.
+	var b []byte
+	var err error
+	if len(s) == 2*linkKeyLength {
+		b, err = hex.DecodeString(s)
+	} else {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != linkKeyLength {
+		return nil, fmt.Errorf("invalid key length: %v", len(b))
+	}
+	return b, nil
+}
+
 // Config is the top level Katzenpost server configuration.
 type Config struct {
+	// ConfigVersion is the version of the configuration file layout, older
+	// layouts are migrated when loaded.  See CurrentConfigVersion.
+	ConfigVersion int
+
 	Server     *Server
 	Logging    *Logging
 	Provider   *Provider
 	PKI        *PKI
 	Management *Management
+	Sandbox    *Sandbox
+	NAT        *NAT
+	Tracing    *Tracing
+	Alerting   *Alerting
+
+	PeerOverrides *PeerOverrides
 
 	Debug *Debug
+
+	warnings []string
+}
+
+// Warnings returns the deprecation warnings for the configuration file,
+// which are intended to be logged once logging is initialized.
+func (cfg *Config) Warnings() []string {
+	return cfg.warnings
 }
 
 // FixupAndValidate applies defaults to config entries and validates the
 // supplied configuration.  Most people should call one of the Load variants
 // instead.
 func (cfg *Config) FixupAndValidate() error {
+	if errs := cfg.fixupAndValidate(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Validate applies defaults to config entries and validates the supplied
+// configuration like FixupAndValidate, but returns all of the problems at
+// once as ValidationErrors instead of only the first one.
+func (cfg *Config) Validate() error {
+	if errs := cfg.fixupAndValidate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidationErrors is the list of problems found by Validate.
+type ValidationErrors []error
+
+// Error implements the error interface.
+func (e ValidationErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+func (cfg *Config) fixupAndValidate() ValidationErrors {
+	var errs ValidationErrors
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	// The Server and PKI sections are mandatory, everything else is optional.
 	if cfg.Server == nil {
-		return errors.New("config: No Server block was present")
+		return ValidationErrors{errors.New("config: No Server block was present")}
 	}
 	if cfg.Debug == nil {
 		cfg.Debug = &Debug{}
 	}
 	if cfg.Logging == nil {
-		cfg.Logging = &defaultLogging
+		l := defaultLogging
+		cfg.Logging = &l
+	}
+	if cfg.Server.ContainerMode && cfg.Logging.Format == "" && cfg.Logging.File == "" && cfg.Logging.Syslog == nil && !cfg.Logging.Journald {
+		cfg.Logging.Format = LogFormatJSON
 	}
 	if cfg.PKI == nil {
-		return errors.New("config: No PKI block was present")
+		return ValidationErrors{errors.New("config: No PKI block was present")}
 	}
 	if cfg.Management == nil {
 		cfg.Management = &Management{}
 	}
-
-	// Perform basic validation.
-	if err := cfg.Server.validate(); err != nil {
-		return err
+	if cfg.Sandbox == nil {
+		cfg.Sandbox = &Sandbox{}
 	}
-	if err := cfg.PKI.validate(); err != nil {
-		return err
+
+	// Configurations constructed in code always use the current layout.
+	switch {
+	case cfg.ConfigVersion == 0:
+		cfg.ConfigVersion = CurrentConfigVersion
+	case cfg.ConfigVersion != CurrentConfigVersion:
+		check(fmt.Errorf("config: ConfigVersion %v is not the supported version %v", cfg.ConfigVersion, CurrentConfigVersion))
 	}
+
+	// Perform basic validation.
+	check(cfg.Server.validate())
+	check(cfg.PKI.validate())
 	if cfg.Server.IsProvider {
 		if cfg.Debug.DisableMixAuthentication {
-			return errors.New("config: DisableMixAuthentication set when not a Mix")
+			check(errors.New("config: DisableMixAuthentication set when not a Mix"))
 		}
 
 		if cfg.Provider == nil {
 			cfg.Provider = &Provider{}
 		}
 		cfg.Provider.applyDefaults(cfg.Server)
-		if err := cfg.Provider.validate(); err != nil {
-			return err
-		}
+		check(cfg.Provider.validate())
 	} else if cfg.Provider != nil {
-		return errors.New("config: Provider block set when not a Provider")
-	}
-	if err := cfg.Logging.validate(); err != nil {
-		return err
+		check(errors.New("config: Provider block set when not a Provider"))
 	}
+	check(cfg.Logging.validate())
 	cfg.Management.applyDefaults(cfg.Server)
-	if err := cfg.Management.validate(); err != nil {
-		return err
+	check(cfg.Management.validate())
+	check(cfg.Sandbox.validate())
+	if cfg.NAT != nil {
+		check(cfg.NAT.validate())
+	}
+	if cfg.Tracing != nil {
+		cfg.Tracing.applyDefaults()
+		check(cfg.Tracing.validate())
+	}
+	if cfg.Alerting != nil {
+		cfg.Alerting.applyDefaults()
+		check(cfg.Alerting.validate())
+		if cfg.Alerting.Command != "" && cfg.Sandbox.SyscallFilter {
+			// The filter does not allow spawning processes.
+			check(errors.New("config: Alerting: Command set with Sandbox SyscallFilter"))
+		}
+	}
+	if cfg.PeerOverrides != nil {
+		check(cfg.PeerOverrides.validate())
+	}
+	if cfg.Sandbox.Chroot && cfg.Server.MixKeyDir != "" && filepath.Clean(cfg.Server.MixKeyDir) != filepath.Clean(cfg.Server.DataDir) {
+		// The mix keys are created every epoch, which is impossible from
+		// within the chroot if they live elsewhere.
+		check(errors.New("config: Sandbox: Chroot set with a MixKeyDir other than the DataDir"))
 	}
 	cfg.Debug.applyDefaults()
+	if p := cfg.Debug.UnixSocketListener; p != "" && !filepath.IsAbs(p) {
+		check(fmt.Errorf("config: Debug: UnixSocketListener '%v' is not an absolute path", p))
+	}
+	switch cfg.Debug.ForwardCapAction {
+	case "":
+		cfg.Debug.ForwardCapAction = ForwardCapDrop
+	case ForwardCapDrop, ForwardCapWithhold:
+	default:
+		check(fmt.Errorf("config: Debug: ForwardCapAction '%v' is invalid", cfg.Debug.ForwardCapAction))
+	}
+	if cfg.Debug.TargetCPU > 100 {
+		check(fmt.Errorf("config: Debug: TargetCPU %v exceeds 100", cfg.Debug.TargetCPU))
+	}
+	switch cfg.Debug.UnknownDestAction {
+	case "":
+		cfg.Debug.UnknownDestAction = UnknownDestDrop
+	case UnknownDestDrop, UnknownDestPark:
+	default:
+		check(fmt.Errorf("config: Debug: UnknownDestAction '%v' is invalid", cfg.Debug.UnknownDestAction))
+	}
 
-	return nil
+	return errs
+}
+
+// Redacted returns a deep copy of the configuration with the secrets (forced
+// keys, URL credentials, alerting command arguments) stripped, suitable for
+// inclusion in bug reports.
+func (cfg *Config) Redacted() (*Config, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Config)
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+
+	if r.Debug != nil && r.Debug.ForceIdentityKey != "" {
+		r.Debug.ForceIdentityKey = redacted
+	}
+	if r.Provider != nil && r.Provider.Extern != nil {
+		r.Provider.Extern.ProviderURL = redactURL(r.Provider.Extern.ProviderURL)
+	}
+	if r.Tracing != nil {
+		r.Tracing.OTLPEndpoint = redactURL(r.Tracing.OTLPEndpoint)
+	}
+	if r.Alerting != nil {
+		r.Alerting.WebhookURL = redactURL(r.Alerting.WebhookURL)
+		for i := range r.Alerting.Args {
+			r.Alerting.Args[i] = redacted
+		}
+	}
+	return r, nil
+}
+
+const redacted = "[REDACTED]"
+
+// redactURL strips the user info and query, which commonly hold tokens, from
+// the URL s.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		if s != "" {
+			return redacted
+		}
+		return s
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
 }
 
 // Load parses and validates the provided buffer b as a config file body and
 // returns the Config.
 func Load(b []byte) (*Config, error) {
-	cfg := new(Config)
-	if err := toml.Unmarshal(b, cfg); err != nil {
+	cfg, err := parse(b)
+	if err != nil {
 		return nil, err
 	}
-	if err := cfg.FixupAndValidate(); err != nil {
+	if err = cfg.FixupAndValidate(); err != nil {
 		return nil, err
 	}
 
 	return cfg, nil
 }
 
+func parse(b []byte) (*Config, error) {
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := migrate(tree)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err = tree.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	cfg.warnings = warnings
+	return cfg, nil
+}
+
 // LoadFile loads, parses and validates the provided file and returns the
 // Config.
 func LoadFile(f string) (*Config, error) {
@@ -428,3 +2080,24 @@ func LoadFile(f string) (*Config, error) {
 	}
 	return Load(b)
 }
+
+// LoadFileWithEnv loads, parses and validates the provided file like
+// LoadFile, with the environment variables in environ overriding it.  See
+// ApplyEnv.
+func LoadFileWithEnv(f string, environ []string) (*Config, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if err = ApplyEnv(cfg, environ); err != nil {
+		return nil, err
+	}
+	if err = cfg.FixupAndValidate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
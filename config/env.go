@@ -0,0 +1,172 @@
+// env.go - Katzenpost server configuration from the environment.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables that the
+// configuration is read from.
+const EnvPrefix = "KATZENPOST"
+
+// ApplyEnv overrides the configuration with the environment variables in
+// environ (as returned by os.Environ), for container deployments.  The
+// variables are named after the section and field, for example
+// `KATZENPOST_SERVER_DATADIR` or `KATZENPOST_PKI_NONVOTING_ADDRESS`, and
+// setting any field of an absent section creates it.  Lists are comma
+// separated.  Maps and lists of sections can only be set in a file.
+//
+// Unknown variables with the prefix are rejected, to catch typos.
+func ApplyEnv(cfg *Config, environ []string) error {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix+"_") {
+			continue
+		}
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+
+	used := make(map[string]bool)
+	if err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), EnvPrefix, vars, used); err != nil {
+		return err
+	}
+
+	var unknown []string
+	for k := range vars {
+		if !used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("config: unknown environment variables: %v", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func hasEnvPrefix(vars map[string]string, prefix string) bool {
+	for k := range vars {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, vars map[string]string, used map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // Unexported.
+		}
+		name := prefix + "_" + strings.ToUpper(sf.Name)
+		f := v.Field(i)
+
+		if sf.Type.Kind() == reflect.Ptr && sf.Type.Elem().Kind() == reflect.Struct {
+			if !hasEnvPrefix(vars, name+"_") {
+				continue
+			}
+			if f.IsNil() {
+				f.Set(reflect.New(sf.Type.Elem()))
+			}
+			if err := applyEnvStruct(f.Elem(), name, vars, used); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if err := setEnvField(f, s); err != nil {
+			return fmt.Errorf("config: %v: %v", name, err)
+		}
+		used[name] = true
+	}
+	return nil
+}
+
+func setEnvField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		fl, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(fl)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return errors.New("can only be set in a file")
+		}
+		var l []string
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				l = append(l, e)
+			}
+		}
+		f.Set(reflect.ValueOf(l))
+	default:
+		return errors.New("can only be set in a file")
+	}
+	return nil
+}
+
+// LoadEnv builds and validates a Config entirely from the environment
+// variables in environ, without a configuration file.  See ApplyEnv.
+func LoadEnv(environ []string) (*Config, error) {
+	cfg := new(Config)
+	if err := ApplyEnv(cfg, environ); err != nil {
+		return nil, err
+	}
+	if err := cfg.FixupAndValidate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
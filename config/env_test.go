@@ -0,0 +1,60 @@
+// env_test.go - Katzenpost server configuration from the environment tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEnv(t *testing.T) {
+	require := require.New(t)
+
+	environ := []string{
+		"PATH=/usr/bin:/bin",
+		"KATZENPOST_SERVER_IDENTIFIER=katzenpost.example.com",
+		"KATZENPOST_SERVER_ADDRESSES=127.0.0.1:29483, 127.0.0.1:29484",
+		"KATZENPOST_SERVER_DATADIR=/var/lib/katzenpost",
+		"KATZENPOST_SERVER_CONTAINERMODE=true",
+		"KATZENPOST_PKI_NONVOTING_ADDRESS=127.0.0.1:6999",
+		"KATZENPOST_PKI_NONVOTING_PUBLICKEY=" + testAuthorityKey,
+		"KATZENPOST_DEBUG_NUMSPHINXWORKERS=3",
+		"KATZENPOST_DEBUG_PACKETTRACEFRACTION=0.5",
+	}
+	cfg, err := LoadEnv(environ)
+	require.NoError(err, "LoadEnv()")
+	require.Equal("katzenpost.example.com", cfg.Server.Identifier, "Server.Identifier")
+	require.Equal([]string{"127.0.0.1:29483", "127.0.0.1:29484"}, cfg.Server.Addresses, "Server.Addresses")
+	require.True(cfg.Server.ContainerMode, "Server.ContainerMode")
+	require.Equal("127.0.0.1:6999", cfg.PKI.Nonvoting.Address, "PKI.Nonvoting.Address")
+	require.Equal(3, cfg.Debug.NumSphinxWorkers, "Debug.NumSphinxWorkers")
+	require.Equal(0.5, cfg.Debug.PacketTraceFraction, "Debug.PacketTraceFraction")
+	require.Equal(LogFormatJSON, cfg.Logging.Format, "ContainerMode Logging.Format")
+
+	_, err = LoadEnv(append(environ, "KATZENPOST_SERVER_DATADRI=/tmp"))
+	require.Error(err, "LoadEnv() with an unknown variable")
+
+	_, err = LoadEnv(append(environ, "KATZENPOST_DEBUG_NUMSPHINXWORKERS=many"))
+	require.Error(err, "LoadEnv() with an invalid integer")
+
+	_, err = LoadEnv(append(environ, "KATZENPOST_SERVER_ADDRESSACLS=x"))
+	require.Error(err, "LoadEnv() with a map")
+
+	_, err = LoadEnv([]string{"KATZENPOST_SERVER_IDENTIFIER=katzenpost.example.com"})
+	require.Error(err, "LoadEnv() without a PKI section")
+}
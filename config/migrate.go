@@ -0,0 +1,123 @@
+// migrate.go - Katzenpost server configuration migration.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// CurrentConfigVersion is the version of the configuration file layout
+// understood by this release.  Files without a ConfigVersion are version 0.
+const CurrentConfigVersion = 1
+
+const configVersionKey = "ConfigVersion"
+
+// migrations[n] converts a version n configuration into a version n+1
+// configuration in place, and returns the deprecation warnings.
+var migrations = []func(*toml.Tree) []string{
+	// 0 -> 1: The bolt user database moved to it's own section, when the
+	// external user database backend was added.
+	func(t *toml.Tree) []string {
+		return renameKey(t, []string{"Provider", "UserDB"}, []string{"Provider", "Bolt", "UserDB"})
+	},
+}
+
+// findKey returns the key in t matching k, using the same case folding as
+// the TOML decoder.
+func findKey(t *toml.Tree, k string) (string, bool) {
+	for _, kk := range []string{k, strings.ToLower(k), strings.ToTitle(k)} {
+		if t.HasPath([]string{kk}) {
+			return kk, true
+		}
+	}
+	return "", false
+}
+
+// resolvePath returns the path in t matching path, and true iff it exists.
+// Path elements past the first missing one are returned as is, and nil is
+// returned if an intermediary element is not a table.
+func resolvePath(t *toml.Tree, path []string) ([]string, bool) {
+	ret := make([]string, 0, len(path))
+	for i, k := range path {
+		kk, ok := findKey(t, k)
+		if !ok {
+			return append(ret, path[i:]...), false
+		}
+		ret = append(ret, kk)
+		if i < len(path)-1 {
+			if t, ok = t.GetPath([]string{kk}).(*toml.Tree); !ok {
+				return nil, false
+			}
+		}
+	}
+	return ret, true
+}
+
+// renameKey copies the value at the path from to the path to, creating the
+// intermediary tables as needed.
+//
+// Note: The TOML library can not remove keys, but the decoder ignores keys
+// without a corresponding field, so the old key is harmless.
+func renameKey(t *toml.Tree, from, to []string) []string {
+	src, ok := resolvePath(t, from)
+	if !ok {
+		return nil
+	}
+
+	fromStr, toStr := strings.Join(from, "."), strings.Join(to, ".")
+	dst, ok := resolvePath(t, to)
+	switch {
+	case dst == nil:
+		return []string{fmt.Sprintf("config: %v is deprecated and was ignored, as %v is not a table", fromStr, strings.Join(to[:len(to)-1], "."))}
+	case ok:
+		return []string{fmt.Sprintf("config: %v is deprecated and was ignored, as %v is set", fromStr, toStr)}
+	}
+	t.SetPath(dst, t.GetPath(src))
+	return []string{fmt.Sprintf("config: %v is deprecated, use %v instead", fromStr, toStr)}
+}
+
+// migrate upgrades the parsed configuration file tree to the current
+// layout in place, and returns the deprecation warnings.
+func migrate(t *toml.Tree) ([]string, error) {
+	version := 0
+	key, ok := findKey(t, configVersionKey)
+	if ok {
+		v, ok := t.GetPath([]string{key}).(int64)
+		if !ok || v < 0 {
+			return nil, fmt.Errorf("config: %v '%v' is invalid", configVersionKey, t.GetPath([]string{key}))
+		}
+		version = int(v)
+	} else {
+		key = configVersionKey
+	}
+	switch {
+	case version > CurrentConfigVersion:
+		return nil, fmt.Errorf("config: %v %v is newer than the supported version %v", configVersionKey, version, CurrentConfigVersion)
+	case version == CurrentConfigVersion:
+		return nil, nil
+	}
+
+	warnings := []string{fmt.Sprintf("config: %v %v is outdated, the file should be updated to version %v", configVersionKey, version, CurrentConfigVersion)}
+	for ; version < CurrentConfigVersion; version++ {
+		warnings = append(warnings, migrations[version](t)...)
+	}
+	t.SetPath([]string{key}, int64(CurrentConfigVersion))
+	return warnings, nil
+}
@@ -17,14 +17,23 @@
 package server
 
 import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/spillqueue"
+	"github.com/katzenpost/server/internal/tokenbucket"
 	"github.com/op/go-logging"
 )
 
+const spillQueueFile = "egress.db"
+
 type connector struct {
 	sync.RWMutex
 	worker.Worker
@@ -34,6 +43,10 @@ type connector struct {
 
 	conns         map[[constants.NodeIDLength]byte]*outgoingConn
 	forceUpdateCh chan interface{}
+	spill         *spillqueue.Store
+
+	dialSem   chan struct{}
+	dialPacer *tokenbucket.Bucket
 
 	closeAllCh chan interface{}
 	closeAllWg sync.WaitGroup
@@ -45,6 +58,12 @@ func (co *connector) Halt() {
 	// Close all outgoing connections.
 	close(co.closeAllCh)
 	co.closeAllWg.Wait()
+
+	// Flush and close the disk backed send queues.
+	if co.spill != nil {
+		co.spill.Close()
+		co.spill = nil
+	}
 }
 
 func (co *connector) forceUpdate() {
@@ -58,13 +77,52 @@ func (co *connector) forceUpdate() {
 	}
 }
 
+// acquireDialSlot blocks until a new outgoing connection attempt may be
+// started, subject to the concurrency limit and pacing.  It returns false
+// iff closeCh is closed first.  Each successful call must be paired with
+// a call to releaseDialSlot once the link handshake has completed.
+func (co *connector) acquireDialSlot(closeCh <-chan struct{}) bool {
+	select {
+	case co.dialSem <- struct{}{}:
+	case <-closeCh:
+		return false
+	}
+	if wait := co.dialPacer.Take(1); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-closeCh:
+			co.releaseDialSlot()
+			return false
+		}
+	}
+	return true
+}
+
+func (co *connector) releaseDialSlot() {
+	<-co.dialSem
+}
+
 func (co *connector) dispatchPacket(pkt *packet) {
+	if co.s.isForwardingPaused() {
+		co.log.Debugf("Dropping packet: %v (Forwarding paused)", pkt.id)
+		co.s.accounting.onDrop(dropForwardingPaused)
+		pkt.dispose()
+		return
+	}
+
+	if fc := co.s.forwardCap; fc != nil && !fc.allow() {
+		co.log.Debugf("Dropping packet: %v (Forwarded packet cap reached)", pkt.id)
+		pkt.dispose()
+		return
+	}
+
 	co.RLock()
 	defer co.RUnlock()
 
 	c, ok := co.conns[pkt.nextNodeHop.ID]
 	if !ok {
 		co.log.Debugf("Dropping packet: %v (No connection for destination)", pkt.id)
+		co.s.accounting.onDrop(dropNoConnection)
 		pkt.dispose()
 		return
 	}
@@ -97,9 +155,12 @@ func (co *connector) worker() {
 			<-timer.C
 		}
 
-		// Start outgoing connections as needed, based on the PKI documents
-		// and current time.
-		co.spawnNewConns()
+		co.sweep()
+
+		// Release the parked packets whose destination is now valid.
+		if co.s.parking != nil {
+			co.s.parking.onConnectorUpdate()
+		}
 
 		co.log.Debugf("Done with sweep.")
 		timer.Reset(resweepInterval)
@@ -108,13 +169,52 @@ func (co *connector) worker() {
 	// NOTREACHED
 }
 
-func (co *connector) spawnNewConns() {
+func (co *connector) sweep() {
+	// Start outgoing connections as needed, based on the PKI documents
+	// and current time.
+	hasDocument := co.s.pki.hasCurrentDocument()
+	co.spawnNewConns(hasDocument)
+
+	// Once the outgoing connection table is populated from the current
+	// document, resume the packets that were queued at the last graceful
+	// shutdown, if any.  Restoring any earlier would drop all of them,
+	// as there are no connections to dispatch them to.
+	if hasDocument {
+		co.s.scheduler.restoreQueue()
+	}
+}
+
+func (co *connector) spawnNewConns(hasDocument bool) {
 	newPeerMap := co.s.pki.outgoingDestinations()
 
+	// Discard the disk backed send queues of peers that are no longer
+	// valid destinations.  This requires the document for the current
+	// epoch, without which no peer is a valid destination, and the queues
+	// saved at the last graceful shutdown would be discarded on startup.
+	if co.spill != nil && hasDocument {
+		if err := co.spill.Prune(func(id []byte) bool {
+			if len(id) != constants.NodeIDLength {
+				return false
+			}
+			var nodeID [constants.NodeIDLength]byte
+			copy(nodeID[:], id)
+			_, ok := newPeerMap[nodeID]
+			return ok
+		}); err != nil {
+			co.log.Warningf("Failed to prune spilled send queues: %v", err)
+		}
+	}
+
 	// Traverse the connection table, to figure out which peers are actually
-	// new.  Each outgoingConn object is responsible for determining when
-	// the connection is stale.
+	// new, and which peers are no longer listed and should be drained.  Each
+	// outgoingConn object is responsible for tearing itself down once it is
+	// drained, or otherwise determines that the connection is stale.
 	co.RLock()
+	for id, c := range co.conns {
+		if _, ok := newPeerMap[id]; !ok {
+			c.startDrain()
+		}
+	}
 	for id := range newPeerMap {
 		if _, ok := co.conns[id]; ok {
 			// There's a connection object for the peer already.
@@ -132,13 +232,13 @@ func (co *connector) spawnNewConns() {
 }
 
 func (co *connector) onNewConn(c *outgoingConn) {
-	nodeID := c.dst.IdentityKey.ByteArray()
+	nodeID := c.nodeID
 
 	co.closeAllWg.Add(1)
 	co.Lock()
 	defer func() {
 		co.Unlock()
-		go c.worker()
+		go co.s.guard("outgoing connection", c.worker)()
 	}()
 	if _, ok := co.conns[nodeID]; ok {
 		// This should NEVER happen.  Not sure what the sensible thing to do is.
@@ -148,7 +248,7 @@ func (co *connector) onNewConn(c *outgoingConn) {
 }
 
 func (co *connector) onClosedConn(c *outgoingConn) {
-	nodeID := c.dst.IdentityKey.ByteArray()
+	nodeID := c.nodeID
 
 	co.Lock()
 	defer func() {
@@ -158,24 +258,105 @@ func (co *connector) onClosedConn(c *outgoingConn) {
 	delete(co.conns, nodeID)
 }
 
+// queueLen returns the total number of packets queued for transmission to
+// all of the peers.
+func (co *connector) queueLen() int {
+	co.RLock()
+	defer co.RUnlock()
+
+	n := 0
+	for _, c := range co.conns {
+		n += len(c.ch)
+		if co.spill != nil {
+			n += co.spill.Len(c.nodeID[:])
+		}
+	}
+	return n
+}
+
+// Status returns a snapshot of the status of all of the outgoing peers,
+// sorted by node ID.
+func (co *connector) Status() []*peerStatus {
+	co.RLock()
+	conns := make([]*outgoingConn, 0, len(co.conns))
+	for _, c := range co.conns {
+		conns = append(conns, c)
+	}
+	co.RUnlock()
+
+	l := make([]*peerStatus, 0, len(conns))
+	for _, c := range conns {
+		l = append(l, c.status())
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return bytes.Compare(l[i].ID[:], l[j].ID[:]) < 0
+	})
+	return l
+}
+
+func (co *connector) onMgmtStatus(c *thwack.Conn, l string) error {
+	for _, st := range co.Status() {
+		for idx, ls := range st.Links {
+			var uptime time.Duration
+			if !ls.ConnectedAt.IsZero() {
+				uptime = time.Since(ls.ConnectedAt)
+			}
+			lastErr := "none"
+			if ls.LastErr != nil {
+				lastErr = ls.LastErr.Error()
+			}
+			if err := c.Writer().PrintfLine("%v-%v Link:%v State:%v Addr:%v Uptime:%v QueueDepth:%v BytesSent:%v Addresses:[%v] LastError:%v", thwack.StatusOk, nodeIDToPrintString(&st.ID), idx, ls.State, ls.Addr, uptime, st.QueueDepth, st.Stats.bytesSent, strings.Join(st.Addresses, ","), lastErr); err != nil {
+				return err
+			}
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
 func (co *connector) isValidForwardDest(id *[constants.NodeIDLength]byte) bool {
 	// This doesn't need to be super accurate, just enough to prevent packets
 	// destined to la-la land from being scheduled.
 	co.RLock()
 	defer co.RUnlock()
 
-	_, ok := co.conns[*id]
-	return ok
+	c, ok := co.conns[*id]
+	return ok && !c.isDraining()
 }
 
-func newConnector(s *Server) *connector {
+// isDelisted returns true iff the connection to the peer is being drained
+// because it is no longer listed in the PKI.
+func (co *connector) isDelisted(id *[constants.NodeIDLength]byte) bool {
+	co.RLock()
+	defer co.RUnlock()
+
+	c, ok := co.conns[*id]
+	return ok && c.isDraining()
+}
+
+func newConnector(s *Server) (*connector, error) {
 	co := new(connector)
 	co.s = s
-	co.log = s.logBackend.GetLogger("connector")
+	co.log = s.newLogger("connector")
 	co.conns = make(map[[constants.NodeIDLength]byte]*outgoingConn)
 	co.forceUpdateCh = make(chan interface{}, 1) // See forceUpdate().
 	co.closeAllCh = make(chan interface{})
+	co.dialSem = make(chan struct{}, s.cfg.Debug.MaxPendingDials)
+	dialRate := float64(time.Second) / float64(time.Duration(s.cfg.Debug.DialInterval)*time.Millisecond)
+	co.dialPacer = tokenbucket.New(dialRate, 1)
+
+	if s.cfg.Debug.SendQueueDiskSize > 0 {
+		var err error
+		f := filepath.Join(s.dataDir(), spillQueueFile)
+		if co.spill, err = spillqueue.New(f); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.cfg.Management.Enable {
+		const cmdStatus = "CONNECTOR_STATUS"
+		s.management.RegisterCommand(cmdStatus, co.onMgmtStatus)
+	}
 
-	co.Go(co.worker)
-	return co
+	co.Go(s.supervise("connector", co.worker))
+	return co, nil
 }
@@ -0,0 +1,192 @@
+// connector_test.go - Katzenpost server connector tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eapache/channels"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/monotime"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/queue"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/katzenpost/server/internal/spillqueue"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nullPKIClient stands in for a PKI that has yet to return any document.
+type nullPKIClient struct {
+	cpki.Client
+}
+
+func newTestDescriptor(t *testing.T, name string, layer uint8) (*cpki.MixDescriptor, [constants.NodeIDLength]byte) {
+	k, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(t, err, "eddsa.NewKeypair()")
+	desc := &cpki.MixDescriptor{
+		Name:        name,
+		IdentityKey: k.PublicKey(),
+		Layer:       layer,
+	}
+	return desc, desc.IdentityKey.ByteArray()
+}
+
+func newTestConnector(s *Server) (*connector, error) {
+	co := new(connector)
+	co.s = s
+	co.log = logging.MustGetLogger("connector")
+	co.conns = make(map[[constants.NodeIDLength]byte]*outgoingConn)
+	co.closeAllCh = make(chan interface{})
+
+	var err error
+	co.spill, err = spillqueue.New(filepath.Join(s.dataDir(), spillQueueFile))
+	return co, err
+}
+
+func newTestOutgoingConn(co *connector, nodeID [constants.NodeIDLength]byte) *outgoingConn {
+	c := new(outgoingConn)
+	c.s = co.s
+	c.co = co
+	c.ch = make(chan *packet, 1)
+	c.log = co.log
+	c.nodeID = nodeID
+	c.drainCh = make(chan interface{})
+	co.conns[nodeID] = c
+	return c
+}
+
+func TestConnectorRestoreQueue(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "server_connector_test")
+	require.NoError(err, "ioutil.TempDir()")
+	defer os.RemoveAll(dir)
+
+	self, _ := newTestDescriptor(t, "self", 0)
+	listed, listedID := newTestDescriptor(t, "listed", 1)
+	_, delistedID := newTestDescriptor(t, "delisted", 1)
+	_, goneID := newTestDescriptor(t, "gone", 1)
+
+	raw := make([]byte, constants.PacketLength)
+	_, err = rand.Reader.Read(raw)
+	require.NoError(err, "rand.Reader.Read()")
+
+	s := &Server{
+		cfg: &config.Config{
+			Server: &config.Server{
+				DataDir: dir,
+			},
+			Debug: &config.Debug{
+				SchedulerSlack:    10,
+				SendQueueDiskSize: 16,
+			},
+		},
+		accounting:    new(accounting),
+		peerOverrides: new(peerOverrides),
+	}
+	s.pki = &pki{
+		s:    s,
+		log:  logging.MustGetLogger("pki"),
+		impl: &nullPKIClient{},
+		docs: make(map[uint64]*pkicache.Entry),
+	}
+	s.scheduler = &scheduler{
+		s:   s,
+		ch:  channels.NewInfiniteChannel(),
+		log: logging.MustGetLogger("scheduler"),
+	}
+
+	// Shut down gracefully with a packet in the scheduler queue, and a
+	// packet in the send queue of each of the peers.
+	q := queue.New()
+	pkt := newPacket()
+	require.NoError(pkt.copyToRaw(raw), "copyToRaw()")
+	pkt.nextNodeHop = &commands.NextNodeHop{ID: listedID}
+	q.Enqueue(uint64(monotime.Now()+time.Minute), pkt)
+	s.scheduler.saveQueue(q)
+
+	co, err := newTestConnector(s)
+	require.NoError(err, "newTestConnector()")
+	for _, id := range [][constants.NodeIDLength]byte{listedID, delistedID} {
+		require.NoError(co.spill.Push(id[:], raw, time.Now(), s.cfg.Debug.SendQueueDiskSize), "spill.Push()")
+	}
+	co.spill.Close()
+
+	// Start up, before the PKI returns the current document.  Nothing is a
+	// valid destination, so nothing may be discarded.
+	co, err = newTestConnector(s)
+	require.NoError(err, "newTestConnector(): restart")
+	defer co.spill.Close()
+	s.connector = co
+	co.sweep()
+	assert.Equal(1, co.spill.Len(listedID[:]), "spill.Len(): listed, no document")
+	assert.Equal(1, co.spill.Len(delistedID[:]), "spill.Len(): delisted, no document")
+	select {
+	case <-s.scheduler.ch.Out():
+		assert.Fail("scheduler queue restored without a document")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Load the document, that lists a single peer.
+	now, _, _ := s.epochNow()
+	doc := &cpki.Document{
+		Epoch:    now,
+		Topology: [][]*cpki.MixDescriptor{{self}, {listed}},
+	}
+	ent, err := pkicache.New(doc, self.IdentityKey, false)
+	require.NoError(err, "pkicache.New()")
+	s.pki.docs[doc.Epoch] = ent
+
+	// The connections are normally spawned by the sweep, stand them in
+	// along with one to a peer that is no longer listed.
+	listedConn := newTestOutgoingConn(co, listedID)
+	goneConn := newTestOutgoingConn(co, goneID)
+	co.sweep()
+
+	assert.Equal(0, co.spill.Len(delistedID[:]), "spill.Len(): delisted")
+	assert.False(listedConn.isDraining(), "isDraining(): listed")
+	assert.True(goneConn.isDraining(), "isDraining(): gone")
+
+	spilled := listedConn.popSpilled(time.Minute)
+	require.NotNil(spilled, "popSpilled(): listed")
+	assert.Equal(raw, spilled.raw, "popSpilled(): raw")
+	spilled.dispose()
+
+	select {
+	case v := <-s.scheduler.ch.Out():
+		restored := v.(*packet)
+		assert.Equal(raw, restored.raw, "restoreQueue(): raw")
+		assert.Equal(listedID, restored.nextNodeHop.ID, "restoreQueue(): next hop")
+		assert.True(restored.delay > 0 && restored.delay <= time.Minute, "restoreQueue(): delay")
+		restored.dispose()
+	case <-time.After(time.Second):
+		assert.Fail("scheduler queue not restored")
+	}
+	_, err = os.Lstat(filepath.Join(dir, schedulerQueueFile))
+	assert.True(os.IsNotExist(err), "restoreQueue(): file removed")
+}
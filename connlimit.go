@@ -0,0 +1,266 @@
+// connlimit.go - Katzenpost server incoming connection limits.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/internal/tokenbucket"
+	"github.com/op/go-logging"
+)
+
+var (
+	errConnRateExceeded  = errors.New("new connection rate exceeded")
+	errConnTotalExceeded = errors.New("too many connections")
+	errConnIPExceeded    = errors.New("too many connections from address")
+)
+
+// connLimiter enforces the limits on incoming connections shared across all
+// of the listeners.  The limits are checked immediately after accept, so
+// that a connection flood cannot exhaust resources prior to authentication.
+//
+// It also tracks the incoming connection lifecycle counters, as it sees
+// every connection from accept till close.
+type connLimiter struct {
+	// Note: The counters are first to guarantee 64 bit alignment.
+
+	// Lifecycle counters, MUST be accessed via sync/atomic.
+	accepted            uint64
+	authenticatedMix    uint64
+	authenticatedClient uint64
+	openMix             int64
+	openClient          int64
+
+	// Rejection counters, MUST be accessed via sync/atomic.
+	rejectedDuplicate uint64
+	rejectedACL       uint64
+	rejectedRate      uint64
+	rejectedTotal     uint64
+	rejectedIP        uint64
+	rejectedOverload  uint64
+
+	// Pre-authentication failure counters, MUST be accessed via sync/atomic.
+	handshakeFailures     uint64
+	handshakeAuthFailures uint64
+	handshakeTimeouts     uint64
+	firstCommandTimeouts  uint64
+
+	isOverloaded uint32 // MUST be accessed via sync/atomic.
+
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	rate  *tokenbucket.Bucket
+	perIP map[string]int
+	total int
+
+	overloadReason string
+}
+
+func connLimiterKey(addr net.Addr) (string, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", false
+	}
+	return tcpAddr.IP.String(), true
+}
+
+// admit checks if a new connection from addr should be accepted, and
+// accounts for it if so.  Each admitted connection MUST be paired with a
+// call to release.
+func (cl *connLimiter) admit(addr net.Addr) error {
+	if !cl.rate.Allow(1) {
+		atomic.AddUint64(&cl.rejectedRate, 1)
+		return errConnRateExceeded
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.total >= cl.s.cfg.Debug.MaxIncomingConns {
+		atomic.AddUint64(&cl.rejectedTotal, 1)
+		return errConnTotalExceeded
+	}
+	if k, ok := connLimiterKey(addr); ok {
+		if cl.perIP[k] >= cl.s.cfg.Debug.MaxIncomingConnsPerIP {
+			atomic.AddUint64(&cl.rejectedIP, 1)
+			return errConnIPExceeded
+		}
+		cl.perIP[k]++
+	}
+	cl.total++
+	atomic.AddUint64(&cl.accepted, 1)
+	return nil
+}
+
+func (cl *connLimiter) release(addr net.Addr) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if k, ok := connLimiterKey(addr); ok {
+		if cl.perIP[k]--; cl.perIP[k] <= 0 {
+			delete(cl.perIP, k)
+		}
+	}
+	cl.total--
+}
+
+func (cl *connLimiter) onHandshakeFailed(timedOut, authFailed bool) {
+	switch {
+	case authFailed:
+		atomic.AddUint64(&cl.handshakeAuthFailures, 1)
+	case timedOut:
+		atomic.AddUint64(&cl.handshakeTimeouts, 1)
+	default:
+		atomic.AddUint64(&cl.handshakeFailures, 1)
+	}
+}
+
+func (cl *connLimiter) onRejectedACL() {
+	atomic.AddUint64(&cl.rejectedACL, 1)
+}
+
+func (cl *connLimiter) onDuplicate() {
+	atomic.AddUint64(&cl.rejectedDuplicate, 1)
+}
+
+func (cl *connLimiter) onAuthenticated(isMix bool) {
+	if isMix {
+		atomic.AddUint64(&cl.authenticatedMix, 1)
+		atomic.AddInt64(&cl.openMix, 1)
+	} else {
+		atomic.AddUint64(&cl.authenticatedClient, 1)
+		atomic.AddInt64(&cl.openClient, 1)
+	}
+}
+
+func (cl *connLimiter) onClosedAuthenticated(isMix bool) {
+	if isMix {
+		atomic.AddInt64(&cl.openMix, -1)
+	} else {
+		atomic.AddInt64(&cl.openClient, -1)
+	}
+}
+
+// admitClient returns false iff new client connections should be rejected,
+// as the node is overloaded.
+//
+// Note: There is no way to signal congestion to peers in the wire protocol,
+// so mix links are always admitted.
+func (cl *connLimiter) admitClient() bool {
+	if atomic.LoadUint32(&cl.isOverloaded) == 0 {
+		return true
+	}
+	atomic.AddUint64(&cl.rejectedOverload, 1)
+	return false
+}
+
+// onTick re-evaluates the overload state from the queue depths and the
+// resource budget.  The node is overloaded once any queue passes its
+// high-water mark, and till all of the queues drop below half of their
+// high-water marks, or while the resource budget is exceeded.
+func (cl *connLimiter) onTick() {
+	type queueDepth struct {
+		name       string
+		depth, hwm int
+	}
+	queues := []queueDepth{
+		{"inbound", cl.s.inboundPackets.Len(), cl.s.cfg.Debug.InboundHighWaterMark},
+		{"scheduler", cl.s.scheduler.queueLen(), cl.s.cfg.Debug.SchedulerHighWaterMark},
+	}
+
+	// The resource budget is checked first, as it has hysteresis of its
+	// own.
+	reason := cl.s.resources.overBudgetReason()
+	isBelowLWM := reason == ""
+	for _, q := range queues {
+		if q.hwm <= 0 {
+			continue
+		}
+		if q.depth > q.hwm && reason == "" {
+			reason = fmt.Sprintf("%v queue depth %v exceeds %v", q.name, q.depth, q.hwm)
+		}
+		if q.depth > q.hwm/2 {
+			isBelowLWM = false
+		}
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+	wasOverloaded := atomic.LoadUint32(&cl.isOverloaded) != 0
+	switch {
+	case !wasOverloaded && reason != "":
+		cl.log.Warningf("Overloaded, rejecting new client connections: %v", reason)
+		atomic.StoreUint32(&cl.isOverloaded, 1)
+		cl.overloadReason = reason
+		cl.s.events.emit(&Event{Type: EventOverloaded, Reason: reason})
+	case wasOverloaded && isBelowLWM:
+		cl.log.Noticef("No longer overloaded, accepting new client connections.")
+		atomic.StoreUint32(&cl.isOverloaded, 0)
+		cl.overloadReason = ""
+		cl.s.emitEvent(EventOverloadCleared)
+	}
+}
+
+func (cl *connLimiter) onFirstCommandTimeout() {
+	atomic.AddUint64(&cl.firstCommandTimeouts, 1)
+}
+
+func (cl *connLimiter) onMgmtListenerStats(c *thwack.Conn, l string) error {
+	cl.Lock()
+	total, nrIPs, overloadReason := cl.total, len(cl.perIP), cl.overloadReason
+	cl.Unlock()
+
+	if err := c.Writer().PrintfLine("%v-Open:%v OpenMix:%v OpenClient:%v SourceAddresses:%v", thwack.StatusOk, total, atomic.LoadInt64(&cl.openMix), atomic.LoadInt64(&cl.openClient), nrIPs); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-Accepted:%v AuthenticatedMix:%v AuthenticatedClient:%v", thwack.StatusOk, atomic.LoadUint64(&cl.accepted), atomic.LoadUint64(&cl.authenticatedMix), atomic.LoadUint64(&cl.authenticatedClient)); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-RejectedACL:%v RejectedRate:%v RejectedTotal:%v RejectedPerIP:%v RejectedDuplicate:%v RejectedOverload:%v", thwack.StatusOk, atomic.LoadUint64(&cl.rejectedACL), atomic.LoadUint64(&cl.rejectedRate), atomic.LoadUint64(&cl.rejectedTotal), atomic.LoadUint64(&cl.rejectedIP), atomic.LoadUint64(&cl.rejectedDuplicate), atomic.LoadUint64(&cl.rejectedOverload)); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-HandshakeFailures:%v HandshakeAuthFailures:%v HandshakeTimeouts:%v FirstCommandTimeouts:%v", thwack.StatusOk, atomic.LoadUint64(&cl.handshakeFailures), atomic.LoadUint64(&cl.handshakeAuthFailures), atomic.LoadUint64(&cl.handshakeTimeouts), atomic.LoadUint64(&cl.firstCommandTimeouts)); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-Overloaded:%v Reason:%v", thwack.StatusOk, atomic.LoadUint32(&cl.isOverloaded) != 0, overloadReason); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newConnLimiter(s *Server) *connLimiter {
+	cl := new(connLimiter)
+	cl.s = s
+	cl.log = s.newLogger("connlimit")
+	cl.rate = tokenbucket.New(float64(s.cfg.Debug.NewConnRate), float64(s.cfg.Debug.NewConnBurst))
+	cl.perIP = make(map[string]int)
+
+	if s.cfg.Management.Enable {
+		const cmdListenerStats = "LISTENER_STATS"
+		s.management.RegisterCommand(cmdListenerStats, cl.onMgmtListenerStats)
+	}
+
+	return cl
+}
@@ -29,6 +29,15 @@ import (
 	"github.com/op/go-logging"
 )
 
+// mixKeyGracePeriod is how long before and after its epoch a mix key is
+// accepted, to tolerate clock skew.
+const mixKeyGracePeriod = 2 * time.Minute
+
+var (
+	errReplay       = errors.New("crypto: Packet is a replay")
+	errReplayWarmup = errors.New("crypto: Mix key replay filter is warming up")
+)
+
 type cryptoWorker struct {
 	worker.Worker
 
@@ -52,9 +61,7 @@ func (w *cryptoWorker) doUnwrap(pkt *packet) error {
 	if w.s.cfg.Debug.DisableKeyRotation {
 		keys = append(keys, w.mixKeys[debugStaticEpoch])
 	} else {
-		const gracePeriod = 2 * time.Minute
-
-		epoch, elapsed, till := epochtime.Now()
+		epoch, elapsed, till := w.s.epochNow()
 		k, ok := w.mixKeys[epoch]
 		if !ok || k == nil {
 			// There always will be a key for the current epoch, since
@@ -65,12 +72,12 @@ func (w *cryptoWorker) doUnwrap(pkt *packet) error {
 
 		// At certain times, this needs to also look at the previous
 		// or next epoch(s) keys, if they exist.
-		if elapsed < gracePeriod {
-			// Less than gracePeriod into the current epoch, the previous
+		if elapsed < mixKeyGracePeriod {
+			// Less than mixKeyGracePeriod into the current epoch, the previous
 			// epoch's key should also be accepted.
 			k, ok = w.mixKeys[epoch-1]
-		} else if till < gracePeriod {
-			// Less than gracePeriod to the next epoch, the next epoch's
+		} else if till < mixKeyGracePeriod {
+			// Less than mixKeyGracePeriod to the next epoch, the next epoch's
 			// key should also be accepted.
 			k, ok = w.mixKeys[epoch+1]
 		} else {
@@ -110,7 +117,15 @@ func (w *cryptoWorker) doUnwrap(pkt *packet) error {
 		if k.IsReplay(tag) {
 			// The packet decrypted successfully, the MAC was valid, and the
 			// tag was seen before, therefore drop the packet as a replay.
-			lastErr = errors.New("crypto: Packet is a replay")
+			lastErr = errReplay
+			break
+		}
+
+		// The tag is recorded above regardless, but while the key's replay
+		// filter is warming up a tag that isn't in it may still have been
+		// seen before, so the packet can not be trusted.
+		if k.IsWarmingUp() {
+			lastErr = errReplayWarmup
 			break
 		}
 
@@ -126,6 +141,7 @@ func (w *cryptoWorker) doUnwrap(pkt *packet) error {
 
 func (w *cryptoWorker) worker() {
 	inCh := w.s.inboundPackets.Out()
+	w.s.mixKeys.shadow(w.mixKeys)
 	defer w.derefKeys()
 
 	for {
@@ -162,6 +178,16 @@ func (w *cryptoWorker) worker() {
 		w.log.Debugf("Attempting to unwrap packet: %v", pkt.id)
 		if err := w.doUnwrap(pkt); err != nil {
 			w.log.Debugf("Dropping packet: %v (%v)", pkt.id, err)
+			pkt.trace("unwrap", "failed: %v", err)
+			if err == errReplayWarmup {
+				w.s.accounting.onDrop(dropReplayWarmup)
+				pkt.dispose()
+				continue
+			}
+			w.s.accounting.onDrop(dropUnwrapFailed)
+			if pkt.srcStats != nil {
+				pkt.srcStats.onUnwrapFailed(err == errReplay)
+			}
 			pkt.dispose()
 			continue
 		}
@@ -172,20 +198,25 @@ func (w *cryptoWorker) worker() {
 		// see what kind of packet it is, and then handle it as appropriate.
 		if err := pkt.splitCommands(); err != nil {
 			w.log.Debugf("Dropping packet: %v (%v)", pkt.id, err)
+			pkt.trace("unwrap", "invalid commands: %v", err)
+			w.s.accounting.onDrop(dropInvalidCommands)
 			pkt.dispose()
 			continue
 		}
+		pkt.trace("unwrap", "ok (%v)", pkt.cmdsToString())
 
 		// The common (in the both most likely, and done by all modes) case
 		// is that the packet is destined for another node.
 		if pkt.isForward() {
 			if pkt.payload != nil {
 				w.log.Debugf("Dropping packet: %v (Unwrap() returned payload)", pkt.id)
+				w.s.accounting.onDrop(dropInvalidPacket)
 				pkt.dispose()
 				continue
 			}
 			if pkt.mustTerminate {
 				w.log.Debugf("Dropping packet: %v (Provider received forward packet from mix)", pkt.id)
+				w.s.accounting.onDrop(dropInvalidPacket)
 				pkt.dispose()
 				continue
 			}
@@ -194,6 +225,16 @@ func (w *cryptoWorker) worker() {
 			pkt.delay = time.Duration(pkt.nodeDelay.Delay) * time.Millisecond
 			if pkt.delay > numMixKeys*epochtime.Period {
 				w.log.Debugf("Dropping packet: %v (Delay %v is past what is possible)", pkt.id, pkt.delay)
+				w.s.accounting.onDrop(dropInvalidPacket)
+				pkt.dispose()
+				continue
+			}
+			if max := w.s.pki.maxNodeDelay(); max > 0 && uint64(pkt.nodeDelay.Delay) > max {
+				// Honest clients sample the delay capped to the bound
+				// advertised in the PKI document, so this is an attempt
+				// to pin the packet in memory for as long as possible.
+				w.log.Debugf("Dropping packet: %v (Delay %v exceeds the %v ms bound)", pkt.id, pkt.delay, max)
+				w.s.accounting.onDrop(dropDelayOutOfBounds)
 				pkt.dispose()
 				continue
 			}
@@ -210,11 +251,17 @@ func (w *cryptoWorker) worker() {
 
 			// Hand off to the scheduler.
 			w.log.Debugf("Dispatching packet: %v", pkt.id)
+			pkt.trace("delay", "%v (requested %v ms)", pkt.delay, pkt.nodeDelay.Delay)
 			w.s.scheduler.onPacket(pkt)
 			continue
+		} else if w.s.decoy.isLoopPacket(pkt) {
+			// Note: Callee takes ownership of pkt.
+			w.s.decoy.onLoopPacket(pkt)
+			continue
 		} else if !w.s.cfg.Server.IsProvider {
 			// Mixes will only ever see forward commands.
 			w.log.Debugf("Dropping mix packet: %v (%v)", pkt.id, pkt.cmdsToString())
+			w.s.accounting.onDrop(dropInvalidPacket)
 			pkt.dispose()
 			continue
 		}
@@ -226,6 +273,7 @@ func (w *cryptoWorker) worker() {
 
 		if pkt.mustForward {
 			w.log.Debugf("Dropping client packet: %v (Send to local user)", pkt.id)
+			w.s.accounting.onDrop(dropInvalidPacket)
 			pkt.dispose()
 			continue
 		}
@@ -237,6 +285,7 @@ func (w *cryptoWorker) worker() {
 			w.s.provider.onPacket(pkt)
 		} else {
 			w.log.Debugf("Dropping user packet: %v (%v)", pkt.id, pkt.cmdsToString())
+			w.s.accounting.onDrop(dropInvalidPacket)
 			pkt.dispose()
 		}
 	}
@@ -245,20 +294,19 @@ func (w *cryptoWorker) worker() {
 }
 
 func (w *cryptoWorker) derefKeys() {
-	for _, v := range w.mixKeys {
+	for k, v := range w.mixKeys {
 		v.Deref()
+		delete(w.mixKeys, k)
 	}
 }
 
 func newCryptoWorker(s *Server, id int) *cryptoWorker {
 	w := new(cryptoWorker)
 	w.s = s
-	w.log = s.logBackend.GetLogger(fmt.Sprintf("crypto:%d", id))
+	w.log = s.newLogger(fmt.Sprintf("crypto:%d", id))
 	w.mixKeys = make(map[uint64]*mixkey.MixKey)
 	w.updateCh = make(chan bool)
 
-	w.s.mixKeys.shadow(w.mixKeys)
-
-	w.Go(w.worker)
+	w.Go(s.supervise(fmt.Sprintf("crypto worker %d", id), w.worker))
 	return w
 }
@@ -0,0 +1,118 @@
+// decommission.go - Katzenpost server decommissioning.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+// decommissionSlack is the time waited past the end of the last epoch the
+// node is published for, to account for packets sent right before the
+// epoch transition by peers with slightly skewed clocks.
+const decommissionSlack = 2 * time.Minute
+
+// decommission retires the node from the network without stranding
+// in-flight traffic.  Once started, no further descriptors are published,
+// the node keeps serving till the end of the last epoch it was published
+// for (and for providers, the spool retrieval window past that), and then
+// gracefully shuts down.
+type decommission struct {
+	isActive uint32 // MUST be accessed via sync/atomic.
+
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	lastEpoch  uint64
+	shutdownAt time.Time
+	isDone     bool
+}
+
+func (s *Server) isDecommissioning() bool {
+	return atomic.LoadUint32(&s.decommission.isActive) != 0
+}
+
+func (d *decommission) start() bool {
+	if !atomic.CompareAndSwapUint32(&d.isActive, 0, 1) {
+		return false
+	}
+	d.log.Warningf("Decommissioning, no further descriptors will be published.")
+	return true
+}
+
+func (d *decommission) onTick(now time.Time) {
+	if atomic.LoadUint32(&d.isActive) == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.isDone {
+		return
+	}
+
+	if d.shutdownAt.IsZero() {
+		// The PKI worker will not publish once decommissioning is active,
+		// so the last published epoch is final.
+		d.lastEpoch = d.s.pki.publishedEpoch()
+		epoch, elapsed, _ := d.s.epochNow()
+		if epoch <= d.lastEpoch {
+			return
+		}
+
+		wait := decommissionSlack
+		if d.s.cfg.Server.IsProvider {
+			wait += time.Duration(d.s.cfg.Debug.DecommissionSpoolWindow) * time.Millisecond
+		}
+		d.shutdownAt = now.Add(wait - elapsed)
+		d.log.Noticef("No longer published as of epoch %v, shutting down at %v.", epoch, d.shutdownAt)
+	}
+	if now.Before(d.shutdownAt) {
+		return
+	}
+
+	d.isDone = true
+	d.log.Noticef("Decommissioning complete, shutting down.")
+	go d.s.GracefulShutdown()
+}
+
+func (d *decommission) onMgmtDecommission(c *thwack.Conn, l string) error {
+	if !d.start() {
+		c.Log().Errorf("DECOMMISSION already in progress")
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (d *decommission) status() (bool, time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	return atomic.LoadUint32(&d.isActive) != 0, d.shutdownAt
+}
+
+func newDecommission(s *Server) *decommission {
+	d := new(decommission)
+	d.s = s
+	d.log = s.newLogger("decommission")
+	return d
+}
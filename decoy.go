@@ -0,0 +1,383 @@
+// decoy.go - Katzenpost server decoy loop traffic.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"math"
+	mRand "math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/monotime"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/op/go-logging"
+)
+
+const (
+	// decoyLoopSlack is the time past the sum of the per-hop delays, after
+	// which a decoy loop is considered lost.
+	decoyLoopSlack = 2 * time.Minute
+
+	decoySweepInterval = 30 * time.Second
+)
+
+var errDecoyNoMixKey = errors.New("decoy: node has no mix key for the epoch")
+
+// decoyLoop is an in-flight decoy loop packet.
+type decoyLoop struct {
+	path     [][sConstants.NodeIDLength]byte
+	deadline time.Time
+
+	// onDone, if set, is called with the decoy lock held when the loop
+	// returns or is written off as lost.
+	onDone func(returned bool)
+}
+
+// decoyNodeCounters are the decoy loop counters for a given node.
+type decoyNodeCounters struct {
+	sent uint64
+	lost uint64
+}
+
+// decoy originates loop packets that traverse the network and return to
+// this node, as cover traffic, and to detect downstream nodes that drop
+// packets.  Lost loops are attributed to each node along their path, so a
+// node that consistently drops packets will stand out.
+type decoy struct {
+	// Note: The counters are first to guarantee 64 bit alignment.
+
+	// Loop counters, MUST be accessed via sync/atomic.
+	sent     uint64
+	received uint64
+	lost     uint64
+
+	sync.Mutex
+	worker.Worker
+
+	s     *Server
+	log   *logging.Logger
+	mRand *mRand.Rand
+
+	pending  map[[sConstants.SURBIDLength]byte]*decoyLoop
+	nodes    map[[sConstants.NodeIDLength]byte]*decoyNodeCounters
+	selfTest *selfTest
+}
+
+// isLoopPacket returns true iff pkt is a (returned) decoy loop packet.
+// Loop packets are addressed to the all zero recipient, which no user can
+// have.
+func (d *decoy) isLoopPacket(pkt *packet) bool {
+	if !pkt.isSURBReply() {
+		return false
+	}
+	for _, v := range pkt.recipient.ID {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// onLoopPacket handles a returned decoy loop packet.  The callee takes
+// ownership of pkt.
+func (d *decoy) onLoopPacket(pkt *packet) {
+	defer pkt.dispose()
+
+	d.Lock()
+	defer d.Unlock()
+
+	l, ok := d.pending[pkt.surbReply.ID]
+	if !ok {
+		// Either a loop that was already written off, or garbage.
+		d.log.Debugf("Dropping unknown/expired loop packet: %v", pkt.id)
+		return
+	}
+	delete(d.pending, pkt.surbReply.ID)
+	pkt.trace("deliver", "decoy loop returned")
+	atomic.AddUint64(&d.received, 1)
+	d.log.Debugf("Received loop packet: %v", pkt.id)
+	if l.onDone != nil {
+		l.onDone(true)
+	}
+}
+
+func (d *decoy) sweep() {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for id, l := range d.pending {
+		if now.Before(l.deadline) {
+			continue
+		}
+		delete(d.pending, id)
+		atomic.AddUint64(&d.lost, 1)
+		for _, nodeID := range l.path {
+			if c, ok := d.nodes[nodeID]; ok {
+				c.lost++
+			}
+		}
+		if l.onDone != nil {
+			l.onDone(false)
+		}
+	}
+}
+
+// selectPath selects a random loop path through each layer of the topology,
+// starting at the layer after this node and ending at this node.
+func (d *decoy) selectPath(ent *pkicache.Entry) []*cpki.MixDescriptor {
+	doc := ent.Document()
+	self := ent.Self()
+	nLayers := len(doc.Topology)
+
+	pick := func(layer int) *cpki.MixDescriptor {
+		var nodes []*cpki.MixDescriptor
+		if layer == nLayers {
+			nodes = doc.Providers
+		} else {
+			nodes = doc.Topology[layer]
+		}
+		if len(nodes) == 0 {
+			return nil
+		}
+		return nodes[d.mRand.Intn(len(nodes))]
+	}
+
+	// The Provider "layer" follows the last mix layer.
+	selfLayer := nLayers
+	if self.Layer != cpki.LayerProvider {
+		selfLayer = int(self.Layer)
+	}
+	path := make([]*cpki.MixDescriptor, 0, nLayers+1)
+	for i := 1; i <= nLayers; i++ {
+		n := pick((selfLayer + i) % (nLayers + 1))
+		if n == nil {
+			return nil
+		}
+		path = append(path, n)
+	}
+	return append(path, self)
+}
+
+func (d *decoy) sampleDelay(lambda float64, max uint64) uint64 {
+	if lambda <= 0 {
+		return max
+	}
+	v := d.mRand.ExpFloat64() / lambda
+	if v >= float64(max) {
+		return max
+	}
+	return uint64(v)
+}
+
+// sendLoop sends a loop packet along a random path, calling onDone (if
+// not nil) when the outcome is known.
+func (d *decoy) sendLoop(ent *pkicache.Entry, onDone func(bool)) error {
+	doc := ent.Document()
+	epoch, _, _ := d.s.epochNow()
+
+	descs := d.selectPath(ent)
+	if descs == nil {
+		return errors.New("decoy: failed to select a loop path")
+	}
+
+	var surbID [sConstants.SURBIDLength]byte
+	if _, err := rand.Reader.Read(surbID[:]); err != nil {
+		return err
+	}
+
+	// Build the Sphinx path, with a per-hop delay sampled the same way a
+	// client would, terminating at this node.
+	var totalDelay time.Duration
+	path := make([]*sphinx.PathHop, 0, len(descs))
+	nodeIDs := make([][sConstants.NodeIDLength]byte, 0, len(descs))
+	for i, desc := range descs {
+		k, ok := desc.MixKeys[epoch]
+		if !ok {
+			return errDecoyNoMixKey
+		}
+		h := &sphinx.PathHop{
+			ID:        desc.IdentityKey.ByteArray(),
+			PublicKey: k,
+		}
+		if i < len(descs)-1 {
+			delay := d.sampleDelay(doc.Mu, doc.MuMaxDelay)
+			totalDelay += time.Duration(delay) * time.Millisecond
+			h.Commands = []commands.RoutingCommand{&commands.NodeDelay{Delay: uint32(delay)}}
+			nodeIDs = append(nodeIDs, h.ID)
+		} else {
+			// The all zero recipient identifies loop packets.
+			surbReply := &commands.SURBReply{ID: surbID}
+			h.Commands = []commands.RoutingCommand{new(commands.Recipient), surbReply}
+		}
+		path = append(path, h)
+	}
+
+	var payload [constants.ForwardPayloadLength]byte
+	raw, err := sphinx.NewPacket(rand.Reader, path, payload[:])
+	if err != nil {
+		return err
+	}
+
+	pkt := newPacket()
+	if err = pkt.copyToRaw(raw); err != nil {
+		pkt.dispose()
+		return err
+	}
+	nextHopCmd := &commands.NextNodeHop{ID: path[0].ID}
+	nodeDelayCmd := new(commands.NodeDelay)
+	pkt.cmds = []commands.RoutingCommand{nextHopCmd, nodeDelayCmd}
+	pkt.nextNodeHop = nextHopCmd
+	pkt.nodeDelay = nodeDelayCmd
+	pkt.recvAt = monotime.Now()
+	pkt.mustForward = true
+	d.s.tracer.sample(pkt)
+	pkt.trace("originate", "decoy loop, %v hops", len(path))
+
+	d.Lock()
+	d.pending[surbID] = &decoyLoop{
+		path:     nodeIDs,
+		deadline: time.Now().Add(totalDelay + decoyLoopSlack),
+		onDone:   onDone,
+	}
+	for _, nodeID := range nodeIDs {
+		c, ok := d.nodes[nodeID]
+		if !ok {
+			c = new(decoyNodeCounters)
+			d.nodes[nodeID] = c
+		}
+		c.sent++
+	}
+	d.Unlock()
+	atomic.AddUint64(&d.sent, 1)
+
+	d.log.Debugf("Sending loop packet: %v (%v hops)", pkt.id, len(path))
+	d.s.scheduler.onPacket(pkt)
+	return nil
+}
+
+func (d *decoy) worker() {
+	sendTimer := time.NewTimer(math.MaxInt64)
+	sweepTicker := time.NewTicker(decoySweepInterval)
+	defer func() {
+		sendTimer.Stop()
+		sweepTicker.Stop()
+	}()
+
+	// The send rate is re-sampled from the current PKI document each time a
+	// loop is sent, or every sweep if there is no document yet.
+	reschedule := func() bool {
+		if !d.s.cfg.Debug.SendDecoyTraffic {
+			return false
+		}
+		ent := d.s.pki.currentDocument()
+		if ent == nil {
+			return false
+		}
+		doc := ent.Document()
+		wait := d.sampleDelay(doc.LambdaM, doc.LambdaMMaxDelay)
+		sendTimer.Reset(time.Duration(wait) * time.Millisecond)
+		return true
+	}
+	isScheduled := false
+
+	for {
+		timerFired := false
+		select {
+		case <-d.HaltCh():
+			d.log.Debugf("Terminating gracefully.")
+			return
+		case <-sweepTicker.C:
+			d.sweep()
+			d.selfTest.maybeStart()
+		case <-sendTimer.C:
+			timerFired = true
+		}
+
+		if timerFired {
+			isScheduled = false
+			if ent := d.s.pki.currentDocument(); ent != nil {
+				if err := d.sendLoop(ent, nil); err != nil {
+					d.log.Debugf("Failed to send loop packet: %v", err)
+				}
+			}
+		}
+		if !isScheduled {
+			isScheduled = reschedule()
+		}
+	}
+}
+
+func (d *decoy) onMgmtDecoyStats(c *thwack.Conn, l string) error {
+	type nodeStat struct {
+		id string
+		decoyNodeCounters
+	}
+
+	d.Lock()
+	nrPending := len(d.pending)
+	stats := make([]nodeStat, 0, len(d.nodes))
+	for id, v := range d.nodes {
+		stats = append(stats, nodeStat{nodeIDToPrintString(&id), *v})
+	}
+	d.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].id < stats[j].id })
+
+	if err := c.Writer().PrintfLine("%v-Sent:%v Received:%v Lost:%v Pending:%v", thwack.StatusOk, atomic.LoadUint64(&d.sent), atomic.LoadUint64(&d.received), atomic.LoadUint64(&d.lost), nrPending); err != nil {
+		return err
+	}
+	for _, v := range stats {
+		lossRate := float64(v.lost) / float64(v.sent)
+		if err := c.Writer().PrintfLine("%v-%v Sent:%v Lost:%v LossRate:%.3f", thwack.StatusOk, v.id, v.sent, v.lost, lossRate); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newDecoy(s *Server) *decoy {
+	d := new(decoy)
+	d.s = s
+	d.log = s.newLogger("decoy")
+	d.mRand = rand.NewMath()
+	d.pending = make(map[[sConstants.SURBIDLength]byte]*decoyLoop)
+	d.nodes = make(map[[sConstants.NodeIDLength]byte]*decoyNodeCounters)
+
+	if s.cfg.Management.Enable {
+		const cmdDecoyStats = "DECOY_STATS"
+		s.management.RegisterCommand(cmdDecoyStats, d.onMgmtDecoyStats)
+	}
+
+	d.selfTest = newSelfTest(d)
+
+	// The worker also handles the self-test, and expiring the loops.
+	if s.cfg.Debug.SendDecoyTraffic || s.cfg.Debug.SelfTestPackets > 0 {
+		d.Go(s.superviseOptional("decoy", d.worker))
+	}
+	return d
+}
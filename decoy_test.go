@@ -0,0 +1,157 @@
+// decoy_test.go - Katzenpost server decoy traffic tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx/commands"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDecoy() *decoy {
+	d := new(decoy)
+	d.log = logging.MustGetLogger("decoy")
+	d.mRand = rand.NewMath()
+	d.pending = make(map[[sConstants.SURBIDLength]byte]*decoyLoop)
+	d.nodes = make(map[[sConstants.NodeIDLength]byte]*decoyNodeCounters)
+	return d
+}
+
+func newTestLoopPacket(surbID [sConstants.SURBIDLength]byte) *packet {
+	pkt := newPacket()
+	pkt.recipient = new(commands.Recipient)
+	pkt.surbReply = &commands.SURBReply{ID: surbID}
+	return pkt
+}
+
+func TestDecoySweep(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newTestDecoy()
+	var a, b, c [sConstants.NodeIDLength]byte
+	a[0], b[0], c[0] = 1, 2, 3
+	for _, id := range [][sConstants.NodeIDLength]byte{a, b, c} {
+		d.nodes[id] = &decoyNodeCounters{sent: 1}
+	}
+
+	// Only the loops past their deadline are written off as lost, and the
+	// loss is attributed to every node along the path.
+	var outcomes []bool
+	onDone := func(returned bool) { outcomes = append(outcomes, returned) }
+	var lostID, pendingID [sConstants.SURBIDLength]byte
+	lostID[0], pendingID[0] = 1, 2
+	d.pending[lostID] = &decoyLoop{
+		path:     [][sConstants.NodeIDLength]byte{a, b},
+		deadline: time.Now().Add(-time.Second),
+		onDone:   onDone,
+	}
+	d.pending[pendingID] = &decoyLoop{
+		path:     [][sConstants.NodeIDLength]byte{c},
+		deadline: time.Now().Add(time.Hour),
+		onDone:   onDone,
+	}
+	d.sweep()
+	assert.Equal([]bool{false}, outcomes, "onDone(): lost loop")
+	assert.Equal(uint64(1), d.lost, "Lost loops")
+	assert.Equal(uint64(1), d.nodes[a].lost, "Lost loops: first hop")
+	assert.Equal(uint64(1), d.nodes[b].lost, "Lost loops: second hop")
+	assert.Zero(d.nodes[c].lost, "Lost loops: pending loop hop")
+	assert.Len(d.pending, 1, "Pending loops")
+
+	// A loop that returns after being written off is ignored.
+	d.onLoopPacket(newTestLoopPacket(lostID))
+	assert.Zero(d.received, "Received loops: expired loop")
+
+	// A loop that returns in time is accounted for.
+	d.onLoopPacket(newTestLoopPacket(pendingID))
+	assert.Equal([]bool{false, true}, outcomes, "onDone(): returned loop")
+	assert.Equal(uint64(1), d.received, "Received loops")
+	assert.Empty(d.pending, "Pending loops")
+}
+
+func TestDecoyIsLoopPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newTestDecoy()
+	var surbID [sConstants.SURBIDLength]byte
+	pkt := newTestLoopPacket(surbID)
+	assert.True(d.isLoopPacket(pkt), "isLoopPacket(): all zero recipient")
+	pkt.recipient.ID[0] = 1
+	assert.False(d.isLoopPacket(pkt), "isLoopPacket(): user recipient")
+	pkt.dispose()
+
+	pkt = newPacket()
+	pkt.recipient = new(commands.Recipient)
+	assert.False(d.isLoopPacket(pkt), "isLoopPacket(): not a SURB reply")
+	pkt.dispose()
+}
+
+func TestDecoySampleDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newTestDecoy()
+	assert.Equal(uint64(1000), d.sampleDelay(0, 1000), "sampleDelay(): no lambda")
+	for i := 0; i < 1000; i++ {
+		assert.True(d.sampleDelay(0.1, 1000) <= 1000, "sampleDelay(): bounded")
+	}
+}
+
+func TestDecoySelectPath(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	// Build a 3 layer topology with a single provider, from the point of
+	// view of a node in the first layer.
+	doc := new(cpki.Document)
+	for layer := 0; layer < 3; layer++ {
+		var nodes []*cpki.MixDescriptor
+		for i := 0; i < 2; i++ {
+			desc, _ := newTestDescriptor(t, "mix", uint8(layer))
+			nodes = append(nodes, desc)
+		}
+		doc.Topology = append(doc.Topology, nodes)
+	}
+	provider, _ := newTestDescriptor(t, "provider", cpki.LayerProvider)
+	doc.Providers = []*cpki.MixDescriptor{provider}
+	self := doc.Topology[0][0]
+	ent, err := pkicache.New(doc, self.IdentityKey, false)
+	require.NoError(err, "pkicache.New()")
+
+	// The loop traverses each of the following layers in order, wrapping
+	// around through the providers, and ends at this node.
+	d := newTestDecoy()
+	for i := 0; i < 10; i++ {
+		path := d.selectPath(ent)
+		require.Len(path, 4, "selectPath()")
+		assert.Equal(uint8(1), path[0].Layer, "selectPath(): first hop")
+		assert.Equal(uint8(2), path[1].Layer, "selectPath(): second hop")
+		assert.Equal(provider, path[2], "selectPath(): third hop")
+		assert.Equal(self, path[3], "selectPath(): last hop")
+	}
+
+	// Loops can not be built through empty layers.
+	doc.Topology[1] = nil
+	assert.Nil(d.selectPath(ent), "selectPath(): empty layer")
+}
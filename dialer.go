@@ -0,0 +1,185 @@
+// dialer.go - Katzenpost server outgoing connection dialer.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/katzenpost/server/config"
+)
+
+var errNoAddresses = errors.New("no addresses to dial")
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// sortAddressesForDial interleaves the IPv6 and IPv4 addresses in addrs,
+// starting with the family preferred by pref, as per RFC 8305 section 4,
+// or discards the other family entirely if pref restricts dialing to a
+// single family.  The relative ordering of addresses within each family is
+// preserved.
+func sortAddressesForDial(addrs []string, pref string) []string {
+	var v6, v4 []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			// Let the dial fail, so that the error gets logged.
+			v4 = append(v4, addr)
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+
+	first, second := v6, v4
+	switch pref {
+	case config.PreferIPv4:
+		first, second = v4, v6
+	case config.IPv6Only:
+		second = nil
+	case config.IPv4Only:
+		first, second = v4, nil
+	}
+
+	sorted := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// resolveAddresses replaces the addresses in addrs that specify a DNS name
+// with the addresses the name currently resolves to.  There is deliberately
+// no caching, so that every dial attempt (including the retries after a
+// failed connection) re-resolves the names, honoring the TTLs as far as the
+// system resolver does.  Names that fail to resolve are dropped, unless
+// nothing resolves at all, in which case the error is returned.  The
+// returned map gives the address in addrs each resolved address came from.
+func resolveAddresses(ctx context.Context, addrs []string) ([]string, map[string]string, error) {
+	var resolved []string
+	origin := make(map[string]string)
+	var lastErr error
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			resolved = append(resolved, addr)
+			origin[addr] = addr
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			a := net.JoinHostPort(ip.String(), port)
+			if _, ok := origin[a]; !ok {
+				resolved = append(resolved, a)
+				origin[a] = addr
+			}
+		}
+	}
+	if len(resolved) == 0 && lastErr != nil {
+		return nil, nil, lastErr
+	}
+	return resolved, origin, nil
+}
+
+// dialAddresses races connection attempts to addrs in the manner described
+// in RFC 8305 ("Happy Eyeballs"), starting a new attempt every attemptDelay
+// or as soon as the previous attempt fails, and returns the first connection
+// that gets established along with the entry in addrs it is connected to.
+// DNS names in addrs are resolved first.
+func dialAddresses(ctx context.Context, dialer *net.Dialer, addrs []string, pref string, attemptDelay time.Duration) (net.Conn, string, error) {
+	addrs, origin, err := resolveAddresses(ctx, addrs)
+	if err != nil {
+		return nil, "", err
+	}
+	addrs = sortAddressesForDial(addrs, pref)
+	if len(addrs) == 0 {
+		return nil, "", errNoAddresses
+	}
+
+	dialCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	// The channel is buffered so that the attempts that lose the race never
+	// block.
+	resultCh := make(chan *dialResult, len(addrs))
+	next, inFlight := 0, 0
+	var attemptCh <-chan time.Time
+	startNext := func() {
+		addr := addrs[next]
+		next++
+		inFlight++
+		go func() {
+			conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+			resultCh <- &dialResult{conn, addr, err}
+		}()
+
+		attemptCh = nil
+		if next < len(addrs) {
+			attemptCh = time.After(attemptDelay)
+		}
+	}
+
+	var lastErr error
+	startNext()
+	for inFlight > 0 {
+		select {
+		case r := <-resultCh:
+			inFlight--
+			if r.err == nil {
+				// Cancel the outstanding attempts, and close any connections
+				// that happen to finish in the mean time.
+				cancelFn()
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if rr := <-resultCh; rr.conn != nil {
+							rr.conn.Close()
+						}
+					}
+				}(inFlight)
+				return r.conn, origin[r.addr], nil
+			}
+			lastErr = r.err
+
+			// Failed attempts immediately start the next attempt.
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-attemptCh:
+			startNext()
+		}
+	}
+
+	return nil, "", lastErr
+}
@@ -0,0 +1,142 @@
+// dialer_test.go - Katzenpost server peer dialer tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortAddressesForDial(t *testing.T) {
+	assert := assert.New(t)
+
+	const (
+		v4a = "192.0.2.1:3219"
+		v4b = "192.0.2.2:3219"
+		v6a = "[2001:db8::1]:3219"
+		v6b = "[2001:db8::2]:3219"
+		bad = "not an address"
+	)
+	addrs := []string{v4a, v6a, v4b, v6b}
+
+	for _, v := range []struct {
+		pref     string
+		addrs    []string
+		expected []string
+	}{
+		{config.PreferIPv6, addrs, []string{v6a, v4a, v6b, v4b}},
+		{config.PreferIPv4, addrs, []string{v4a, v6a, v4b, v6b}},
+		{config.IPv6Only, addrs, []string{v6a, v6b}},
+		{config.IPv4Only, addrs, []string{v4a, v4b}},
+
+		// The families are interleaved for as long as both have addresses.
+		{config.PreferIPv6, []string{v4a, v4b, v6a}, []string{v6a, v4a, v4b}},
+		{config.PreferIPv4, []string{v6a, v6b, v4a}, []string{v4a, v6a, v6b}},
+
+		// A single family is left as is, unless it is excluded.
+		{config.PreferIPv4, []string{v6b, v6a}, []string{v6b, v6a}},
+		{config.IPv4Only, []string{v6a, v6b}, []string{}},
+
+		// Malformed addresses are kept, so that the dial failure is logged.
+		{config.PreferIPv6, []string{bad, v6a}, []string{v6a, bad}},
+	} {
+		assert.Equal(v.expected, sortAddressesForDial(v.addrs, v.pref), "sortAddressesForDial(): %v %v", v.pref, v.addrs)
+	}
+}
+
+func TestResolveAddresses(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	// IP addresses and malformed addresses are passed through as is.
+	addrs := []string{"192.0.2.1:3219", "[2001:db8::1]:3219", "not an address"}
+	resolved, origin, err := resolveAddresses(ctx, addrs)
+	require.NoError(err, "resolveAddresses(): IP addresses")
+	require.Equal(addrs, resolved, "resolveAddresses(): IP addresses")
+	for _, v := range addrs {
+		require.Equal(v, origin[v], "resolveAddresses(): IP address origin")
+	}
+
+	// Names are replaced by what they resolve to, and map back to the name.
+	resolved, origin, err = resolveAddresses(ctx, []string{"localhost:3219"})
+	require.NoError(err, "resolveAddresses(): localhost")
+	require.Contains(resolved, "127.0.0.1:3219", "resolveAddresses(): localhost")
+	for _, v := range resolved {
+		require.Equal("localhost:3219", origin[v], "resolveAddresses(): localhost origin")
+	}
+
+	// Names that fail to resolve are dropped, unless nothing resolves.
+	resolved, _, err = resolveAddresses(ctx, []string{"nonexistent.invalid:3219", "192.0.2.1:3219"})
+	require.NoError(err, "resolveAddresses(): partial failure")
+	require.Equal([]string{"192.0.2.1:3219"}, resolved, "resolveAddresses(): partial failure")
+	_, _, err = resolveAddresses(ctx, []string{"nonexistent.invalid:3219"})
+	require.Error(err, "resolveAddresses(): total failure")
+}
+
+func TestDialAddresses(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "net.Listen()")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(err, "net.SplitHostPort()")
+
+	// Grab a port that nothing is listening on.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "net.Listen()")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	// A failed attempt falls through to the next address.
+	conn, addr, err := dialAddresses(ctx, dialer, []string{closedAddr, ln.Addr().String()}, config.PreferIPv4, time.Second)
+	require.NoError(err, "dialAddresses(): fallback")
+	require.Equal(ln.Addr().String(), addr, "dialAddresses(): fallback")
+	conn.Close()
+
+	// Names are resolved, and the name is returned as the dialed address.
+	nameAddr := net.JoinHostPort("localhost", port)
+	conn, addr, err = dialAddresses(ctx, dialer, []string{nameAddr}, config.IPv4Only, time.Second)
+	require.NoError(err, "dialAddresses(): localhost")
+	require.Equal(nameAddr, addr, "dialAddresses(): localhost")
+	conn.Close()
+
+	// Nothing to dial once the address family policy is applied.
+	_, _, err = dialAddresses(ctx, dialer, []string{"[::1]:" + port}, config.IPv4Only, time.Second)
+	require.Equal(errNoAddresses, err, "dialAddresses(): IPv4Only with IPv6")
+
+	// Every attempt failing returns the error.
+	_, _, err = dialAddresses(ctx, dialer, []string{closedAddr}, config.PreferIPv6, time.Second)
+	require.Error(err, "dialAddresses(): all attempts failed")
+}
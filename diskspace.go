@@ -0,0 +1,228 @@
+// diskspace.go - Katzenpost server disk space monitoring.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+const diskCheckInterval = 10 * time.Second
+
+var errDiskFreeNotSupported = errors.New("not supported on this platform")
+
+type diskLevel int
+
+const (
+	diskOk diskLevel = iota
+	diskLow
+	diskRefuseSpool
+	diskDegraded
+)
+
+func (l diskLevel) String() string {
+	switch l {
+	case diskOk:
+		return "Ok"
+	case diskLow:
+		return "Low"
+	case diskRefuseSpool:
+		return "RefuseSpool"
+	case diskDegraded:
+		return "Degraded"
+	default:
+		return "[Unknown]"
+	}
+}
+
+// diskMonitor periodically checks the free space on the filesystems backing
+// the DataDir, mix keys and spool, so that the node backs off gracefully
+// instead of failing with opaque Bolt errors once the disk is full.
+type diskMonitor struct {
+	level uint32 // MUST be accessed via sync/atomic.
+
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	lastCheck time.Time
+	minFree   uint64
+	minPath   string
+}
+
+// isRefusingSpool returns true iff new messages should not be written to
+// the spool.
+func (m *diskMonitor) isRefusingSpool() bool {
+	return diskLevel(atomic.LoadUint32(&m.level)) >= diskRefuseSpool
+}
+
+// isWithholding returns true iff the next descriptor should not be
+// published.
+func (m *diskMonitor) isWithholding() bool {
+	return diskLevel(atomic.LoadUint32(&m.level)) >= diskDegraded
+}
+
+func (m *diskMonitor) paths() []string {
+	paths := []string{m.s.dataDir(), m.s.mixKeyDir()}
+	if m.s.cfg.Provider != nil && atomic.LoadUint32(&m.s.isChrooted) == 0 {
+		paths = append(paths, filepath.Dir(m.s.cfg.Provider.SpoolDB))
+	}
+
+	ret := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// levelFor returns the level corresponding to free bytes of free space.
+// Leaving a level requires 10% more free space than entering it, so that
+// the node does not flap around a threshold.
+func (m *diskMonitor) levelFor(free uint64, cur diskLevel) diskLevel {
+	thresholds := []int{
+		m.s.cfg.Debug.LowDiskWarning,
+		m.s.cfg.Debug.LowDiskRefuseSpool,
+		m.s.cfg.Debug.LowDiskDegraded,
+	}
+
+	level := diskOk
+	for i, mib := range thresholds {
+		if mib < 0 {
+			continue
+		}
+		l := diskLevel(i + 1)
+		thresh := uint64(mib) << 20
+		if l <= cur {
+			thresh += thresh / 10
+		}
+		if free < thresh {
+			level = l
+		}
+	}
+	return level
+}
+
+func (m *diskMonitor) onTick(now time.Time) {
+	if now.Sub(m.lastCheck) < diskCheckInterval {
+		return
+	}
+	m.lastCheck = now
+	m.check()
+}
+
+func (m *diskMonitor) check() {
+	m.Lock()
+	defer m.Unlock()
+
+	var minFree uint64
+	minPath := ""
+	for _, p := range m.paths() {
+		free, err := diskFree(p)
+		if err != nil {
+			if err != errDiskFreeNotSupported {
+				m.log.Warningf("Failed to query the free space of '%v': %v", p, err)
+			}
+			continue
+		}
+		if minPath == "" || free < minFree {
+			minFree, minPath = free, p
+		}
+	}
+	if minPath == "" {
+		return
+	}
+	m.minFree, m.minPath = minFree, minPath
+
+	cur := diskLevel(atomic.LoadUint32(&m.level))
+	level := m.levelFor(minFree, cur)
+	if level == cur {
+		return
+	}
+	atomic.StoreUint32(&m.level, uint32(level))
+
+	freeMiB := minFree >> 20
+	switch {
+	case level == diskOk:
+		m.log.Noticef("Disk space recovered: %v MiB free on '%v'.", freeMiB, minPath)
+	case level < cur:
+		m.log.Noticef("Disk space partially recovered: %v MiB free on '%v' (%v).", freeMiB, minPath, level)
+	default:
+		m.log.Warningf("Low disk space: %v MiB free on '%v' (%v).", freeMiB, minPath, level)
+	}
+	if m.s.cfg.Provider != nil {
+		if level >= diskRefuseSpool && cur < diskRefuseSpool {
+			m.log.Warningf("No longer accepting new messages into the spool.")
+		} else if level < diskRefuseSpool && cur >= diskRefuseSpool {
+			m.log.Noticef("Accepting new messages into the spool again.")
+		}
+	}
+	if level >= diskDegraded && cur < diskDegraded {
+		m.log.Warningf("Withholding the next descriptor till disk space is freed.")
+		m.s.emitDegradedEvent("low disk space")
+	}
+}
+
+func (m *diskMonitor) status() (diskLevel, uint64, string) {
+	m.Lock()
+	defer m.Unlock()
+	return diskLevel(atomic.LoadUint32(&m.level)), m.minFree, m.minPath
+}
+
+func (m *diskMonitor) onMgmtDiskSpace(c *thwack.Conn, l string) error {
+	level, free, path := m.status()
+	if path == "" {
+		c.Log().Errorf("DISK_SPACE: free space is unknown")
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	for _, p := range m.paths() {
+		free, err := diskFree(p)
+		if err != nil {
+			continue
+		}
+		if err = c.Writer().PrintfLine("%v-Path:%v FreeMiB:%v", thwack.StatusOk, p, free>>20); err != nil {
+			return err
+		}
+	}
+	if err := c.Writer().PrintfLine("%v-Level:%v MinFreeMiB:%v MinPath:%v", thwack.StatusOk, level, free>>20, path); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newDiskMonitor(s *Server) *diskMonitor {
+	m := new(diskMonitor)
+	m.s = s
+	m.log = s.newLogger("disk")
+	if _, err := diskFree(s.dataDir()); err == errDiskFreeNotSupported {
+		m.log.Warningf("Disk space monitoring is %v.", err)
+	}
+	m.check()
+	m.lastCheck = time.Now()
+	return m
+}
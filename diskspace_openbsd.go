@@ -0,0 +1,33 @@
+// diskspace_openbsd.go - Disk space monitoring (OpenBSD).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "syscall"
+
+// diskFree returns the space available to unprivileged users on the
+// filesystem containing path, in bytes.
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	if st.F_bavail < 0 {
+		// The reserved blocks are in use.
+		return 0, nil
+	}
+	return uint64(st.F_bavail) * uint64(st.F_bsize), nil
+}
@@ -0,0 +1,144 @@
+// diskspace_test.go - Katzenpost server disk space monitoring tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDiskMonitor(s *Server) *diskMonitor {
+	m := new(diskMonitor)
+	m.s = s
+	m.log = logging.MustGetLogger("disk")
+	return m
+}
+
+func TestDiskLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				LowDiskWarning:     100,
+				LowDiskRefuseSpool: 50,
+				LowDiskDegraded:    10,
+			},
+		},
+	}
+	m := newTestDiskMonitor(s)
+
+	const mib = 1 << 20
+	for _, v := range []struct {
+		free     uint64
+		cur      diskLevel
+		expected diskLevel
+	}{
+		// Entering a level happens as soon as a threshold is crossed.
+		{200 * mib, diskOk, diskOk},
+		{100 * mib, diskOk, diskOk},
+		{100*mib - 1, diskOk, diskLow},
+		{50*mib - 1, diskOk, diskRefuseSpool},
+		{10*mib - 1, diskOk, diskDegraded},
+		{0, diskOk, diskDegraded},
+
+		// Leaving a level requires 10% more than the threshold.
+		{100 * mib, diskLow, diskLow},
+		{110*mib - 1, diskLow, diskLow},
+		{110 * mib, diskLow, diskOk},
+		{52 * mib, diskRefuseSpool, diskRefuseSpool},
+		{55 * mib, diskRefuseSpool, diskLow},
+		{10 * mib, diskDegraded, diskDegraded},
+		{11 * mib, diskDegraded, diskRefuseSpool},
+		{200 * mib, diskDegraded, diskOk},
+
+		// The hysteresis only applies to the levels being left.
+		{50*mib - 1, diskLow, diskRefuseSpool},
+	} {
+		assert.Equal(v.expected, m.levelFor(v.free, v.cur), "levelFor(): %v MiB free, %v", float64(v.free)/mib, v.cur)
+	}
+
+	// Negative thresholds are disabled.
+	s.cfg.Debug.LowDiskRefuseSpool = -1
+	assert.Equal(diskLow, m.levelFor(20*mib, diskOk), "levelFor(): disabled threshold")
+	assert.Equal(diskDegraded, m.levelFor(5*mib, diskOk), "levelFor(): disabled threshold")
+}
+
+func TestDiskMonitorCheck(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "diskspace_test")
+	require.NoError(err, "ioutil.TempDir()")
+	defer os.RemoveAll(dir)
+	if _, err = diskFree(dir); err == errDiskFreeNotSupported {
+		t.Skip("diskFree() is not supported on this platform")
+	}
+
+	s := &Server{
+		cfg: &config.Config{
+			Server: &config.Server{
+				DataDir: dir,
+			},
+			Debug: &config.Debug{
+				LowDiskWarning:     -1,
+				LowDiskRefuseSpool: -1,
+				LowDiskDegraded:    -1,
+			},
+		},
+	}
+	m := newTestDiskMonitor(s)
+
+	m.check()
+	level, free, path := m.status()
+	assert.Equal(diskOk, level, "status(): no thresholds")
+	assert.NotZero(free, "status(): free space")
+	assert.Equal(dir, path, "status(): path")
+
+	// No filesystem has a PiB free, so every threshold is crossed at once.
+	const pib = 1 << 30
+	s.cfg.Debug.LowDiskWarning = pib
+	s.cfg.Debug.LowDiskRefuseSpool = pib
+	s.cfg.Debug.LowDiskDegraded = pib
+	m.check()
+	level, _, _ = m.status()
+	assert.Equal(diskDegraded, level, "status(): all thresholds")
+	assert.True(m.isRefusingSpool(), "isRefusingSpool(): all thresholds")
+	assert.True(m.isWithholding(), "isWithholding(): all thresholds")
+	assert.Equal(uint64(1), atomic.LoadUint64(&s.events.counts[EventDegraded]), "EventDegraded emitted")
+
+	// Recovering only refuses the spool till below the withholding level.
+	s.cfg.Debug.LowDiskDegraded = -1
+	m.check()
+	assert.True(m.isRefusingSpool(), "isRefusingSpool(): refuse spool threshold")
+	assert.False(m.isWithholding(), "isWithholding(): refuse spool threshold")
+
+	s.cfg.Debug.LowDiskWarning = -1
+	s.cfg.Debug.LowDiskRefuseSpool = -1
+	m.check()
+	level, _, _ = m.status()
+	assert.Equal(diskOk, level, "status(): recovered")
+	assert.False(m.isRefusingSpool(), "isRefusingSpool(): recovered")
+	assert.Equal(uint64(1), atomic.LoadUint64(&s.events.counts[EventDegraded]), "EventDegraded not emitted again")
+}
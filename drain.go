@@ -0,0 +1,172 @@
+// drain.go - Katzenpost server termination drain and probes.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+const (
+	drainPollInterval = 100 * time.Millisecond
+
+	// livenessTimeout is how long the periodic timer may go without running
+	// before the server is considered wedged.
+	livenessTimeout = 10 * time.Second
+)
+
+func (s *Server) isDrainingNow() bool {
+	return atomic.LoadUint32(&s.isDraining) != 0
+}
+
+// Drain terminates the server within timeout, as container orchestrators
+// expect on SIGTERM.  New connections are refused immediately, the packets
+// already in the scheduler are sent while the deadline permits, the state is
+// flushed, and the server is shut down with whatever time remains.  If
+// timeout is 0, Debug.TerminationDrainTimeout is used.
+//
+// The server does not install any signal handlers, so it is up to the
+// caller to call Drain upon SIGTERM.
+func (s *Server) Drain(timeout time.Duration) {
+	if !atomic.CompareAndSwapUint32(&s.isDraining, 0, 1) {
+		return
+	}
+	if timeout <= 0 {
+		timeout = time.Duration(s.cfg.Debug.TerminationDrainTimeout) * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+	s.log.Noticef("Draining, terminating within %v.", timeout)
+
+	// Half of the time is reserved for the shutdown proper, which persists
+	// whatever is left in the scheduler queue.
+	shutdownReserve := timeout / 2
+	if max := time.Duration(s.cfg.Debug.ShutdownTimeout) * time.Millisecond; shutdownReserve > max {
+		shutdownReserve = max
+	}
+	drainEnd := deadline.Add(-shutdownReserve)
+
+	// Stop accepting new connections.  The established ones are left
+	// alone, as they carry the traffic that is still being forwarded.
+	s.listenersLock.RLock()
+	for _, l := range s.listeners {
+		if l != nil {
+			l.stopAccepting()
+		}
+	}
+	s.listenersLock.RUnlock()
+
+	// Give the packets scheduled prior to the drain a chance to be sent.
+	if s.scheduler != nil {
+		windowEnd := time.Now().Add(s.scheduler.windowRemaining())
+		if windowEnd.After(drainEnd) {
+			windowEnd = drainEnd
+		}
+		for s.scheduler.queueLen() > 0 && time.Now().Before(windowEnd) {
+			time.Sleep(drainPollInterval)
+		}
+		if n := s.scheduler.queueLen(); n > 0 {
+			s.log.Noticef("Drain window elapsed with %v packet(s) still scheduled.", n)
+		}
+	}
+
+	// Flush the state that is otherwise written back lazily.
+	if s.mixKeys != nil {
+		s.mixKeys.flush()
+	}
+	if s.accounting != nil {
+		s.accounting.flush(false)
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < drainPollInterval {
+		remaining = drainPollInterval
+	}
+	s.haltOnce.Do(func() { s.haltWithDeadline(remaining) })
+}
+
+// isLive returns the empty string iff the server is not wedged, for
+// liveness probes, or why it is otherwise.
+func (s *Server) isLive() string {
+	t := s.periodic
+	if t == nil {
+		return "periodic timer stopped"
+	}
+	if d := t.sinceLastTick(); d > livenessTimeout {
+		return "periodic timer stalled for " + d.Round(time.Second).String()
+	}
+	if failed := s.workers.failedCritical(); len(failed) > 0 {
+		return "failed workers: " + strings.Join(failed, ",")
+	}
+	return ""
+}
+
+// isReady returns the empty string iff the server should receive traffic,
+// for readiness probes, or why not otherwise.
+func (s *Server) isReady() string {
+	if reason := s.isLive(); reason != "" {
+		return reason
+	}
+	switch {
+	case s.isDrainingNow():
+		return "draining"
+	case !s.pki.hasCurrentDocument():
+		return "no PKI document for the current epoch"
+	}
+	if isDecommissioning, _ := s.decommission.status(); isDecommissioning {
+		return "decommissioning"
+	}
+	return ""
+}
+
+func (s *Server) onMgmtDrain(c *thwack.Conn, l string) error {
+	var timeout time.Duration
+	if sp := strings.Fields(l); len(sp) == 2 {
+		ms, err := strconv.Atoi(sp[1])
+		if err != nil || ms <= 0 {
+			c.Log().Debugf("DRAIN invalid timeout: '%v'", sp[1])
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	} else if len(sp) != 1 {
+		c.Log().Debugf("DRAIN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	go s.Drain(timeout)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtProbe(c *thwack.Conn, reason string) error {
+	if reason != "" {
+		if err := c.Writer().PrintfLine("%v-Reason:%v", thwack.StatusTransactionFailed, reason); err != nil {
+			return err
+		}
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtLiveness(c *thwack.Conn, l string) error {
+	return s.onMgmtProbe(c, s.isLive())
+}
+
+func (s *Server) onMgmtReadiness(c *thwack.Conn, l string) error {
+	return s.onMgmtProbe(c, s.isReady())
+}
@@ -0,0 +1,106 @@
+// drain_test.go - Katzenpost server termination drain tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/monotime"
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDrainServer(t *testing.T, window time.Duration) (*Server, net.Listener) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "net.Listen()")
+
+	s := &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				ShutdownTimeout: 60 * 1000,
+			},
+		},
+		log:          logging.MustGetLogger("server"),
+		decommission: new(decommission),
+	}
+	l := &listener{s: s, l: nl, log: logging.MustGetLogger("listener")}
+	l.Go(l.worker)
+	s.listeners = []*listener{l}
+	s.pki = &pki{s: s}
+	s.periodic = &periodicTimer{s: s, lastTick: time.Now().UnixNano()}
+
+	// A single packet is scheduled, to be dispatched after window.
+	s.scheduler = &scheduler{s: s}
+	atomic.StoreInt64(&s.scheduler.qLen, 1)
+	atomic.StoreInt64(&s.scheduler.maxDispatchAt, int64(monotime.Now()+window))
+
+	// The shutdown proper is out of scope.
+	s.haltOnce.Do(func() {})
+
+	return s, nl
+}
+
+func TestDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	s, nl := newTestDrainServer(t, 300*time.Millisecond)
+	assert.Empty(s.isReady(), "isReady(): before the drain")
+
+	// The drain waits for the scheduled packets to be sent, and stops
+	// accepting new connections.
+	start := time.Now()
+	s.Drain(10 * time.Second)
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 300*time.Millisecond, "Drain(): waits for the scheduler")
+	assert.True(elapsed < 5*time.Second, "Drain(): returns once the scheduler window elapsed")
+	assert.Equal("draining", s.isReady(), "isReady(): draining")
+	_, err := nl.Accept()
+	assert.Error(err, "Accept(): after the drain")
+
+	// The listener worker was stopped, rather than left to trip over the
+	// closed socket.
+	select {
+	case <-s.listeners[0].HaltCh():
+	default:
+		assert.Fail("Drain(): listener worker not halted")
+	}
+
+	// Draining again is a no-op.
+	start = time.Now()
+	s.Drain(10 * time.Second)
+	assert.True(time.Since(start) < drainPollInterval, "Drain(): again")
+}
+
+func TestDrainDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	// Packets that are scheduled past the deadline do not hold up the
+	// shutdown, which is left half of the time.
+	s, nl := newTestDrainServer(t, time.Hour)
+	defer nl.Close()
+
+	start := time.Now()
+	s.Drain(time.Second)
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 500*time.Millisecond, "Drain(): waits till the drain deadline")
+	assert.True(elapsed < time.Second, "Drain(): reserves time for the shutdown")
+}
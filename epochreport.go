@@ -0,0 +1,138 @@
+// epochreport.go - Katzenpost server epoch transition report.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/op/go-logging"
+)
+
+// epochReportLead is how long before an epoch transition the report of
+// the upcoming changes is logged.
+const epochReportLead = 1 * time.Minute
+
+// epochReporter logs a summary of what will change at each epoch
+// transition shortly before it happens, so that operators can correlate
+// delivery issues with topology changes when reviewing the logs.
+type epochReporter struct {
+	s   *Server
+	log *logging.Logger
+
+	lastEpoch uint64
+}
+
+func (r *epochReporter) onTick(now time.Time) {
+	epoch, _, till := r.s.epochNow()
+	if till > epochReportLead || epoch == r.lastEpoch {
+		return
+	}
+	r.lastEpoch = epoch
+	if r.s.pki.impl == nil {
+		return
+	}
+
+	next := epoch + 1
+	nextDoc := r.s.pki.documentForEpoch(next)
+	if nextDoc == nil {
+		r.log.Warningf("Epoch %v starts in %v, the PKI document is not available yet.", next, till.Truncate(time.Second))
+		return
+	}
+	curDoc := r.s.pki.documentForEpoch(epoch)
+
+	var b []string
+	b = append(b, fmt.Sprintf("Layer: %v", layerToString(curDoc, nextDoc)))
+	if curDoc != nil {
+		b = append(b, fmt.Sprintf("Incoming: %v", diffDescriptors(curDoc.Incoming(), nextDoc.Incoming())))
+		b = append(b, fmt.Sprintf("Outgoing: %v", diffDescriptors(curDoc.Outgoing(), nextDoc.Outgoing())))
+	} else {
+		b = append(b, fmt.Sprintf("Incoming: %v peer(s)", len(nextDoc.Incoming())))
+		b = append(b, fmt.Sprintf("Outgoing: %v peer(s)", len(nextDoc.Outgoing())))
+	}
+	if k, ok := r.s.mixKeys.publicKey(next); ok {
+		b = append(b, fmt.Sprintf("Mix key: %v", k))
+		if pub := nextDoc.Self().MixKeys[next]; pub == nil || !bytes.Equal(pub.Bytes(), k.Bytes()) {
+			b = append(b, "WARNING: the published mix key does not match")
+		}
+	} else if !r.s.cfg.Debug.DisableKeyRotation {
+		b = append(b, "WARNING: no mix key")
+	}
+	r.log.Noticef("Epoch %v starts in %v: %v", next, till.Truncate(time.Second), strings.Join(b, ", "))
+}
+
+func layerToString(curDoc, nextDoc *pkicache.Entry) string {
+	f := func(l uint8) string {
+		if l == cpki.LayerProvider {
+			return "provider"
+		}
+		return fmt.Sprintf("%v", l)
+	}
+
+	next := f(nextDoc.Self().Layer)
+	if curDoc == nil {
+		return next
+	}
+	if cur := f(curDoc.Self().Layer); cur != next {
+		return cur + " -> " + next
+	}
+	return next + " (unchanged)"
+}
+
+// diffDescriptors returns a summary of the nodes added to and removed from
+// the set of peers.
+func diffDescriptors(cur, next []*cpki.MixDescriptor) string {
+	curNames := make(map[string]bool)
+	for _, v := range cur {
+		curNames[v.Name] = true
+	}
+	nextNames := make(map[string]bool)
+	for _, v := range next {
+		nextNames[v.Name] = true
+	}
+
+	var added, removed []string
+	for n := range nextNames {
+		if !curNames[n] {
+			added = append(added, "+"+n)
+		}
+	}
+	for n := range curNames {
+		if !nextNames[n] {
+			removed = append(removed, "-"+n)
+		}
+	}
+	if len(added)+len(removed) == 0 {
+		return fmt.Sprintf("%v peer(s), unchanged", len(next))
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return fmt.Sprintf("%v peer(s), %v", len(next), strings.Join(append(added, removed...), " "))
+}
+
+func newEpochReporter(s *Server) *epochReporter {
+	r := new(epochReporter)
+	r.s = s
+	r.log = s.newLogger("epoch")
+	r.lastEpoch, _, _ = s.epochNow()
+	return r
+}
@@ -0,0 +1,271 @@
+// events.go - Katzenpost server lifecycle events.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/sphinx/constants"
+)
+
+// EventType is the type of a server lifecycle event.
+type EventType int
+
+const (
+	// EventStarted is emitted once the server is fully initialized.
+	EventStarted EventType = iota
+
+	// EventPKIUpdated is emitted when a new PKI document is loaded, with
+	// Epoch set to the document's epoch.
+	EventPKIUpdated
+
+	// EventEpochTransition is emitted when the epoch changes, with Epoch
+	// set to the new epoch.
+	EventEpochTransition
+
+	// EventPeerConnected is emitted when a link with a mix is established.
+	EventPeerConnected
+
+	// EventPeerDisconnected is emitted when a link with a mix is closed.
+	EventPeerDisconnected
+
+	// EventDegraded is emitted when the server is unable to fully perform
+	// its function, with Reason set to the cause.
+	EventDegraded
+
+	// EventShuttingDown is emitted when the server starts shutting down.
+	EventShuttingDown
+
+	// EventAttackSuspected is emitted when the traffic heuristics suggest
+	// an active attack against the node, with Reason set to the heuristic
+	// that was triggered.
+	EventAttackSuspected
+
+	// EventOverloaded is emitted when the queue depths pass the high-water
+	// marks, and new client connections start being rejected, with Reason
+	// set to the queue.
+	EventOverloaded
+
+	// EventOverloadCleared is emitted when the queue depths drop below the
+	// low-water marks again.
+	EventOverloadCleared
+
+	// EventClientBanned is emitted when a client is temporarily banned for
+	// misbehaving, with Reason set to the username.
+	EventClientBanned
+
+	// EventPeerBanned is emitted when a peer is temporarily banned for
+	// link layer misbehavior, with Reason set to the IP address.
+	EventPeerBanned
+
+	// EventAccountExpiring is emitted when an idle account is about to be
+	// disabled, with Reason set to the username, so that the user can be
+	// notified out of band.
+	EventAccountExpiring
+
+	nrEventTypes
+)
+
+// String returns the string representation of the EventType.
+func (t EventType) String() string {
+	switch t {
+	case EventStarted:
+		return "Started"
+	case EventPKIUpdated:
+		return "PKIUpdated"
+	case EventEpochTransition:
+		return "EpochTransition"
+	case EventPeerConnected:
+		return "PeerConnected"
+	case EventPeerDisconnected:
+		return "PeerDisconnected"
+	case EventDegraded:
+		return "Degraded"
+	case EventShuttingDown:
+		return "ShuttingDown"
+	case EventAttackSuspected:
+		return "AttackSuspected"
+	case EventOverloaded:
+		return "Overloaded"
+	case EventOverloadCleared:
+		return "OverloadCleared"
+	case EventClientBanned:
+		return "ClientBanned"
+	case EventPeerBanned:
+		return "PeerBanned"
+	case EventAccountExpiring:
+		return "AccountExpiring"
+	default:
+		return "[Unknown]"
+	}
+}
+
+// Event is a server lifecycle event.
+type Event struct {
+	// Type is the event type.
+	Type EventType
+
+	// Time is the time the event occurred.
+	Time time.Time
+
+	// Epoch is the epoch associated with the event, if any.
+	Epoch uint64
+
+	// PeerID is the node ID of the peer associated with the event, if any.
+	PeerID *[constants.NodeIDLength]byte
+
+	// IsOutgoing is true iff the peer link associated with the event is an
+	// outgoing connection.
+	IsOutgoing bool
+
+	// Reason is the human readable reason for the event, if any.
+	Reason string
+}
+
+// EventSubscription is a subscription to the server lifecycle events.
+type EventSubscription struct {
+	s  *Server
+	ch chan *Event
+
+	dropped uint64
+}
+
+// Events returns the channel on which the events are delivered.  The
+// channel is closed when the subscription is canceled, or the server is
+// shut down.
+func (sub *EventSubscription) Events() <-chan *Event {
+	return sub.ch
+}
+
+// Dropped returns the number of events that were not delivered because the
+// subscriber was not keeping up.
+func (sub *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close cancels the subscription.
+func (sub *EventSubscription) Close() {
+	sub.s.events.unsubscribe(sub)
+}
+
+type eventBus struct {
+	// Per type event counts since the last collection, MUST be accessed
+	// via sync/atomic.
+	counts [nrEventTypes]uint64
+
+	sync.Mutex
+
+	subs     map[*EventSubscription]bool
+	isClosed bool
+}
+
+func (b *eventBus) subscribe(s *Server, bufSize int) *EventSubscription {
+	sub := &EventSubscription{
+		s:  s,
+		ch: make(chan *Event, bufSize),
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.isClosed {
+		close(sub.ch)
+		return sub
+	}
+	if b.subs == nil {
+		b.subs = make(map[*EventSubscription]bool)
+	}
+	b.subs[sub] = true
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *EventSubscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// emit delivers the event to every subscriber, without blocking.  Events are
+// dropped for subscribers that are not keeping up.
+func (b *eventBus) emit(ev *Event) {
+	ev.Time = time.Now()
+	if ev.Type >= 0 && ev.Type < nrEventTypes {
+		atomic.AddUint64(&b.counts[ev.Type], 1)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// collectCounts returns the per type event counts accumulated since the
+// last call.
+func (b *eventBus) collectCounts() [nrEventTypes]uint64 {
+	var counts [nrEventTypes]uint64
+	for i := range counts {
+		counts[i] = atomic.SwapUint64(&b.counts[i], 0)
+	}
+	return counts
+}
+
+func (b *eventBus) close() {
+	b.Lock()
+	defer b.Unlock()
+
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+	b.isClosed = true
+}
+
+// SubscribeEvents subscribes to the server lifecycle events, buffering up
+// to bufSize events.  Events are delivered without blocking the server, so
+// subscribers that fall behind will miss events.
+func (s *Server) SubscribeEvents(bufSize int) *EventSubscription {
+	return s.events.subscribe(s, bufSize)
+}
+
+func (s *Server) emitEvent(t EventType) {
+	s.events.emit(&Event{Type: t})
+}
+
+func (s *Server) emitEpochEvent(t EventType, epoch uint64) {
+	s.events.emit(&Event{Type: t, Epoch: epoch})
+}
+
+func (s *Server) emitPeerEvent(t EventType, id *[constants.NodeIDLength]byte, isOutgoing bool) {
+	peerID := *id
+	s.events.emit(&Event{Type: t, PeerID: &peerID, IsOutgoing: isOutgoing})
+}
+
+func (s *Server) emitDegradedEvent(reason string) {
+	s.events.emit(&Event{Type: EventDegraded, Reason: reason})
+}
@@ -0,0 +1,105 @@
+// forwardcap.go - Katzenpost server per-epoch forwarding cap.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+)
+
+// forwardCap caps the number of packets forwarded per epoch, for operators
+// on billed bandwidth.  Once the cap is reached, packets are either dropped
+// for the rest of the epoch, or the descriptor for the next epoch is
+// withheld so that the node drops out of the topology, depending on the
+// configured action.
+type forwardCap struct {
+	count uint64 // MUST be accessed via sync/atomic.
+
+	isReached uint32 // MUST be accessed via sync/atomic.
+
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	max      uint64
+	withhold bool
+	epoch    uint64
+}
+
+// allow accounts for a packet about to be forwarded, and returns false iff
+// the packet should be dropped.
+func (fc *forwardCap) allow() bool {
+	if atomic.AddUint64(&fc.count, 1) <= fc.max {
+		return true
+	}
+	if atomic.CompareAndSwapUint32(&fc.isReached, 0, 1) {
+		if fc.withhold {
+			fc.log.Warningf("Forwarded packet cap of %v reached, withholding the next descriptor.", fc.max)
+		} else {
+			fc.log.Warningf("Forwarded packet cap of %v reached, dropping packets till the next epoch.", fc.max)
+		}
+		fc.s.emitDegradedEvent("forwarded packet cap reached")
+	}
+	if fc.withhold {
+		return true
+	}
+	fc.s.accounting.onDrop(dropForwardCap)
+	return false
+}
+
+// isWithholding returns true iff the next descriptor should not be
+// published.
+func (fc *forwardCap) isWithholding() bool {
+	return fc.withhold && atomic.LoadUint32(&fc.isReached) != 0
+}
+
+func (fc *forwardCap) forwarded() uint64 {
+	return atomic.LoadUint64(&fc.count)
+}
+
+func (fc *forwardCap) onTick(now time.Time) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if epoch, _, _ := fc.s.epochNow(); epoch != fc.epoch {
+		fc.epoch = epoch
+		atomic.StoreUint64(&fc.count, 0)
+		if atomic.SwapUint32(&fc.isReached, 0) != 0 {
+			fc.log.Noticef("Forwarded packet cap reset for epoch %v.", epoch)
+		}
+	}
+}
+
+func newForwardCap(s *Server) *forwardCap {
+	fc := new(forwardCap)
+	fc.s = s
+	fc.log = s.newLogger("forwardcap")
+	fc.max = uint64(s.cfg.Debug.MaxForwardPerEpoch)
+	fc.withhold = s.cfg.Debug.ForwardCapAction == config.ForwardCapWithhold
+	fc.epoch, _, _ = s.epochNow()
+
+	// Account for what was already sent in this epoch prior to a restart.
+	if r, err := s.accounting.load(fc.epoch); err == nil {
+		fc.count = r.PktsOut
+	}
+	return fc
+}
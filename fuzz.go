@@ -0,0 +1,101 @@
+// fuzz.go - Katzenpost server fuzzing entry points.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build gofuzz
+// +build gofuzz
+
+package server
+
+import (
+	"errors"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+// The go-fuzz harnesses for the untrusted input surfaces, built with:
+//
+//   go-fuzz-build -func FuzzPacket github.com/katzenpost/server
+//   go-fuzz-build -func FuzzCommand github.com/katzenpost/server
+
+// fuzzMixKey is the fixed mix key used by FuzzPacket, so that a corpus of
+// valid packets can be generated against it.
+var fuzzMixKey = func() *ecdh.PrivateKey {
+	var raw [ecdh.PrivateKeySize]byte
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	k := new(ecdh.PrivateKey)
+	if err := k.FromBytes(raw[:]); err != nil {
+		panic("BUG: failed to load the fuzzing mix key: " + err.Error())
+	}
+	return k
+}()
+
+// ProcessRawPacket runs the crypto worker's processing of a single raw
+// Sphinx packet with the provided mix key, up to the point where the packet
+// would be handed off to the scheduler or the provider backend.  Replay
+// detection is not done.
+func ProcessRawPacket(k *ecdh.PrivateKey, raw []byte) error {
+	pkt := newPacket()
+	defer pkt.dispose()
+	if err := pkt.copyToRaw(raw); err != nil {
+		return err
+	}
+
+	payload, _, cmds, err := sphinx.Unwrap(k, pkt.raw)
+	if err != nil {
+		return err
+	}
+	pkt.payload = payload
+	pkt.cmds = cmds
+	if err = pkt.splitCommands(); err != nil {
+		return err
+	}
+
+	switch {
+	case pkt.isForward():
+		if pkt.payload != nil {
+			return errors.New("Unwrap() returned payload")
+		}
+	case pkt.isToUser(), pkt.isUnreliableToUser(), pkt.isSURBReply():
+	default:
+		return errors.New("invalid commands: " + pkt.cmdsToString())
+	}
+	return nil
+}
+
+// ParseWireCommand parses a single link layer command.
+func ParseWireCommand(b []byte) (commands.Command, error) {
+	return commands.FromBytes(b)
+}
+
+// FuzzPacket is the go-fuzz entry point for the Sphinx packet processing.
+func FuzzPacket(data []byte) int {
+	if err := ProcessRawPacket(fuzzMixKey, data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzCommand is the go-fuzz entry point for the link layer command parsing.
+func FuzzCommand(data []byte) int {
+	if _, err := ParseWireCommand(data); err != nil {
+		return 0
+	}
+	return 1
+}
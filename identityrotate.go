@@ -0,0 +1,215 @@
+// identityrotate.go - Katzenpost server identity key rotation.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/utils"
+)
+
+const (
+	nextIdentityPrivateKeyFile     = "identity.next.private.pem"
+	nextIdentityPublicKeyFile      = "identity.next.public.pem"
+	previousIdentityPrivateKeyFile = "identity.previous.private.pem"
+	previousIdentityPublicKeyFile  = "identity.previous.public.pem"
+
+	identityRotationContext = "katzenpost-identity-rotation-v0"
+)
+
+// The identity key rotation is staged, and driven via the management
+// interface:
+//
+//  1. IDENTITY_NEXT_GENERATE creates the next identity key, and returns the
+//     cross-signatures binding the current and next keys.  Since the
+//     descriptor has no way to carry them, these along with the next public
+//     key need to be handed to the authority operators out of band, so that
+//     the next key is added to the authority configuration.
+//  2. IDENTITY_NEXT_COMMIT replaces the current identity key with the next
+//     one (keeping the current one as the previous key), which takes effect
+//     once the server is restarted.
+//
+// IDENTITY_NEXT_ABORT discards the next identity key prior to the commit,
+// and IDENTITY_NEXT shows the state of the rotation.
+
+var errForcedIdentity = errors.New("identity key is forced via the Debug config")
+
+func (s *Server) identityKeyFile(f string) string {
+	return filepath.Join(s.dataDir(), f)
+}
+
+// loadNextIdentityKey loads the next identity key, and returns nil if there
+// is none.
+func (s *Server) loadNextIdentityKey() (*eddsa.PrivateKey, error) {
+	privFile := s.identityKeyFile(nextIdentityPrivateKeyFile)
+	exists, err := s.checkKeyFile(privFile)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return eddsa.Load(privFile, s.identityKeyFile(nextIdentityPublicKeyFile), rand.Reader)
+}
+
+// identityCrossSignatures returns the signature of the next identity public
+// key by the current identity key, and the signature of the current
+// identity public key by the next identity key.
+func (s *Server) identityCrossSignatures(next *eddsa.PrivateKey) (string, string) {
+	sign := func(k *eddsa.PrivateKey, pk *eddsa.PublicKey) string {
+		msg := append([]byte(identityRotationContext), pk.Bytes()...)
+		return base64.StdEncoding.EncodeToString(k.Sign(msg))
+	}
+	return sign(s.identityKey, next.PublicKey()), sign(next, s.identityKey.PublicKey())
+}
+
+func (s *Server) onMgmtIdentityNext(c *thwack.Conn, l string) error {
+	s.identityRotationLock.Lock()
+	defer s.identityRotationLock.Unlock()
+
+	next, err := s.loadNextIdentityKey()
+	if err != nil {
+		c.Log().Errorf("IDENTITY_NEXT failed to load the next key: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	if err = c.Writer().PrintfLine("%v-Current:%s", thwack.StatusOk, s.identityKey.PublicKey()); err != nil {
+		return err
+	}
+	if next != nil {
+		defer next.Reset()
+		if err = s.writeIdentityNext(c, next); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) writeIdentityNext(c *thwack.Conn, next *eddsa.PrivateKey) error {
+	curSig, nextSig := s.identityCrossSignatures(next)
+	if err := c.Writer().PrintfLine("%v-Next:%s", thwack.StatusOk, next.PublicKey()); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-CurrentSignature:%v", thwack.StatusOk, curSig); err != nil {
+		return err
+	}
+	return c.Writer().PrintfLine("%v-NextSignature:%v", thwack.StatusOk, nextSig)
+}
+
+func (s *Server) onMgmtIdentityNextGenerate(c *thwack.Conn, l string) error {
+	if s.cfg.Debug.ForceIdentityKey != "" {
+		c.Log().Errorf("IDENTITY_NEXT_GENERATE failed: %v", errForcedIdentity)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.identityRotationLock.Lock()
+	defer s.identityRotationLock.Unlock()
+
+	privFile := s.identityKeyFile(nextIdentityPrivateKeyFile)
+	if exists, err := s.checkKeyFile(privFile); err != nil || exists {
+		c.Log().Errorf("IDENTITY_NEXT_GENERATE next key already exists: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	next, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		c.Log().Errorf("IDENTITY_NEXT_GENERATE failed to generate key: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	defer next.Reset()
+	b := next.Bytes()
+	defer utils.ExplicitBzero(b)
+	if err = writePEMFile(privFile, identityPrivateKeyType, b, 0600); err != nil {
+		c.Log().Errorf("IDENTITY_NEXT_GENERATE failed to write key: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	if err = writePEMFile(s.identityKeyFile(nextIdentityPublicKeyFile), identityPublicKeyType, next.PublicKey().Bytes(), 0644); err != nil {
+		c.Log().Errorf("IDENTITY_NEXT_GENERATE failed to write public key: %v", err)
+		os.Remove(privFile)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.log.Noticef("Generated the next identity key: %s", next.PublicKey())
+
+	if err = s.writeIdentityNext(c, next); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtIdentityNextCommit(c *thwack.Conn, l string) error {
+	if s.cfg.Debug.ForceIdentityKey != "" {
+		c.Log().Errorf("IDENTITY_NEXT_COMMIT failed: %v", errForcedIdentity)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.identityRotationLock.Lock()
+	defer s.identityRotationLock.Unlock()
+
+	next, err := s.loadNextIdentityKey()
+	if err != nil || next == nil {
+		c.Log().Errorf("IDENTITY_NEXT_COMMIT failed to load the next key: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	nextPk := next.PublicKey().String()
+	next.Reset()
+
+	// Each rename is atomic, and the current private key is moved out of
+	// the way only after its public key, so that an interrupted commit is
+	// easy to recover from by hand.
+	renames := []struct{ from, to string }{
+		{identityPublicKeyFile, previousIdentityPublicKeyFile},
+		{identityPrivateKeyFile, previousIdentityPrivateKeyFile},
+		{nextIdentityPublicKeyFile, identityPublicKeyFile},
+		{nextIdentityPrivateKeyFile, identityPrivateKeyFile},
+	}
+	for _, r := range renames {
+		if err = os.Rename(s.identityKeyFile(r.from), s.identityKeyFile(r.to)); err != nil {
+			c.Log().Errorf("IDENTITY_NEXT_COMMIT failed to rename '%v': %v", r.from, err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+	}
+	s.log.Warningf("Committed the next identity key: %s, it will be used once the server is restarted.", nextPk)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtIdentityNextAbort(c *thwack.Conn, l string) error {
+	s.identityRotationLock.Lock()
+	defer s.identityRotationLock.Unlock()
+
+	for _, f := range []string{nextIdentityPrivateKeyFile, nextIdentityPublicKeyFile} {
+		if err := os.Remove(s.identityKeyFile(f)); err != nil && !os.IsNotExist(err) {
+			c.Log().Errorf("IDENTITY_NEXT_ABORT failed to remove '%v': %v", f, err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+	}
+	s.log.Noticef("Discarded the next identity key.")
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) registerIdentityRotationCommands() {
+	const (
+		cmdIdentityNext         = "IDENTITY_NEXT"
+		cmdIdentityNextGenerate = "IDENTITY_NEXT_GENERATE"
+		cmdIdentityNextCommit   = "IDENTITY_NEXT_COMMIT"
+		cmdIdentityNextAbort    = "IDENTITY_NEXT_ABORT"
+	)
+	s.management.RegisterCommand(cmdIdentityNext, s.onMgmtIdentityNext)
+	s.management.RegisterCommand(cmdIdentityNextGenerate, s.onMgmtIdentityNextGenerate)
+	s.management.RegisterCommand(cmdIdentityNextCommit, s.onMgmtIdentityNextCommit)
+	s.management.RegisterCommand(cmdIdentityNextAbort, s.onMgmtIdentityNextAbort)
+}
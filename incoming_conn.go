@@ -18,6 +18,7 @@ package server
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
 	"math"
 	"net"
@@ -28,14 +29,20 @@ import (
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/sphinx"
-	"github.com/katzenpost/core/utils"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/wire/commands"
+	"github.com/katzenpost/server/internal/tokenbucket"
+	"github.com/katzenpost/server/spool"
 	"github.com/op/go-logging"
 )
 
 var incomingConnID uint64
 
+// errMisSizedEntry is the error returned when a spool retrieval fails due to
+// the entry not fitting in a retrieval response.
+var errMisSizedEntry = errors.New("provider: stored spool entry is mis-sized")
+
 type incomingConn struct {
 	s   *Server
 	l   *listener
@@ -50,10 +57,37 @@ type incomingConn struct {
 	fromClient    bool
 	fromMix       bool
 	canSend       bool
+	authFailed    bool
+	isCounted     bool
+	countedAsMix  bool
+
+	stats  *peerCounters
+	peerID *[sConstants.NodeIDLength]byte
+
+	lastKeepAliveAck time.Time
+
+	sendRate  int
+	sendLimit *tokenbucket.Bucket
 }
 
 func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
-	if c.s.provider != nil && !c.fromMix {
+	isValid := c.isPeerValid(creds)
+	if !isValid {
+		c.authFailed = true
+	}
+	return isValid
+}
+
+func (c *incomingConn) isPeerValid(creds *wire.PeerCredentials) bool {
+	if c.l.isTrusted {
+		// Peers connected via the trusted (unix domain socket) listener
+		// are treated as mixes that are always allowed to send.
+		c.fromMix = true
+		c.canSend = true
+		return true
+	}
+
+	if c.s.provider != nil && !c.fromMix && !c.l.mixesOnly {
 		isClient := c.s.provider.authenticateClient(creds)
 		if !isClient && c.fromClient {
 			// This used to be a client, but is no longer listed in
@@ -61,9 +95,21 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 			c.canSend = false
 			return false
 		} else if isClient {
+			if c.s.provider.abuse.isBanned(creds.AdditionalData) {
+				c.log.Debugf("Authenticate failed: User: '%v' (Banned)", c.s.logRedactor.user(creds.AdditionalData))
+				c.canSend = false
+				return false
+			}
+
 			// Ok this is a connection from a client.
 			c.fromClient = true
-			c.canSend = true // Clients can always send for now.
+			c.canSend = true // Clients can always send, subject to the tier.
+			if rate := c.s.provider.sendRate(creds.AdditionalData); rate != c.sendRate {
+				c.sendRate, c.sendLimit = rate, nil
+				if rate > 0 {
+					c.sendLimit = tokenbucket.New(float64(rate), 2*float64(rate))
+				}
+			}
 			return true
 		}
 
@@ -73,13 +119,17 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 	// Well, the peer has to be a mix since we're not a provider, or the user
 	// is unknown.
 	c.fromClient = false
+	if c.l.clientsOnly {
+		c.log.Debugf("Authenticate failed: '%v' (Not a client)", c.s.logRedactor.user(creds.AdditionalData))
+		return false
+	}
 	isValid := false
 	_, c.canSend, isValid = c.s.pki.authenticateConnection(creds, false)
 	if isValid {
 		c.fromMix = true
 	}
 	if !isValid {
-		c.log.Debugf("Authenticate failed: '%v' (%v)", bytesToPrintString(creds.AdditionalData), creds.PublicKey)
+		c.log.Debugf("Authenticate failed: '%v' (%v)", c.s.logRedactor.user(creds.AdditionalData), creds.PublicKey)
 	}
 	return isValid
 }
@@ -88,6 +138,12 @@ func (c *incomingConn) worker() {
 	defer func() {
 		c.log.Debugf("Closing.")
 		c.c.Close()
+		if c.isCounted {
+			c.s.connLimiter.onClosedAuthenticated(c.countedAsMix)
+			if c.peerID != nil {
+				c.s.emitPeerEvent(EventPeerDisconnected, c.peerID, false)
+			}
+		}
 		c.l.onClosedConn(c) // Remove from the connection list.
 	}()
 
@@ -108,35 +164,100 @@ func (c *incomingConn) worker() {
 
 	// Bind the session to the conn, handshake, authenticate.
 	timeoutMs := time.Duration(c.s.cfg.Debug.HandshakeTimeout) * time.Millisecond
-	c.c.SetDeadline(time.Now().Add(timeoutMs))
+	handshakeDeadline := time.Now().Add(timeoutMs)
+	c.c.SetDeadline(handshakeDeadline)
+	remoteAddr := c.c.RemoteAddr()
+	if c.l.transport != nil {
+		conn, err := c.l.transport.WrapServer(c.c)
+		if err != nil {
+			c.log.Errorf("Transport handshake failed: %v", err)
+			c.s.connLimiter.onHandshakeFailed(!time.Now().Before(handshakeDeadline), false)
+			if isPeerFault(err) {
+				c.s.peerBans.onMisbehavior(remoteAddr, misbehaviorHandshake)
+			}
+			return
+		}
+		c.c = conn
+	}
+	if c.l.network == networkTCP && c.s.linkTLSConfig != nil {
+		// Transparently handle peers that wrap the link in TLS.
+		conn, err := acceptLinkTLS(c.c, c.s.linkTLSConfig)
+		if err != nil {
+			c.log.Errorf("Handshake failed: %v", err)
+			c.s.connLimiter.onHandshakeFailed(!time.Now().Before(handshakeDeadline), false)
+			if isPeerFault(err) {
+				c.s.peerBans.onMisbehavior(remoteAddr, misbehaviorHandshake)
+			}
+			return
+		}
+		c.c = conn
+	}
 	if err = c.w.Initialize(c.c); err != nil {
 		c.log.Errorf("Handshake failed: %v", err)
+		c.s.connLimiter.onHandshakeFailed(!time.Now().Before(handshakeDeadline), c.authFailed)
+		if c.authFailed || isPeerFault(err) {
+			// Only cryptographic and protocol failures count against the
+			// peer, not the network dropping the connection.
+			c.s.peerBans.onMisbehavior(remoteAddr, misbehaviorHandshake)
+		}
 		return
 	}
 	c.log.Debugf("Handshake completed.")
+
+	// The peer is authenticated, but to avoid sockets being held open
+	// indefinitely, it has a limited amount of time to send the first
+	// command.  The deadline is cleared by the reader after that.
+	firstCmdTimeout := time.Duration(c.s.cfg.Debug.FirstCommandTimeout) * time.Millisecond
+	firstCmdDeadline := time.Now().Add(firstCmdTimeout)
 	c.c.SetDeadline(time.Time{})
+	c.c.SetReadDeadline(firstCmdDeadline)
 	c.l.onInitializedConn(c)
 
 	// Log the connection source.
 	creds := c.w.PeerCredentials()
 	if c.fromMix {
 		c.log.Debugf("Peer: '%v' (%v)", bytesToPrintString(creds.AdditionalData), creds.PublicKey)
+		if len(creds.AdditionalData) == sConstants.NodeIDLength {
+			c.peerID = new([sConstants.NodeIDLength]byte)
+			copy(c.peerID[:], creds.AdditionalData)
+			c.stats = c.s.peerStats.get(c.peerID)
+		}
 	} else {
-		c.log.Debugf("User: '%v', Key: '%v'", utils.ASCIIBytesToPrintString(creds.AdditionalData), creds.PublicKey)
+		c.log.Debugf("User: '%v', Key: '%v'", c.s.logRedactor.user(creds.AdditionalData), creds.PublicKey)
 	}
 
-	// Ensure that there's only one incoming conn from any given peer, though
-	// this only really matters for user sessions.  The easiest thing to do
-	// is "oldest connection wins" since that doesn't require one connection
-	// closing another.
+	// Ensure that there's only one incoming conn from any given client, and
+	// that mixes do not exceed the number of parallel links that they are
+	// allowed.  The easiest thing to do is "oldest connection wins" since
+	// that doesn't require one connection closing another.
 	//
 	// TODO: Newest connection wins is more annoying to implement, but better
 	// behavior.
-	for _, s := range c.s.listeners {
-		if !s.isConnUnique(c) {
-			c.log.Errorf("Connection with credentials already exists.")
-			return
+	maxConns := 1
+	if c.fromMix {
+		maxConns = c.s.cfg.Debug.MaxIncomingLinks
+	}
+	nConns := 0
+	if !c.l.isTrusted {
+		c.s.listenersLock.RLock()
+		for _, s := range c.s.listeners {
+			nConns += s.countDuplicateConns(c)
 		}
+		c.s.listenersLock.RUnlock()
+	}
+	if nConns >= maxConns {
+		c.log.Errorf("Connection with credentials already exists.")
+		c.s.connLimiter.onDuplicate()
+		return
+	}
+	if !c.fromMix && !c.l.isTrusted && !c.s.connLimiter.admitClient() {
+		c.log.Debugf("Rejecting client connection, overloaded.")
+		return
+	}
+	c.isCounted, c.countedAsMix = true, c.fromMix
+	c.s.connLimiter.onAuthenticated(c.countedAsMix)
+	if c.peerID != nil {
+		c.s.emitPeerEvent(EventPeerConnected, c.peerID, false)
 	}
 
 	// Start the reauthenticate ticker.
@@ -149,13 +270,27 @@ func (c *incomingConn) worker() {
 	commandCloseCh := make(chan interface{})
 	defer close(commandCloseCh)
 	go func() {
+		defer c.s.handlePanic("incoming connection reader")
 		defer close(commandCh)
+		gotFirstCmd := false
 		for {
 			rawCmd, err := c.w.RecvCommand()
 			if err != nil {
 				c.log.Debugf("Failed to receive command: %v", err)
+				if !gotFirstCmd && !time.Now().Before(firstCmdDeadline) {
+					c.s.connLimiter.onFirstCommandTimeout()
+				}
+				if isPeerFault(err) {
+					// Not a disconnect, so the frame failed to decrypt
+					// or parse.
+					c.s.peerBans.onMisbehavior(remoteAddr, misbehaviorFraming)
+				}
 				return
 			}
+			if !gotFirstCmd {
+				gotFirstCmd = true
+				c.c.SetReadDeadline(time.Time{})
+			}
 			select {
 			case commandCh <- rawCmd:
 			case <-commandCloseCh:
@@ -166,6 +301,22 @@ func (c *incomingConn) worker() {
 		}
 	}()
 
+	// Start the client link padding timer if enabled.  Only the gaps
+	// between replies are padded, so the timer is restarted every time
+	// something is sent.
+	var padTimer *time.Timer
+	var padCh <-chan time.Time
+	padIval := float64(c.s.cfg.Debug.ClientPaddingInterval) * float64(time.Millisecond)
+	mRand := rand.NewMath()
+	nextPad := func() time.Duration {
+		return time.Duration(mRand.ExpFloat64() * padIval)
+	}
+	if c.fromClient && padIval > 0 {
+		padTimer = time.NewTimer(nextPad())
+		defer padTimer.Stop()
+		padCh = padTimer.C
+	}
+
 	// Process incoming packets.
 	for {
 		var rawCmd commands.Command
@@ -175,6 +326,13 @@ func (c *incomingConn) worker() {
 		case <-c.l.closeAllCh:
 			// Server is getting shutdown, all connections are being closed.
 			return
+		case <-padCh:
+			if err := c.w.SendCommand(&commands.NoOp{}); err != nil {
+				c.log.Debugf("Failed to send padding: %v", err)
+				return
+			}
+			padTimer.Reset(nextPad())
+			continue
 		case <-reauth.C:
 			// Each incoming conn has a periodic 1/15 Hz timer to wake up
 			// and re-authenticate the connection to handle the PKI document(s)
@@ -207,12 +365,24 @@ func (c *incomingConn) worker() {
 		if c.fromClient {
 			// The only command specific to a client is RetreiveMessage.
 			if retrCmd, ok := rawCmd.(*commands.RetrieveMessage); ok {
+				if !c.throttlePoll() {
+					return
+				}
 				if err := c.onRetrieveMessage(retrCmd); err != nil {
 					c.log.Debugf("Failed to handle RetreiveMessage: %v", err)
 					return
 				}
+				if padTimer != nil {
+					if !padTimer.Stop() {
+						<-padTimer.C
+					}
+					padTimer.Reset(nextPad())
+				}
 				continue
 			}
+			if _, ok := rawCmd.(*commands.SendPacket); ok && !c.throttleSend() {
+				return
+			}
 		}
 
 		// Handle all of the common commands.
@@ -228,22 +398,113 @@ func (c *incomingConn) worker() {
 func (c *incomingConn) onMixCommand(rawCmd commands.Command) bool {
 	switch cmd := rawCmd.(type) {
 	case *commands.NoOp:
-		c.log.Debugf("Received NoOp from peer.")
+		if c.fromMix && c.isKeepAlive() {
+			// Mixes use NoOps as link keepalives, so respond in kind.
+			if err := c.w.SendCommand(&commands.NoOp{}); err != nil {
+				c.log.Debugf("Failed to respond to keepalive: %v", err)
+				return false
+			}
+		}
 		return true
 	case *commands.SendPacket:
+		if c.fromMix && isPaddingPacket(cmd.SphinxPacket) {
+			// Dummy packets sent by peers in constant-rate padding mode
+			// are discarded without any processing.
+			return true
+		}
 		err := c.onSendPacket(cmd)
 		if err == nil {
 			return true
 		}
 		c.log.Debugf("Failed to handle SendPacket: %v", err)
+		c.onClientAbuse(abuseMalformedCommand)
+		c.onMixMisbehavior()
 	case *commands.Disconnect:
 		c.log.Debugf("Received disconnect from peer.")
 	default:
 		c.log.Debugf("Received unexpected command: %t", cmd)
+		c.onClientAbuse(abuseMalformedCommand)
+		c.onMixMisbehavior()
 	}
 	return false
 }
 
+// isKeepAlive returns true iff a NoOp received from a mix should be treated
+// as a keepalive and responded to.  Peers only send keepalives on links that
+// have been idle for LinkKeepAliveInterval, so at most one response is sent
+// per half of the interval, so that a peer can not use NoOps to generate an
+// arbitrary amount of reverse traffic.
+func (c *incomingConn) isKeepAlive() bool {
+	minInterval := time.Duration(c.s.cfg.Debug.LinkKeepAliveInterval) * time.Millisecond / 2
+	now := time.Now()
+	if now.Sub(c.lastKeepAliveAck) < minInterval {
+		return false
+	}
+	c.lastKeepAliveAck = now
+	return true
+}
+
+// onClientAbuse records misbehavior by the peer iff it is a client, and
+// returns true iff the client is now banned.
+func (c *incomingConn) onClientAbuse(kind abuseKind) bool {
+	if !c.fromClient {
+		return false
+	}
+	return c.s.provider.abuse.onAbuse(c.w.PeerCredentials().AdditionalData, kind)
+}
+
+// onMixMisbehavior records a protocol violation by the peer iff it is a mix.
+// Clients are accounted for by the provider's abuse tracker instead.
+func (c *incomingConn) onMixMisbehavior() {
+	if c.fromMix && !c.l.isTrusted {
+		c.s.peerBans.onMisbehavior(c.c.RemoteAddr(), misbehaviorProtocol)
+	}
+}
+
+// throttlePoll accounts for a client's spool retrieval, delaying it if the
+// client is polling excessively and throttling is enabled.  It returns false
+// iff the connection should be closed.
+func (c *incomingConn) throttlePoll() bool {
+	delay, isBanned := c.s.provider.abuse.onPoll(c.w.PeerCredentials().AdditionalData)
+	if isBanned {
+		c.log.Debugf("Disconnecting, client banned.")
+		return false
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.l.closeAllCh:
+		return false
+	}
+}
+
+// throttleSend delays a client's packet if the client is sending faster than
+// the tier allows.  It returns false iff the connection should be closed.
+func (c *incomingConn) throttleSend() bool {
+	if c.sendLimit == nil {
+		return true
+	}
+	delay := c.sendLimit.Take(1)
+	if delay <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.l.closeAllCh:
+		return false
+	}
+}
+
 func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 	advance := false
 	switch cmd.Sequence {
@@ -254,11 +515,22 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 		c.retrSeq++ // Advance the sequence number.
 		advance = true
 	default:
+		c.onClientAbuse(abuseProtocolViolation)
 		return fmt.Errorf("provider: RetrieveMessage out of sequence: %d", cmd.Sequence)
 	}
 
 	// Get the message from the user's spool, advancing as appropriate.
-	msg, surbID, remaining, err := c.s.provider.spool.Get(c.w.PeerCredentials().AdditionalData, advance)
+	u := c.w.PeerCredentials().AdditionalData
+	msg, surbID, remaining, err := c.s.provider.spool.Get(u, advance)
+	for err == spool.ErrUndecryptable {
+		// The entry can never be returned, discard it so that it does not
+		// block the rest of the spool.  A missing master key is not such a
+		// case, and is left to fail the request, as the spool refuses to
+		// open without the key it was encrypted with.
+		c.log.Warningf("Discarding undecryptable spool entry: User: '%v' (%v)", c.s.logRedactor.user(u), err)
+		c.s.accounting.onDrop(dropUndecryptable)
+		msg, surbID, remaining, err = c.s.provider.spool.Get(u, true)
+	}
 	if err != nil {
 		return err
 	}
@@ -280,7 +552,7 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 		respCmd = surbCmd
 
 		if len(msg) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
-			return fmt.Errorf("stored SURBReply payload is mis-sized: %v", len(msg))
+			return c.onMisSizedEntry(u, len(msg))
 		}
 	} else if msg != nil {
 		// This was a message.
@@ -290,7 +562,7 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 			Payload:       msg,
 		}
 		if len(msg) != constants.UserForwardPayloadLength {
-			return fmt.Errorf("stored user payload is mis-sized: %v", len(msg))
+			return c.onMisSizedEntry(u, len(msg))
 		}
 	} else {
 		// Queue must be empty.
@@ -305,11 +577,43 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 	return c.w.SendCommand(respCmd)
 }
 
+// onMisSizedEntry handles the head of the user u's spool being of a size
+// that can not be sent in a retrieval response, as the responses are fixed
+// size.  The entry is discarded so that it does not block the rest of the
+// spool, and the client is sent a Disconnect, as the wire protocol has no
+// other way to signal an error.  The client's next session resumes at the
+// following entry.
+func (c *incomingConn) onMisSizedEntry(u []byte, sz int) error {
+	c.log.Warningf("Discarding mis-sized spool entry: User: '%v' (%v bytes)", c.s.logRedactor.user(u), sz)
+	c.s.accounting.onDrop(dropMisSized)
+	if _, _, _, err := c.s.provider.spool.Get(u, true); err != nil {
+		c.log.Errorf("Failed to discard mis-sized spool entry: %v", err)
+	}
+	if err := c.w.SendCommand(&commands.Disconnect{}); err != nil {
+		c.log.Debugf("Failed to send Disconnect: %v", err)
+	}
+	return errMisSizedEntry
+}
+
 func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	pkt := newPacket()
 	if err := pkt.copyToRaw(cmd.SphinxPacket); err != nil {
 		return err
 	}
+	if c.stats != nil {
+		c.stats.onReceived(len(cmd.SphinxPacket))
+		pkt.srcStats = c.stats
+	}
+	c.s.accounting.onReceived(len(cmd.SphinxPacket))
+	if c.s.attackDetector != nil {
+		c.s.attackDetector.onInbound()
+	}
+	c.s.tracer.sample(pkt)
+	if c.peerID != nil {
+		pkt.trace("receive", "from mix %v", nodeIDToPrintString(c.peerID))
+	} else {
+		pkt.trace("receive", "from client")
+	}
 
 	// Providers need to track packets received from other mixes vs
 	// packets received from clients, avoid attempts by the final layer
@@ -318,8 +622,8 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	pkt.mustForward = c.fromClient
 	pkt.mustTerminate = c.s.cfg.Server.IsProvider && !c.fromClient
 
-	// TODO: If clients should be rate-limited in how fast they can send
-	// packets, this is probably the natural place to do so.
+	// Note: Clients are rate-limited per service tier by the caller, see
+	// throttleSend.
 
 	c.log.Debugf("Handing off packet: %v", pkt.id)
 
@@ -338,9 +642,9 @@ func newIncomingConn(l *listener, conn net.Conn) *incomingConn {
 	c.l = l
 	c.c = conn
 	c.id = atomic.AddUint64(&incomingConnID, 1) // Diagnostic only, wrapping is fine.
-	c.log = l.s.logBackend.GetLogger(fmt.Sprintf("incoming:%d", c.id))
+	c.log = l.s.newLogger(fmt.Sprintf("incoming:%d", c.id))
 
-	c.log.Debugf("New incoming connection: %v", conn.RemoteAddr())
+	c.log.Debugf("New incoming connection: %v", c.s.logRedactor.addr(conn.RemoteAddr()))
 
 	// Note: Unlike most other things, this does not spawn the worker here,
 	// because the worker needs to be spawned after the struct is added to
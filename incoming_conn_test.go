@@ -0,0 +1,127 @@
+// incoming_conn_test.go - Katzenpost server incoming connection tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/tokenbucket"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingTransport is a Transport that always fails the handshake.
+type failingTransport struct{}
+
+func (t *failingTransport) WrapServer(conn net.Conn) (net.Conn, error) {
+	return nil, errors.New("failingTransport: handshake failed")
+}
+
+func (t *failingTransport) WrapClient(conn net.Conn, peer *cpki.MixDescriptor) (net.Conn, error) {
+	return nil, errors.New("failingTransport: handshake failed")
+}
+
+func newTestIncomingServer(t *testing.T) *Server {
+	s := &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				HandshakeTimeout:      1000,
+				MaxIncomingConns:      16,
+				MaxIncomingConnsPerIP: 16,
+			},
+		},
+		logRedactor: new(logRedactor),
+	}
+
+	var err error
+	s.identityKey, err = eddsa.NewKeypair(rand.Reader)
+	require.NoError(t, err, "eddsa.NewKeypair()")
+	s.linkKey, err = ecdh.NewKeypair(rand.Reader)
+	require.NoError(t, err, "ecdh.NewKeypair()")
+
+	s.connLimiter = &connLimiter{
+		s:     s,
+		log:   logging.MustGetLogger("connlimit"),
+		rate:  tokenbucket.New(1000, 1000),
+		perIP: make(map[string]int),
+	}
+	s.peerBans = &peerBans{
+		s:     s,
+		log:   logging.MustGetLogger("peerbans"),
+		peers: make(map[string]*peerBanRecord),
+	}
+	return s
+}
+
+// runTestIncomingConn accepts a connection from a peer that closes it
+// right away, and runs the connection's worker to completion.
+func runTestIncomingConn(t *testing.T, s *Server, l *listener) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "net.Listen()")
+	defer nl.Close()
+
+	peer, err := net.Dial("tcp", nl.Addr().String())
+	require.NoError(err, "net.Dial()")
+	peer.Close()
+	conn, err := nl.Accept()
+	require.NoError(err, "Accept()")
+	require.NoError(s.connLimiter.admit(conn.RemoteAddr()), "admit()")
+
+	l.s = s
+	l.network = networkTCP
+	l.conns = list.New()
+	l.log = logging.MustGetLogger("listener")
+	c := &incomingConn{
+		s:   s,
+		l:   l,
+		c:   conn,
+		log: logging.MustGetLogger("incoming"),
+	}
+	l.closeAllWg.Add(1)
+	c.e = l.conns.PushFront(c)
+
+	// The connection must be released, even though the handshake never
+	// got started.
+	assert.NotPanics(c.worker, "worker()")
+	assert.Zero(l.conns.Len(), "Listener connections")
+	assert.Zero(s.connLimiter.total, "Admitted connections")
+	assert.Empty(s.connLimiter.perIP, "Admitted connections per IP")
+}
+
+func TestIncomingConnClosedBeforeLinkTLS(t *testing.T) {
+	s := newTestIncomingServer(t)
+	s.linkTLSConfig = new(tls.Config)
+	runTestIncomingConn(t, s, new(listener))
+}
+
+func TestIncomingConnTransportFailed(t *testing.T) {
+	s := newTestIncomingServer(t)
+	runTestIncomingConn(t, s, &listener{transport: new(failingTransport)})
+}
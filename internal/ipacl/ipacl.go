@@ -0,0 +1,75 @@
+// ipacl.go - IP address access control lists.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ipacl provides IP address based access control lists.
+package ipacl
+
+import (
+	"fmt"
+	"net"
+)
+
+// ACL is an IP address based access control list.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowed returns true iff the ACL allows ip.  Denied networks take
+// precedence over allowed networks, and an empty allow list allows every
+// address that is not explicitly denied.
+func (a *ACL) IsAllowed(ip net.IP) bool {
+	if contains(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || contains(a.allow, ip)
+}
+
+func parseCIDRs(v []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(v))
+	for _, s := range v {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("ipacl: invalid network '%v': %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// New returns a new ACL from the allowed and denied networks in CIDR
+// notation.
+func New(allow, deny []string) (*ACL, error) {
+	var err error
+
+	a := new(ACL)
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
@@ -0,0 +1,49 @@
+// ipacl_test.go - IP address access control list tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ipacl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	_, err := New([]string{"10.0.0.1"}, nil)
+	assert.Error(err, "New(): not CIDR")
+
+	a, err := New(nil, nil)
+	require.NoError(err, "New(): empty")
+	assert.True(a.IsAllowed(net.ParseIP("192.0.2.1")), "IsAllowed(): empty")
+
+	a, err = New([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16"})
+	require.NoError(err, "New()")
+	assert.True(a.IsAllowed(net.ParseIP("10.0.0.1")), "IsAllowed(): allowed v4")
+	assert.True(a.IsAllowed(net.ParseIP("2001:db8::1")), "IsAllowed(): allowed v6")
+	assert.False(a.IsAllowed(net.ParseIP("10.1.0.1")), "IsAllowed(): denied")
+	assert.False(a.IsAllowed(net.ParseIP("192.0.2.1")), "IsAllowed(): not allowed")
+
+	a, err = New(nil, []string{"192.0.2.0/24"})
+	require.NoError(err, "New(): deny only")
+	assert.False(a.IsAllowed(net.ParseIP("192.0.2.1")), "IsAllowed(): deny only, denied")
+	assert.True(a.IsAllowed(net.ParseIP("198.51.100.1")), "IsAllowed(): deny only, allowed")
+}
@@ -0,0 +1,72 @@
+// logrotate.go - Log file rotation.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package logrotate implements log file rotation.
+package logrotate
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func backupName(f string, n int) string {
+	return fmt.Sprintf("%s.%d", f, n)
+}
+
+// Rotate rotates the log file f, retaining at most keep old logs named
+// f.1 (most recent) through f.keep.
+//
+// Since the log file is held open by the logging backend, the rotation is
+// done by copying the contents and truncating the file in place, which
+// requires that the file is opened with O_APPEND.  Anything written between
+// the copy and the truncation is lost.
+func Rotate(f string, keep int) error {
+	if keep > 0 {
+		// Shift the existing old logs, discarding the oldest.
+		if err := os.Remove(backupName(f, keep)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := keep - 1; i > 0; i-- {
+			if err := os.Rename(backupName(f, i), backupName(f, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := copyFile(f, backupName(f, 1)); err != nil {
+			return err
+		}
+	}
+	return os.Truncate(f, 0)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,70 @@
+// logrotate_test.go - Log file rotation tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logrotate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "logrotate_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	f := filepath.Join(tmpDir, "katzenpost.log")
+	w, err := os.OpenFile(f, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	require.NoError(err, "OpenFile()")
+	defer w.Close()
+
+	readFile := func(f string) string {
+		b, err := ioutil.ReadFile(f)
+		require.NoError(err, "ReadFile(%v)", f)
+		return string(b)
+	}
+
+	for _, s := range []string{"first", "second", "third"} {
+		_, err = w.WriteString(s)
+		require.NoError(err, "WriteString(%v)", s)
+		err = Rotate(f, 2)
+		require.NoError(err, "Rotate(): %v", s)
+		assert.Equal("", readFile(f), "Truncated log: %v", s)
+	}
+	assert.Equal("third", readFile(backupName(f, 1)), "Most recent old log")
+	assert.Equal("second", readFile(backupName(f, 2)), "Oldest old log")
+	_, err = os.Lstat(backupName(f, 3))
+	assert.True(os.IsNotExist(err), "Excess old log discarded")
+
+	// Writes after the rotation go to the start of the truncated file.
+	_, err = w.WriteString("fourth")
+	require.NoError(err, "WriteString(fourth)")
+	assert.Equal("fourth", readFile(f), "Log after rotation")
+
+	// Rotation without retention just truncates.
+	err = Rotate(f, 0)
+	require.NoError(err, "Rotate(): no retention")
+	assert.Equal("", readFile(f), "Truncated log, no retention")
+	assert.Equal("third", readFile(backupName(f, 1)), "Old log untouched")
+}
@@ -0,0 +1,107 @@
+// journald.go - Systemd journal log sink.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultJournalSocket is the path of the systemd journal socket.
+const DefaultJournalSocket = "/run/systemd/journal/socket"
+
+// Journal is a systemd journal log sink, using the native journal protocol.
+//
+// Note: Messages are sent as a single datagram, so entries larger than the
+// socket buffer size will fail to be sent.
+type Journal struct {
+	sync.Mutex
+
+	conn       *net.UnixConn
+	identifier string
+}
+
+func appendJournalField(b *bytes.Buffer, k, v string) {
+	b.WriteString(k)
+	if !strings.ContainsRune(v, '\n') {
+		b.WriteByte('=')
+		b.WriteString(v)
+		b.WriteByte('\n')
+		return
+	}
+
+	// Values containing newlines use the binary safe serialization.
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(v)))
+	b.WriteByte('\n')
+	b.Write(l[:])
+	b.WriteString(v)
+	b.WriteByte('\n')
+}
+
+func encodeJournalEntry(fields map[string]string) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		appendJournalField(&b, k, fields[k])
+	}
+	return b.Bytes()
+}
+
+// Write writes a single log message with the given severity.
+func (j *Journal) Write(sev Severity, msg string) error {
+	b := encodeJournalEntry(map[string]string{
+		"MESSAGE":           msg,
+		"PRIORITY":          strconv.Itoa(int(sev)),
+		"SYSLOG_IDENTIFIER": j.identifier,
+	})
+
+	j.Lock()
+	defer j.Unlock()
+	_, err := j.conn.Write(b)
+	return err
+}
+
+// Close closes the sink.
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
+
+// NewJournal creates a new systemd journal sink, connected to the journal
+// socket at path.
+func NewJournal(path, identifier string) (*Journal, error) {
+	addr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	j := new(Journal)
+	j.conn = conn
+	j.identifier = identifier
+	return j, nil
+}
@@ -0,0 +1,66 @@
+// json.go - JSON lines log sink.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logsink
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type jsonEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+// JSON is a log sink that writes each message as a JSON object on its own
+// line, for log collectors that ingest stdout (eg: container runtimes).
+type JSON struct {
+	sync.Mutex
+
+	w io.Writer
+}
+
+// Write writes a single log message with the given severity.
+func (j *JSON) Write(sev Severity, msg string) error {
+	b, err := json.Marshal(&jsonEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   sev.String(),
+		Message: msg,
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	j.Lock()
+	defer j.Unlock()
+	_, err = j.w.Write(b)
+	return err
+}
+
+// Close closes the sink.  The underlying writer is left open.
+func (j *JSON) Close() error {
+	return nil
+}
+
+// NewJSON creates a new JSON lines sink writing to w.
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{w: w}
+}
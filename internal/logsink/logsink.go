@@ -0,0 +1,71 @@
+// logsink.go - External log sinks.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package logsink implements external log sinks (syslog and the systemd
+// journal).
+package logsink
+
+import "errors"
+
+// Severity is a syslog message severity.
+type Severity int
+
+// The syslog severities, as per RFC 5424.
+const (
+	SeverityEmergency Severity = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+// String returns the name of the severity.
+func (sev Severity) String() string {
+	switch sev {
+	case SeverityEmergency:
+		return "EMERGENCY"
+	case SeverityAlert:
+		return "ALERT"
+	case SeverityCritical:
+		return "CRITICAL"
+	case SeverityError:
+		return "ERROR"
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityNotice:
+		return "NOTICE"
+	case SeverityInfo:
+		return "INFO"
+	case SeverityDebug:
+		return "DEBUG"
+	default:
+		return "[Unknown]"
+	}
+}
+
+var errBackoff = errors.New("logsink: connection failed, backing off")
+
+// Sink is an external log sink.
+type Sink interface {
+	// Write writes a single log message with the given severity.
+	Write(sev Severity, msg string) error
+
+	// Close closes the sink.
+	Close() error
+}
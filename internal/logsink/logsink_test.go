@@ -0,0 +1,161 @@
+// logsink_test.go - External log sink tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logsink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogLocal(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "logsink_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	p := filepath.Join(tmpDir, "log")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p, Net: "unixgram"})
+	require.NoError(err, "ListenUnixgram()")
+	defer l.Close()
+
+	f, ok := Facility("daemon")
+	require.True(ok, "Facility(daemon)")
+	s, err := NewSyslog(&SyslogConfig{
+		Network:  NetworkUnix,
+		Address:  p,
+		Tag:      "katzenpost",
+		Facility: f,
+	})
+	require.NoError(err, "NewSyslog()")
+	defer s.Close()
+
+	err = s.Write(SeverityWarning, "server: hello")
+	require.NoError(err, "Write()")
+
+	var buf [1024]byte
+	n, err := l.Read(buf[:])
+	require.NoError(err, "Read()")
+	msg := string(buf[:n])
+	assert.True(strings.HasPrefix(msg, "<28>"), "Priority: %v", msg)
+	assert.True(strings.HasSuffix(msg, " katzenpost["+strconv.Itoa(os.Getpid())+"]: server: hello\n"), "Message: %v", msg)
+}
+
+func TestSyslogTCP(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen()")
+	defer l.Close()
+
+	s, err := NewSyslog(&SyslogConfig{
+		Network:  NetworkTCP,
+		Address:  l.Addr().String(),
+		Tag:      "katzenpost",
+		Facility: 16,
+	})
+	require.NoError(err, "NewSyslog()")
+	defer s.Close()
+
+	conn, err := l.Accept()
+	require.NoError(err, "Accept()")
+	defer conn.Close()
+
+	err = s.Write(SeverityError, "server: hello")
+	require.NoError(err, "Write()")
+
+	r := bufio.NewReader(conn)
+	lenStr, err := r.ReadString(' ')
+	require.NoError(err, "ReadString()")
+	n, err := strconv.Atoi(strings.TrimSpace(lenStr))
+	require.NoError(err, "Atoi()")
+	buf := make([]byte, n)
+	_, err = r.Read(buf)
+	require.NoError(err, "Read()")
+	msg := string(buf)
+	assert.True(strings.HasPrefix(msg, "<131>1 "), "Header: %v", msg)
+	assert.True(strings.HasSuffix(msg, " katzenpost "+strconv.Itoa(os.Getpid())+" - - server: hello"), "Message: %v", msg)
+}
+
+func TestJournal(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "logsink_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	p := filepath.Join(tmpDir, "journal")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p, Net: "unixgram"})
+	require.NoError(err, "ListenUnixgram()")
+	defer l.Close()
+
+	j, err := NewJournal(p, "katzenpost")
+	require.NoError(err, "NewJournal()")
+	defer j.Close()
+
+	var buf [1024]byte
+	err = j.Write(SeverityNotice, "server: hello")
+	require.NoError(err, "Write()")
+	n, err := l.Read(buf[:])
+	require.NoError(err, "Read()")
+	assert.Equal("MESSAGE=server: hello\nPRIORITY=5\nSYSLOG_IDENTIFIER=katzenpost\n", string(buf[:n]), "Entry")
+
+	err = j.Write(SeverityNotice, "a\nb")
+	require.NoError(err, "Write(): multi-line")
+	n, err = l.Read(buf[:])
+	require.NoError(err, "Read(): multi-line")
+	assert.Equal("MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\nPRIORITY=5\nSYSLOG_IDENTIFIER=katzenpost\n", string(buf[:n]), "Binary entry")
+}
+
+func TestJSON(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	j := NewJSON(&buf)
+	defer j.Close()
+
+	err := j.Write(SeverityWarning, "server: \"hello\"\nworld")
+	require.NoError(err, "Write()")
+	err = j.Write(SeverityDebug, "server: again")
+	require.NoError(err, "Write(): second")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(lines, 2, "Lines")
+	var ent map[string]string
+	err = json.Unmarshal([]byte(lines[0]), &ent)
+	require.NoError(err, "Unmarshal()")
+	assert.Equal("WARNING", ent["level"], "Level")
+	assert.Equal("server: \"hello\"\nworld", ent["msg"], "Message")
+	_, err = time.Parse(time.RFC3339Nano, ent["time"])
+	assert.NoError(err, "Time")
+}
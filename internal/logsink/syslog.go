@@ -0,0 +1,226 @@
+// syslog.go - Syslog log sink.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logsink
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// NetworkUDP is the network for a remote syslog daemon over UDP.
+	NetworkUDP = "udp"
+
+	// NetworkTCP is the network for a remote syslog daemon over TCP.
+	NetworkTCP = "tcp"
+
+	// NetworkTLS is the network for a remote syslog daemon over TLS.
+	NetworkTLS = "tls"
+
+	// NetworkUnix is the network for a local syslog daemon.
+	NetworkUnix = "unixgram"
+
+	dialTimeout   = 10 * time.Second
+	writeTimeout  = 5 * time.Second
+	retryInterval = 10 * time.Second
+)
+
+var (
+	localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+	facilities = map[string]int{
+		"kern":     0,
+		"user":     1,
+		"mail":     2,
+		"daemon":   3,
+		"auth":     4,
+		"syslog":   5,
+		"lpr":      6,
+		"news":     7,
+		"uucp":     8,
+		"cron":     9,
+		"authpriv": 10,
+		"ftp":      11,
+		"local0":   16,
+		"local1":   17,
+		"local2":   18,
+		"local3":   19,
+		"local4":   20,
+		"local5":   21,
+		"local6":   22,
+		"local7":   23,
+	}
+)
+
+// Facility returns the syslog facility code for the named facility.
+func Facility(name string) (int, bool) {
+	f, ok := facilities[name]
+	return f, ok
+}
+
+// SyslogConfig is a syslog sink configuration.
+type SyslogConfig struct {
+	// Network is one of the Network constants.  If the network is
+	// NetworkUnix and Address is empty, the well known local syslog socket
+	// paths are tried in turn.
+	Network string
+
+	// Address is the syslog daemon address.
+	Address string
+
+	// Tag is the application name attached to each message.
+	Tag string
+
+	// Facility is the syslog facility code.
+	Facility int
+
+	// TLSConfig is the TLS configuration used for NetworkTLS.
+	TLSConfig *tls.Config
+}
+
+// Syslog is a syslog log sink.  Local messages are formatted as per the
+// traditional BSD syslog format, remote messages as per RFC 5424 with
+// octet-counted framing (RFC 6587/RFC 5425) on stream transports.
+//
+// Connections are established lazily, and re-established on failure.  To
+// avoid stalling the caller when the syslog daemon is unreachable, messages
+// are dropped for a while after a failed connection attempt.
+type Syslog struct {
+	sync.Mutex
+
+	cfg      SyslogConfig
+	hostname string
+	pid      int
+
+	conn    net.Conn
+	retryAt time.Time
+}
+
+func (s *Syslog) isLocal() bool {
+	return s.cfg.Network == NetworkUnix
+}
+
+func (s *Syslog) isStream() bool {
+	return s.cfg.Network == NetworkTCP || s.cfg.Network == NetworkTLS
+}
+
+func (s *Syslog) connect() error {
+	var err error
+	switch s.cfg.Network {
+	case NetworkUnix:
+		paths := localSyslogPaths
+		if s.cfg.Address != "" {
+			paths = []string{s.cfg.Address}
+		}
+		for _, p := range paths {
+			if s.conn, err = net.DialTimeout(NetworkUnix, p, dialTimeout); err == nil {
+				return nil
+			}
+		}
+		return err
+	case NetworkTLS:
+		d := &net.Dialer{Timeout: dialTimeout}
+		s.conn, err = tls.DialWithDialer(d, NetworkTCP, s.cfg.Address, s.cfg.TLSConfig)
+		return err
+	default:
+		s.conn, err = net.DialTimeout(s.cfg.Network, s.cfg.Address, dialTimeout)
+		return err
+	}
+}
+
+func (s *Syslog) format(sev Severity, msg string) []byte {
+	pri := s.cfg.Facility<<3 | int(sev)
+	now := time.Now()
+	if s.isLocal() {
+		return []byte(fmt.Sprintf("<%d>%s %s[%d]: %s\n", pri, now.Format(time.Stamp), s.cfg.Tag, s.pid, msg))
+	}
+
+	b := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, now.Format(time.RFC3339Nano), s.hostname, s.cfg.Tag, s.pid, msg)
+	if s.isStream() {
+		b = fmt.Sprintf("%d %s", len(b), b)
+	}
+	return []byte(b)
+}
+
+// Write writes a single log message with the given severity.
+func (s *Syslog) Write(sev Severity, msg string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		if time.Now().Before(s.retryAt) {
+			return errBackoff
+		}
+		if err := s.connect(); err != nil {
+			s.conn = nil
+			s.retryAt = time.Now().Add(retryInterval)
+			return err
+		}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := s.conn.Write(s.format(sev, msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the sink.
+func (s *Syslog) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// NewSyslog creates a new syslog sink.
+func NewSyslog(cfg *SyslogConfig) (*Syslog, error) {
+	switch cfg.Network {
+	case NetworkUnix:
+	case NetworkUDP, NetworkTCP, NetworkTLS:
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("logsink: no address for network '%v'", cfg.Network)
+		}
+	default:
+		return nil, fmt.Errorf("logsink: invalid syslog network '%v'", cfg.Network)
+	}
+
+	s := new(Syslog)
+	s.cfg = *cfg
+	s.pid = os.Getpid()
+	if s.hostname, _ = os.Hostname(); s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	// Try to connect immediately, so that configuration errors are caught
+	// early.
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,56 @@
+// memlock.go - Secret memory locking.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package memlock locks memory holding secret material, so that it is never
+// written to swap, or included in core dumps.
+package memlock
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+)
+
+// ErrNotSupported is the error returned when memory locking is not
+// supported on the platform.
+var ErrNotSupported = errors.New("memlock: not supported on this platform")
+
+// pageRange returns the page aligned byte slice covering size bytes at p.
+func pageRange(p unsafe.Pointer, size uintptr) []byte {
+	pageSize := uintptr(os.Getpagesize())
+	off := uintptr(p) & (pageSize - 1)
+	n := (off + size + pageSize - 1) &^ (pageSize - 1)
+	return unsafe.Slice((*byte)(unsafe.Add(p, -int(off))), n)
+}
+
+// Lock locks the pages holding the size bytes at p in memory, and excludes
+// them from core dumps.  The pages are locked for the lifetime of the
+// process, as other objects may share them.
+//
+// Note: This is only meaningful for memory that will not be moved, such as
+// objects on the Go heap.
+func Lock(p unsafe.Pointer, size uintptr) error {
+	if size == 0 {
+		return nil
+	}
+	return lockPages(pageRange(p, size))
+}
+
+// LockAll locks all of the current and future pages of the process in
+// memory.
+func LockAll() error {
+	return lockAll()
+}
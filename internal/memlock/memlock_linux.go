@@ -0,0 +1,34 @@
+// memlock_linux.go - Secret memory locking (Linux).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package memlock
+
+import "syscall"
+
+// madvDontDump is MADV_DONTDUMP from <asm-generic/mman-common.h>, which the
+// syscall package does not define.
+const madvDontDump = 16
+
+func lockPages(b []byte) error {
+	if err := syscall.Mlock(b); err != nil {
+		return err
+	}
+	return syscall.Madvise(b, madvDontDump)
+}
+
+func lockAll() error {
+	return syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+}
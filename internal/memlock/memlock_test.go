@@ -0,0 +1,54 @@
+// memlock_test.go - Secret memory locking tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package memlock
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageRange(t *testing.T) {
+	assert := assert.New(t)
+
+	pageSize := uintptr(os.Getpagesize())
+	buf := make([]byte, 3*pageSize)
+	off := -uintptr(unsafe.Pointer(&buf[0])) & (pageSize - 1)
+	base := &buf[off]
+
+	b := pageRange(unsafe.Pointer(&buf[off+1]), 8)
+	assert.True(base == &b[0], "Start: Unaligned")
+	assert.Equal(int(pageSize), len(b), "Length: Single page")
+
+	b = pageRange(unsafe.Pointer(&buf[off+pageSize-4]), 8)
+	assert.True(base == &b[0], "Start: Straddling")
+	assert.Equal(int(2*pageSize), len(b), "Length: Straddling")
+}
+
+func TestLock(t *testing.T) {
+	require := require.New(t)
+
+	var secret [32]byte
+	err := Lock(unsafe.Pointer(&secret), unsafe.Sizeof(secret))
+	if err == ErrNotSupported {
+		t.Skip("Not supported on this platform")
+	}
+	require.NoError(err, "Lock()")
+}
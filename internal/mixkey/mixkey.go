@@ -21,12 +21,14 @@ import (
 	"crypto/sha512"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"git.schwanenlied.me/yawning/bloom.git"
 	bolt "github.com/coreos/bbolt"
@@ -34,12 +36,23 @@ import (
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/memlock"
 )
 
 const (
 	replayBucket   = "replay"
 	metadataBucket = "metadata"
 
+	versionKey = "version"
+	pkKey      = "privateKey"
+	epochKey   = "epochKey"
+
+	// lastFlushKey is the time of the most recent write-back cache flush,
+	// which is updated even if the cache was empty.
+	lastFlushKey = "lastFlush"
+
+	inspectTimeout = 1 * time.Second
+
 	writeBackInterval = 10 * time.Second
 	writeBackSize     = 4096 // TODO/perf: Tune this.
 
@@ -53,6 +66,10 @@ const (
 	// KeyFmt is the format string corresponding to filenames for keys that
 	// have been persisted to disk.
 	KeyFmt = "mixkey-%d.db"
+
+	// JournalSuffix is the suffix appended to a key's database filename to
+	// form the filename of its replay tag journal.
+	JournalSuffix = ".journal"
 )
 
 // MixKey is a Katzenpost server mix key.
@@ -67,6 +84,10 @@ type MixKey struct {
 	f         *bloom.Filter
 	writeBack map[[TagLength]byte]bool
 	flushCh   chan interface{}
+	journal   *os.File
+
+	lastFlush   time.Time
+	warmupUntil int64
 
 	refCount        int32
 	unlinkIfExpired bool
@@ -78,6 +99,40 @@ func (k *MixKey) SetUnlinkIfExpired(b bool) {
 	k.unlinkIfExpired = b
 }
 
+// Unlink immediately deletes the key's database, so that the key can not
+// be loaded again, even though it remains usable till it is closed.
+func (k *MixKey) Unlink() error {
+	return Remove(k.db.Path())
+}
+
+// EnableJournal enables the replay tag journal, which makes every tag added
+// to the write-back cache durable before IsReplay returns, so that a crash
+// can not lose the tags seen since the last flush.  This costs a fsync()
+// per new tag.
+func (k *MixKey) EnableJournal() error {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.journal != nil {
+		return nil
+	}
+	f, err := os.OpenFile(k.db.Path()+JournalSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	k.journal = f
+	return nil
+}
+
+// Remove deletes the persisted key database at path, and its replay tag
+// journal if any.
+func Remove(path string) error {
+	if err := os.Remove(path + JournalSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
+
 // PublicKey returns the public component of the key.
 func (k *MixKey) PublicKey() *ecdh.PublicKey {
 	return k.keypair.PublicKey()
@@ -93,6 +148,38 @@ func (k *MixKey) Epoch() uint64 {
 	return k.epoch
 }
 
+// LastFlush returns the time that the key's replay filter was last flushed
+// to disk as of when the key was loaded, or the zero time if the database
+// predates the timestamp being recorded.
+func (k *MixKey) LastFlush() time.Time {
+	return k.lastFlush
+}
+
+// SetWarmup marks the key as warming up until the given time, for use when
+// the key's replay filter is suspected to be missing entries, for example
+// when the database was restored from a backup.
+func (k *MixKey) SetWarmup(until time.Time) {
+	atomic.StoreInt64(&k.warmupUntil, until.UnixNano())
+}
+
+// IsWarmingUp returns true iff the key is currently warming up, and packets
+// unwrapped with it should not be trusted to not be replays.
+func (k *MixKey) IsWarmingUp() bool {
+	until := atomic.LoadInt64(&k.warmupUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// NumReplayTags returns the number of replay tags persisted to the key's
+// database, excluding the ones still in the write-back cache.
+func (k *MixKey) NumReplayTags() (int, error) {
+	n := 0
+	err := k.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte(replayBucket)).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
 // IsReplay marks a given replay tag as seen, and returns true iff the tag has
 // been seen previously (Test and Set).
 func (k *MixKey) IsReplay(rawTag []byte) bool {
@@ -168,6 +255,12 @@ func testAndSetTagDB(bkt *bolt.Bucket, tag []byte) bool {
 	return seenCount != 1
 }
 
+func putTime(bkt *bolt.Bucket, key string, t time.Time) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	return bkt.Put([]byte(key), b[:])
+}
+
 func (k *MixKey) testAndSetTagMemory(tag *[TagLength]byte) (bool, bool) {
 	k.Lock()
 	defer k.Unlock()
@@ -182,8 +275,17 @@ func (k *MixKey) testAndSetTagMemory(tag *[TagLength]byte) (bool, bool) {
 	if !k.f.TestAndSet(tag[:]) {
 		// The tag is not in the bloom filter, so by definition it is not a replay.
 
-		// Insert it into the write-back cache.
+		// Insert it into the write-back cache, journaling it first if
+		// enabled.
 		k.writeBack[*tag] = true
+		if k.journal != nil {
+			if _, err := k.journal.Write(tag[:]); err != nil {
+				panic("BUG: mixkey: Failed to append to the journal: " + err.Error())
+			}
+			if err := k.journal.Sync(); err != nil {
+				panic("BUG: mixkey: Failed to sync the journal: " + err.Error())
+			}
+		}
 		return false, true
 	}
 
@@ -210,13 +312,19 @@ func (k *MixKey) worker() {
 	}
 }
 
+// Flush immediately flushes the write-back cache to the database.
+func (k *MixKey) Flush() {
+	k.doFlush(true)
+}
+
 func (k *MixKey) doFlush(forceFlush bool) {
 	k.Lock()
 	defer k.Unlock()
 
-	// Accumulate up to writeBackSize entries.
+	// Accumulate up to writeBackSize entries.  Forced flushes happen even
+	// if the cache is empty, so that the last flush time stays current.
 	nEntries := len(k.writeBack)
-	if nEntries == 0 || (!forceFlush && nEntries < writeBackSize) {
+	if !forceFlush && nEntries < writeBackSize {
 		return
 	}
 
@@ -225,10 +333,18 @@ func (k *MixKey) doFlush(forceFlush bool) {
 		for tag := range k.writeBack {
 			testAndSetTagDB(bkt, tag[:])
 		}
-		return nil
+		return putTime(tx.Bucket([]byte(metadataBucket)), lastFlushKey, time.Now())
 	}); err != nil {
 		panic("BUG: mixkey: Failed to flush write-back cache: " + err.Error())
 	}
+
+	// The flushed tags are durable now that the transaction has committed,
+	// so the journal can be discarded.
+	if k.journal != nil && nEntries > 0 {
+		if err := k.journal.Truncate(0); err != nil {
+			panic("BUG: mixkey: Failed to truncate the journal: " + err.Error())
+		}
+	}
 	k.writeBack = make(map[[TagLength]byte]bool)
 }
 
@@ -262,6 +378,10 @@ func (k *MixKey) forceClose() {
 		k.db.Sync()
 		k.db.Close()
 		k.db = nil
+		if k.journal != nil {
+			k.journal.Close()
+			k.journal = nil
+		}
 
 		// Delete the database if the key is expired, and the owner requested
 		// full cleanup.
@@ -272,7 +392,7 @@ func (k *MixKey) forceClose() {
 			// given how many levels of indirection there are to files vs
 			// the raw physical media, and the cleanup process being slightly
 			// race prone around epoch transitions.  Use FDE.
-			os.Remove(f)
+			Remove(f)
 		}
 	}
 	if k.keypair != nil {
@@ -284,11 +404,6 @@ func (k *MixKey) forceClose() {
 // New creates (or loads) a mix key in the provided data directory, for the
 // given epoch.
 func New(dataDir string, epoch uint64) (*MixKey, error) {
-	const (
-		versionKey = "version"
-		pkKey      = "privateKey"
-		epochKey   = "epochKey"
-	)
 	var err error
 
 	// Initialize the structure and create or open the database.
@@ -307,6 +422,14 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 	k.writeBack = make(map[[TagLength]byte]bool)
 	k.flushCh = make(chan interface{}, 1)
 
+	// Load the tags journaled since the last flush, if any.
+	jf := f + JournalSuffix
+	journaled, err := readJournal(jf)
+	if err != nil {
+		k.db.Close()
+		return nil, err
+	}
+
 	didCreate := false
 	if err := k.db.Update(func(tx *bolt.Tx) error {
 		// Ensure that all the buckets exist.
@@ -354,6 +477,19 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 				return fmt.Errorf("mixkey: db epoch mismatch")
 			}
 
+			// The last flush time is optional, as older databases lack it.
+			if b = bkt.Get([]byte(lastFlushKey)); len(b) == 8 {
+				k.lastFlush = time.Unix(0, int64(binary.LittleEndian.Uint64(b)))
+			}
+
+			// Merge the journaled tags, skipping ones that made it into
+			// the database before the journal was truncated.
+			for _, tag := range journaled {
+				if replayBkt.Get(tag) == nil {
+					testAndSetTagDB(replayBkt, tag)
+				}
+			}
+
 			// Rebuild the bloom filter.
 			replayBkt.ForEach(func(tag, rawCount []byte) error {
 				k.f.TestAndSet(tag)
@@ -377,7 +513,8 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 		bkt.Put([]byte(pkKey), k.keypair.Bytes())
 		bkt.Put([]byte(epochKey), epochBytes[:])
 
-		return nil
+		k.lastFlush = time.Now()
+		return putTime(bkt, lastFlushKey, k.lastFlush)
 	}); err != nil {
 		k.db.Close()
 		return nil, err
@@ -386,8 +523,92 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 		// Flush the newly created database to disk.
 		k.db.Sync()
 	}
+	if journaled != nil {
+		// The journaled tags were committed to the database above.
+		if err = os.Remove(jf); err != nil {
+			k.db.Close()
+			return nil, err
+		}
+	}
+
+	// Keep the private key out of swap and core dumps, on a best effort
+	// basis.
+	memlock.Lock(unsafe.Pointer(k.keypair), unsafe.Sizeof(*k.keypair))
 
 	k.Go(k.worker)
 
 	return k, nil
 }
+
+// readJournal returns the tags in the replay tag journal at path, ignoring a
+// truncated trailing tag from an interrupted append.
+func readJournal(path string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tags := make([][]byte, 0, len(b)/TagLength)
+	for len(b) >= TagLength {
+		tags = append(tags, b[:TagLength])
+		b = b[TagLength:]
+	}
+	return tags, nil
+}
+
+// Info is the metadata of a persisted mix key.
+type Info struct {
+	// Epoch is the Katzenpost epoch associated with the key.
+	Epoch uint64
+
+	// PublicKey is the public component of the key.
+	PublicKey *ecdh.PublicKey
+
+	// NumReplayTags is the number of replay tags in the key's database.
+	NumReplayTags int
+}
+
+// Inspect returns the metadata of the mix key persisted in the database
+// at path, without loading the key.  Keys that are currently loaded can not
+// be inspected.
+func Inspect(path string) (*Info, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: inspectTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	info := new(Info)
+	if err = db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(metadataBucket))
+		if bkt == nil {
+			return fmt.Errorf("mixkey: db missing metadata bucket")
+		}
+		if b := bkt.Get([]byte(versionKey)); len(b) != 1 || b[0] != 0 {
+			return fmt.Errorf("mixkey: incompatible version")
+		}
+		b := bkt.Get([]byte(epochKey))
+		if len(b) != 8 {
+			return fmt.Errorf("mixkey: db corrupted entry '%v'", epochKey)
+		}
+		info.Epoch = binary.LittleEndian.Uint64(b)
+
+		// Only the public key is retained.
+		var privKey ecdh.PrivateKey
+		if err := privKey.FromBytes(bkt.Get([]byte(pkKey))); err != nil {
+			return err
+		}
+		info.PublicKey = privKey.PublicKey()
+		privKey.Reset()
+
+		if replayBkt := tx.Bucket([]byte(replayBucket)); replayBkt != nil {
+			info.NumReplayTags = replayBkt.Stats().KeyN
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -22,8 +22,12 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -43,8 +47,11 @@ func TestMixKey(t *testing.T) {
 	t.Logf("Temp Dir: %v", tmpDir)
 
 	if ok := t.Run("create", doTestCreate); ok {
+		t.Run("inspect", doTestInspect)
 		t.Run("load", doTestLoad)
 		t.Run("unlink", doTestUnlink)
+		t.Run("revoke", doTestRevoke)
+		t.Run("journal", doTestJournal)
 	} else {
 		t.Errorf("create tests failed, skipping load tests")
 	}
@@ -82,6 +89,20 @@ func doTestCreate(t *testing.T) {
 	}
 }
 
+func doTestInspect(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	info, err := Inspect(testKeyPath)
+	require.NoError(err, "Inspect()")
+	assert.Equal(uint64(testEpoch), info.Epoch, "Inspect(): Epoch")
+	assert.Equal(testKey.PublicKey(), info.PublicKey, "Inspect(): Public key")
+	assert.Equal(len(testPositiveTags), info.NumReplayTags, "Inspect(): Replay tags")
+
+	_, err = Inspect(testKeyPath + ".missing")
+	assert.Error(err, "Inspect() missing database")
+}
+
 func doTestLoad(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
@@ -94,6 +115,15 @@ func doTestLoad(t *testing.T) {
 	assert.Equal(&testKey, k.PrivateKey(), "Serialized private key")
 	assert.Equal(testKey.PublicKey(), k.PublicKey(), "Serialized public key")
 	assert.Equal(uint64(testEpoch), k.Epoch(), "Serialized epoch")
+	assert.False(k.LastFlush().IsZero(), "Serialized last flush")
+	assert.True(time.Since(k.LastFlush()) < time.Minute, "Serialized last flush: %v", k.LastFlush())
+
+	// Ensure that the warm-up deadline is honored.
+	assert.False(k.IsWarmingUp(), "IsWarmingUp() default")
+	k.SetWarmup(time.Now().Add(time.Hour))
+	assert.True(k.IsWarmingUp(), "IsWarmingUp() future")
+	k.SetWarmup(time.Now().Add(-time.Second))
+	assert.False(k.IsWarmingUp(), "IsWarmingUp() past")
 
 	// Ensure that the loaded replay filter is consistent.
 	assert.True(k.IsReplay([]byte{}), "IsReplay([]byte{})")
@@ -115,6 +145,66 @@ func doTestUnlink(t *testing.T) {
 	require.True(os.IsNotExist(err), "Database should not exist")
 }
 
+func doTestRevoke(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	k, err := New(tmpDir, testEpoch+1)
+	require.NoError(err, "New()")
+	pk := append([]byte{}, k.PublicKey().Bytes()...)
+	err = k.Unlink()
+	require.NoError(err, "Unlink()")
+	k.Deref()
+
+	// Loading the key again must create a new key.
+	k, err = New(tmpDir, testEpoch+1)
+	require.NoError(err, "New() after Unlink()")
+	defer k.Deref()
+	assert.NotEqual(pk, k.PublicKey().Bytes(), "New() after Unlink(): Public key")
+	k.Unlink()
+}
+
+func doTestJournal(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	k, err := New(tmpDir, testEpoch+2)
+	require.NoError(err, "New()")
+	f := k.db.Path()
+	k.Deref()
+
+	// Simulate a crash after journaling tags that were never flushed,
+	// with the last append interrupted.
+	var journal []byte
+	for tag := range testNegativeTags {
+		journal = append(journal, tag[:]...)
+	}
+	journal = append(journal, 0x23, 0x42)
+	err = ioutil.WriteFile(f+JournalSuffix, journal, 0600)
+	require.NoError(err, "WriteFile() journal")
+
+	k, err = New(tmpDir, testEpoch+2)
+	require.NoError(err, "New() with journal")
+	defer Remove(f)
+	defer k.Deref()
+	_, err = os.Lstat(f + JournalSuffix)
+	assert.True(os.IsNotExist(err), "Journal should be removed on load")
+	for tag := range testNegativeTags {
+		isReplay := k.IsReplay(tag[:])
+		assert.True(isReplay, "IsReplay() journaled: %v", hex.EncodeToString(tag[:]))
+	}
+
+	// Ensure that new tags are journaled.
+	err = k.EnableJournal()
+	require.NoError(err, "EnableJournal()")
+	for tag := range testPositiveTags {
+		assert.False(k.IsReplay(tag[:]), "IsReplay() new: %v", hex.EncodeToString(tag[:]))
+	}
+	fi, err := os.Stat(f + JournalSuffix)
+	require.NoError(err, "Stat() journal")
+	assert.Equal(int64(len(testPositiveTags)*TagLength), fi.Size(), "Journal size")
+}
+
 func BenchmarkMixKey(b *testing.B) {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "mixkey_benchmarks")
@@ -125,6 +215,7 @@ func BenchmarkMixKey(b *testing.B) {
 
 	b.Run("IsReplay (miss)", doBenchIsReplayMiss)
 	b.Run("IsReplay (hit)", doBenchIsReplayHit)
+	b.Run("Unwrap", doBenchUnwrap)
 }
 
 func doBenchIsReplayMiss(b *testing.B) {
@@ -180,6 +271,43 @@ func doBenchIsReplayHit(b *testing.B) {
 	}
 }
 
+func doBenchUnwrap(b *testing.B) {
+	k, err := New(tmpDir, testEpoch)
+	if err != nil {
+		b.Fatalf("Failed to open key: %v", err)
+	}
+	k.SetUnlinkIfExpired(true)
+	defer k.Deref()
+
+	// Build a packet with this key as the first hop, as the crypto workers
+	// would see it.
+	path := make([]*sphinx.PathHop, 2)
+	for i := range path {
+		path[i] = &sphinx.PathHop{PublicKey: k.PublicKey()}
+		rand.Read(path[i].ID[:])
+	}
+	path[0].Commands = []commands.RoutingCommand{&commands.NodeDelay{Delay: 0x10}}
+	path[1].Commands = []commands.RoutingCommand{new(commands.Recipient)}
+	var payload [constants.ForwardPayloadLength]byte
+	pkt, err := sphinx.NewPacket(rand.Reader, path, payload[:])
+	if err != nil {
+		b.Fatalf("Failed to create packet: %v", err)
+	}
+	raw := make([]byte, len(pkt))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Unwrap() operates in place, so start from a fresh copy.
+		b.StopTimer()
+		copy(raw, pkt)
+		b.StartTimer()
+
+		if _, _, _, err = sphinx.Unwrap(k.PrivateKey(), raw); err != nil {
+			b.Fatalf("Failed to unwrap packet: %v", err)
+		}
+	}
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "mixkey_tests")
@@ -0,0 +1,171 @@
+// natpmp.go - NAT-PMP client.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package natpmp implements a minimal NAT Port Mapping Protocol (RFC 6886)
+// client, sufficient to discover the external address of a NAT gateway, and
+// to map TCP ports through it.
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// Port is the UDP port that NAT-PMP gateways listen on.
+	Port = 5351
+
+	version = 0
+
+	opExternalAddress = 0
+	opMapTCP          = 2
+	opResponse        = 128
+
+	initialRetransmit = 250 * time.Millisecond
+	maxAttempts       = 9
+)
+
+// ErrTimeout is the error returned when the gateway does not respond.
+var ErrTimeout = errors.New("natpmp: gateway did not respond")
+
+// ResultError is the error returned when the gateway rejects a request.
+type ResultError uint16
+
+func (e ResultError) Error() string {
+	switch e {
+	case 1:
+		return "natpmp: unsupported version"
+	case 2:
+		return "natpmp: not authorized"
+	case 3:
+		return "natpmp: network failure"
+	case 4:
+		return "natpmp: out of resources"
+	case 5:
+		return "natpmp: unsupported opcode"
+	default:
+		return fmt.Sprintf("natpmp: result code %d", uint16(e))
+	}
+}
+
+// Mapping is a port mapping created on the gateway.
+type Mapping struct {
+	// InternalPort is the local port that is mapped.
+	InternalPort uint16
+
+	// ExternalPort is the port on the gateway's external address.
+	ExternalPort uint16
+
+	// Lifetime is the duration for which the gateway keeps the mapping.
+	Lifetime time.Duration
+}
+
+// Client is a NAT-PMP client talking to a given gateway.
+type Client struct {
+	gateway string
+}
+
+// ExternalAddress queries the gateway for its external IPv4 address.
+func (c *Client) ExternalAddress(ctx context.Context) (net.IP, error) {
+	resp, err := c.call(ctx, []byte{version, opExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// MapTCP requests that the gateway maps the TCP port internalPort to the
+// (suggested) external port externalPort, for the given lifetime.  A zero
+// lifetime deletes the mapping.
+func (c *Client) MapTCP(ctx context.Context, internalPort, externalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	req := make([]byte, 12)
+	req[0] = version
+	req[1] = opMapTCP
+	binary.BigEndian.PutUint16(req[4:], internalPort)
+	binary.BigEndian.PutUint16(req[6:], externalPort)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp, err := c.call(ctx, req, 16)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{
+		InternalPort: binary.BigEndian.Uint16(resp[8:]),
+		ExternalPort: binary.BigEndian.Uint16(resp[10:]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}
+	if m.InternalPort != internalPort {
+		return nil, fmt.Errorf("natpmp: response for the wrong port: %v", m.InternalPort)
+	}
+	return m, nil
+}
+
+func (c *Client) call(ctx context.Context, req []byte, respLen int) ([]byte, error) {
+	conn, err := net.Dial("udp", c.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Retransmit with an exponential backoff, as per RFC 6886 section 3.1.
+	buf := make([]byte, 16)
+	timeout := initialRetransmit
+	for i := 0; i < maxAttempts; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < respLen || buf[0] != version || buf[1] != req[1]|opResponse {
+				// Not a response to this request, keep waiting.
+				continue
+			}
+			if res := binary.BigEndian.Uint16(buf[2:]); res != 0 {
+				return nil, ResultError(res)
+			}
+			return buf[:respLen], nil
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		timeout *= 2
+	}
+	return nil, ErrTimeout
+}
+
+// New creates a new Client for the gateway at the given address, which
+// may omit the port.
+func New(gateway string) *Client {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, fmt.Sprintf("%d", Port))
+	}
+	return &Client{gateway: gateway}
+}
@@ -0,0 +1,102 @@
+// natpmp_test.go - NAT-PMP client tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestGateway(t *testing.T, handler func(req []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err, "ListenPacket()")
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := handler(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestExternalAddress(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dropped := false
+	gw := newTestGateway(t, func(req []byte) []byte {
+		if !dropped {
+			// Exercise the retransmission.
+			dropped = true
+			return nil
+		}
+		return []byte{0, 128, 0, 0, 0, 0, 0, 1, 192, 0, 2, 1}
+	})
+
+	ip, err := New(gw).ExternalAddress(context.Background())
+	require.NoError(err, "ExternalAddress()")
+	assert.True(ip.Equal(net.IPv4(192, 0, 2, 1)), "ExternalAddress(): IP")
+}
+
+func TestMapTCP(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	gw := newTestGateway(t, func(req []byte) []byte {
+		resp := make([]byte, 16)
+		resp[1] = 128 | req[1]
+		copy(resp[8:], req[4:6])
+		binary.BigEndian.PutUint16(resp[10:], 40000)
+		binary.BigEndian.PutUint32(resp[12:], binary.BigEndian.Uint32(req[8:])/2)
+		return resp
+	})
+
+	m, err := New(gw).MapTCP(context.Background(), 29483, 29483, time.Hour)
+	require.NoError(err, "MapTCP()")
+	assert.Equal(uint16(29483), m.InternalPort, "MapTCP(): InternalPort")
+	assert.Equal(uint16(40000), m.ExternalPort, "MapTCP(): ExternalPort")
+	assert.Equal(30*time.Minute, m.Lifetime, "MapTCP(): Lifetime")
+
+	gw = newTestGateway(t, func(req []byte) []byte {
+		return []byte{0, 130, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	})
+	_, err = New(gw).MapTCP(context.Background(), 29483, 29483, time.Hour)
+	assert.Equal(ResultError(2), err, "MapTCP(): Not authorized")
+}
+
+func TestTimeout(t *testing.T) {
+	gw := newTestGateway(t, func(req []byte) []byte { return nil })
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+	_, err := New(gw).ExternalAddress(ctx)
+	require.Error(t, err, "ExternalAddress(): Timeout")
+}
@@ -0,0 +1,170 @@
+// notary.go - Timestamping notary service.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package notary implements the wire format of the provider timestamping
+// notary service, which returns a signed timestamp over a client supplied
+// hash.
+package notary
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Version is the notary protocol version.
+	Version = 0
+
+	// MaxHashLength is the maximum length of a hash that can be notarized.
+	MaxHashLength = 64
+
+	// SignatureLength is the length of a (Ed25519) signature.
+	SignatureLength = 64
+
+	// StatusOk is the response status for a successful request.
+	StatusOk = 0
+
+	// StatusInvalidRequest is the response status for a malformed request.
+	StatusInvalidRequest = 1
+
+	requestHeaderLength  = 2
+	responseHeaderLength = 2 + 8 + 1
+	signatureContext     = "katzenpost-notary-v0"
+)
+
+// ErrInvalidResponse is the error returned when a response is malformed.
+var ErrInvalidResponse = errors.New("notary: invalid response")
+
+// Signer signs the message msg, returning a SignatureLength byte signature.
+type Signer func(msg []byte) []byte
+
+// Response is a notary response.
+type Response struct {
+	// Status is the response status.
+	Status byte
+
+	// Timestamp is the time at which the hash was notarized.
+	Timestamp time.Time
+
+	// Hash is the notarized hash.
+	Hash []byte
+
+	// Signature is the signature over the timestamp and hash.
+	Signature []byte
+}
+
+// Verify returns true iff the signature on the response is valid, as
+// determined by the provided verification function.
+func (r *Response) Verify(verify func(msg, sig []byte) bool) bool {
+	if r.Status != StatusOk {
+		return false
+	}
+	return verify(SignedMessage(r.Timestamp, r.Hash), r.Signature)
+}
+
+// SignedMessage returns the message that is signed by the notary for the
+// hash at the timestamp t.
+func SignedMessage(t time.Time, hash []byte) []byte {
+	b := make([]byte, 0, len(signatureContext)+8+len(hash))
+	b = append(b, signatureContext...)
+	b = appendUint64(b, uint64(t.Unix()))
+	return append(b, hash...)
+}
+
+// NewRequest returns a request to notarize hash.
+func NewRequest(hash []byte) ([]byte, error) {
+	if len(hash) == 0 || len(hash) > MaxHashLength {
+		return nil, fmt.Errorf("notary: invalid hash length: %d", len(hash))
+	}
+	b := make([]byte, 0, requestHeaderLength+len(hash))
+	b = append(b, Version, byte(len(hash)))
+	return append(b, hash...), nil
+}
+
+// HandleRequest handles a (possibly padded) request, returning the response
+// signed with sign at the time now.  Malformed requests result in a response
+// with the StatusInvalidRequest status, and an error.
+func HandleRequest(sign Signer, req []byte, now time.Time) ([]byte, error) {
+	hash, err := parseRequest(req)
+	if err != nil {
+		return []byte{Version, StatusInvalidRequest}, err
+	}
+
+	now = now.Truncate(time.Second)
+	sig := sign(SignedMessage(now, hash))
+	if len(sig) != SignatureLength {
+		return nil, fmt.Errorf("notary: invalid signature length: %d", len(sig))
+	}
+
+	b := make([]byte, 0, responseHeaderLength+len(hash)+len(sig))
+	b = append(b, Version, StatusOk)
+	b = appendUint64(b, uint64(now.Unix()))
+	b = append(b, byte(len(hash)))
+	b = append(b, hash...)
+	return append(b, sig...), nil
+}
+
+// ParseResponse parses a (possibly padded) response.
+func ParseResponse(b []byte) (*Response, error) {
+	if len(b) < 2 || b[0] != Version {
+		return nil, ErrInvalidResponse
+	}
+	r := &Response{Status: b[1]}
+	if r.Status != StatusOk {
+		return r, nil
+	}
+	if len(b) < responseHeaderLength {
+		return nil, ErrInvalidResponse
+	}
+	r.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(b[2:])), 0)
+	hashLen := int(b[10])
+	if hashLen == 0 || hashLen > MaxHashLength {
+		return nil, ErrInvalidResponse
+	}
+	b = b[responseHeaderLength:]
+	if len(b) < hashLen+SignatureLength {
+		return nil, ErrInvalidResponse
+	}
+	r.Hash = append([]byte{}, b[:hashLen]...)
+	r.Signature = append([]byte{}, b[hashLen:hashLen+SignatureLength]...)
+	return r, nil
+}
+
+func parseRequest(b []byte) ([]byte, error) {
+	if len(b) < requestHeaderLength {
+		return nil, errors.New("notary: truncated request")
+	}
+	if b[0] != Version {
+		return nil, fmt.Errorf("notary: unsupported version: %d", b[0])
+	}
+	hashLen := int(b[1])
+	if hashLen == 0 || hashLen > MaxHashLength {
+		return nil, fmt.Errorf("notary: invalid hash length: %d", hashLen)
+	}
+	b = b[requestHeaderLength:]
+	if len(b) < hashLen {
+		return nil, errors.New("notary: truncated hash")
+	}
+	return b[:hashLen], nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(b, tmp[:]...)
+}
@@ -0,0 +1,84 @@
+// notary_test.go - Timestamping notary service tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notary
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotary(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err, "ed25519.GenerateKey()")
+	sign := func(msg []byte) []byte { return ed25519.Sign(sk, msg) }
+	verify := func(msg, sig []byte) bool { return ed25519.Verify(pk, msg, sig) }
+
+	hash := sha256.Sum256([]byte("Sometimes you need a timestamp."))
+	req, err := NewRequest(hash[:])
+	require.NoError(err, "NewRequest()")
+
+	// Requests arrive padded to the payload size.
+	padded := make([]byte, 1024)
+	copy(padded, req)
+
+	now := time.Unix(1500000000, 123456789)
+	b, err := HandleRequest(sign, padded, now)
+	require.NoError(err, "HandleRequest()")
+
+	paddedResp := make([]byte, 1024)
+	copy(paddedResp, b)
+	resp, err := ParseResponse(paddedResp)
+	require.NoError(err, "ParseResponse()")
+	assert.Equal(byte(StatusOk), resp.Status, "Status")
+	assert.Equal(now.Unix(), resp.Timestamp.Unix(), "Timestamp")
+	assert.Equal(hash[:], resp.Hash, "Hash")
+	assert.True(resp.Verify(verify), "Verify()")
+
+	// Tampering with the timestamp must invalidate the signature.
+	resp.Timestamp = resp.Timestamp.Add(time.Second)
+	assert.False(resp.Verify(verify), "Verify(): tampered")
+
+	// Malformed requests get an error response.
+	for _, v := range [][]byte{
+		nil,
+		{Version + 1, 32},
+		{Version, 0},
+		{Version, MaxHashLength + 1},
+		{Version, 32, 0x23},
+	} {
+		b, err = HandleRequest(sign, v, now)
+		assert.Error(err, "HandleRequest(%x)", v)
+		resp, err = ParseResponse(b)
+		require.NoError(err, "ParseResponse(): invalid request")
+		assert.Equal(byte(StatusInvalidRequest), resp.Status, "Status: invalid request")
+		assert.False(resp.Verify(verify), "Verify(): invalid request")
+	}
+
+	_, err = NewRequest(make([]byte, MaxHashLength+1))
+	assert.Error(err, "NewRequest(): oversized")
+	_, err = ParseResponse([]byte{Version, StatusOk, 0})
+	assert.Equal(ErrInvalidResponse, err, "ParseResponse(): truncated")
+}
@@ -0,0 +1,333 @@
+// otlp.go - OpenTelemetry trace exporter.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package otlp implements a minimal OpenTelemetry trace exporter, that sends
+// spans to a collector using the OTLP/HTTP JSON encoding.
+package otlp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ScopeName is the instrumentation scope name of the exported spans.
+	ScopeName = "katzenpost-server"
+
+	maxQueuedSpans = 2048
+	maxBatchSize   = 512
+	flushInterval  = 5 * time.Second
+	postTimeout    = 10 * time.Second
+
+	spanKindInternal = 1
+	statusCodeOk     = 1
+	statusCodeError  = 2
+)
+
+// Span is a timed operation.
+type Span struct {
+	e *Exporter
+
+	name    string
+	traceID [16]byte
+	spanID  [8]byte
+	parent  *[8]byte
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	errMsg  string
+	isError bool
+}
+
+// SetAttribute sets the string attribute k to v.  It is safe to call on a
+// nil Span.
+func (s *Span) SetAttribute(k, v string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[k] = v
+}
+
+// StartChild starts a new span that is a child of s.  It is safe to call on
+// a nil Span.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := s.e.newSpan(name)
+	c.traceID = s.traceID
+	parent := s.spanID
+	c.parent = &parent
+	return c
+}
+
+// End ends the span, with the error status set iff err is non-nil, and
+// queues it for export.  It is safe to call on a nil Span.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.isError = true
+		s.errMsg = err.Error()
+	}
+	s.e.enqueue(s)
+}
+
+// Exporter is an OTLP/HTTP JSON span exporter.
+type Exporter struct {
+	sync.Mutex
+
+	url      string
+	resource map[string]string
+	client   *http.Client
+
+	spans   []*Span
+	dropped uint64
+
+	flushCh chan struct{}
+	closeCh chan struct{}
+	doneCh  chan struct{}
+	errFn   func(error)
+}
+
+// StartSpan starts a new root span.  It is safe to call on a nil Exporter, in
+// which case nil is returned.
+func (e *Exporter) StartSpan(name string) *Span {
+	if e == nil {
+		return nil
+	}
+	s := e.newSpan(name)
+	rand.Read(s.traceID[:])
+	return s
+}
+
+func (e *Exporter) newSpan(name string) *Span {
+	s := &Span{e: e, name: name, start: time.Now()}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (e *Exporter) enqueue(s *Span) {
+	e.Lock()
+	defer e.Unlock()
+
+	if len(e.spans) >= maxQueuedSpans {
+		// The collector is not keeping up, or is unreachable.
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, s)
+	if len(e.spans) >= maxBatchSize {
+		select {
+		case e.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of spans that were dropped as the queue was
+// full.
+func (e *Exporter) Dropped() uint64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.dropped
+}
+
+func (e *Exporter) flush() {
+	for {
+		e.Lock()
+		n := len(e.spans)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		batch := e.spans[:n]
+		e.spans = e.spans[n:]
+		e.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil && e.errFn != nil {
+			e.errFn(err)
+		}
+	}
+}
+
+func (e *Exporter) post(batch []*Span) error {
+	b, err := Encode(e.resource, batch)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("otlp: collector returned status: %v", resp.Status)
+	}
+	return nil
+}
+
+func (e *Exporter) worker() {
+	defer close(e.doneCh)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closeCh:
+			e.flush()
+			return
+		case <-ticker.C:
+		case <-e.flushCh:
+		}
+		e.flush()
+	}
+}
+
+// Close flushes the queued spans and stops the exporter.
+func (e *Exporter) Close() {
+	close(e.closeCh)
+	<-e.doneCh
+}
+
+// New creates a new Exporter, that posts spans to the OTLP/HTTP traces
+// endpoint url (eg: `http://localhost:4318/v1/traces`), with the resource
+// attributes resource.  Export errors are reported via errFn if non-nil.
+func New(url string, resource map[string]string, errFn func(error)) *Exporter {
+	e := &Exporter{
+		url:      url,
+		resource: resource,
+		client:   &http.Client{Timeout: postTimeout},
+		flushCh:  make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+		errFn:    errFn,
+	}
+	go e.worker()
+	return e
+}
+
+type jsonAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type jsonKeyValue struct {
+	Key   string       `json:"key"`
+	Value jsonAnyValue `json:"value"`
+}
+
+type jsonStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type jsonSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []jsonKeyValue `json:"attributes,omitempty"`
+	Status            jsonStatus     `json:"status"`
+}
+
+type jsonScope struct {
+	Name string `json:"name"`
+}
+
+type jsonScopeSpans struct {
+	Scope jsonScope  `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type jsonResource struct {
+	Attributes []jsonKeyValue `json:"attributes"`
+}
+
+type jsonResourceSpans struct {
+	Resource   jsonResource     `json:"resource"`
+	ScopeSpans []jsonScopeSpans `json:"scopeSpans"`
+}
+
+type jsonTracesData struct {
+	ResourceSpans []jsonResourceSpans `json:"resourceSpans"`
+}
+
+func toKeyValues(m map[string]string) []jsonKeyValue {
+	kvs := make([]jsonKeyValue, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, jsonKeyValue{Key: k, Value: jsonAnyValue{StringValue: v}})
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Encode encodes the spans with the resource attributes resource as an OTLP
+// ExportTraceServiceRequest, using the JSON encoding.
+func Encode(resource map[string]string, spans []*Span) ([]byte, error) {
+	ss := jsonScopeSpans{
+		Scope: jsonScope{Name: ScopeName},
+		Spans: make([]jsonSpan, 0, len(spans)),
+	}
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        toKeyValues(s.attrs),
+			Status:            jsonStatus{Code: statusCodeOk},
+		}
+		if s.parent != nil {
+			js.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.isError {
+			js.Status = jsonStatus{Code: statusCodeError, Message: s.errMsg}
+		}
+		ss.Spans = append(ss.Spans, js)
+	}
+
+	d := jsonTracesData{
+		ResourceSpans: []jsonResourceSpans{
+			{
+				Resource:   jsonResource{Attributes: toKeyValues(resource)},
+				ScopeSpans: []jsonScopeSpans{ss},
+			},
+		},
+	}
+	return json.Marshal(&d)
+}
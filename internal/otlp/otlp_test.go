@@ -0,0 +1,92 @@
+// otlp_test.go - OpenTelemetry trace exporter tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package otlp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporter(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	reqCh := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/json", r.Header.Get("Content-Type"), "Content-Type")
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(err, "ReadAll()")
+		reqCh <- b
+	}))
+	defer srv.Close()
+
+	e := New(srv.URL, map[string]string{"service.name": "test"}, func(err error) {
+		t.Errorf("Export error: %v", err)
+	})
+
+	s := e.StartSpan("parent")
+	s.SetAttribute("epoch", "23")
+	c := s.StartChild("child")
+	c.End(errors.New("child failed"))
+	s.End(nil)
+	e.Close()
+
+	var b []byte
+	select {
+	case b = <-reqCh:
+	case <-time.After(5 * time.Second):
+		require.FailNow("Timed out waiting for the export")
+	}
+
+	var d jsonTracesData
+	require.NoError(json.Unmarshal(b, &d), "Unmarshal()")
+	require.Len(d.ResourceSpans, 1, "ResourceSpans")
+	rs := d.ResourceSpans[0]
+	assert.Equal([]jsonKeyValue{{Key: "service.name", Value: jsonAnyValue{StringValue: "test"}}}, rs.Resource.Attributes, "Resource")
+	require.Len(rs.ScopeSpans, 1, "ScopeSpans")
+	spans := rs.ScopeSpans[0].Spans
+	require.Len(spans, 2, "Spans")
+
+	child, parent := spans[0], spans[1]
+	assert.Equal("child", child.Name, "Child name")
+	assert.Equal("parent", parent.Name, "Parent name")
+	assert.Equal(parent.TraceID, child.TraceID, "Child trace ID")
+	assert.Equal(parent.SpanID, child.ParentSpanID, "Child parent span ID")
+	assert.Len(parent.TraceID, 32, "Trace ID length")
+	assert.Len(parent.SpanID, 16, "Span ID length")
+	assert.Equal(jsonStatus{Code: statusCodeError, Message: "child failed"}, child.Status, "Child status")
+	assert.Equal(jsonStatus{Code: statusCodeOk}, parent.Status, "Parent status")
+	assert.Equal([]jsonKeyValue{{Key: "epoch", Value: jsonAnyValue{StringValue: "23"}}}, parent.Attributes, "Parent attributes")
+	assert.Equal(uint64(0), e.Dropped(), "Dropped()")
+}
+
+func TestNilExporter(t *testing.T) {
+	var e *Exporter
+	s := e.StartSpan("noop")
+	require.Nil(t, s, "StartSpan() on nil Exporter")
+	s.SetAttribute("k", "v")
+	s.StartChild("child").End(nil)
+	s.End(nil)
+}
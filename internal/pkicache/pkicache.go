@@ -35,11 +35,21 @@ type Entry struct {
 	all      map[[constants.NodeIDLength]byte]*pki.MixDescriptor
 }
 
+// Document returns the cached PKI document.
+func (e *Entry) Document() *pki.Document {
+	return e.doc
+}
+
 // Epoch returns the epoch that the cached PKI document is valid for.
 func (e *Entry) Epoch() uint64 {
 	return e.doc.Epoch
 }
 
+// Len returns the number of nodes listed in the cached PKI document.
+func (e *Entry) Len() int {
+	return len(e.all)
+}
+
 // Self returns the descriptor for the current node.
 func (e *Entry) Self() *pki.MixDescriptor {
 	return e.self
@@ -76,6 +86,16 @@ func (e *Entry) GetByID(id *[constants.NodeIDLength]byte) *pki.MixDescriptor {
 	return desc
 }
 
+// Incoming returns a slice of all MixDescriptors that describe valid incoming
+// connection sources.
+func (e *Entry) Incoming() []*pki.MixDescriptor {
+	l := make([]*pki.MixDescriptor, 0, len(e.incoming))
+	for _, v := range e.incoming {
+		l = append(l, v)
+	}
+	return l
+}
+
 // Outgoing returns a slice of all MixDescriptors that describe valid outgoing
 // connection destinations.
 func (e *Entry) Outgoing() []*pki.MixDescriptor {
@@ -0,0 +1,97 @@
+// sdnotify.go - systemd service notification.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sdnotify implements the systemd service notification protocol.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Ready is the state notifying systemd that the service is ready.
+	Ready = "READY=1"
+
+	// Stopping is the state notifying systemd that the service is stopping.
+	Stopping = "STOPPING=1"
+
+	// Watchdog is the state that keeps the systemd watchdog alive.
+	Watchdog = "WATCHDOG=1"
+
+	envNotifySocket = "NOTIFY_SOCKET"
+	envWatchdogUsec = "WATCHDOG_USEC"
+	envWatchdogPid  = "WATCHDOG_PID"
+)
+
+// Notify sends the state to the service manager.  It returns false if the
+// service manager did not request notifications.
+func Notify(state string) (bool, error) {
+	path := os.Getenv(envNotifySocket)
+	if path == "" {
+		return false, nil
+	}
+	if path[0] == '@' {
+		// Abstract namespace socket.
+		path = "\x00" + path[1:]
+	}
+
+	addr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Status returns a state that sets the free-form service status.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// WatchdogInterval returns the interval at which the service manager
+// expects watchdog keep-alives, or 0 if the watchdog is disabled.
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv(envWatchdogUsec)
+	if s == "" {
+		return 0, nil
+	}
+	usec, err := strconv.ParseUint(s, 10, 63)
+	if err != nil || usec == 0 {
+		return 0, fmt.Errorf("sdnotify: invalid %v: '%v'", envWatchdogUsec, s)
+	}
+
+	// The watchdog may be intended for another process.
+	if s = os.Getenv(envWatchdogPid); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("sdnotify: invalid %v: '%v'", envWatchdogPid, s)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
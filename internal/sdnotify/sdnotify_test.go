@@ -0,0 +1,87 @@
+// sdnotify_test.go - systemd service notification tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sdnotify
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	os.Unsetenv(envNotifySocket)
+	ok, err := Notify(Ready)
+	require.NoError(err, "Notify(): No socket")
+	assert.False(ok, "Notify(): No socket")
+
+	tmpDir, err := ioutil.TempDir("", "sdnotify_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	p := filepath.Join(tmpDir, "notify")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p, Net: "unixgram"})
+	require.NoError(err, "ListenUnixgram()")
+	defer l.Close()
+
+	os.Setenv(envNotifySocket, p)
+	defer os.Unsetenv(envNotifySocket)
+	ok, err = Notify(Ready + "\n" + Status("Running"))
+	require.NoError(err, "Notify()")
+	assert.True(ok, "Notify()")
+
+	var buf [128]byte
+	n, err := l.Read(buf[:])
+	require.NoError(err, "Read()")
+	assert.Equal("READY=1\nSTATUS=Running", string(buf[:n]), "Notification")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	defer os.Unsetenv(envWatchdogUsec)
+	defer os.Unsetenv(envWatchdogPid)
+
+	os.Unsetenv(envWatchdogUsec)
+	d, err := WatchdogInterval()
+	require.NoError(err, "WatchdogInterval(): Disabled")
+	assert.Equal(time.Duration(0), d, "WatchdogInterval(): Disabled")
+
+	os.Setenv(envWatchdogUsec, "30000000")
+	d, err = WatchdogInterval()
+	require.NoError(err, "WatchdogInterval()")
+	assert.Equal(30*time.Second, d, "WatchdogInterval()")
+
+	os.Setenv(envWatchdogPid, strconv.Itoa(os.Getpid()+1))
+	d, err = WatchdogInterval()
+	require.NoError(err, "WatchdogInterval(): Other pid")
+	assert.Equal(time.Duration(0), d, "WatchdogInterval(): Other pid")
+
+	os.Setenv(envWatchdogUsec, "bogus")
+	_, err = WatchdogInterval()
+	assert.Error(err, "WatchdogInterval(): Invalid")
+}
@@ -0,0 +1,121 @@
+// sntp.go - SNTP client.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sntp implements a minimal Simple Network Time Protocol (RFC 4330)
+// client, sufficient to measure the local clock's offset from a server.
+package sntp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// Port is the UDP port that NTP servers listen on.
+	Port = 123
+
+	packetLen = 48
+
+	// LI = 0, VN = 4, Mode = 3 (client).
+	clientHeader = 0x23
+	modeServer   = 4
+
+	// ntpEpochOffset is the number of seconds between the NTP epoch (1900)
+	// and the UNIX epoch (1970).
+	ntpEpochOffset = 2208988800
+)
+
+var (
+	// ErrTimeout is the error returned when the server does not respond.
+	ErrTimeout = errors.New("sntp: server did not respond")
+
+	errKissOfDeath = errors.New("sntp: server sent a kiss-o'-death")
+)
+
+// Result is the result of a query.
+type Result struct {
+	// Offset is the offset of the server's clock relative to the local
+	// clock, that is the local clock is behind by Offset.
+	Offset time.Duration
+
+	// RTT is the round trip time to the server, excluding the server's
+	// processing time.
+	RTT time.Duration
+}
+
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+func fromNTP(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nsec := int64(((v & 0xffffffff) * uint64(time.Second)) >> 32)
+	return time.Unix(secs, nsec)
+}
+
+// Query queries the server for its time, and returns the offset of the
+// local clock.
+func Query(ctx context.Context, server string) (*Result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, packetLen)
+	req[0] = clientHeader
+	t1 := time.Now()
+	xmit := toNTP(t1)
+	binary.BigEndian.PutUint64(req[40:], xmit)
+	if _, err = conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, packetLen*2)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		t4 := time.Now()
+		if n < packetLen || buf[0]&0x7 != modeServer || binary.BigEndian.Uint64(buf[24:]) != xmit {
+			// Not a response to this request, keep waiting.
+			continue
+		}
+		if buf[1] == 0 {
+			return nil, errKissOfDeath
+		}
+
+		t2 := fromNTP(binary.BigEndian.Uint64(buf[32:]))
+		t3 := fromNTP(binary.BigEndian.Uint64(buf[40:]))
+		return &Result{
+			Offset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+			RTT:    t4.Sub(t1) - t3.Sub(t2),
+		}, nil
+	}
+}
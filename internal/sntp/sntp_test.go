@@ -0,0 +1,72 @@
+// sntp_test.go - SNTP client tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sntp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestamp(t *testing.T) {
+	now := time.Unix(1500000000, 123456789)
+	assert.WithinDuration(t, now, fromNTP(toNTP(now)), time.Microsecond, "fromNTP(toNTP())")
+}
+
+func TestQuery(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	const skew = 42 * time.Second
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err, "ListenPacket()")
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, packetLen)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n != packetLen {
+				continue
+			}
+			resp := make([]byte, packetLen)
+			resp[0] = 0x24 // LI = 0, VN = 4, Mode = 4 (server).
+			resp[1] = 1
+			copy(resp[24:], buf[40:48])
+			now := time.Now().Add(skew)
+			binary.BigEndian.PutUint64(resp[32:], toNTP(now))
+			binary.BigEndian.PutUint64(resp[40:], toNTP(now))
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	r, err := Query(ctx, conn.LocalAddr().String())
+	require.NoError(err, "Query()")
+	assert.InDelta(float64(skew), float64(r.Offset), float64(100*time.Millisecond), "Query(): Offset")
+	assert.True(r.RTT >= 0, "Query(): RTT")
+}
@@ -0,0 +1,245 @@
+// spillqueue.go - Katzenpost server on-disk egress packet queue.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package spillqueue provides bounded persistent per-peer packet queues,
+// used to hold outgoing packets that overflow the in-memory send queue.
+package spillqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	metadataBucket = "metadata"
+	queuesBucket   = "queues"
+	versionKey     = "version"
+
+	timestampLength = 8
+)
+
+// ErrFull is the error returned when a queue is at capacity.
+var ErrFull = errors.New("spillqueue: queue is full")
+
+// Store is a collection of persistent per-peer packet queues.
+type Store struct {
+	sync.Mutex
+
+	db     *bolt.DB
+	counts map[string]int
+}
+
+// Close closes the Store instance.
+func (s *Store) Close() {
+	s.db.Sync()
+	s.db.Close()
+}
+
+// Len returns the number of entries in the queue identified by id.
+func (s *Store) Len(id []byte) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.counts[string(id)]
+}
+
+// Push appends the packet b to the queue identified by id, timestamped with
+// t.  ErrFull will be returned iff the queue already holds maxLen entries.
+func (s *Store) Push(id, b []byte, t time.Time, maxLen int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.counts[string(id)] >= maxLen {
+		return ErrFull
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		// Grab or create the peer's queue bucket.
+		qBkt, err := tx.Bucket([]byte(queuesBucket)).CreateBucketIfNotExists(id)
+		if err != nil {
+			return err
+		}
+
+		// Allocate a unique identifier for this entry, so that the
+		// cursor traverses entries in insertion order.
+		seq, err := qBkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		var entryID [8]byte
+		binary.BigEndian.PutUint64(entryID[:], seq)
+
+		v := make([]byte, timestampLength, timestampLength+len(b))
+		binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+		v = append(v, b...)
+		return qBkt.Put(entryID[:], v)
+	}); err != nil {
+		return err
+	}
+	s.counts[string(id)]++
+
+	return nil
+}
+
+// Pop removes and returns the oldest entry in the queue identified by id,
+// discarding any entries that were pushed before notBefore along the way.
+// If the queue is empty, a nil slice will be returned.
+func (s *Store) Pop(id []byte, notBefore time.Time) (b []byte, t time.Time, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.counts[string(id)] == 0 {
+		return
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		qBkt := tx.Bucket([]byte(queuesBucket)).Bucket(id)
+		if qBkt == nil {
+			return nil
+		}
+
+		cur := qBkt.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.First() {
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+			s.counts[string(id)]--
+			if len(v) < timestampLength {
+				// Treat pathologically malformed entries as expired.
+				continue
+			}
+
+			entryT := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+			if entryT.Before(notBefore) {
+				continue
+			}
+
+			// The memory backing v is only valid for the lifetime of the
+			// transaction, so make a copy.
+			b = append([]byte{}, v[timestampLength:]...)
+			t = entryT
+			break
+		}
+		if s.counts[string(id)] == 0 {
+			qBkt.SetSequence(0) // Don't keep a lifetime entry count.
+		}
+		return nil
+	})
+	return
+}
+
+// Remove removes the queue identified by id.
+func (s *Store) Remove(id []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.doRemove(tx.Bucket([]byte(queuesBucket)), id)
+	})
+}
+
+// Prune removes all the queues for which keep returns false.
+func (s *Store) Prune(keep func([]byte) bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(queuesBucket))
+
+		var toRemove [][]byte
+		cur := bkt.Cursor()
+		for id, _ := cur.First(); id != nil; id, _ = cur.Next() {
+			if !keep(id) {
+				toRemove = append(toRemove, append([]byte{}, id...))
+			}
+		}
+		for _, id := range toRemove {
+			if err := s.doRemove(bkt, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) doRemove(bkt *bolt.Bucket, id []byte) error {
+	if bkt.Bucket(id) == nil {
+		return nil
+	}
+	if err := bkt.DeleteBucket(id); err != nil {
+		return err
+	}
+	delete(s.counts, string(id))
+	return nil
+}
+
+// New creates (or loads) a packet queue store with the given file name f.
+func New(f string) (*Store, error) {
+	var err error
+
+	s := new(Store)
+	s.counts = make(map[string]int)
+	s.db, err = bolt.Open(f, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The queues are a best effort buffer, so don't fsync on every commit.
+	s.db.NoSync = true
+
+	if err = s.db.Update(func(tx *bolt.Tx) error {
+		// Ensure that all the buckets exists, and grab the metadata bucket.
+		bkt, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		qBkt, err := tx.CreateBucketIfNotExists([]byte(queuesBucket))
+		if err != nil {
+			return err
+		}
+
+		if b := bkt.Get([]byte(versionKey)); b != nil {
+			// Well it looks like we loaded as opposed to created.
+			if len(b) != 1 || b[0] != 0 {
+				return fmt.Errorf("spillqueue: incompatible version: %d", uint(b[0]))
+			}
+
+			// Populate the entry counts.
+			return qBkt.ForEach(func(id, v []byte) error {
+				if v != nil {
+					// Not a bucket, ignore.
+					return nil
+				}
+				s.counts[string(id)] = qBkt.Bucket(id).Stats().KeyN
+				return nil
+			})
+		}
+
+		// We created a new database, so populate the new `metadata` bucket.
+		return bkt.Put([]byte(versionKey), []byte{0})
+	}); err != nil {
+		// The struct isn't getting returned so clean up the database.
+		s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,111 @@
+// spillqueue_test.go - On-disk egress packet queue tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package spillqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testStore  = "spill.db"
+	testMaxLen = 3
+)
+
+var (
+	tmpDir        string
+	testStorePath string
+
+	testPeer  = []byte("peer")
+	testOther = []byte("other")
+)
+
+func TestSpillQueue(t *testing.T) {
+	t.Logf("Temp Dir: %v", tmpDir)
+	if ok := t.Run("create", doTestCreate); ok {
+		t.Run("load", doTestLoad)
+	} else {
+		t.Errorf("create tests failed, skipping load test")
+	}
+
+	os.RemoveAll(tmpDir)
+}
+
+func doTestCreate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s, err := New(testStorePath)
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	now := time.Now()
+	err = s.Push(testPeer, []byte{0}, now.Add(-time.Hour), testMaxLen)
+	require.NoError(err, "Push(): stale")
+	for i := 1; i < testMaxLen; i++ {
+		err = s.Push(testPeer, []byte{byte(i)}, now, testMaxLen)
+		require.NoErrorf(err, "Push(): %d", i)
+	}
+	err = s.Push(testPeer, []byte{0xff}, now, testMaxLen)
+	assert.Equal(ErrFull, err, "Push(): full")
+	assert.Equal(testMaxLen, s.Len(testPeer), "Len()")
+
+	err = s.Push(testOther, []byte{0}, now, testMaxLen)
+	require.NoError(err, "Push(): other")
+}
+
+func doTestLoad(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s, err := New(testStorePath)
+	require.NoError(err, "New() load")
+	defer s.Close()
+
+	assert.Equal(testMaxLen, s.Len(testPeer), "Len() load")
+
+	// The stale entry should get discarded.
+	notBefore := time.Now().Add(-time.Minute)
+	for i := 1; i < testMaxLen; i++ {
+		b, _, err := s.Pop(testPeer, notBefore)
+		require.NoErrorf(err, "Pop(): %d", i)
+		assert.Equalf([]byte{byte(i)}, b, "Pop(): %d", i)
+	}
+	b, _, err := s.Pop(testPeer, notBefore)
+	require.NoError(err, "Pop(): empty")
+	assert.Nil(b, "Pop(): empty")
+	assert.Equal(0, s.Len(testPeer), "Len() drained")
+
+	err = s.Prune(func(id []byte) bool { return false })
+	require.NoError(err, "Prune()")
+	assert.Equal(0, s.Len(testOther), "Len() pruned")
+}
+
+func init() {
+	var err error
+	tmpDir, err = ioutil.TempDir("", "spillqueue_tests")
+	if err != nil {
+		panic(err)
+	}
+	testStorePath = filepath.Join(tmpDir, testStore)
+}
@@ -0,0 +1,279 @@
+// spoolarchive.go - Encrypted user spool archives.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package spoolarchive implements the encrypted archive format used to
+// export a user's spool and account metadata, so that the account can be
+// migrated to another provider.
+//
+// An archive is a magic string followed by a sequence of length prefixed
+// records, each sealed with AES-256-GCM under a per-archive key, with the
+// record counter and a final record flag as the nonce.  This allows the
+// archive to be streamed, while detecting reordered and truncated records.
+package spoolarchive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// KeyLength is the archive key length in bytes.
+	KeyLength = 32
+
+	maxRecordLength = 1 << 20
+	version         = 0
+)
+
+var magic = []byte("katzenpost-spool-archive-v0\n")
+
+// ErrTruncated is the error returned when an archive ends without a final
+// record.
+var ErrTruncated = errors.New("spoolarchive: archive is truncated")
+
+// Header is the account information stored at the start of an archive.
+type Header struct {
+	// Version is the archive version.
+	Version int
+
+	// User is the username of the account.
+	User []byte
+
+	// Metadata is the account's userdb metadata.
+	Metadata map[string][]byte
+}
+
+// Entry is a spool entry stored in an archive.
+type Entry struct {
+	// Message is the spooled message.
+	Message []byte
+
+	// SURBID is the SURB ID of a spooled SURBReply, or nil for a message.
+	SURBID []byte `json:",omitempty"`
+}
+
+type stream struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func newStream(key []byte) (*stream, error) {
+	if len(key) != KeyLength {
+		return nil, fmt.Errorf("spoolarchive: invalid key length: %d", len(key))
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{aead: aead}, nil
+}
+
+func (s *stream) nonce(isFinal bool) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[:8], s.seq)
+	if isFinal {
+		nonce[len(nonce)-1] = 1
+	}
+	s.seq++
+	return nonce
+}
+
+// Writer writes an archive.
+type Writer struct {
+	s *stream
+	w io.Writer
+
+	isClosed bool
+}
+
+func (w *Writer) writeRecord(v interface{}, isFinal bool) error {
+	if w.isClosed {
+		return errors.New("spoolarchive: write to closed archive")
+	}
+
+	var pt []byte
+	if v != nil {
+		var err error
+		if pt, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	ct := w.s.aead.Seal(nil, w.s.nonce(isFinal), pt, magic)
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(ct)))
+	if _, err := w.w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(ct)
+	return err
+}
+
+// Write writes a spool entry to the archive.
+func (w *Writer) Write(e *Entry) error {
+	return w.writeRecord(e, false)
+}
+
+// Close writes the final record to the archive.  It does not close the
+// underlying io.Writer.
+func (w *Writer) Close() error {
+	err := w.writeRecord(nil, true)
+	w.isClosed = true
+	return err
+}
+
+// NewWriter writes the header of a new archive encrypted with key to w, and
+// returns a Writer for the spool entries.
+func NewWriter(w io.Writer, key []byte, hdr *Header) (*Writer, error) {
+	s, err := newStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(magic); err != nil {
+		return nil, err
+	}
+
+	aw := &Writer{s: s, w: w}
+	hdr.Version = version
+	if err = aw.writeRecord(hdr, false); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Reader reads an archive.
+type Reader struct {
+	s *stream
+	r io.Reader
+
+	isDone bool
+}
+
+func (r *Reader) readRecord() ([]byte, bool, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r.r, l[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, ErrTruncated
+		}
+		return nil, false, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxRecordLength {
+		return nil, false, fmt.Errorf("spoolarchive: oversized record: %d", n)
+	}
+	ct := make([]byte, n)
+	if _, err := io.ReadFull(r.r, ct); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, ErrTruncated
+		}
+		return nil, false, err
+	}
+
+	// Only one of the nonces will authenticate the record.
+	seq := r.s.seq
+	if pt, err := r.s.aead.Open(nil, r.s.nonce(false), ct, magic); err == nil {
+		return pt, false, nil
+	}
+	r.s.seq = seq
+	pt, err := r.s.aead.Open(nil, r.s.nonce(true), ct, magic)
+	if err != nil {
+		return nil, false, errors.New("spoolarchive: failed to authenticate record")
+	}
+	return pt, true, nil
+}
+
+// Next returns the next spool entry in the archive, or io.EOF once all of
+// the entries have been read.
+func (r *Reader) Next() (*Entry, error) {
+	if r.isDone {
+		return nil, io.EOF
+	}
+	pt, isFinal, err := r.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if isFinal {
+		r.isDone = true
+		return nil, io.EOF
+	}
+
+	e := new(Entry)
+	if err = json.Unmarshal(pt, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// NewReader reads the header of the archive encrypted with key from r, and
+// returns a Reader for the spool entries.
+func NewReader(r io.Reader, key []byte) (*Reader, *Header, error) {
+	s, err := newStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := make([]byte, len(magic))
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, nil, ErrTruncated
+	}
+	if string(b) != string(magic) {
+		return nil, nil, errors.New("spoolarchive: not a spool archive")
+	}
+
+	ar := &Reader{s: s, r: r}
+	pt, isFinal, err := ar.readRecord()
+	if err != nil {
+		return nil, nil, err
+	}
+	if isFinal {
+		return nil, nil, errors.New("spoolarchive: archive has no header")
+	}
+	hdr := new(Header)
+	if err = json.Unmarshal(pt, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Version != version {
+		return nil, nil, fmt.Errorf("spoolarchive: unsupported version: %d", hdr.Version)
+	}
+	return ar, hdr, nil
+}
+
+// ReadAll reads and authenticates the entire archive encrypted with key from
+// r, and returns the header and all of the spool entries.  Unlike with the
+// Reader, nothing is returned unless the whole archive is intact, so that a
+// damaged archive can't be partially applied.
+func ReadAll(r io.Reader, key []byte) (*Header, []*Entry, error) {
+	ar, hdr, err := NewReader(r, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []*Entry
+	for {
+		e, err := ar.Next()
+		if err == io.EOF {
+			return hdr, entries, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+}
@@ -0,0 +1,91 @@
+// spoolarchive_test.go - Encrypted user spool archive tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package spoolarchive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	key := make([]byte, KeyLength)
+	_, err := rand.Read(key)
+	require.NoError(err, "rand.Read()")
+
+	entries := []*Entry{
+		{Message: []byte("message")},
+		{Message: []byte("surb reply"), SURBID: []byte("surb id")},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key, &Header{
+		User:     []byte("alice"),
+		Metadata: map[string][]byte{"tier": []byte("paid")},
+	})
+	require.NoError(err, "NewWriter()")
+	for _, e := range entries {
+		require.NoError(w.Write(e), "Write()")
+	}
+	require.NoError(w.Close(), "Close()")
+	assert.Error(w.Write(entries[0]), "Write() after Close()")
+	archive := buf.Bytes()
+
+	r, hdr, err := NewReader(bytes.NewReader(archive), key)
+	require.NoError(err, "NewReader()")
+	assert.Equal([]byte("alice"), hdr.User, "Header: User")
+	assert.Equal([]byte("paid"), hdr.Metadata["tier"], "Header: Metadata")
+	for i, e := range entries {
+		ee, err := r.Next()
+		require.NoError(err, "Next(): %d", i)
+		assert.Equal(e, ee, "Next(): %d", i)
+	}
+	_, err = r.Next()
+	assert.Equal(io.EOF, err, "Next(): final")
+
+	// Truncation is detected, even on a record boundary.
+	r, _, err = NewReader(bytes.NewReader(archive[:len(archive)-20]), key)
+	require.NoError(err, "NewReader(): truncated")
+	for err == nil {
+		_, err = r.Next()
+	}
+	assert.Equal(ErrTruncated, err, "Next(): truncated")
+
+	hdr, ee, err := ReadAll(bytes.NewReader(archive), key)
+	require.NoError(err, "ReadAll()")
+	assert.Equal([]byte("alice"), hdr.User, "ReadAll(): User")
+	assert.Equal(entries, ee, "ReadAll(): entries")
+
+	// A truncated archive yields nothing at all, so that the import leaves
+	// the user untouched.
+	hdr, ee, err = ReadAll(bytes.NewReader(archive[:len(archive)-20]), key)
+	assert.Equal(ErrTruncated, err, "ReadAll(): truncated")
+	assert.Nil(hdr, "ReadAll(): truncated header")
+	assert.Nil(ee, "ReadAll(): truncated entries")
+
+	// The wrong key fails.
+	key[0] ^= 1
+	_, _, err = NewReader(bytes.NewReader(archive), key)
+	assert.Error(err, "NewReader(): wrong key")
+}
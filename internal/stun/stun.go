@@ -0,0 +1,185 @@
+// stun.go - STUN client.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package stun implements a minimal STUN (RFC 5389) client, sufficient to
+// discover the external address of a host behind a NAT via a Binding
+// request.
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	magicCookie = 0x2112a442
+	headerLen   = 20
+
+	typeBindingRequest  = 0x0001
+	typeBindingResponse = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrXorMappedAddress = 0x0020
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+
+	initialRetransmit = 500 * time.Millisecond
+	maxAttempts       = 7
+)
+
+var (
+	// ErrTimeout is the error returned when the server does not respond.
+	ErrTimeout = errors.New("stun: server did not respond")
+
+	errNoAddress  = errors.New("stun: response has no mapped address")
+	errBadAddress = errors.New("stun: malformed mapped address")
+)
+
+// Discover sends a Binding request to the STUN server, and returns the
+// external address the server observed the request from.
+func Discover(ctx context.Context, server string) (*net.UDPAddr, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(req[0:], typeBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], magicCookie)
+	if _, err = rand.Read(req[8:headerLen]); err != nil {
+		return nil, err
+	}
+	txID := req[8:headerLen]
+
+	// Retransmit with an exponential backoff, as per RFC 5389 section 7.2.1.
+	buf := make([]byte, 1500)
+	timeout := initialRetransmit
+	for i := 0; i < maxAttempts; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if addr, ok, err := parseResponse(buf[:n], txID); ok {
+				return addr, err
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		timeout *= 2
+	}
+	return nil, ErrTimeout
+}
+
+// parseResponse parses a Binding response to the transaction txID.  It
+// returns false if b is not such a response.
+func parseResponse(b, txID []byte) (*net.UDPAddr, bool, error) {
+	if len(b) < headerLen || binary.BigEndian.Uint16(b[0:]) != typeBindingResponse {
+		return nil, false, nil
+	}
+	if binary.BigEndian.Uint32(b[4:]) != magicCookie || string(b[8:headerLen]) != string(txID) {
+		return nil, false, nil
+	}
+	msgLen := int(binary.BigEndian.Uint16(b[2:]))
+	if headerLen+msgLen > len(b) {
+		return nil, true, errBadAddress
+	}
+
+	var mapped *net.UDPAddr
+	attrs := b[headerLen : headerLen+msgLen]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+attrLen > len(attrs) {
+			return nil, true, errBadAddress
+		}
+		v := attrs[4 : 4+attrLen]
+		switch attrType {
+		case attrXorMappedAddress:
+			// XOR-MAPPED-ADDRESS is preferred when present.
+			addr, err := parseAddress(v, b[4:headerLen])
+			return addr, true, err
+		case attrMappedAddress:
+			addr, err := parseAddress(v, nil)
+			if err != nil {
+				return nil, true, err
+			}
+			mapped = addr
+		}
+
+		// Attributes are padded to a multiple of 4 bytes.
+		padded := (attrLen + 3) &^ 3
+		if 4+padded > len(attrs) {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+	if mapped == nil {
+		return nil, true, errNoAddress
+	}
+	return mapped, true, nil
+}
+
+// parseAddress parses a (XOR-)MAPPED-ADDRESS attribute value, where xorKey
+// is the magic cookie followed by the transaction ID for XOR-MAPPED-ADDRESS,
+// and nil otherwise.
+func parseAddress(v, xorKey []byte) (*net.UDPAddr, error) {
+	if len(v) < 4 {
+		return nil, errBadAddress
+	}
+	var ipLen int
+	switch v[1] {
+	case familyIPv4:
+		ipLen = net.IPv4len
+	case familyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, errBadAddress
+	}
+	if len(v) != 4+ipLen {
+		return nil, errBadAddress
+	}
+
+	port := binary.BigEndian.Uint16(v[2:])
+	ip := make(net.IP, ipLen)
+	copy(ip, v[4:])
+	if xorKey != nil {
+		port ^= binary.BigEndian.Uint16(xorKey)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
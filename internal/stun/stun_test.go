@@ -0,0 +1,90 @@
+// stun_test.go - STUN client tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscover(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err, "ListenPacket()")
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n != headerLen {
+				continue
+			}
+
+			// Reply with an unrelated attribute, followed by the
+			// XOR-MAPPED-ADDRESS of the client.
+			uAddr := addr.(*net.UDPAddr)
+			resp := make([]byte, headerLen+8+12)
+			binary.BigEndian.PutUint16(resp[0:], typeBindingResponse)
+			binary.BigEndian.PutUint16(resp[2:], 8+12)
+			copy(resp[4:], buf[4:headerLen])
+			binary.BigEndian.PutUint16(resp[20:], 0x8022)
+			binary.BigEndian.PutUint16(resp[22:], 3)
+			binary.BigEndian.PutUint16(resp[28:], attrXorMappedAddress)
+			binary.BigEndian.PutUint16(resp[30:], 8)
+			resp[33] = familyIPv4
+			binary.BigEndian.PutUint16(resp[34:], uint16(uAddr.Port)^(magicCookie>>16))
+			ip := uAddr.IP.To4()
+			for i := range ip {
+				resp[36+i] = ip[i] ^ resp[4+i]
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	addr, err := Discover(ctx, conn.LocalAddr().String())
+	require.NoError(err, "Discover()")
+	assert.True(addr.IP.Equal(net.IPv4(127, 0, 0, 1)), "Discover(): IP")
+	assert.NotZero(addr.Port, "Discover(): Port")
+}
+
+func TestParseAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, err := parseAddress([]byte{0, familyIPv4, 0x12, 0x34, 192, 0, 2, 1}, nil)
+	assert.NoError(err, "parseAddress(): MAPPED-ADDRESS")
+	assert.Equal("192.0.2.1:4660", addr.String(), "parseAddress(): MAPPED-ADDRESS")
+
+	_, err = parseAddress([]byte{0, familyIPv6, 0x12, 0x34, 192, 0, 2, 1}, nil)
+	assert.Error(err, "parseAddress(): Truncated")
+
+	_, err = parseAddress([]byte{0, 3, 0x12, 0x34, 192, 0, 2, 1}, nil)
+	assert.Error(err, "parseAddress(): Invalid family")
+}
@@ -0,0 +1,90 @@
+// tokenbucket.go - Token bucket rate limiter.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package tokenbucket provides a simple token bucket rate limiter.
+package tokenbucket
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket.
+type Bucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	nowFn func() time.Time
+}
+
+func (b *Bucket) refill() {
+	now := b.nowFn()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Allow removes n tokens from the bucket and returns true iff there are
+// enough tokens available, otherwise the bucket is left untouched.
+func (b *Bucket) Allow(n float64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Take unconditionally removes n tokens from the bucket, and returns how long
+// the caller should wait before the tokens would have been available.
+func (b *Bucket) Take(n float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// New returns a new full Bucket that refills at rate tokens per second, and
+// holds at most burst tokens.
+func New(rate, burst float64) *Bucket {
+	return newWithClock(rate, burst, time.Now)
+}
+
+func newWithClock(rate, burst float64, nowFn func() time.Time) *Bucket {
+	b := new(Bucket)
+	b.rate = rate
+	b.burst = burst
+	b.tokens = burst
+	b.nowFn = nowFn
+	b.last = nowFn()
+	return b
+}
@@ -0,0 +1,46 @@
+// tokenbucket_test.go - Token bucket rate limiter tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tokenbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(0, 0)
+	b := newWithClock(10, 20, func() time.Time { return now })
+
+	assert.True(b.Allow(20), "Allow(): burst")
+	assert.False(b.Allow(1), "Allow(): empty")
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(b.Allow(5), "Allow(): refilled")
+	assert.False(b.Allow(1), "Allow(): empty again")
+
+	assert.Equal(time.Second, b.Take(10), "Take(): overdrawn")
+	now = now.Add(time.Second)
+	assert.Equal(time.Duration(0), b.Take(0), "Take(): repaid")
+
+	now = now.Add(time.Hour)
+	assert.True(b.Allow(20), "Allow(): capped at burst")
+	assert.False(b.Allow(1), "Allow(): capped at burst")
+}
@@ -0,0 +1,117 @@
+// kaetzchen.go - Katzenpost provider auto-responder services.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/notary"
+	"github.com/katzenpost/server/userdb"
+)
+
+// kaetzchen is the interface implemented by the provider side auto-responder
+// services.  Requests are the user payload of a forward packet addressed to
+// the service's endpoint, and responses are returned via the packet's SURB.
+type kaetzchen interface {
+	// onRequest handles a request, returning the response payload, which
+	// MUST be at most constants.ForwardPayloadLength bytes.
+	onRequest(id uint64, payload []byte) ([]byte, error)
+
+	// version returns the service's protocol version.
+	version() int
+}
+
+// kaetzchenParameters returns the parameters advertised for the service,
+// keyed by capability, that allow clients to discover the service.
+func kaetzchenParameters(cfg *config.Kaetzchen, k kaetzchen) map[string]interface{} {
+	params := make(map[string]interface{})
+	for name, v := range cfg.Parameters {
+		params[name] = v
+	}
+	params[config.KaetzchenParamEndpoint] = cfg.Endpoint
+	params[config.KaetzchenParamVersion] = k.version()
+	return params
+}
+
+// loopKaetzchen is a service that echos back the request payload.
+type loopKaetzchen struct{}
+
+func (k *loopKaetzchen) version() int {
+	return 0
+}
+
+func (k *loopKaetzchen) onRequest(id uint64, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// notaryKaetzchen is a service that returns a timestamp over a client
+// supplied hash, signed with the server's identity key.
+type notaryKaetzchen struct {
+	s *Server
+}
+
+func (k *notaryKaetzchen) version() int {
+	return notary.Version
+}
+
+func (k *notaryKaetzchen) onRequest(id uint64, payload []byte) ([]byte, error) {
+	return notary.HandleRequest(k.s.identityKey.Sign, payload, time.Now())
+}
+
+func newKaetzchen(s *Server, cfg *config.Kaetzchen) (kaetzchen, error) {
+	if len(cfg.Endpoint) > userdb.MaxUsernameSize {
+		return nil, fmt.Errorf("kaetzchen: endpoint '%v' is too long", cfg.Endpoint)
+	}
+	switch cfg.Capability {
+	case config.KaetzchenLoop:
+		return &loopKaetzchen{}, nil
+	case config.KaetzchenNotary:
+		return &notaryKaetzchen{s: s}, nil
+	default:
+		return nil, fmt.Errorf("kaetzchen: unknown capability '%v'", cfg.Capability)
+	}
+}
+
+func (p *provider) onMgmtKaetzchenList(c *thwack.Conn, l string) error {
+	caps := make([]string, 0, len(p.kaetzchenParams))
+	for k := range p.kaetzchenParams {
+		caps = append(caps, k)
+	}
+	sort.Strings(caps)
+
+	for _, capa := range caps {
+		params := p.kaetzchenParams[capa]
+		names := make([]string, 0, len(params))
+		for k := range params {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		line := fmt.Sprintf("%v-Kaetzchen:%v", thwack.StatusOk, capa)
+		for _, k := range names {
+			line += fmt.Sprintf(" %v:%v", k, params[k])
+		}
+		if err := c.Writer().PrintfLine("%s", line); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
@@ -0,0 +1,216 @@
+// keyfile.go - Katzenpost server key files.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/spool/boltspool"
+)
+
+const (
+	identityPrivateKeyFile = "identity.private.pem"
+	identityPublicKeyFile  = "identity.public.pem"
+	linkPrivateKeyFile     = "link.private.pem"
+
+	identityPrivateKeyType = "ED25519 PRIVATE KEY"
+	identityPublicKeyType  = "ED25519 PUBLIC KEY"
+	linkPrivateKeyType     = "X25519 PRIVATE KEY"
+	spoolMasterKeyType     = "SPOOL MASTER KEY"
+)
+
+// writeFileAtomic writes data to the file f, such that either the old or
+// the new contents are present on disk should the write be interrupted, by
+// writing to a temporary file that is fsync()ed and renamed over f.
+func writeFileAtomic(f string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(f)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(f)+".tmp")
+	if err != nil {
+		return err
+	}
+	isOk := false
+	defer func() {
+		if !isOk {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), f); err != nil {
+		return err
+	}
+	isOk = true
+
+	// Persist the rename itself.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkKeyFile ensures that the key file f is a regular file that is
+// neither group nor world accessible, and that is owned by either the
+// current user or the configured sandbox user.  It returns false iff the
+// file does not exist.
+func (s *Server) checkKeyFile(f string) (bool, error) {
+	fi, err := os.Lstat(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return true, fmt.Errorf("key file '%v' is not a regular file", f)
+	}
+	if perm := fi.Mode().Perm(); hasFilePerms && perm&0077 != 0 {
+		return true, fmt.Errorf("key file '%v' has insecure permissions '%v'", f, perm)
+	}
+	if uid, ok := fileOwner(fi); ok && uid != os.Geteuid() {
+		okOwner := false
+		if sbCfg := s.cfg.Sandbox; sbCfg.User != "" {
+			if sbUID, _, err := lookupUser(sbCfg.User, sbCfg.Group); err == nil {
+				okOwner = uid == sbUID
+			}
+		}
+		if !okOwner {
+			return true, fmt.Errorf("key file '%v' is owned by uid %v", f, uid)
+		}
+	}
+	return true, nil
+}
+
+// writePEMFile atomically writes a PEM encoded key to the file f.
+func writePEMFile(f, keyType string, b []byte, mode os.FileMode) error {
+	buf := pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: b})
+	defer utils.ExplicitBzero(buf)
+	return writeFileAtomic(f, buf, mode)
+}
+
+func (s *Server) initIdentityKey() error {
+	privFile := filepath.Join(s.cfg.Server.DataDir, identityPrivateKeyFile)
+	pubFile := filepath.Join(s.cfg.Server.DataDir, identityPublicKeyFile)
+	exists, err := s.checkKeyFile(privFile)
+	if err != nil {
+		return err
+	}
+	if exists {
+		s.identityKey, err = eddsa.Load(privFile, pubFile, rand.Reader)
+		return err
+	}
+
+	k, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	b := k.Bytes()
+	defer utils.ExplicitBzero(b)
+	if err = writePEMFile(privFile, identityPrivateKeyType, b, 0600); err != nil {
+		k.Reset()
+		return err
+	}
+	if err = writePEMFile(pubFile, identityPublicKeyType, k.PublicKey().Bytes(), 0644); err != nil {
+		k.Reset()
+		return err
+	}
+	s.identityKey = k
+	return nil
+}
+
+func (s *Server) initLinkKey() error {
+	f := filepath.Join(s.cfg.Server.DataDir, linkPrivateKeyFile)
+	exists, err := s.checkKeyFile(f)
+	if err != nil {
+		return err
+	}
+	if exists {
+		s.linkKey, err = ecdh.Load(f, rand.Reader)
+		return err
+	}
+
+	k, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	b := k.Bytes()
+	defer utils.ExplicitBzero(b)
+	if err = writePEMFile(f, linkPrivateKeyType, b, 0600); err != nil {
+		k.Reset()
+		return err
+	}
+	s.linkKey = k
+	return nil
+}
+
+// loadSpoolKey loads the spool master key from the file f, generating and
+// saving a new key if the file does not exist.
+func (s *Server) loadSpoolKey(f string) ([]byte, error) {
+	exists, err := s.checkKeyFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		defer utils.ExplicitBzero(buf)
+		blk, _ := pem.Decode(buf)
+		if blk == nil || blk.Type != spoolMasterKeyType {
+			return nil, fmt.Errorf("spool key file '%v' is not a valid PEM encoded key", f)
+		}
+		if len(blk.Bytes) != boltspool.MasterKeyLength {
+			utils.ExplicitBzero(blk.Bytes)
+			return nil, fmt.Errorf("spool key file '%v' has an invalid key length: %v", f, len(blk.Bytes))
+		}
+		return blk.Bytes, nil
+	}
+
+	k := make([]byte, boltspool.MasterKeyLength)
+	if _, err = io.ReadFull(rand.Reader, k); err != nil {
+		return nil, err
+	}
+	if err = writePEMFile(f, spoolMasterKeyType, k, 0600); err != nil {
+		utils.ExplicitBzero(k)
+		return nil, err
+	}
+	s.log.Noticef("Generated new spool master key: '%v'", f)
+	return k, nil
+}
@@ -0,0 +1,147 @@
+// linktls.go - Katzenpost server optional link layer TLS.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+)
+
+// tlsRecordTypeHandshake is the first byte of a TLS ClientHello.  The link
+// protocol handshake never begins with this value, so it is used to tell
+// TLS wrapped incoming connections apart from plain ones.
+const tlsRecordTypeHandshake = 0x16
+
+var errLinkTLSPinning = errors.New("link TLS certificate does not match the peer's identity key")
+
+// newLinkTLSCertificate returns a self-signed certificate for the server's
+// identity key.  The link key is X25519 and can not sign, so the certificate
+// is bound to the identity key that signs the descriptor instead, and the
+// link key is authenticated by the link protocol handshake as usual.
+func newLinkTLSCertificate(identityKey *eddsa.PrivateKey) (tls.Certificate, error) {
+	privKey := ed25519.PrivateKey(identityKey.Bytes())
+	var serialBytes [16]byte
+	if _, err := io.ReadFull(rand.Reader, serialBytes[:]); err != nil {
+		return tls.Certificate{}, err
+	}
+	serial := new(big.Int).SetBytes(serialBytes[:])
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "katzenpost"},
+		NotBefore:    now.Add(-24 * time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, privKey.Public(), privKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  privKey,
+	}, nil
+}
+
+func newLinkTLSServerConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// newLinkTLSClientConfig returns a TLS configuration that accepts only the
+// self-signed certificate for the peer's identity key.
+func newLinkTLSClientConfig(identityKey *eddsa.PublicKey) *tls.Config {
+	expected := identityKey.Bytes()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+
+		// There is no PKIX involved, the certificate is pinned instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) != 1 {
+				return errLinkTLSPinning
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			pubKey, ok := cert.PublicKey.(ed25519.PublicKey)
+			if !ok || !bytes.Equal(pubKey, expected) {
+				return errLinkTLSPinning
+			}
+			return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+		},
+	}
+}
+
+// peekConn is a net.Conn that has had data buffered.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// acceptLinkTLS wraps the incoming connection conn in TLS iff the peer
+// initiated a TLS handshake.  On failure conn is left to the caller to
+// close.
+func acceptLinkTLS(conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	pc := &peekConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	b, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != tlsRecordTypeHandshake {
+		return pc, nil
+	}
+	return tls.Server(pc, cfg), nil
+}
+
+// resetLinkTLSKey clears the copy of the identity key held by the link TLS
+// certificate, if any.
+func (s *Server) resetLinkTLSKey() {
+	if s.linkTLSConfig == nil {
+		return
+	}
+	for _, cert := range s.linkTLSConfig.Certificates {
+		if k, ok := cert.PrivateKey.(ed25519.PrivateKey); ok {
+			utils.ExplicitBzero(k)
+		}
+	}
+}
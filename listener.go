@@ -19,63 +19,122 @@ package server
 import (
 	"bytes"
 	"container/list"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/ipacl"
 	"github.com/op/go-logging"
 )
 
+const (
+	networkTCP       = "tcp"
+	networkWebSocket = "websocket"
+	networkUnix      = "unix"
+)
+
 type listener struct {
 	sync.Mutex
 	worker.Worker
 
+	isStopping uint32 // MUST be accessed via sync/atomic.
+
 	s   *Server
 	l   net.Listener
 	log *logging.Logger
 
+	addr  string
 	conns *list.List
 
+	network     string
+	acl         *ipacl.ACL
+	transport   Transport
+	clientsOnly bool
+	mixesOnly   bool
+	isTrusted   bool
+
 	closeAllCh chan interface{}
 	closeAllWg sync.WaitGroup
+	haltOnce   sync.Once
 }
 
 func (l *listener) Halt() {
-	// Close the listener, wait for worker() to return.
-	l.l.Close()
-	l.Worker.Halt()
+	l.stopAccepting()
 
 	// Close all connections belonging to the listener.
 	//
 	// Note: Worst case this can take up to the handshake timeout to
 	// actually complete, since the channel isn't checked mid-handshake.
-	close(l.closeAllCh)
+	l.haltOnce.Do(func() { close(l.closeAllCh) })
 	l.closeAllWg.Wait()
 }
 
+// Drain stops accepting new connections, and waits up to timeout for the
+// existing connections to be closed by the peers, before closing the rest.
+func (l *listener) Drain(timeout time.Duration) {
+	const pollInterval = 100 * time.Millisecond
+
+	l.stopAccepting()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		l.Lock()
+		nConns := l.conns.Len()
+		l.Unlock()
+		if nConns == 0 {
+			break
+		}
+		time.Sleep(pollInterval)
+	}
+
+	l.Halt()
+}
+
+// stopAccepting closes the listener, and waits for worker() to return,
+// leaving the established connections alone.
+func (l *listener) stopAccepting() {
+	atomic.StoreUint32(&l.isStopping, 1)
+	l.l.Close()
+	l.Worker.Halt()
+}
+
 func (l *listener) worker() {
 	addr := l.l.Addr()
 	l.log.Noticef("Listening on: %v", addr)
-	defer func() {
-		l.log.Noticef("Stopping listening on: %v", addr)
-		l.l.Close() // Usually redundant, but harmless.
-	}()
+	defer l.log.Noticef("Stopping listening on: %v", addr)
 	for {
 		conn, err := l.l.Accept()
 		if err != nil {
+			if atomic.LoadUint32(&l.isStopping) != 0 {
+				return
+			}
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
 				l.log.Errorf("Critical accept failure: %v", err)
+				l.l.Close() // Usually redundant, but harmless.
 				return
 			}
 			continue
 		}
 
-		tcpConn := conn.(*net.TCPConn)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(keepAliveInterval)
+		// WebSocket connections are admitted by the wsListener, before
+		// the HTTP server sees them.
+		if l.network != networkWebSocket && !l.admit(conn) {
+			conn.Close()
+			continue
+		}
 
-		l.log.Debugf("Accepted new connection: %v", conn.RemoteAddr())
+		l.log.Debugf("Accepted new connection: %v", l.s.logRedactor.addr(conn.RemoteAddr()))
+		if err = tuneTCPConn(conn, l.s.cfg.Debug); err != nil {
+			l.log.Warningf("Failed to set socket options: %v", err)
+		}
 
 		l.onNewConn(conn)
 	}
@@ -83,6 +142,27 @@ func (l *listener) worker() {
 	// NOTREACHED
 }
 
+// admit returns true iff a new connection passes the listener's access
+// control list, the peer bans, and the connection limits.  Each admitted
+// connection MUST be paired with a call to connLimiter.release.
+func (l *listener) admit(conn net.Conn) bool {
+	addr := conn.RemoteAddr()
+	if !l.isAllowed(addr) {
+		l.log.Debugf("Rejecting new connection: %v (Denied by ACL)", l.s.logRedactor.addr(addr))
+		l.s.connLimiter.onRejectedACL()
+		return false
+	}
+	if l.s.peerBans.isBanned(addr) {
+		l.log.Debugf("Rejecting new connection: %v (Banned)", l.s.logRedactor.addr(addr))
+		return false
+	}
+	if err := l.s.connLimiter.admit(addr); err != nil {
+		l.log.Debugf("Rejecting new connection: %v (%v)", l.s.logRedactor.addr(addr), err)
+		return false
+	}
+	return true
+}
+
 func (l *listener) onNewConn(conn net.Conn) {
 	c := newIncomingConn(l, conn)
 
@@ -90,7 +170,7 @@ func (l *listener) onNewConn(conn net.Conn) {
 	l.Lock()
 	defer func() {
 		l.Unlock()
-		go c.worker()
+		go l.s.guard("incoming connection", c.worker)()
 	}()
 	c.e = l.conns.PushFront(c)
 }
@@ -109,14 +189,19 @@ func (l *listener) onClosedConn(c *incomingConn) {
 		l.closeAllWg.Done()
 	}()
 	l.conns.Remove(c.e)
+	if l.network != networkWebSocket {
+		// WebSocket connections are released by the wsListener.
+		l.s.connLimiter.release(c.c.RemoteAddr())
+	}
 }
 
-func (l *listener) isConnUnique(c *incomingConn) bool {
+func (l *listener) countDuplicateConns(c *incomingConn) int {
 	l.Lock()
 	defer l.Unlock()
 
 	a := c.w.PeerCredentials()
 
+	n := 0
 	for e := l.conns.Front(); e != nil; e = e.Next() {
 		cc := e.Value.(*incomingConn)
 
@@ -127,31 +212,283 @@ func (l *listener) isConnUnique(c *incomingConn) bool {
 
 		// Compare both by AdditionalData and PublicKey.
 		b := cc.w.PeerCredentials()
-		if bytes.Equal(a.AdditionalData, b.AdditionalData) {
-			return false
-		}
-		if a.PublicKey.Equal(b.PublicKey) {
-			return false
+		if bytes.Equal(a.AdditionalData, b.AdditionalData) || a.PublicKey.Equal(b.PublicKey) {
+			n++
 		}
 	}
 
-	return true
+	return n
 }
 
 func newListener(s *Server, id int, addr string) (*listener, error) {
-	var err error
+	nl, err := s.listenTCP(bindAddress(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	l := newListenerFrom(s, fmt.Sprintf("listener:%d", id), nl)
+	l.addr = addr
+	l.network = networkTCP
+	l.setRole(s.cfg.Server.AddressRole(addr))
+	if l.acl, err = newACL(s.cfg.Server.AddressACL(addr)); err != nil {
+		nl.Close()
+		return nil, err
+	}
+	if name, ok := s.cfg.Server.AddressTransports[addr]; ok {
+		if l.transport, err = getTransport(name); err != nil {
+			nl.Close()
+			return nil, err
+		}
+	}
+	l.Go(s.supervise("listener "+l.addr, l.worker))
+	return l, nil
+}
+
+// bindAddress returns the address that the listener for addr binds to.
+// Addresses with a DNS name are bound on all interfaces, since the name
+// need not resolve to a local address, eg: when behind a NAT.
+func bindAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr
+	}
+	return net.JoinHostPort("", port)
+}
+
+func newACL(cfg *config.ACL) (*ipacl.ACL, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	return ipacl.New(cfg.Allow, cfg.Deny)
+}
+
+// isAllowed returns true iff the listener's access control list, if any,
+// allows connections from addr.
+func (l *listener) isAllowed(addr net.Addr) bool {
+	if l.acl == nil {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return l.acl.IsAllowed(tcpAddr.IP)
+}
+
+func (l *listener) setRole(role string) {
+	l.clientsOnly = role == config.RoleClient
+	l.mixesOnly = role == config.RoleMix
+}
+
+func (l *listener) role() string {
+	switch {
+	case l.clientsOnly:
+		return config.RoleClient
+	case l.mixesOnly:
+		return config.RoleMix
+	default:
+		return "any"
+	}
+}
+
+func newWebSocketListener(s *Server, id int, addr string) (*listener, error) {
+	nl, err := newWSListener(s.cfg.Provider.WebSocket, addr, time.Duration(s.cfg.Debug.HandshakeTimeout)*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
 
+	// WebSocket listeners exist to let clients on restrictive networks
+	// reach their provider, so only accept connections from clients.
+	l := newListenerFrom(s, fmt.Sprintf("listener:ws:%d", id), nl)
+	l.addr = addr
+	l.network = networkWebSocket
+	l.clientsOnly = true
+	if l.acl, err = newACL(s.cfg.Server.AddressACL(addr)); err != nil {
+		nl.Close()
+		return nil, err
+	}
+	nl.serve(l.admit, s.connLimiter.release)
+	l.Go(s.supervise("listener "+l.addr, l.worker))
+	return l, nil
+}
+
+func newUnixListener(s *Server, path string) (*listener, error) {
+	// Remove the stale socket left behind by an unclean shutdown, if any.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	nl, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Peers on the unix domain socket are implicitly trusted, so restrict
+	// access to the owner.
+	if err = os.Chmod(path, 0600); err != nil {
+		nl.Close()
+		return nil, err
+	}
+
+	l := newListenerFrom(s, "listener:unix", nl)
+	l.addr = path
+	l.network = networkUnix
+	l.isTrusted = true
+	l.Go(s.supervise("listener "+l.addr, l.worker))
+	return l, nil
+}
+
+func newListenerFrom(s *Server, name string, nl net.Listener) *listener {
 	l := new(listener)
 	l.s = s
-	l.log = s.logBackend.GetLogger(fmt.Sprintf("listener:%d", id))
+	l.l = nl
+	l.log = s.newLogger(name)
 	l.conns = list.New()
 	l.closeAllCh = make(chan interface{})
+	return l
+}
+
+// listenerAddresses returns the addresses of the link layer listeners, for
+// inclusion in the descriptor.
+func (s *Server) listenerAddresses() []string {
+	s.listenersLock.RLock()
+	defer s.listenersLock.RUnlock()
+
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		// Client only addresses are handed to clients out of band, since
+		// the descriptor has no way to express roles, and mixes will
+		// otherwise attempt to connect to them.
+		if l != nil && l.network == networkTCP && !l.clientsOnly {
+			addr := l.addr
+			if s.nat != nil {
+				addr = s.nat.externalAddress(addr)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (s *Server) onMgmtListenerList(c *thwack.Conn, l string) error {
+	s.listenersLock.RLock()
+	defer s.listenersLock.RUnlock()
+
+	for _, ll := range s.listeners {
+		if ll == nil {
+			continue
+		}
+		ll.Lock()
+		nConns := ll.conns.Len()
+		ll.Unlock()
+		if err := c.Writer().PrintfLine("%v-%v Network:%v Role:%v Conns:%v", thwack.StatusOk, ll.addr, ll.network, ll.role(), nConns); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
 
-	l.l, err = net.Listen("tcp", addr)
+func (s *Server) onMgmtListenerAdd(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 && len(sp) != 3 {
+		c.Log().Debugf("LISTENER_ADD invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	addr := sp[1]
+	if err := config.EnsureAddrHostPort(addr); err != nil {
+		c.Log().Errorf("LISTENER_ADD invalid address '%v': %v", addr, err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	role := ""
+	if len(sp) == 3 {
+		role = sp[2]
+		switch role {
+		case config.RoleMix:
+		case config.RoleClient:
+			if !s.cfg.Server.IsProvider {
+				c.Log().Errorf("LISTENER_ADD client role set when not a Provider")
+				return c.WriteReply(thwack.StatusTransactionFailed)
+			}
+		default:
+			c.Log().Errorf("LISTENER_ADD invalid role '%v'", role)
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+	}
+
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	for _, ll := range s.listeners {
+		if ll != nil && ll.network == networkTCP && ll.addr == addr {
+			c.Log().Errorf("LISTENER_ADD address '%v' already exists", addr)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+	}
+
+	ll, err := newListener(s, s.listenerID, addr)
 	if err != nil {
-		return nil, err
+		c.Log().Errorf("Failed to spawn listener on address: %v (%v).", addr, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	if role != "" {
+		ll.setRole(role)
 	}
+	s.listenerID++
+	s.listeners = append(s.listeners, ll)
+	s.log.Noticef("Added listener on address: %v, the change will be advertised with the next descriptor.", addr)
 
-	l.Go(l.worker)
-	return l, nil
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// takeListener removes the link layer listener on addr from the listener
+// table, and returns it.  The last listener that accepts connections from
+// mixes is never removed.
+func (s *Server) takeListener(addr string) (*listener, error) {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	idx := -1
+	nListeners := 0
+	for i, v := range s.listeners {
+		if v == nil || v.network != networkTCP {
+			continue
+		}
+		if !v.clientsOnly {
+			nListeners++
+		}
+		if v.addr == addr {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("no listener on address '%v'", addr)
+	}
+	ll := s.listeners[idx]
+	if !ll.clientsOnly && nListeners == 1 {
+		return nil, errors.New("refusing to remove the last listener")
+	}
+	s.listeners = append(s.listeners[:idx:idx], s.listeners[idx+1:]...)
+	return ll, nil
+}
+
+func (s *Server) onMgmtListenerRemove(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("LISTENER_REMOVE invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	addr := sp[1]
+
+	ll, err := s.takeListener(addr)
+	if err != nil {
+		c.Log().Errorf("LISTENER_REMOVE %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	// Stop accepting new connections, and give the existing connections a
+	// chance to wind down gracefully.
+	s.log.Noticef("Removing listener on address: %v, the change will be advertised with the next descriptor.", addr)
+	ll.Drain(time.Duration(s.cfg.Debug.ListenerDrainTimeout) * time.Millisecond)
+
+	return c.WriteReply(thwack.StatusOk)
 }
@@ -0,0 +1,61 @@
+// listener_test.go - Katzenpost server listener tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTakeListener(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	mixL := &listener{addr: "127.0.0.1:1234", network: networkTCP}
+	clientL := &listener{addr: "127.0.0.1:1235", network: networkTCP, clientsOnly: true}
+	unixL := &listener{addr: "/tmp/katzenpost.sock", network: networkUnix}
+	s := &Server{listeners: []*listener{mixL, unixL, clientL}}
+
+	_, err := s.takeListener("127.0.0.1:9999")
+	assert.Error(err, "takeListener(): unknown address")
+
+	// Only TCP listeners can be removed.
+	_, err = s.takeListener(unixL.addr)
+	assert.Error(err, "takeListener(): unix listener")
+
+	// The last listener that accepts mixes is kept.
+	_, err = s.takeListener(mixL.addr)
+	assert.Error(err, "takeListener(): last mix listener")
+	assert.Len(s.listeners, 3, "takeListener(): last mix listener")
+
+	// Client only listeners can be removed, and do not count towards the
+	// listeners that accept mixes.
+	l, err := s.takeListener(clientL.addr)
+	require.NoError(err, "takeListener(): client only listener")
+	assert.Equal(clientL, l, "takeListener(): client only listener")
+	assert.Equal([]*listener{mixL, unixL}, s.listeners, "takeListener(): client only listener")
+
+	// With another listener that accepts mixes, either can be removed.
+	mixL2 := &listener{addr: "127.0.0.1:1236", network: networkTCP}
+	s.listeners = append(s.listeners, mixL2)
+	l, err = s.takeListener(mixL.addr)
+	require.NoError(err, "takeListener(): mix listener")
+	assert.Equal(mixL, l, "takeListener(): mix listener")
+	assert.Equal([]*listener{unixL, mixL2}, s.listeners, "takeListener(): mix listener")
+}
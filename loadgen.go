@@ -0,0 +1,190 @@
+// loadgen.go - Katzenpost server synthetic load generator.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/monotime"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/worker"
+	"github.com/op/go-logging"
+)
+
+const (
+	loadGenTickInterval = 10 * time.Millisecond
+	loadGenMaxDelay     = 1000 // ms
+)
+
+var errLoadGenNoMixKey = errors.New("loadgen: no mix key for the current epoch")
+
+// loadGen is the synthetic load generator, that injects packets addressed
+// to the node's own mix keys into the crypto workers at a fixed rate, so
+// that the unwrap, replay detection and scheduling throughput can be
+// measured on a running node.  The packets are discarded by the scheduler
+// instead of being forwarded.
+type loadGen struct {
+	// Note: The counters are first to guarantee 64 bit alignment.
+	generated  uint64 // MUST be accessed via sync/atomic.
+	failed     uint64 // MUST be accessed via sync/atomic.
+	dispatched uint64 // MUST be accessed via sync/atomic.
+	slackSum   int64  // MUST be accessed via sync/atomic.
+
+	worker.Worker
+
+	s   *Server
+	log *logging.Logger
+
+	sinkID    [sConstants.NodeIDLength]byte
+	startedAt time.Time
+}
+
+// onDispatch is called by the scheduler when a synthetic packet would have
+// been forwarded.
+func (lg *loadGen) onDispatch(pkt *packet, slack time.Duration) {
+	atomic.AddUint64(&lg.dispatched, 1)
+	atomic.AddInt64(&lg.slackSum, int64(slack))
+	pkt.dispose()
+}
+
+func (lg *loadGen) newPacket(delay uint32) (*packet, error) {
+	epoch := uint64(debugStaticEpoch)
+	if !lg.s.cfg.Debug.DisableKeyRotation {
+		epoch, _, _ = lg.s.epochNow()
+	}
+	k, ok := lg.s.mixKeys.publicKey(epoch)
+	if !ok {
+		return nil, errLoadGenNoMixKey
+	}
+
+	// The first hop is this node, and the second is a sink that does not
+	// exist, which is fine since the packet never leaves the node.
+	path := []*sphinx.PathHop{
+		{
+			ID:        lg.s.identityKey.PublicKey().ByteArray(),
+			PublicKey: k,
+			Commands:  []commands.RoutingCommand{&commands.NodeDelay{Delay: delay}},
+		},
+		{
+			ID:        lg.sinkID,
+			PublicKey: k,
+			Commands:  []commands.RoutingCommand{new(commands.Recipient)},
+		},
+	}
+	var payload [constants.ForwardPayloadLength]byte
+	raw, err := sphinx.NewPacket(rand.Reader, path, payload[:])
+	if err != nil {
+		return nil, err
+	}
+
+	pkt := newPacket()
+	if err = pkt.copyToRaw(raw); err != nil {
+		pkt.dispose()
+		return nil, err
+	}
+	pkt.isSynthetic = true
+	return pkt, nil
+}
+
+func (lg *loadGen) worker() {
+	mRand := rand.NewMath()
+	rate := float64(lg.s.cfg.Debug.LoadGenRate)
+	ticker := time.NewTicker(loadGenTickInterval)
+	defer ticker.Stop()
+
+	lg.log.Warningf("Generating synthetic load: %v packets/sec.", lg.s.cfg.Debug.LoadGenRate)
+	lastTick := monotime.Now()
+	credit := 0.0
+	for {
+		select {
+		case <-lg.HaltCh():
+			lg.log.Debugf("Terminating gracefully.")
+			return
+		case <-ticker.C:
+		}
+
+		// Accumulate the packets owed since the last tick, capping the
+		// backlog to a second's worth if generation can't keep up.
+		now := monotime.Now()
+		credit += rate * (now - lastTick).Seconds()
+		lastTick = now
+		if credit > rate {
+			credit = rate
+		}
+
+		for ; credit >= 1; credit-- {
+			maxDelay := uint64(loadGenMaxDelay)
+			if d := lg.s.pki.maxNodeDelay(); d > 0 && d < maxDelay {
+				maxDelay = d
+			}
+			pkt, err := lg.newPacket(uint32(mRand.Int63n(int64(maxDelay) + 1)))
+			if err != nil {
+				lg.log.Debugf("Failed to generate packet: %v", err)
+				atomic.AddUint64(&lg.failed, 1)
+				continue
+			}
+			atomic.AddUint64(&lg.generated, 1)
+			pkt.recvAt = monotime.Now()
+			lg.s.inboundPackets.In() <- pkt
+		}
+	}
+
+	// NOTREACHED
+}
+
+func (lg *loadGen) onMgmtLoadGenStats(c *thwack.Conn, l string) error {
+	generated := atomic.LoadUint64(&lg.generated)
+	dispatched := atomic.LoadUint64(&lg.dispatched)
+	elapsed := time.Since(lg.startedAt).Seconds()
+
+	var meanSlack time.Duration
+	if dispatched > 0 {
+		meanSlack = time.Duration(atomic.LoadInt64(&lg.slackSum) / int64(dispatched))
+	}
+	if err := c.Writer().PrintfLine("%v-Generated:%v Failed:%v Dispatched:%v", thwack.StatusOk, generated, atomic.LoadUint64(&lg.failed), dispatched); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-GeneratedRate:%.1f DispatchedRate:%.1f MeanSlack:%v", thwack.StatusOk, float64(generated)/elapsed, float64(dispatched)/elapsed, meanSlack); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newLoadGen(s *Server) *loadGen {
+	lg := new(loadGen)
+	lg.s = s
+	lg.log = s.newLogger("loadgen")
+	lg.startedAt = time.Now()
+	if _, err := rand.Reader.Read(lg.sinkID[:]); err != nil {
+		panic("BUG: failed to generate the load generator sink ID: " + err.Error())
+	}
+
+	if s.cfg.Management.Enable {
+		const cmdLoadGenStats = "LOADGEN_STATS"
+		s.management.RegisterCommand(cmdLoadGenStats, lg.onMgmtLoadGenStats)
+	}
+
+	lg.Go(s.superviseOptional("loadgen", lg.worker))
+	return lg
+}
@@ -0,0 +1,136 @@
+// logrotate.go - Katzenpost server log rotation.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/internal/logrotate"
+)
+
+var errLogNotAccessible = errors.New("log file is not accessible")
+
+type logRotator struct {
+	sync.Mutex
+
+	s *Server
+
+	path      string
+	rotatedAt time.Time
+
+	inProgress uint32 // MUST be accessed via sync/atomic.
+}
+
+func (r *logRotator) rotate(reason string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.path == "" {
+		return errLogNotAccessible
+	}
+
+	keep := r.s.cfg.Logging.MaxBackups
+	if keep < 0 {
+		keep = 0
+	}
+	if err := logrotate.Rotate(r.path, keep); err != nil {
+		r.s.log.Errorf("Failed to rotate log file: %v", err)
+		return err
+	}
+	r.rotatedAt = time.Now()
+	r.s.log.Noticef("Rotated log file (%v).", reason)
+	return nil
+}
+
+// maybeRotate is called periodically, and will asynchronously rotate the
+// log file if it is over the configured size or age.
+func (r *logRotator) maybeRotate() {
+	r.Lock()
+	age, path := time.Since(r.rotatedAt), r.path
+	r.Unlock()
+	if path == "" {
+		return
+	}
+
+	var reason string
+	if maxAge := r.s.cfg.Logging.MaxAge; maxAge > 0 && age >= time.Duration(maxAge)*time.Hour {
+		reason = "age"
+	} else if maxSize := r.s.cfg.Logging.MaxSize; maxSize > 0 {
+		fi, err := os.Stat(path)
+		if err != nil || fi.Size() < int64(maxSize)<<20 {
+			return
+		}
+		reason = "size"
+	} else {
+		return
+	}
+
+	if !atomic.CompareAndSwapUint32(&r.inProgress, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreUint32(&r.inProgress, 0)
+		r.rotate(reason)
+	}()
+}
+
+func (r *logRotator) onMgmtRotateLog(c *thwack.Conn, l string) error {
+	if err := r.rotate("management interface"); err != nil {
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// onChroot adjusts the log file path after a chroot to root, disabling
+// rotation if the log file is outside of the chroot.
+func (r *logRotator) onChroot(root string) {
+	r.Lock()
+	defer r.Unlock()
+
+	rel, err := filepath.Rel(root, r.path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		r.s.log.Warningf("Log file is outside of the chroot, disabling rotation.")
+		r.path = ""
+		return
+	}
+	r.path = filepath.Join("/", rel)
+}
+
+func newLogRotator(s *Server, path string) *logRotator {
+	r := new(logRotator)
+	r.s = s
+	r.path = path
+	r.rotatedAt = time.Now()
+	return r
+}
+
+// RotateLog rotates the log file.  This is intended to be called by the
+// host application, on receipt of SIGUSR1 or similar.  It is a no-op if
+// logging to a file is not enabled.
+func (s *Server) RotateLog() error {
+	if s.logRotator == nil {
+		return nil
+	}
+	return s.logRotator.rotate("requested")
+}
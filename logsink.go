@@ -0,0 +1,128 @@
+// logsink.go - Katzenpost server external log sinks.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/logsink"
+	"github.com/op/go-logging"
+)
+
+// logSinkBackend is a go-logging backend that sends log records to an
+// external log sink.
+type logSinkBackend struct {
+	sink logsink.Sink
+}
+
+func (b *logSinkBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	var sev logsink.Severity
+	switch level {
+	case logging.CRITICAL:
+		sev = logsink.SeverityCritical
+	case logging.ERROR:
+		sev = logsink.SeverityError
+	case logging.WARNING:
+		sev = logsink.SeverityWarning
+	case logging.NOTICE:
+		sev = logsink.SeverityNotice
+	case logging.INFO:
+		sev = logsink.SeverityInfo
+	default:
+		sev = logsink.SeverityDebug
+	}
+	return b.sink.Write(sev, rec.Module+": "+rec.Message())
+}
+
+func loadCertPool(f string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("server: no certificates in '%v'", f)
+	}
+	return pool, nil
+}
+
+func (s *Server) newLogSink() (logsink.Sink, error) {
+	lCfg := s.cfg.Logging
+	if lCfg.Format == config.LogFormatJSON {
+		return logsink.NewJSON(os.Stdout), nil
+	}
+	if lCfg.Journald {
+		return logsink.NewJournal(logsink.DefaultJournalSocket, "katzenpost")
+	}
+
+	sCfg := lCfg.Syslog
+	cfg := &logsink.SyslogConfig{
+		Network: sCfg.Network,
+		Address: sCfg.Address,
+		Tag:     sCfg.Tag,
+	}
+	if cfg.Network == "" {
+		cfg.Network = logsink.NetworkUnix
+	}
+	var ok bool
+	if cfg.Facility, ok = logsink.Facility(sCfg.Facility); !ok {
+		panic("BUG: Invalid syslog facility: " + sCfg.Facility)
+	}
+	if cfg.Network == logsink.NetworkTLS {
+		cfg.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if sCfg.TLSCAFile != "" {
+			var err error
+			if cfg.TLSConfig.RootCAs, err = loadCertPool(sCfg.TLSCAFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return logsink.NewSyslog(cfg)
+}
+
+func (s *Server) initLogSink() error {
+	sink, err := s.newLogSink()
+	if err != nil {
+		return err
+	}
+
+	lvl, err := logging.LogLevel(s.cfg.Logging.Level)
+	if err != nil {
+		sink.Close()
+		return err
+	}
+	s.logSink = sink
+	s.logSinkBackend = logging.AddModuleLevel(&logSinkBackend{sink: sink})
+	s.logSinkBackend.SetLevel(lvl, "")
+	return nil
+}
+
+func (s *Server) newLogger(module string) *logging.Logger {
+	if s.cfg.Logging.PrefixIdentifier {
+		module = s.cfg.Server.Identifier + ":" + module
+	}
+	l := s.logBackend.GetLogger(module)
+	if s.logSinkBackend != nil {
+		l.SetBackend(s.logSinkBackend)
+	}
+	return l
+}
@@ -0,0 +1,86 @@
+// management.go - Katzenpost server management commands.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+func (s *Server) isForwardingPaused() bool {
+	return atomic.LoadUint32(&s.forwardingPaused) != 0
+}
+
+func (s *Server) onMgmtQueueDepths(c *thwack.Conn, l string) error {
+	if err := c.Writer().PrintfLine("%v-Inbound:%v", thwack.StatusOk, s.inboundPackets.Len()); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-Scheduler:%v SchedulerInbound:%v", thwack.StatusOk, s.scheduler.queueLen(), s.scheduler.ch.Len()); err != nil {
+		return err
+	}
+	if s.provider != nil {
+		if err := c.Writer().PrintfLine("%v-Provider:%v", thwack.StatusOk, s.provider.ch.Len()); err != nil {
+			return err
+		}
+	}
+	if err := c.Writer().PrintfLine("%v-Outgoing:%v ForwardingPaused:%v Overloaded:%v", thwack.StatusOk, s.connector.queueLen(), s.isForwardingPaused(), atomic.LoadUint32(&s.connLimiter.isOverloaded) != 0); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtHealth(c *thwack.Conn, l string) error {
+	if err := c.Writer().PrintfLine("%v-PKIDocument:%v ForwardingPaused:%v", thwack.StatusOk, s.pki.hasCurrentDocument(), s.isForwardingPaused()); err != nil {
+		return err
+	}
+	if failed := s.workers.failedCritical(); len(failed) > 0 {
+		if err := c.Writer().PrintfLine("%v-FailedWorkers:%v", thwack.StatusOk, strings.Join(failed, ",")); err != nil {
+			return err
+		}
+	}
+	if isDecommissioning, shutdownAt := s.decommission.status(); isDecommissioning {
+		if err := c.Writer().PrintfLine("%v-Decommissioning:true ShutdownAt:%v", thwack.StatusOk, shutdownAt); err != nil {
+			return err
+		}
+	}
+	if s.forwardCap != nil {
+		if err := c.Writer().PrintfLine("%v-Forwarded:%v ForwardCap:%v ForwardCapReached:%v", thwack.StatusOk, s.forwardCap.forwarded(), s.forwardCap.max, atomic.LoadUint32(&s.forwardCap.isReached) != 0); err != nil {
+			return err
+		}
+	}
+	state, sent, returned := s.decoy.selfTest.status()
+	if err := c.Writer().PrintfLine("%v-SelfTest:%v Sent:%v Returned:%v", thwack.StatusOk, state, sent, returned); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtPauseForwarding(c *thwack.Conn, l string) error {
+	if atomic.CompareAndSwapUint32(&s.forwardingPaused, 0, 1) {
+		s.log.Warningf("Forwarding paused via the management interface.")
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onMgmtResumeForwarding(c *thwack.Conn, l string) error {
+	if atomic.CompareAndSwapUint32(&s.forwardingPaused, 1, 0) {
+		s.log.Noticef("Forwarding resumed via the management interface.")
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
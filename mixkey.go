@@ -17,12 +17,20 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/server/internal/mixkey"
 	"github.com/op/go-logging"
 )
@@ -46,11 +54,17 @@ func (m *mixKeys) init() error {
 		// If key rotation is disabled via the debug parameter, then
 		// use a static epoch for the purpose of identifying the internal
 		// key.
-		k, err := mixkey.New(m.s.cfg.Server.DataDir, debugStaticEpoch)
+		k, err := mixkey.New(m.s.mixKeyDir(), debugStaticEpoch)
 		if err != nil {
 			return err
 		}
 		m.keys[debugStaticEpoch] = k
+		if m.s.cfg.Debug.ReplayJournal {
+			if err = k.EnableJournal(); err != nil {
+				return err
+			}
+		}
+		m.checkRestored(k)
 
 		m.log.Warning("Static mix key is used, there will be no forward secrecy.")
 
@@ -62,17 +76,17 @@ func (m *mixKeys) init() error {
 	// TODO: In theory this should also try to load the previous epoch's key
 	// if the current time is in the clock skew grace period.  But it may not
 	// matter much in practice.
-	epoch, _, _ := epochtime.Now()
+	epoch, _, _ := m.s.epochNow()
 	if _, err := m.generateMixKeys(epoch); err != nil {
 		return err
 	}
 
 	// Clean up stale mix keys hanging around the data directory.
-	files, err := filepath.Glob(filepath.Join(m.s.cfg.Server.DataDir, mixkey.KeyGlob))
+	files, err := filepath.Glob(filepath.Join(m.s.mixKeyDir(), mixkey.KeyGlob))
 	if err != nil {
 		m.log.Warningf("Failed to find persisted keys: %v", err)
 	}
-	keyFmt := filepath.Join(m.s.cfg.Server.DataDir, mixkey.KeyFmt)
+	keyFmt := filepath.Join(m.s.mixKeyDir(), mixkey.KeyFmt)
 	for _, f := range files {
 		e := uint64(0)
 		if _, err := fmt.Sscanf(f, keyFmt, &e); err != nil {
@@ -81,7 +95,7 @@ func (m *mixKeys) init() error {
 		}
 		if _, ok := m.keys[e]; !ok && e < epoch {
 			m.log.Debugf("Purging stale key: %v", f)
-			os.Remove(f)
+			mixkey.Remove(f)
 		}
 	}
 
@@ -100,7 +114,7 @@ func (m *mixKeys) generateMixKeys(baseEpoch uint64) (bool, error) {
 		}
 
 		didGenerate = true
-		k, err := mixkey.New(m.s.cfg.Server.DataDir, e)
+		k, err := mixkey.New(m.s.mixKeyDir(), e)
 		if err != nil {
 			// Clean up whatever keys that may have succeded.
 			for ee := baseEpoch; ee < baseEpoch+numMixKeys; ee++ {
@@ -113,13 +127,69 @@ func (m *mixKeys) generateMixKeys(baseEpoch uint64) (bool, error) {
 		}
 		k.SetUnlinkIfExpired(true)
 		m.keys[e] = k
+		if m.s.cfg.Debug.ReplayJournal {
+			if err = k.EnableJournal(); err != nil {
+				m.log.Warningf("Failed to enable the replay tag journal for epoch %v: %v", e, err)
+			}
+		}
+		m.checkRestored(k)
 	}
 
 	return didGenerate, nil
 }
 
+// checkRestored puts a freshly loaded key into warm-up if its replay filter
+// was last flushed longer ago than Debug.ReplayRestoreGap while the key was
+// usable, as happens when the database is restored from a backup.  Since the
+// tags seen after the backup point are unknown, packets for the key are
+// dropped till the warm-up ends.
+func (m *mixKeys) checkRestored(k *mixkey.MixKey) {
+	gap := time.Duration(m.s.cfg.Debug.ReplayRestoreGap) * time.Millisecond
+	lastFlush := k.LastFlush()
+	if gap <= 0 || lastFlush.IsZero() {
+		return
+	}
+
+	// Only the time since the key became usable counts, a future epoch's
+	// key is never used and can't have missed any tags.
+	now := time.Now()
+	epoch, elapsed, till := m.s.epochNow()
+	keyEnd := now.Add(till)
+	since := lastFlush
+	if !m.s.cfg.Debug.DisableKeyRotation {
+		offset := time.Duration(int64(k.Epoch())-int64(epoch)) * epochtime.Period
+		keyStart := now.Add(offset - elapsed - mixKeyGracePeriod)
+		if keyStart.After(since) {
+			since = keyStart
+		}
+		keyEnd = keyEnd.Add(offset)
+	}
+	if now.Sub(since) <= gap {
+		return
+	}
+
+	until := keyEnd.Add(mixKeyGracePeriod)
+	if warmup := m.s.cfg.Debug.ReplayWarmup; warmup > 0 {
+		until = now.Add(time.Duration(warmup) * time.Millisecond)
+	}
+	k.SetWarmup(until)
+	m.log.Warningf("Mix key for epoch %v was last flushed %v ago, assuming it was restored from a backup.", k.Epoch(), now.Sub(lastFlush).Round(time.Second))
+	m.log.Warningf("Dropping all packets for the epoch %v mix key till %v, use REVOKE_MIXKEY to replace the key instead.", k.Epoch(), until.Format(time.RFC3339))
+	m.s.emitDegradedEvent(fmt.Sprintf("mix key %v replay warm-up", k.Epoch()))
+}
+
+// flush flushes the replay filter write-back caches of all of the keys.
+func (m *mixKeys) flush() {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, k := range m.keys {
+		k.Flush()
+	}
+}
+
 func (m *mixKeys) pruneMixKeys() bool {
-	epoch, _, _ := epochtime.Now()
+	epoch, _, _ := m.s.epochNow()
 	didPrune := false
 
 	m.Lock()
@@ -137,6 +207,136 @@ func (m *mixKeys) pruneMixKeys() bool {
 	return didPrune
 }
 
+// revoke immediately destroys the mix key for the given epoch, so that it
+// can not be used to process packets once the crypto workers re-shadow the
+// keys.  A fresh key will be generated for the epoch if it is still going to
+// be published.
+func (m *mixKeys) revoke(epoch uint64) error {
+	if m.s.cfg.Debug.DisableKeyRotation {
+		return fmt.Errorf("key rotation is disabled")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	k, ok := m.keys[epoch]
+	if !ok {
+		return fmt.Errorf("no key for epoch %v", epoch)
+	}
+
+	// Remove the database right away, the key is fully destroyed once the
+	// last reference to it is dropped.
+	if err := k.Unlink(); err != nil {
+		m.log.Warningf("Failed to delete key for epoch %v: %v", epoch, err)
+	}
+	k.Deref()
+	delete(m.keys, epoch)
+	return nil
+}
+
+func (m *mixKeys) onMgmtRevokeMixKey(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("REVOKE_MIXKEY invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	epoch, err := strconv.ParseUint(sp[1], 10, 64)
+	if err != nil {
+		c.Log().Errorf("REVOKE_MIXKEY invalid epoch '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if err = m.revoke(epoch); err != nil {
+		c.Log().Errorf("REVOKE_MIXKEY failed: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	m.log.Warningf("Revoked the mix key for epoch %v.", epoch)
+
+	// Stop accepting packets for the revoked key, and publish a descriptor
+	// with the replacement key.
+	m.s.reshadowCryptoWorkers()
+	if m.s.pki != nil {
+		m.s.pki.forceRepublish()
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// onMgmtMixKeys lists the mix keys persisted to disk, and with the PURGE
+// argument removes the expired ones that are not loaded.
+func (m *mixKeys) onMgmtMixKeys(c *thwack.Conn, l string) error {
+	sp := strings.Fields(l)
+	doPurge := false
+	switch len(sp) {
+	case 1:
+	case 2:
+		if doPurge = strings.ToUpper(sp[1]) == "PURGE"; !doPurge {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+	default:
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	files, err := filepath.Glob(filepath.Join(m.s.mixKeyDir(), mixkey.KeyGlob))
+	if err != nil {
+		c.Log().Errorf("MIXKEYS failed to find persisted keys: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	sort.Strings(files)
+
+	// Hold the lock for the duration, so that keys are not loaded or
+	// unloaded while being inspected.
+	m.Lock()
+	defer m.Unlock()
+
+	now, _, _ := m.s.epochNow()
+	keyFmt := filepath.Join(m.s.mixKeyDir(), mixkey.KeyFmt)
+	for _, f := range files {
+		epoch := uint64(0)
+		if _, err := fmt.Sscanf(f, keyFmt, &epoch); err != nil {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+
+		// Keys that are loaded hold the database lock, so query them
+		// directly instead.
+		var pubKey *ecdh.PublicKey
+		var nrTags int
+		status := "Loaded"
+		if k, ok := m.keys[epoch]; ok {
+			pubKey = k.PublicKey()
+			if nrTags, err = k.NumReplayTags(); err != nil {
+				m.log.Warningf("Failed to count replay tags for epoch %v: %v", epoch, err)
+			}
+		} else {
+			info, err := mixkey.Inspect(f)
+			if err != nil {
+				m.log.Warningf("Failed to inspect key '%v': %v", f, err)
+				continue
+			}
+			pubKey, nrTags = info.PublicKey, info.NumReplayTags
+			status = "Unloaded"
+			if epoch < now && !m.s.cfg.Debug.DisableKeyRotation {
+				status = "Expired"
+				if doPurge {
+					if err = mixkey.Remove(f); err != nil {
+						m.log.Warningf("Failed to purge expired key '%v': %v", f, err)
+					} else {
+						m.log.Noticef("Purged expired key for epoch: %v", epoch)
+						status = "Purged"
+					}
+				}
+			}
+		}
+
+		fp := sha256.Sum256(pubKey.Bytes())
+		if err = c.Writer().PrintfLine("%v-Epoch:%v Fingerprint:%v Status:%v ReplayTags:%v Size:%v", thwack.StatusOk, epoch, hex.EncodeToString(fp[:8]), status, nrTags, fi.Size()); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
 func (m *mixKeys) shadow(dst map[uint64]*mixkey.MixKey) {
 	m.Lock()
 	defer m.Unlock()
@@ -158,6 +358,18 @@ func (m *mixKeys) shadow(dst map[uint64]*mixkey.MixKey) {
 	}
 }
 
+// publicKey returns the mix public key for the specified epoch, if any.
+func (m *mixKeys) publicKey(epoch uint64) (*ecdh.PublicKey, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	k, ok := m.keys[epoch]
+	if !ok {
+		return nil, false
+	}
+	return k.PublicKey(), true
+}
+
 func (m *mixKeys) Halt() {
 	m.Lock()
 	defer m.Unlock()
@@ -171,7 +383,7 @@ func (m *mixKeys) Halt() {
 func newMixKeys(s *Server) (*mixKeys, error) {
 	m := new(mixKeys)
 	m.s = s
-	m.log = s.logBackend.GetLogger("mixkeys")
+	m.log = s.newLogger("mixkeys")
 	m.keys = make(map[uint64]*mixkey.MixKey)
 	if err := m.init(); err != nil {
 		return nil, err
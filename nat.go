@@ -0,0 +1,218 @@
+// nat.go - Katzenpost server NAT traversal.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/natpmp"
+	"github.com/katzenpost/server/internal/stun"
+	"github.com/op/go-logging"
+)
+
+const (
+	natMappingLifetime = 2 * time.Hour
+	natRefreshInterval = natMappingLifetime / 4
+	natRequestTimeout  = 10 * time.Second
+)
+
+// natTraversal discovers the server's external address when it is behind a
+// NAT, and optionally maps the listener ports through the gateway, so that
+// the descriptor advertises an address that peers can reach.
+type natTraversal struct {
+	worker.Worker
+	sync.RWMutex
+
+	s   *Server
+	log *logging.Logger
+
+	pmp *natpmp.Client
+
+	external net.IP
+	mappings map[uint16]*natpmp.Mapping
+}
+
+// isNATAddress returns true iff ip is an address that is not reachable
+// from outside of a NAT.
+func isNATAddress(ip net.IP) bool {
+	if ip.To4() == nil {
+		// IPv6 is assumed to be globally reachable, modulo firewalls.
+		return false
+	}
+	return ip.IsUnspecified() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// natPorts returns the listener ports on addresses behind the NAT.
+func (n *natTraversal) natPorts() []uint16 {
+	var ports []uint16
+	for _, addr := range n.s.cfg.Server.Addresses {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil || !isNATAddress(ip) {
+			continue
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			ports = append(ports, uint16(p))
+		}
+	}
+	return ports
+}
+
+func (n *natTraversal) refresh() {
+	ctx, cancelFn := context.WithTimeout(context.Background(), natRequestTimeout)
+	defer cancelFn()
+
+	var ip net.IP
+	mappings := make(map[uint16]*natpmp.Mapping)
+	if n.pmp != nil {
+		var err error
+		if ip, err = n.pmp.ExternalAddress(ctx); err != nil {
+			n.log.Warningf("Failed to query the external address: %v", err)
+			return
+		}
+		for _, port := range n.natPorts() {
+			m, err := n.pmp.MapTCP(ctx, port, port, natMappingLifetime)
+			if err != nil {
+				n.log.Warningf("Failed to map port %v: %v", port, err)
+				continue
+			}
+			n.log.Debugf("Mapped port %v to %v for %v.", m.InternalPort, m.ExternalPort, m.Lifetime)
+			mappings[port] = m
+		}
+	} else {
+		addr, err := stun.Discover(ctx, n.s.cfg.NAT.STUNServer)
+		if err != nil {
+			n.log.Warningf("Failed to discover the external address: %v", err)
+			return
+		}
+		ip = addr.IP
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if !ip.Equal(n.external) {
+		// The descriptor for the current epoch is already published, so the
+		// address takes effect with the next publication.
+		n.log.Noticef("External address is: %v", ip)
+	}
+	n.external = ip
+	n.mappings = mappings
+}
+
+// externalAddress returns the address to advertise in the descriptor for
+// the listener address addr.
+func (n *natTraversal) externalAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip == nil || !isNATAddress(ip) {
+		return addr
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return addr
+	}
+
+	n.RLock()
+	defer n.RUnlock()
+	if n.external == nil {
+		return addr
+	}
+	if m, ok := n.mappings[uint16(p)]; ok {
+		p = uint64(m.ExternalPort)
+	}
+	return net.JoinHostPort(n.external.String(), strconv.FormatUint(p, 10))
+}
+
+func (n *natTraversal) worker() {
+	ticker := time.NewTicker(natRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.HaltCh():
+			n.log.Debugf("Terminating gracefully.")
+			return
+		case <-ticker.C:
+		}
+		n.refresh()
+	}
+}
+
+func (n *natTraversal) halt() {
+	n.Halt()
+	if n.pmp == nil {
+		return
+	}
+
+	// Remove the port mappings, on a best effort basis.
+	ctx, cancelFn := context.WithTimeout(context.Background(), natRequestTimeout)
+	defer cancelFn()
+	n.Lock()
+	defer n.Unlock()
+	for port := range n.mappings {
+		if _, err := n.pmp.MapTCP(ctx, port, 0, 0); err != nil {
+			n.log.Warningf("Failed to remove mapping for port %v: %v", port, err)
+		}
+	}
+	n.mappings = nil
+}
+
+func (n *natTraversal) onMgmtNATStatus(c *thwack.Conn, l string) error {
+	n.RLock()
+	defer n.RUnlock()
+
+	if err := c.Writer().PrintfLine("%v-External:%v", thwack.StatusOk, n.external); err != nil {
+		return err
+	}
+	for _, m := range n.mappings {
+		if err := c.Writer().PrintfLine("%v-Port:%v ExternalPort:%v Lifetime:%v", thwack.StatusOk, m.InternalPort, m.ExternalPort, m.Lifetime); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// newNATTraversal creates the NAT traversal helper, and synchronously
+// discovers the external address, so that it is available for the first
+// descriptor publication.
+func newNATTraversal(s *Server) *natTraversal {
+	n := new(natTraversal)
+	n.s = s
+	n.log = s.newLogger("nat")
+	if s.cfg.NAT.PortMapping {
+		n.pmp = natpmp.New(s.cfg.NAT.Gateway)
+	}
+
+	if s.cfg.Management.Enable {
+		const cmdNATStatus = "NAT_STATUS"
+		s.management.RegisterCommand(cmdNATStatus, n.onMgmtNATStatus)
+	}
+
+	n.refresh()
+	n.Go(s.superviseOptional("nat", n.worker))
+	return n
+}
@@ -19,49 +19,134 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	mRand "math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/monotime"
 	cpki "github.com/katzenpost/core/pki"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/wire/commands"
+	"github.com/katzenpost/server/internal/otlp"
+	"github.com/katzenpost/server/internal/tokenbucket"
 	"github.com/op/go-logging"
 )
 
-const keepAliveInterval = 3 * time.Minute
+var (
+	outgoingConnID uint64
 
-var outgoingConnID uint64
+	// paddingPacket is a sentinel used to request that a dummy packet be
+	// sent in constant-rate mode.  It MUST NOT be disposed.
+	paddingPacket = new(packet)
+
+	errPeerClosed      = errors.New("connection closed by peer")
+	errReverseTraffic  = errors.New("peer sent reverse traffic")
+	errReauthFailed    = errors.New("peer reauthenticate failed")
+	errKeepAliveFailed = errors.New("peer failed to respond to keepalive")
+	errPeerBanned      = errors.New("peer is banned for misbehavior")
+)
+
+type linkState int
+
+const (
+	linkStateDialing linkState = iota
+	linkStateHandshaking
+	linkStateEstablished
+)
+
+func (s linkState) String() string {
+	switch s {
+	case linkStateDialing:
+		return "Dialing"
+	case linkStateHandshaking:
+		return "Handshaking"
+	case linkStateEstablished:
+		return "Established"
+	default:
+		return fmt.Sprintf("[Unknown state: %d]", int(s))
+	}
+}
+
+// linkStatus is a snapshot of the status of an outgoing link.
+type linkStatus struct {
+	State       linkState
+	Addr        string
+	LastErr     error
+	ConnectedAt time.Time
+}
+
+// peerStatus is a snapshot of the status of an outgoing peer.
+type peerStatus struct {
+	ID         [sConstants.NodeIDLength]byte
+	Addresses  []string
+	Links      []linkStatus
+	QueueDepth int
+	Stats      peerCounters
+}
 
 type outgoingConn struct {
+	sync.Mutex
+
 	s   *Server
 	co  *connector
 	dst *cpki.MixDescriptor
 	ch  chan *packet
 	log *logging.Logger
 
-	id         uint64
-	retryDelay time.Duration
-	canSend    bool
+	id     uint64
+	nodeID [sConstants.NodeIDLength]byte
+	links  []*outgoingLink
+
+	drainCh   chan interface{}
+	drainOnce sync.Once
+
+	stats       *peerCounters
+	egressLimit *tokenbucket.Bucket
+}
+
+type outgoingLink struct {
+	s   *Server
+	c   *outgoingConn
+	dst *cpki.MixDescriptor
+	log *logging.Logger
+
+	idx           int
+	retryDelay    time.Duration
+	retryAttempts int
+	canSend       bool
+
+	// load is the number of packets being written to the peer by the
+	// link, and is accessed atomically.
+	load int32
+
+	// Protected by the outgoingConn's lock.
+	status linkStatus
+
+	mRand *mRand.Rand
 }
 
-func (c *outgoingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
+func (l *outgoingLink) IsPeerValid(creds *wire.PeerCredentials) bool {
 	// At a minimum, the peer's credentials should match what we started out
 	// with.  This is enforced even if mix authentication is disabled.
-	if !bytes.Equal(c.dst.IdentityKey.Bytes(), creds.AdditionalData) {
+	if !bytes.Equal(l.dst.IdentityKey.Bytes(), creds.AdditionalData) {
 		return false
 	}
-	if !c.dst.LinkKey.Equal(creds.PublicKey) {
+	if !l.dst.LinkKey.Equal(creds.PublicKey) {
 		return false
 	}
 
 	// Query the PKI to figure out if we can send or not, and to ensure that
 	// the peer is listed in a PKI document that's valid.
 	isValid := false
-	_, c.canSend, isValid = c.s.pki.authenticateConnection(creds, true)
+	_, l.canSend, isValid = l.s.pki.authenticateConnection(creds, true)
 
 	return isValid
 }
@@ -70,6 +155,17 @@ func (c *outgoingConn) dispatchPacket(pkt *packet) {
 	select {
 	case c.ch <- pkt:
 	default:
+		// The in-memory queue is full, try to spill the packet to disk
+		// if that is enabled.  Note that this means that packets may
+		// get sent out of order, which is fine since each packet is
+		// independent.
+		if c.co.spill != nil {
+			if err := c.co.spill.Push(c.nodeID[:], pkt.raw, time.Now(), c.s.cfg.Debug.SendQueueDiskSize); err == nil {
+				pkt.dispose()
+				return
+			}
+		}
+
 		// Drop-tail.  This would be better as a RingChannel from the channels
 		// package (Drop-head), but it doesn't provide a way to tell if the
 		// item was discared or not.
@@ -84,18 +180,235 @@ func (c *outgoingConn) dispatchPacket(pkt *packet) {
 	}
 }
 
-func (c *outgoingConn) worker() {
-	const (
-		retryIncrement = 15 * time.Second
-		maxRetryDelay  = 120 * time.Second
-	)
+func (c *outgoingConn) maxQueueDwellTime() (time.Duration, time.Duration) {
+	sendSlack := time.Duration(c.s.cfg.Debug.SendSlack) * time.Millisecond
+	maxAge := time.Duration(c.s.cfg.Debug.SendQueueMaxAge) * time.Millisecond
+	if maxAge < sendSlack {
+		maxAge = sendSlack
+	}
+	return sendSlack, maxAge
+}
+
+func (c *outgoingConn) popSpilled(maxAge time.Duration) *packet {
+	if c.co.spill == nil {
+		return nil
+	}
+
+	b, t, err := c.co.spill.Pop(c.nodeID[:], time.Now().Add(-maxAge))
+	if err != nil {
+		c.log.Warningf("Failed to read spilled packet: %v", err)
+		return nil
+	}
+	if b == nil {
+		return nil
+	}
+
+	pkt := newPacket()
+	if err = pkt.copyToRaw(b); err != nil {
+		c.log.Debugf("Dropping spilled packet: %v (%v)", pkt.id, err)
+		pkt.dispose()
+		return nil
+	}
+
+	// The spilled packets are timestamped with the civil time, convert it
+	// back to something comparable to the monotonic clock.
+	pkt.dispatchAt = monotime.Now() - time.Since(t)
+	return pkt
+}
+
+// saveQueue moves the packets remaining in the in-memory send queue to the
+// disk backed one on graceful shutdown, so that they are resumed by
+// popSpilled once the link is re-established after a restart.
+func (c *outgoingConn) saveQueue() {
+	if c.co.spill == nil || c.s.cfg.Debug.DisableQueuePersistence {
+		return
+	}
+	select {
+	case <-c.co.closeAllCh:
+	default:
+		// The peer was removed, the queue is moot.
+		return
+	}
+
+	nSaved := 0
+	for {
+		select {
+		case pkt := <-c.ch:
+			t := time.Now().Add(pkt.dispatchAt - monotime.Now())
+			if err := c.co.spill.Push(c.nodeID[:], pkt.raw, t, c.s.cfg.Debug.SendQueueDiskSize); err == nil {
+				nSaved++
+			}
+			pkt.dispose()
+		default:
+			if nSaved > 0 {
+				c.log.Debugf("Saved %v queued packet(s).", nSaved)
+			}
+			return
+		}
+	}
+}
 
+func (c *outgoingConn) worker() {
 	defer func() {
 		c.log.Debugf("Halting connect worker.")
+
+		// The queue must be saved before the connection is removed, as the
+		// connector closes the disk backed queues once all of the
+		// connections are gone.
+		c.saveQueue()
 		c.co.onClosedConn(c)
 		close(c.ch)
 	}()
 
+	// Each link to the peer is handled by a separate go routine, all of
+	// which pull packets off the same send queue, so that packets are
+	// split across whatever links happen to be established, by load.
+	var wg sync.WaitGroup
+	for i := 0; i < c.s.cfg.Debug.NumOutgoingLinks; i++ {
+		l := newOutgoingLink(c, i)
+		c.Lock()
+		c.links = append(c.links, l)
+		c.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.s.handlePanic("outgoing link")
+			l.worker()
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *outgoingConn) onNewDescriptor(desc *cpki.MixDescriptor) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.dst = desc
+}
+
+func (c *outgoingConn) startDrain() {
+	c.drainOnce.Do(func() {
+		c.log.Debugf("Draining send queue prior to disconnecting.")
+		close(c.drainCh)
+	})
+}
+
+func (c *outgoingConn) isDraining() bool {
+	select {
+	case <-c.drainCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *outgoingConn) status() *peerStatus {
+	st := new(peerStatus)
+	st.ID = c.nodeID
+	st.QueueDepth = len(c.ch)
+	if c.co.spill != nil {
+		st.QueueDepth += c.co.spill.Len(c.nodeID[:])
+	}
+	st.Stats = c.stats.load()
+
+	c.Lock()
+	defer c.Unlock()
+
+	st.Addresses = append([]string{}, c.dst.Addresses...)
+	for _, l := range c.links {
+		st.Links = append(st.Links, l.status)
+	}
+	return st
+}
+
+// isLeastLoaded returns true iff no other established link to the peer has
+// less load than l, so that packets are split across the links by how fast
+// each is able to write them, rather than by whichever link happens to pull
+// from the shared send queue first.
+func (c *outgoingConn) isLeastLoaded(l *outgoingLink) bool {
+	n := atomic.LoadInt32(&l.load)
+	if n == 0 {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, ll := range c.links {
+		if ll != l && ll.status.State == linkStateEstablished && atomic.LoadInt32(&ll.load) < n {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *outgoingLink) setState(state linkState, addr string) {
+	l.c.Lock()
+	defer l.c.Unlock()
+
+	l.status.State = state
+	l.status.Addr = addr
+	if state == linkStateEstablished {
+		l.status.ConnectedAt = time.Now()
+	} else {
+		l.status.ConnectedAt = time.Time{}
+	}
+}
+
+func (l *outgoingLink) setError(err error) {
+	l.c.Lock()
+	defer l.c.Unlock()
+
+	l.status.LastErr = err
+}
+
+func (l *outgoingLink) onRetry() {
+	// Back off exponentially on reconnects, with a bit of jitter so that
+	// a large number of peers going down at once won't result in everyone
+	// hammering them in lockstep when they come back.
+	//
+	// This maybe should be tracked per address, but whatever.  I remember
+	// when IPng was supposed to take over the world in the 90s, and it
+	// still hasn't happened yet.
+	minDelay := time.Duration(l.s.cfg.Debug.RetryMinDelay) * time.Millisecond
+	maxDelay := time.Duration(l.s.cfg.Debug.RetryMaxDelay) * time.Millisecond
+	switch {
+	case l.retryDelay < minDelay:
+		l.retryDelay = minDelay
+	case l.retryDelay < maxDelay:
+		l.retryDelay *= 2
+	}
+	if l.retryDelay > maxDelay {
+		l.retryDelay = maxDelay
+	}
+}
+
+// onLinkClosed updates the retry state once an established link is closed,
+// given how long it was up for.  The retry state is only reset if the link
+// was alive for a sensible amount of time, so that peers that close the
+// link right after the handshake (eg: capacity limits, or peers that only
+// allow a single link) or that are just flapping keep on being backed off.
+func (l *outgoingLink) onLinkClosed(uptime time.Duration) {
+	if minDelay := time.Duration(l.s.cfg.Debug.RetryMinDelay) * time.Millisecond; uptime >= minDelay {
+		l.retryDelay = 0
+		l.retryAttempts = 0
+	}
+}
+
+// retryWait returns the time to wait before the next connection attempt,
+// which is the retry delay plus jitter.  The jitter is not accumulated into
+// the retry delay, so that the delay stays bounded by RetryMaxDelay.
+func (l *outgoingLink) retryWait() time.Duration {
+	wait := l.retryDelay
+	if jitter := l.s.cfg.Debug.RetryJitter; jitter > 0 && wait > 0 {
+		wait += time.Duration(l.mRand.Intn(jitter)) * time.Millisecond
+	}
+	return wait
+}
+
+func (l *outgoingLink) worker() {
+	defer l.log.Debugf("Halting link worker.")
+
 	// Sigh, I assume the correct thing to do is to use context for everything,
 	// but the whole package feels like a shitty hack to make up for the fact
 	// that Go lacks a real object model.
@@ -105,22 +418,23 @@ func (c *outgoingConn) worker() {
 	dialCtx, cancelFn := context.WithCancel(context.Background())
 	defer cancelFn()
 	dialer := net.Dialer{
-		KeepAlive: keepAliveInterval,
-		Timeout:   time.Duration(c.s.cfg.Debug.ConnectTimeout) * time.Millisecond,
+		KeepAlive: time.Duration(l.s.cfg.Debug.TCPKeepAliveInterval) * time.Millisecond,
+		Timeout:   time.Duration(l.s.cfg.Debug.ConnectTimeout) * time.Millisecond,
 	}
+	attemptDelay := time.Duration(l.s.cfg.Debug.ConnectAttemptDelay) * time.Millisecond
 	go func() {
 		// Bolt a bunch of channels to the dial canceler, such that closing
 		// either channel results in the dial context being canceled.
 		select {
-		case <-c.co.closeAllCh:
+		case <-l.c.co.closeAllCh:
 			cancelFn()
 		case <-dialCtx.Done():
 		}
 	}()
 
 	dialCheckCreds := wire.PeerCredentials{
-		AdditionalData: c.dst.IdentityKey.Bytes(),
-		PublicKey:      c.dst.LinkKey,
+		AdditionalData: l.dst.IdentityKey.Bytes(),
+		PublicKey:      l.dst.LinkKey,
 	}
 
 	// Establish the outgoing connection.
@@ -130,187 +444,474 @@ func (c *outgoingConn) worker() {
 		// something like this, stale connections can get stuck in the
 		// dialing state since the connector relies on outgoingConnection
 		// objects to remove themselves from the connection table.
-		if desc, _, isValid := c.s.pki.authenticateConnection(&dialCheckCreds, true); isValid {
+		if desc, _, isValid := l.s.pki.authenticateConnection(&dialCheckCreds, true); isValid {
 			// The list of addresses could have changed, authenticateConnection
 			// will return the most "current" descriptor on success, so update
 			// the cached pointer.
 			if desc != nil {
-				c.dst = desc
-				dialCheckCreds.PublicKey = c.dst.LinkKey
+				l.dst = desc
+				l.c.onNewDescriptor(desc)
+				dialCheckCreds.PublicKey = l.dst.LinkKey
 			}
 		} else {
-			c.log.Debugf("Bailing out of Dial loop, no longer in PKI.")
+			l.log.Debugf("Bailing out of Dial loop, no longer in PKI.")
 			return
 		}
 
-		for _, addrPort := range c.dst.Addresses {
-			select {
-			case <-time.After(c.retryDelay):
-				// Back off incrementally on reconnects.
-				//
-				// This maybe should be tracked per address, but whatever.  I
-				// remember when IPng was supposed to take over the world in
-				// the 90s, and it still hasn't happened yet.
-				c.retryDelay += retryIncrement
-				if c.retryDelay > maxRetryDelay {
-					c.retryDelay = maxRetryDelay
-				}
-			case <-dialCtx.Done():
-				// Canceled mid-retry delay.
-				c.log.Debugf("(Re)connection attempts canceled.")
-				return
-			}
+		select {
+		case <-time.After(l.retryWait()):
+		case <-dialCtx.Done():
+			// Canceled mid-retry delay.
+			l.log.Debugf("(Re)connection attempts canceled.")
+			return
+		}
 
-			// Dial.
-			c.log.Debugf("Dialing: %v", addrPort)
-			conn, err := dialer.DialContext(dialCtx, "tcp", addrPort)
-			select {
-			case <-dialCtx.Done():
-				// Canceled.
-				if conn != nil {
-					conn.Close()
-				}
-				return
-			default:
-				if err != nil {
-					c.log.Warningf("Failed to connect to '%v': %v", addrPort, err)
-					continue
-				}
-			}
-			c.log.Debugf("TCP connection established.")
-			start := time.Now()
+		// Give up on the peer if it has been unreachable for too long,
+		// the next connector sweep will spawn a fresh connection object
+		// if it is still listed in the PKI.  This only bounds each burst
+		// of retries, as the fresh object starts over with the initial
+		// backoff.
+		if max := l.s.cfg.Debug.RetryMaxAttempts; max > 0 && l.retryAttempts >= max {
+			l.log.Debugf("Bailing out of Dial loop, too many failed attempts: %v", l.retryAttempts)
+			return
+		}
+		l.retryAttempts++
+		l.onRetry()
 
-			// Handle the new connection.
-			if c.onConnEstablished(conn, dialCtx.Done()) {
-				// Canceled with a connection established.
-				c.log.Debugf("Existing connection canceled.")
-				return
-			}
+		// There is no point in establishing a connection just to drain the
+		// send queue.
+		if l.c.isDraining() {
+			l.log.Debugf("Bailing out of Dial loop, peer is being drained.")
+			return
+		}
 
-			// That's odd, the connection died, reconnect.
-			c.log.Debugf("Connection terminated, will reconnect.")
-			if time.Since(start) < retryIncrement {
-				// If the connection was not alive for a sensible amount of
-				// time, re-impose a reconnect delay.
-				c.retryDelay = retryIncrement
+		// Wait for the connector to allow another connection attempt, so
+		// that bootstrap does not dial every single peer all at once.
+		l.setState(linkStateDialing, "")
+		if !l.c.co.acquireDialSlot(dialCtx.Done()) {
+			l.log.Debugf("(Re)connection attempts canceled.")
+			return
+		}
+		var releaseOnce sync.Once
+		releaseFn := func() { releaseOnce.Do(l.c.co.releaseDialSlot) }
+
+		// Dial, racing all of the peer's addresses against each other.
+		span := l.s.otel.StartSpan("link.connect")
+		span.SetAttribute("peer", nodeIDToPrintString(&l.c.nodeID))
+		l.log.Debugf("Dialing: %v", l.dst.Addresses)
+		conn, addrPort, err := dialAddresses(dialCtx, &dialer, l.dst.Addresses, l.s.cfg.Server.AddressPreference, attemptDelay)
+		select {
+		case <-dialCtx.Done():
+			// Canceled.
+			releaseFn()
+			span.End(dialCtx.Err())
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		default:
+			if err != nil {
+				releaseFn()
+				span.End(err)
+				l.log.Warningf("Failed to connect to '%v': %v", l.dst.Addresses, err)
+				l.setError(err)
+				continue
 			}
-			break
 		}
+		span.SetAttribute("address", addrPort)
+		l.log.Debugf("TCP connection established: %v", addrPort)
+		if l.s.peerBans.isOutgoingBanned(conn.RemoteAddr()) {
+			l.log.Debugf("Refusing to talk to '%v' (Banned)", addrPort)
+			span.End(errPeerBanned)
+			l.setError(errPeerBanned)
+			conn.Close()
+			releaseFn()
+			continue
+		}
+		if err = tuneTCPConn(conn, l.s.cfg.Debug); err != nil {
+			l.log.Warningf("Failed to set socket options: %v", err)
+		}
+		if t := l.s.peerTransport(addrPort); t != nil {
+			conn.SetDeadline(time.Now().Add(time.Duration(l.s.cfg.Debug.HandshakeTimeout) * time.Millisecond))
+			wConn, err := t.WrapClient(conn, l.dst)
+			if err != nil {
+				l.log.Warningf("Transport handshake with '%v' failed: %v", addrPort, err)
+				if isPeerFault(err) {
+					l.s.peerBans.onOutgoingMisbehavior(conn.RemoteAddr(), misbehaviorHandshake)
+				}
+				span.End(err)
+				l.setError(err)
+				conn.Close()
+				releaseFn()
+				continue
+			}
+			conn = wConn
+		}
+		if l.s.cfg.Server.LinkTLS {
+			// The TLS handshake is done as part of the link protocol
+			// handshake, and is subject to the same timeout.
+			conn = tls.Client(conn, newLinkTLSClientConfig(l.dst.IdentityKey))
+		}
+		l.setState(linkStateHandshaking, addrPort)
+
+		// Handle the new connection.
+		wasHalted := l.onConnEstablished(conn, dialCtx.Done(), releaseFn, span)
+		releaseFn()
+		if wasHalted {
+			// Canceled with a connection established.
+			l.log.Debugf("Existing connection canceled.")
+			return
+		}
+		if l.c.isDraining() {
+			l.log.Debugf("Connection drained.")
+			return
+		}
+
+		// That's odd, the connection died, reconnect.
+		l.log.Debugf("Connection terminated, will reconnect.")
+		l.setState(linkStateDialing, "")
 	}
 }
 
-func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{}) (wasHalted bool) {
+func (l *outgoingLink) onConnEstablished(conn net.Conn, closeCh <-chan struct{}, handshakeDoneFn func(), span *otlp.Span) (wasHalted bool) {
 	defer func() {
-		c.log.Debugf("TCP connection closed. (wasHalted: %v)", wasHalted)
+		l.log.Debugf("TCP connection closed. (wasHalted: %v)", wasHalted)
 		conn.Close()
 	}()
 
 	// Allocate the session struct.
 	cfg := &wire.SessionConfig{
-		Authenticator:     c,
-		AdditionalData:    c.s.identityKey.PublicKey().Bytes(),
-		AuthenticationKey: c.s.linkKey,
+		Authenticator:     l,
+		AdditionalData:    l.s.identityKey.PublicKey().Bytes(),
+		AuthenticationKey: l.s.linkKey,
 		RandomReader:      rand.Reader,
 	}
 	w, err := wire.NewSession(cfg, true)
 	if err != nil {
-		c.log.Errorf("Failed to allocate session: %v", err)
+		l.log.Errorf("Failed to allocate session: %v", err)
+		span.End(err)
+		l.setError(err)
 		return
 	}
 	defer w.Close()
 
 	// Bind the session to the conn, handshake, authenticate.
-	timeoutMs := time.Duration(c.s.cfg.Debug.HandshakeTimeout) * time.Millisecond
+	timeoutMs := time.Duration(l.s.cfg.Debug.HandshakeTimeout) * time.Millisecond
 	conn.SetDeadline(time.Now().Add(timeoutMs))
-	if err = w.Initialize(conn); err != nil {
-		c.log.Errorf("Handshake failed: %v", err)
+	err = w.Initialize(conn)
+	handshakeDoneFn()
+	span.End(err)
+	if err != nil {
+		l.log.Errorf("Handshake failed: %v", err)
+		if isPeerFault(err) {
+			l.s.peerBans.onOutgoingMisbehavior(conn.RemoteAddr(), misbehaviorHandshake)
+		}
+		l.setError(err)
 		return
 	}
-	c.log.Debugf("Handshake completed.")
+	l.log.Debugf("Handshake completed.")
 	conn.SetDeadline(time.Time{})
-	c.retryDelay = 0 // Reset the retry delay on successful handshakes.
 
-	// Since outgoing connections have no reverse traffic, read from the
-	// reverse path to detect that the connection has been closed.
+	l.setState(linkStateEstablished, conn.RemoteAddr().String())
+	establishedAt := time.Now()
+	defer func() { l.onLinkClosed(time.Since(establishedAt)) }()
+	l.s.emitPeerEvent(EventPeerConnected, &l.c.nodeID, true)
+	defer l.s.emitPeerEvent(EventPeerDisconnected, &l.c.nodeID, true)
+
+	// Since outgoing connections have no reverse traffic other than the
+	// replies to link keepalives, read from the reverse path to detect that
+	// the connection has been closed, and to track the peer's liveness.
 	//
 	// Incoming connections do not need similar treatment by virtue of
 	// the fact that they are constantly reading.
 	peerClosedCh := make(chan interface{})
+	keepAliveAckCh := make(chan interface{}, 1)
 	go func() {
-		var oneByte [1]byte
-		if n, err := conn.Read(oneByte[:]); n != 0 || err == nil {
-			// This should *NEVER* happen past the handshake,
-			// and is an invariant violation that will force close
-			// the connection.
-			c.log.Warningf("Peer sent reverse traffic.")
+		defer close(peerClosedCh)
+		for {
+			rawCmd, err := w.RecvCommand()
+			if err != nil {
+				return
+			}
+			if _, ok := rawCmd.(*commands.NoOp); !ok {
+				// This should *NEVER* happen past the handshake,
+				// and is an invariant violation that will force close
+				// the connection.
+				l.log.Warningf("Peer sent reverse traffic.")
+				l.s.peerBans.onOutgoingMisbehavior(conn.RemoteAddr(), misbehaviorProtocol)
+				l.setError(errReverseTraffic)
+				return
+			}
+			select {
+			case keepAliveAckCh <- true:
+			default:
+			}
 		}
-		close(peerClosedCh)
 	}()
 
+	// Packets are sent by a separate go routine, a nil packet is used to
+	// request that a keepalive be sent, and paddingPacket is used to request
+	// that a dummy packet be sent.
 	pktCh := make(chan *packet)
 	pktCloseCh := make(chan error)
+	pktSentCh := make(chan interface{}, 1)
 	defer close(pktCh)
 	go func() {
 		defer close(pktCloseCh)
+		var padBuf []byte
 		for {
 			pkt, ok := <-pktCh
 			if !ok {
 				return
 			}
+			if pkt == nil {
+				if err := w.SendCommand(&commands.NoOp{}); err != nil {
+					l.log.Debugf("Failed to send keepalive: %v", err)
+					l.setError(err)
+					return
+				}
+				continue
+			}
+			if pkt == paddingPacket {
+				// Dummy packets are the same size as real packets on the
+				// wire, but are all zeros, so that the peer can discard
+				// them without any Sphinx processing, and without a reply.
+				if padBuf == nil {
+					padBuf = make([]byte, constants.PacketLength)
+				}
+				if err := w.SendCommand(&commands.SendPacket{SphinxPacket: padBuf}); err != nil {
+					l.log.Debugf("Failed to send padding: %v", err)
+					l.setError(err)
+					return
+				}
+				l.c.stats.onPaddingSent(len(padBuf))
+				continue
+			}
 			cmd := commands.SendPacket{
 				SphinxPacket: pkt.raw,
 			}
-			if err := w.SendCommand(&cmd); err != nil {
-				c.log.Debugf("Dropping packet: %v (SendCommand failed: %v)", pkt.id, err)
+			atomic.AddInt32(&l.load, 1)
+			err := w.SendCommand(&cmd)
+			atomic.AddInt32(&l.load, -1)
+			select {
+			case pktSentCh <- true:
+			default:
+			}
+			if err != nil {
+				l.log.Debugf("Dropping packet: %v (SendCommand failed: %v)", pkt.id, err)
+				l.s.accounting.onDrop(dropSendFailed)
+				l.setError(err)
 				pkt.dispose()
 				return
 			}
-			c.log.Debugf("Sent packet: %v", pkt.id)
+			l.log.Debugf("Sent packet: %v", pkt.id)
+			pkt.trace("send", "to %v", nodeIDToPrintString(&l.c.nodeID))
+			l.c.stats.onSent(len(pkt.raw))
+			l.s.accounting.onSent(len(pkt.raw))
 			pkt.dispose()
 		}
 	}()
 
+	// Start the keepalive ticker.  Keepalives are only sent on idle links,
+	// and peers that never respond to them are assumed to be running code
+	// that predates link keepalives, so the timeout is only enforced after
+	// the first response.
+	keepAliveInterval := time.Duration(l.s.cfg.Debug.LinkKeepAliveInterval) * time.Millisecond
+	keepAliveTimeout := time.Duration(l.s.cfg.Debug.LinkKeepAliveTimeout) * time.Millisecond
+	keepAlivePeriod := keepAliveInterval
+	if keepAliveTimeout < keepAlivePeriod {
+		keepAlivePeriod = keepAliveTimeout
+	}
+	keepAlive := time.NewTicker(keepAlivePeriod)
+	defer keepAlive.Stop()
+	lastSendAt := time.Now()
+	var keepAliveSentAt time.Time
+	peerAcksKeepAlives := false
+
 	// Start the reauthenticate ticker.
-	reauthMs := time.Duration(c.s.cfg.Debug.ReauthInterval) * time.Millisecond
+	reauthMs := time.Duration(l.s.cfg.Debug.ReauthInterval) * time.Millisecond
 	reauth := time.NewTicker(reauthMs)
 	defer reauth.Stop()
 
 	// Shuffle packets from the send queue out to the peer.
+	c := l.c
+	sendSlack, maxAge := c.maxQueueDwellTime()
+
+	// Start the constant-rate padding ticker if enabled.  Each tick is a
+	// send slot that gets filled with a real packet if one is queued, and a
+	// dummy packet otherwise.  Since real packets need to wait for the next
+	// slot, the scheduler's send slack is extended by the slot interval.
+	var padCh <-chan time.Time
+	if rate := l.s.cfg.Debug.LinkPaddingRate; rate > 0 {
+		padInterval := time.Second / time.Duration(rate)
+		padTicker := time.NewTicker(padInterval)
+		defer padTicker.Stop()
+		padCh = padTicker.C
+		sendSlack += padInterval
+	}
+	connectedAt := monotime.Now()
+	drainCh := c.drainCh
+	var drainTimeoutCh <-chan time.Time
 	for {
+		// Only take packets from the shared send queue when none of the
+		// other links are less loaded, otherwise wait for this link's
+		// current write to complete.
 		var pkt *packet
-		select {
-		case <-peerClosedCh:
-			c.log.Debugf("Connection closed by peer.")
-			return
-		case <-closeCh:
-			wasHalted = true
-			return
-		case <-reauth.C:
-			// Each outgoing connection has a periodic 1/15 Hz timer to wake up
-			// and re-authenticate to handle the PKI document(s) changing.
-			if !c.IsPeerValid(w.PeerCredentials()) {
-				c.log.Debugf("Disconnecting, peer reauthenticate failed.")
-				return
+		var queueCh <-chan *packet
+		hasSlot := false
+		if c.isLeastLoaded(l) {
+			queueCh = c.ch
+			if len(c.ch) == 0 {
+				// Drain the packets that got spilled to disk, once the
+				// in-memory queue is empty.
+				pkt = c.popSpilled(maxAge)
+				if pkt == nil && drainTimeoutCh != nil {
+					// The peer is being drained, and the queue is empty.
+					return
+				}
 			}
-			continue
-		case pkt = <-c.ch:
-			// Check the packet queue dwell time and drop it if it is excessive.
-			now := monotime.Now()
-			if now-pkt.dispatchAt > time.Duration(c.s.cfg.Debug.SendSlack)*time.Millisecond {
-				c.log.Debugf("Dropping packet: %v (Deadline blown by %v)", pkt.id, now-pkt.dispatchAt)
-				pkt.dispose()
+		}
+		if pkt == nil {
+			select {
+			case <-drainCh:
+				// The peer is no longer listed in the PKI, finish sending
+				// what is already queued, but only for so long.
+				drainCh = nil
+				drainTimeoutCh = time.After(time.Duration(l.s.cfg.Debug.LinkDrainTimeout) * time.Millisecond)
+				continue
+			case <-drainTimeoutCh:
+				l.log.Debugf("Disconnecting, drain timeout expired with %v queued packets.", len(c.ch))
+				return
+			case <-peerClosedCh:
+				l.log.Debugf("Connection closed by peer.")
+				l.setError(errPeerClosed)
+				return
+			case <-closeCh:
+				wasHalted = true
+				return
+			case <-reauth.C:
+				// Each outgoing connection has a periodic 1/15 Hz timer to wake up
+				// and re-authenticate to handle the PKI document(s) changing.
+				//
+				// Failure to reauthenticate most likely means that the peer
+				// got de-listed, so drain the send queue, with the existing
+				// send permission, before disconnecting.
+				if drainTimeoutCh != nil {
+					continue
+				}
+				canSend := l.canSend
+				if !l.IsPeerValid(w.PeerCredentials()) {
+					l.log.Debugf("Peer reauthenticate failed.")
+					l.setError(errReauthFailed)
+					l.canSend = canSend
+					c.startDrain()
+				}
+				continue
+			case <-keepAliveAckCh:
+				peerAcksKeepAlives = true
+				keepAliveSentAt = time.Time{}
+				continue
+			case <-keepAlive.C:
+				if !keepAliveSentAt.IsZero() {
+					if time.Since(keepAliveSentAt) < keepAliveTimeout {
+						continue
+					}
+					if peerAcksKeepAlives {
+						l.log.Debugf("Disconnecting, peer failed to respond to keepalive.")
+						l.setError(errKeepAliveFailed)
+						return
+					}
+					keepAliveSentAt = time.Time{}
+				}
+				if time.Since(lastSendAt) < keepAliveInterval {
+					continue
+				}
+				select {
+				case <-closeCh:
+					wasHalted = true
+					return
+				case <-pktCloseCh:
+					return
+				case pktCh <- nil:
+					keepAliveSentAt = time.Now()
+					lastSendAt = keepAliveSentAt
+				}
+				continue
+			case <-pktSentCh:
 				continue
+			case <-padCh:
+				// Fill the send slot with padding, unless a real packet
+				// got queued in the meantime.  Packets queued while this
+				// link is not the least loaded are left to the others.
+				select {
+				case pkt = <-queueCh:
+					hasSlot = true
+				default:
+					if len(c.ch) > 0 {
+						continue
+					}
+					pkt = paddingPacket
+				}
+			case pkt = <-queueCh:
 			}
 		}
+		isPadding := pkt == paddingPacket
+
+		// Check the packet queue dwell time and drop it if it is excessive.
+		//
+		// Packets that were queued while the link was down are allowed to
+		// sit in the queue for longer, so that short outages do not result
+		// in the queue getting discarded.
+		now := monotime.Now()
+		maxDwell := sendSlack
+		if pkt.dispatchAt < connectedAt {
+			maxDwell = maxAge
+		}
+		if !isPadding && now-pkt.dispatchAt > maxDwell {
+			l.log.Debugf("Dropping packet: %v (Deadline blown by %v)", pkt.id, now-pkt.dispatchAt)
+			pkt.dispose()
+			continue
+		}
 
-		if !c.canSend {
+		if !l.canSend {
 			// This is presumably a early connect, and we aren't allowed to
 			// actually send packets to the peer yet.
-			c.log.Debugf("Dropping packet: %v (Out of epoch)", pkt.id)
+			if isPadding {
+				continue
+			}
+			l.log.Debugf("Dropping packet: %v (Out of epoch)", pkt.id)
 			pkt.dispose()
 			continue
 		}
 
+		// In constant-rate mode, real packets take the place of padding, so
+		// wait for the next send slot.
+		if padCh != nil && !isPadding && !hasSlot {
+			select {
+			case <-closeCh:
+				pkt.dispose()
+				wasHalted = true
+				return
+			case <-padCh:
+			}
+		}
+
+		// Enforce the egress rate limit if any.  This is shared across all
+		// of the links to the peer.
+		if c.egressLimit != nil {
+			if wait := c.egressLimit.Take(float64(constants.PacketLength)); wait > 0 {
+				select {
+				case <-closeCh:
+					if !isPadding {
+						pkt.dispose()
+					}
+					wasHalted = true
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
 		// Use a go routine to actually send packets to the peer so that
 		// cancelation can happen, even when mid SendCommand().
 		select {
@@ -323,20 +924,31 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 			return
 		case pktCh <- pkt:
 			// Pass the packet onto the worker that actually handles writing.
+			lastSendAt = time.Now()
 		}
 	}
 }
 
 func newOutgoingConn(co *connector, dst *cpki.MixDescriptor) *outgoingConn {
-	const maxQueueSize = 64 // TODO/perf: Tune this.
-
 	c := new(outgoingConn)
 	c.s = co.s
 	c.co = co
 	c.dst = dst
-	c.ch = make(chan *packet, maxQueueSize)
+	c.nodeID = dst.IdentityKey.ByteArray()
+	c.ch = make(chan *packet, co.s.cfg.Debug.SendQueueSize)
+	c.drainCh = make(chan interface{})
+	c.stats = co.s.peerStats.get(&c.nodeID)
+	if limit := co.s.cfg.Debug.PeerEgressRateLimit; limit > 0 {
+		// Allow bursting up to a second's worth of traffic, or a single
+		// packet, whichever is larger.
+		burst := float64(limit)
+		if burst < constants.PacketLength {
+			burst = constants.PacketLength
+		}
+		c.egressLimit = tokenbucket.New(float64(limit), burst)
+	}
 	c.id = atomic.AddUint64(&outgoingConnID, 1) // Diagnostic only, wrapping is fine.
-	c.log = co.s.logBackend.GetLogger(fmt.Sprintf("outgoing:%d", c.id))
+	c.log = co.s.newLogger(fmt.Sprintf("outgoing:%d", c.id))
 
 	c.log.Debugf("New outgoing connection: %+v", dst)
 
@@ -346,3 +958,18 @@ func newOutgoingConn(co *connector, dst *cpki.MixDescriptor) *outgoingConn {
 
 	return c
 }
+
+func newOutgoingLink(c *outgoingConn, idx int) *outgoingLink {
+	c.Lock()
+	defer c.Unlock()
+
+	l := new(outgoingLink)
+	l.s = c.s
+	l.c = c
+	l.dst = c.dst
+	l.idx = idx
+	l.mRand = rand.NewMath()
+	l.log = c.s.newLogger(fmt.Sprintf("outgoing:%d:%d", c.id, idx))
+
+	return l
+}
@@ -0,0 +1,92 @@
+// outgoing_conn_test.go - Katzenpost server outgoing connection tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRetryMinDelay = 100
+	testRetryMaxDelay = 400
+	testRetryJitter   = 50
+)
+
+func newTestOutgoingLink(jitter int) *outgoingLink {
+	l := new(outgoingLink)
+	l.s = &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				RetryMinDelay: testRetryMinDelay,
+				RetryMaxDelay: testRetryMaxDelay,
+				RetryJitter:   jitter,
+			},
+		},
+	}
+	l.mRand = rand.NewMath()
+	return l
+}
+
+func TestOutgoingLinkBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	// The first attempt is made immediately, and each consecutive failure
+	// doubles the delay, up to the maximum.
+	l := newTestOutgoingLink(0)
+	assert.Zero(l.retryWait(), "retryWait(): initial")
+	for _, d := range []time.Duration{100, 200, 400, 400} {
+		l.onRetry()
+		assert.Equal(d*time.Millisecond, l.retryWait(), "retryWait(): backoff")
+	}
+
+	// The jitter is only applied to the wait, and does not accumulate.
+	l = newTestOutgoingLink(testRetryJitter)
+	for i := 0; i < 10; i++ {
+		l.onRetry()
+		wait := l.retryWait()
+		assert.True(wait >= l.retryDelay, "retryWait(): jitter >= delay")
+		assert.True(wait < l.retryDelay+testRetryJitter*time.Millisecond, "retryWait(): jitter bound")
+	}
+	assert.Equal(testRetryMaxDelay*time.Millisecond, l.retryDelay, "retryDelay: bounded")
+}
+
+func TestOutgoingLinkClosedAfterHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	// A peer that is at its incoming link limit accepts the connection, and
+	// closes it right after the handshake.  The backoff must persist, or
+	// the link will be redialed in a tight loop.
+	l := newTestOutgoingLink(0)
+	for i := 1; i <= 3; i++ {
+		l.retryAttempts++
+		l.onRetry()
+		l.onLinkClosed(10 * time.Millisecond)
+		assert.Equal(i, l.retryAttempts, "retryAttempts: short lived link")
+	}
+	assert.Equal(400*time.Millisecond, l.retryWait(), "retryWait(): short lived link")
+
+	// A link that stayed up for a sensible amount of time resets the
+	// backoff, so that it is redialed immediately.
+	l.onLinkClosed(testRetryMinDelay * time.Millisecond)
+	assert.Zero(l.retryAttempts, "retryAttempts: long lived link")
+	assert.Zero(l.retryWait(), "retryWait(): long lived link")
+}
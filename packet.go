@@ -60,6 +60,45 @@ type packet struct {
 
 	mustForward   bool
 	mustTerminate bool
+	isSynthetic   bool
+
+	traceID uint64
+	tracer  *packetTracer
+
+	// srcStats are the counters of the mix the packet was received from,
+	// if any, for attributing processing failures.
+	srcStats *peerCounters
+}
+
+// trace records a stage of the packet's journey, iff the packet was sampled
+// for tracing.
+func (pkt *packet) trace(stage, format string, args ...interface{}) {
+	if pkt.tracer == nil {
+		return
+	}
+	pkt.tracer.write(pkt.traceID, stage, fmt.Sprintf(format, args...))
+}
+
+// inheritTrace makes pkt share the trace correlation ID of src, for packets
+// derived from another packet.
+func (pkt *packet) inheritTrace(src *packet) {
+	pkt.traceID = src.traceID
+	pkt.tracer = src.tracer
+}
+
+// isPaddingPacket returns true iff b is a dummy packet, as sent by peers in
+// constant-rate padding mode.  Dummy packets are all zeros, which a real
+// packet never is, as the header contains a random group element.
+func isPaddingPacket(b []byte) bool {
+	if len(b) != constants.PacketLength {
+		return false
+	}
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func (pkt *packet) splitCommands() error {
@@ -166,6 +205,7 @@ func (pkt *packet) dispose() {
 	// is no special effort made to clean out the various queues.
 
 	// TODO/perf: Return the packet components to the various pools.
+	pkt.trace("release", "")
 	pkt.disposeRaw()
 
 	// Clear out the struct for reuse.
@@ -182,6 +222,10 @@ func (pkt *packet) dispose() {
 	pkt.dispatchAt = 0
 	pkt.mustForward = false
 	pkt.mustTerminate = false
+	pkt.isSynthetic = false
+	pkt.traceID = 0
+	pkt.tracer = nil
+	pkt.srcStats = nil
 
 	// Return the packet struct to the pool.
 	pktPool.Put(pkt)
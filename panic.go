@@ -0,0 +1,148 @@
+// panic.go - Katzenpost server panic handling.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+// secretPattern matches long hex and base64 strings, and byte slices
+// formatted with the `%v` verb, which is what key material looks like if it
+// ends up in a panic message or stack trace.
+var secretPattern = regexp.MustCompile(`[0-9a-fA-F]{32,}|[A-Za-z0-9+/]{40,}={0,2}|\[(?:[0-9]{1,3} ){15,}[0-9]{1,3}\]`)
+
+func isMixedCase(b []byte) bool {
+	return bytes.ContainsAny(b, "0123456789") && bytes.ContainsAny(b, "abcdefghijklmnopqrstuvwxyz") && bytes.ContainsAny(b, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+// redactSecrets replaces anything that resembles key material in b.
+func redactSecrets(b []byte) []byte {
+	return secretPattern.ReplaceAllFunc(b, func(m []byte) []byte {
+		// Long lowercase runs (eg: import paths) are not base64 encoded keys.
+		if m[0] != '[' && !isHex(m) && !isMixedCase(m) {
+			return m
+		}
+		return []byte("[REDACTED]")
+	})
+}
+
+func isHex(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// crashStats tracks the number of recovered panics per worker.
+type crashStats struct {
+	sync.Mutex
+
+	counts map[string]uint64
+	total  uint64
+}
+
+func (cs *crashStats) inc(name string) uint64 {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.counts == nil {
+		cs.counts = make(map[string]uint64)
+	}
+	cs.counts[name]++
+	cs.total++
+	return cs.counts[name]
+}
+
+func (s *Server) onMgmtWorkerCrashes(c *thwack.Conn, l string) error {
+	s.crashes.Lock()
+	names := make([]string, 0, len(s.crashes.counts))
+	for k := range s.crashes.counts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	counts := make([]uint64, 0, len(names))
+	for _, k := range names {
+		counts = append(counts, s.crashes.counts[k])
+	}
+	total := s.crashes.total
+	s.crashes.Unlock()
+
+	if err := c.Writer().PrintfLine("%v-Total:%v", thwack.StatusOk, total); err != nil {
+		return err
+	}
+	for i, k := range names {
+		if err := c.Writer().PrintfLine("%v-%v:%v", thwack.StatusOk, k, counts[i]); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// onPanic logs and accounts for a recovered panic.  If
+// Sandbox.DisableCoreDumps is set, anything that looks like key material is
+// redacted from the panic value and the stack trace.
+func (s *Server) onPanic(name string, r interface{}, stack []byte) {
+	msg := []byte(fmt.Sprint(r))
+	if s.cfg.Sandbox.DisableCoreDumps {
+		msg, stack = redactSecrets(msg), redactSecrets(stack)
+	}
+	n := s.crashes.inc(name)
+	s.log.Criticalf("Recovered panic in %v (%v so far): %s", name, n, msg)
+	s.log.Criticalf("Stack trace:\n%s", stack)
+	s.emitDegradedEvent(fmt.Sprintf("panic in %v", name))
+}
+
+// handlePanic MUST be deferred at the start of every go routine that is not
+// started via guard or supervise, so that panics are logged and accounted
+// for instead of crashing the server.
+func (s *Server) handlePanic(name string) {
+	if r := recover(); r != nil {
+		s.onPanic(name, r, debug.Stack())
+	}
+}
+
+// runRecovered calls fn, and returns true iff it panicked.
+func (s *Server) runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.onPanic(name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	fn()
+	return
+}
+
+// guard wraps fn, so that any panics are recovered from and logged.  This is
+// used for short lived go routines (eg: per-connection), that are not worth
+// restarting.
+func (s *Server) guard(name string, fn func()) func() {
+	return func() {
+		s.runRecovered(name, fn)
+	}
+}
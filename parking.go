@@ -0,0 +1,129 @@
+// parking.go - Katzenpost server unknown destination parking.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/op/go-logging"
+)
+
+type parkedPacket struct {
+	pkt      *packet
+	parkedAt time.Time
+}
+
+// parking holds the packets whose next hop is not a valid forward
+// destination for up to an epoch, and releases them back to the scheduler
+// if the destination becomes valid in the mean time, so that PKI churn
+// (eg: a peer missing from a single document) does not result in loss.
+type parking struct {
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	pkts map[[constants.NodeIDLength]byte][]*parkedPacket
+	n    int
+}
+
+// park takes ownership of pkt, and holds it till the next hop is valid.
+func (p *parking) park(pkt *packet) {
+	p.Lock()
+	defer p.Unlock()
+
+	sID := nodeIDToPrintString(&pkt.nextNodeHop.ID)
+	if p.n >= p.s.cfg.Debug.ParkingQueueSize {
+		p.log.Debugf("Dropping packet: %v (Parking full, next hop: %v)", pkt.id, sID)
+		p.s.accounting.onDrop(dropQueueFull)
+		pkt.dispose()
+		return
+	}
+
+	p.log.Debugf("Parking packet: %v (Next hop is invalid: %v)", pkt.id, sID)
+	pkt.trace("park", "next hop %v", sID)
+	id := pkt.nextNodeHop.ID
+	p.pkts[id] = append(p.pkts[id], &parkedPacket{pkt: pkt, parkedAt: time.Now()})
+	p.n++
+}
+
+// onConnectorUpdate releases the packets whose next hop is now valid back
+// to the scheduler, for immediate dispatch.
+func (p *parking) onConnectorUpdate() {
+	var released []*packet
+
+	p.Lock()
+	for id, v := range p.pkts {
+		if !p.s.connector.isValidForwardDest(&id) {
+			continue
+		}
+		for _, e := range v {
+			released = append(released, e.pkt)
+		}
+		p.n -= len(v)
+		delete(p.pkts, id)
+	}
+	p.Unlock()
+
+	if len(released) > 0 {
+		p.log.Debugf("Releasing %v parked packet(s).", len(released))
+	}
+	for _, pkt := range released {
+		// The requested delay has long since passed.
+		pkt.delay = 0
+		p.s.scheduler.onPacket(pkt)
+	}
+}
+
+func (p *parking) onTick(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	for id, v := range p.pkts {
+		i := 0
+		for ; i < len(v) && now.Sub(v[i].parkedAt) > epochtime.Period; i++ {
+			p.log.Debugf("Dropping packet: %v (Parked for too long)", v[i].pkt.id)
+			p.s.accounting.onDrop(dropParkingExpired)
+			v[i].pkt.dispose()
+		}
+		p.n -= i
+		if i == len(v) {
+			delete(p.pkts, id)
+		} else if i > 0 {
+			p.pkts[id] = v[i:]
+		}
+	}
+}
+
+// queueLen returns the number of parked packets.
+func (p *parking) queueLen() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.n
+}
+
+func newParking(s *Server) *parking {
+	p := new(parking)
+	p.s = s
+	p.log = s.newLogger("parking")
+	p.pkts = make(map[[constants.NodeIDLength]byte][]*parkedPacket)
+	return p
+}
@@ -0,0 +1,262 @@
+// peerban.go - Katzenpost server peer misbehavior bans.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+const (
+	// peerBanMaxDuration caps the exponential growth of the ban duration
+	// for repeat offenders.
+	peerBanMaxDuration = 24 * time.Hour
+
+	// peerBanForgetAfter is how long after the last violation a peer's
+	// record (including the ban history) is discarded.
+	peerBanForgetAfter = peerBanMaxDuration
+
+	// peerBanStrikeDecay is how long a peer has to go without violations
+	// for each of its strikes to be forgiven, so that occasional failures
+	// spread out over a long time do not add up to a ban.
+	peerBanStrikeDecay = 10 * time.Minute
+)
+
+type misbehaviorKind int
+
+const (
+	misbehaviorHandshake misbehaviorKind = iota
+	misbehaviorFraming
+	misbehaviorProtocol
+
+	nrMisbehaviorKinds
+)
+
+func (k misbehaviorKind) String() string {
+	switch k {
+	case misbehaviorHandshake:
+		return "HandshakeFailures"
+	case misbehaviorFraming:
+		return "FramingErrors"
+	case misbehaviorProtocol:
+		return "ProtocolViolations"
+	default:
+		return "[Unknown]"
+	}
+}
+
+type peerBanRecord struct {
+	counts      [nrMisbehaviorKinds]uint64
+	strikes     int
+	nrBans      uint
+	lastSeen    time.Time
+	lastStrike  time.Time
+	bannedUntil time.Time
+}
+
+// peerBans scores the link layer misbehavior of each remote IP address, on
+// both the incoming and outgoing connections, and temporarily refuses to
+// talk to repeat offenders, with the ban duration doubling on each
+// subsequent ban.
+type peerBans struct {
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	peers map[string]*peerBanRecord
+}
+
+// isPeerFault returns true iff the link layer handshake error err is a
+// cryptographic or protocol failure that the peer is to blame for, as
+// opposed to the network failing or the connection getting closed.
+func isPeerFault(err error) bool {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr)
+}
+
+// onMisbehavior records misbehavior by the peer at addr, and returns true
+// iff the peer is now banned.
+func (pb *peerBans) onMisbehavior(addr net.Addr, kind misbehaviorKind) bool {
+	return pb.record(addr, kind, true)
+}
+
+// onOutgoingMisbehavior records misbehavior by the peer at addr on an
+// outgoing connection, and returns true iff the peer is now banned.
+//
+// Outgoing connections are only made to peers listed in the PKI document,
+// and refusing to dial one of them drops all of the traffic routed via
+// it, so unless Debug.PeerBanOutgoing is set the misbehavior is counted
+// without ever leading to a ban.
+func (pb *peerBans) onOutgoingMisbehavior(addr net.Addr, kind misbehaviorKind) bool {
+	return pb.record(addr, kind, pb.s.cfg.Debug.PeerBanOutgoing)
+}
+
+// isOutgoingBanned returns true iff the peer at addr is currently banned,
+// and bans apply to outgoing connections.
+func (pb *peerBans) isOutgoingBanned(addr net.Addr) bool {
+	return pb.s.cfg.Debug.PeerBanOutgoing && pb.isBanned(addr)
+}
+
+func (pb *peerBans) record(addr net.Addr, kind misbehaviorKind, canBan bool) bool {
+	k, ok := connLimiterKey(addr)
+	if !ok {
+		return false
+	}
+
+	pb.Lock()
+	defer pb.Unlock()
+
+	now := time.Now()
+	r, ok := pb.peers[k]
+	if !ok {
+		r = new(peerBanRecord)
+		pb.peers[k] = r
+	}
+	r.counts[kind]++
+	r.lastSeen = now
+	if !canBan {
+		return false
+	}
+	if r.strikes > 0 {
+		if n := int(now.Sub(r.lastStrike) / peerBanStrikeDecay); n < r.strikes {
+			r.strikes -= n
+		} else {
+			r.strikes = 0
+		}
+	}
+	r.strikes++
+	r.lastStrike = now
+
+	threshold := pb.s.cfg.Debug.PeerBanThreshold
+	if threshold <= 0 || r.strikes < threshold {
+		return false
+	}
+
+	banDuration := time.Duration(pb.s.cfg.Debug.PeerBanDuration) * time.Millisecond
+	for i := uint(0); i < r.nrBans && banDuration < peerBanMaxDuration; i++ {
+		banDuration *= 2
+	}
+	if banDuration > peerBanMaxDuration {
+		banDuration = peerBanMaxDuration
+	}
+	r.strikes = 0
+	r.nrBans++
+	r.bannedUntil = r.lastStrike.Add(banDuration)
+	pb.log.Warningf("Banning peer '%v' for %v (%v).", pb.s.logRedactor.addr(addr), banDuration, kind)
+	pb.s.events.emit(&Event{Type: EventPeerBanned, Reason: k})
+	return true
+}
+
+// isBanned returns true iff the peer at addr is currently banned.
+func (pb *peerBans) isBanned(addr net.Addr) bool {
+	k, ok := connLimiterKey(addr)
+	if !ok {
+		return false
+	}
+
+	pb.Lock()
+	defer pb.Unlock()
+
+	r, ok := pb.peers[k]
+	return ok && time.Now().Before(r.bannedUntil)
+}
+
+func (pb *peerBans) onTick(now time.Time) {
+	pb.Lock()
+	defer pb.Unlock()
+
+	for k, r := range pb.peers {
+		if now.After(r.bannedUntil) && now.Sub(r.lastSeen) > peerBanForgetAfter {
+			delete(pb.peers, k)
+		}
+	}
+}
+
+func (pb *peerBans) onMgmtPeerBans(c *thwack.Conn, l string) error {
+	pb.Lock()
+	defer pb.Unlock()
+
+	addrs := make([]string, 0, len(pb.peers))
+	for k := range pb.peers {
+		addrs = append(addrs, k)
+	}
+	sort.Strings(addrs)
+
+	now := time.Now()
+	for _, k := range addrs {
+		r := pb.peers[k]
+		var banned time.Duration
+		if now.Before(r.bannedUntil) {
+			banned = r.bannedUntil.Sub(now).Truncate(time.Second)
+		}
+		if err := c.Writer().PrintfLine("%v-Peer:%v %v:%v %v:%v %v:%v Bans:%v Banned:%v", thwack.StatusOk, k,
+			misbehaviorHandshake, r.counts[misbehaviorHandshake],
+			misbehaviorFraming, r.counts[misbehaviorFraming],
+			misbehaviorProtocol, r.counts[misbehaviorProtocol], r.nrBans, banned); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (pb *peerBans) onMgmtPeerUnban(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("PEER_UNBAN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	pb.Lock()
+	defer pb.Unlock()
+
+	if _, ok := pb.peers[sp[1]]; !ok {
+		c.Log().Errorf("No misbehavior record for peer '%v'", sp[1])
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	delete(pb.peers, sp[1])
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newPeerBans(s *Server) *peerBans {
+	pb := new(peerBans)
+	pb.s = s
+	pb.log = s.newLogger("peerbans")
+	pb.peers = make(map[string]*peerBanRecord)
+
+	if s.cfg.Management.Enable {
+		const (
+			cmdPeerBans  = "PEER_BANS"
+			cmdPeerUnban = "PEER_UNBAN"
+		)
+		s.management.RegisterCommand(cmdPeerBans, pb.onMgmtPeerBans)
+		s.management.RegisterCommand(cmdPeerUnban, pb.onMgmtPeerUnban)
+	}
+
+	return pb
+}
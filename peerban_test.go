@@ -0,0 +1,180 @@
+// peerban_test.go - Katzenpost server peer misbehavior ban tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPeerBans(threshold int) *peerBans {
+	s := &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				PeerBanThreshold: threshold,
+				PeerBanDuration:  60 * 1000,
+			},
+		},
+		logRedactor: new(logRedactor),
+	}
+	s.peerBans = &peerBans{
+		s:     s,
+		log:   logging.MustGetLogger("peerbans"),
+		peers: make(map[string]*peerBanRecord),
+	}
+	return s.peerBans
+}
+
+func TestIsPeerFault(t *testing.T) {
+	assert := assert.New(t)
+
+	opErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	for _, v := range []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{io.ErrUnexpectedEOF, false},
+		{fmt.Errorf("wire/session: %w", io.EOF), false},
+		{opErr, false},
+		{fmt.Errorf("transport: %w", opErr), false},
+		{errors.New("wire/session: authentication failed"), true},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, true},
+	} {
+		assert.Equal(v.expected, isPeerFault(v.err), "isPeerFault(): %v", v.err)
+	}
+}
+
+func TestPeerBanEscalation(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	pb := newTestPeerBans(3)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3219}
+	k, _ := connLimiterKey(addr)
+
+	// Each ban lasts twice as long as the previous one.
+	baseDuration := time.Duration(pb.s.cfg.Debug.PeerBanDuration) * time.Millisecond
+	for i := 0; i < 3; i++ {
+		assert.False(pb.onMisbehavior(addr, misbehaviorHandshake), "onMisbehavior(): ban %v, strike 1", i)
+		assert.False(pb.onMisbehavior(addr, misbehaviorFraming), "onMisbehavior(): ban %v, strike 2", i)
+		assert.True(pb.onMisbehavior(addr, misbehaviorProtocol), "onMisbehavior(): ban %v, strike 3", i)
+		assert.True(pb.isBanned(addr), "isBanned(): ban %v", i)
+
+		r := pb.peers[k]
+		require.NotNil(r, "peer record")
+		assert.Equal(baseDuration<<uint(i), r.bannedUntil.Sub(r.lastStrike), "ban %v duration", i)
+		assert.Equal(uint(i+1), r.nrBans, "ban %v count", i)
+		assert.Zero(r.strikes, "ban %v strikes reset", i)
+
+		// Expire the ban.
+		r.bannedUntil = time.Now().Add(-time.Second)
+		assert.False(pb.isBanned(addr), "isBanned(): ban %v expired", i)
+	}
+	r := pb.peers[k]
+	assert.Equal(uint64(3), r.counts[misbehaviorHandshake], "HandshakeFailures")
+	assert.Equal(uint64(3), r.counts[misbehaviorFraming], "FramingErrors")
+	assert.Equal(uint64(3), r.counts[misbehaviorProtocol], "ProtocolViolations")
+	assert.Equal(uint64(3), pb.s.events.counts[EventPeerBanned], "EventPeerBanned")
+
+	// The ban duration is capped.
+	r.nrBans = 64
+	r.strikes = 2
+	r.lastStrike = time.Now()
+	assert.True(pb.onMisbehavior(addr, misbehaviorHandshake), "onMisbehavior(): capped ban")
+	assert.Equal(peerBanMaxDuration, r.bannedUntil.Sub(r.lastStrike), "capped ban duration")
+
+	// Other peers are unaffected.
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3219}
+	assert.False(pb.isBanned(other), "isBanned(): other peer")
+
+	// Records are forgotten once stale, but not while banned.
+	r.lastSeen = time.Now().Add(-2 * peerBanForgetAfter)
+	pb.onTick(time.Now())
+	assert.Contains(pb.peers, k, "onTick(): banned peer kept")
+	pb.onTick(r.bannedUntil.Add(time.Second))
+	assert.NotContains(pb.peers, k, "onTick(): stale peer forgotten")
+}
+
+func TestPeerBanDecay(t *testing.T) {
+	assert := assert.New(t)
+
+	pb := newTestPeerBans(3)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3219}
+	k, _ := connLimiterKey(addr)
+
+	// Strikes spread out over time are forgiven.
+	for i := 0; i < 10; i++ {
+		assert.False(pb.onMisbehavior(addr, misbehaviorHandshake), "onMisbehavior(): spread out strike %v", i)
+		pb.peers[k].lastStrike = pb.peers[k].lastStrike.Add(-peerBanStrikeDecay)
+	}
+	assert.Equal(1, pb.peers[k].strikes, "strikes after spread out violations")
+
+	// Only one strike is forgiven per decay interval.
+	pb.peers[k].strikes = 2
+	pb.peers[k].lastStrike = time.Now().Add(-peerBanStrikeDecay)
+	assert.False(pb.onMisbehavior(addr, misbehaviorHandshake), "onMisbehavior(): one strike forgiven")
+	assert.Equal(2, pb.peers[k].strikes, "strikes after one decay interval")
+	assert.True(pb.onMisbehavior(addr, misbehaviorHandshake), "onMisbehavior(): burst")
+
+	// Banning can be disabled.
+	pb = newTestPeerBans(0)
+	for i := 0; i < 10; i++ {
+		assert.False(pb.onMisbehavior(addr, misbehaviorHandshake), "onMisbehavior(): disabled")
+	}
+	assert.False(pb.isBanned(addr), "isBanned(): disabled")
+}
+
+func TestPeerBanOutgoing(t *testing.T) {
+	assert := assert.New(t)
+
+	pb := newTestPeerBans(1)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3219}
+	k, _ := connLimiterKey(addr)
+
+	// Misbehavior on outgoing connections is counted, but never bans.
+	for i := 0; i < 3; i++ {
+		assert.False(pb.onOutgoingMisbehavior(addr, misbehaviorProtocol), "onOutgoingMisbehavior(): %v", i)
+	}
+	assert.False(pb.isBanned(addr), "isBanned(): outgoing misbehavior")
+	assert.Equal(uint64(3), pb.peers[k].counts[misbehaviorProtocol], "ProtocolViolations")
+
+	// A ban from incoming misbehavior does not stop the peer from being
+	// dialed.
+	assert.True(pb.onMisbehavior(addr, misbehaviorFraming), "onMisbehavior()")
+	assert.True(pb.isBanned(addr), "isBanned(): incoming misbehavior")
+	assert.False(pb.isOutgoingBanned(addr), "isOutgoingBanned(): not enabled")
+
+	// Unless explicitly enabled.
+	pb.s.cfg.Debug.PeerBanOutgoing = true
+	assert.True(pb.isOutgoingBanned(addr), "isOutgoingBanned(): enabled")
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3219}
+	assert.True(pb.onOutgoingMisbehavior(other, misbehaviorHandshake), "onOutgoingMisbehavior(): enabled")
+	assert.True(pb.isOutgoingBanned(other), "isOutgoingBanned(): outgoing misbehavior")
+}
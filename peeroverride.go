@@ -0,0 +1,210 @@
+// peeroverride.go - Katzenpost server peer link overrides.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+)
+
+// peerOverrides is the operator specified set of peers that links are
+// allowed or refused with regardless of the PKI document.  Allowed peers
+// are only consulted when the PKI does not authenticate a peer, while
+// denied peers are refused even if they are listed.
+type peerOverrides struct {
+	sync.RWMutex
+
+	s   *Server
+	log *logging.Logger
+
+	allowed map[[constants.NodeIDLength]byte]*cpki.MixDescriptor
+	denied  map[[constants.NodeIDLength]byte]bool
+}
+
+func (o *peerOverrides) isDenied(id *[constants.NodeIDLength]byte) bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.denied[*id]
+}
+
+// allowedPeer returns the descriptor of the allowed peer, or nil.  Outgoing
+// links are only allowed to peers that have addresses configured.
+func (o *peerOverrides) allowedPeer(id *[constants.NodeIDLength]byte, isOutgoing bool) *cpki.MixDescriptor {
+	o.RLock()
+	defer o.RUnlock()
+
+	desc := o.allowed[*id]
+	if desc == nil || o.denied[*id] || (isOutgoing && len(desc.Addresses) == 0) {
+		return nil
+	}
+	return desc
+}
+
+// outgoing returns the descriptors of the allowed peers that outgoing links
+// should be made to.
+func (o *peerOverrides) outgoing() []*cpki.MixDescriptor {
+	o.RLock()
+	defer o.RUnlock()
+
+	var descs []*cpki.MixDescriptor
+	for id, desc := range o.allowed {
+		if len(desc.Addresses) > 0 && !o.denied[id] {
+			descs = append(descs, desc)
+		}
+	}
+	return descs
+}
+
+func (o *peerOverrides) setDenied(id *[constants.NodeIDLength]byte, isDenied bool) {
+	o.Lock()
+	if isDenied {
+		o.denied[*id] = true
+	} else {
+		delete(o.denied, *id)
+	}
+	o.Unlock()
+
+	// Existing links are torn down when they next fail to re-authenticate.
+	if co := o.s.connector; co != nil {
+		co.forceUpdate()
+	}
+}
+
+func (o *peerOverrides) onMgmtPeerOverrides(c *thwack.Conn, l string) error {
+	o.RLock()
+	defer o.RUnlock()
+
+	var lines []string
+	for id, desc := range o.allowed {
+		lines = append(lines, fmt.Sprintf("Peer:%v Name:%v Override:Allow Addresses:%v Denied:%v", hex.EncodeToString(id[:]), desc.Name, strings.Join(desc.Addresses, ","), o.denied[id]))
+	}
+	for id := range o.denied {
+		if _, ok := o.allowed[id]; !ok {
+			lines = append(lines, fmt.Sprintf("Peer:%v Override:Deny", hex.EncodeToString(id[:])))
+		}
+	}
+	sort.Strings(lines)
+
+	for _, v := range lines {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (o *peerOverrides) doMgmtPeerDeny(c *thwack.Conn, l string, isDenied bool) error {
+	sp := strings.Fields(l)
+	if len(sp) != 2 {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	id, err := parseNodeID(sp[1])
+	if err != nil {
+		c.Log().Debugf("Invalid node ID: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	o.setDenied(id, isDenied)
+	if isDenied {
+		o.log.Warningf("Denied links with peer: %v", sp[1])
+	} else {
+		o.log.Noticef("Removed the link denial of peer: %v", sp[1])
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (o *peerOverrides) onMgmtPeerDeny(c *thwack.Conn, l string) error {
+	return o.doMgmtPeerDeny(c, l, true)
+}
+
+func (o *peerOverrides) onMgmtPeerUndeny(c *thwack.Conn, l string) error {
+	return o.doMgmtPeerDeny(c, l, false)
+}
+
+func newAllowedPeerDescriptor(cfg *config.AllowedPeer) (*cpki.MixDescriptor, error) {
+	desc := &cpki.MixDescriptor{
+		Name:        cfg.Name,
+		IdentityKey: new(eddsa.PublicKey),
+		LinkKey:     new(ecdh.PublicKey),
+		Addresses:   cfg.Addresses,
+	}
+	if err := desc.IdentityKey.FromString(cfg.IdentityKey); err != nil {
+		return nil, err
+	}
+	raw, err := config.DecodeLinkKey(cfg.LinkKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = desc.LinkKey.FromBytes(raw); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+func newPeerOverrides(s *Server) (*peerOverrides, error) {
+	o := new(peerOverrides)
+	o.s = s
+	o.log = s.newLogger("peeroverrides")
+	o.allowed = make(map[[constants.NodeIDLength]byte]*cpki.MixDescriptor)
+	o.denied = make(map[[constants.NodeIDLength]byte]bool)
+
+	if cfg := s.cfg.PeerOverrides; cfg != nil {
+		for _, v := range cfg.Allow {
+			desc, err := newAllowedPeerDescriptor(v)
+			if err != nil {
+				return nil, fmt.Errorf("server: invalid PeerOverrides Allow entry '%v': %v", v.Name, err)
+			}
+			o.allowed[desc.IdentityKey.ByteArray()] = desc
+			o.log.Noticef("Allowing links with peer regardless of the PKI: '%v'", desc.Name)
+		}
+		for _, v := range cfg.Deny {
+			var pubKey eddsa.PublicKey
+			if err := pubKey.FromString(v); err != nil {
+				return nil, fmt.Errorf("server: invalid PeerOverrides Deny entry '%v': %v", v, err)
+			}
+			o.denied[pubKey.ByteArray()] = true
+		}
+		if len(o.denied) > 0 {
+			o.log.Noticef("Denying links with %v peer(s) regardless of the PKI.", len(o.denied))
+		}
+	}
+
+	if s.cfg.Management.Enable {
+		const (
+			cmdPeerOverrides = "PEER_OVERRIDES"
+			cmdPeerDeny      = "PEER_DENY"
+			cmdPeerUndeny    = "PEER_UNDENY"
+		)
+		s.management.RegisterCommand(cmdPeerOverrides, o.onMgmtPeerOverrides)
+		s.management.RegisterCommand(cmdPeerDeny, o.onMgmtPeerDeny)
+		s.management.RegisterCommand(cmdPeerUndeny, o.onMgmtPeerUndeny)
+	}
+
+	return o, nil
+}
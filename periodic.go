@@ -17,15 +17,20 @@
 package server
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/core/worker"
 )
 
 type periodicTimer struct {
+	lastTick int64 // MUST be accessed via sync/atomic.
+
 	worker.Worker
 
-	s *Server
+	s           *Server
+	systemd     *systemdNotifier
+	epochReport *epochReporter
 }
 
 func (t *periodicTimer) worker() {
@@ -33,6 +38,7 @@ func (t *periodicTimer) worker() {
 	defer ticker.Stop()
 
 	lastCallbackTime := time.Now()
+	lastEpoch, _, _ := t.s.epochNow()
 	for {
 		select {
 		case <-t.HaltCh():
@@ -55,6 +61,7 @@ func (t *periodicTimer) worker() {
 		// screws with epoch timing and PKI interactions, but everything
 		// should keep working, for varying amounts of "working".
 		now := time.Now()
+		atomic.StoreInt64(&t.lastTick, now.UnixNano())
 		deltaT := now.Sub(lastCallbackTime)
 		if deltaT < 0 {
 			t.s.log.Warning("Civil time jumped backwards: %v", deltaT)
@@ -62,6 +69,59 @@ func (t *periodicTimer) worker() {
 			t.s.log.Warning("Civil time jumped forward: %v", deltaT)
 		}
 
+		// Notify subscribers of epoch transitions.
+		if epoch, _, _ := t.s.epochNow(); epoch != lastEpoch {
+			t.s.emitEpochEvent(EventEpochTransition, epoch)
+			lastEpoch = epoch
+		}
+
+		// Summarize the upcoming epoch transition.
+		t.epochReport.onTick(now)
+
+		// Handle systemd readiness notification and the watchdog.
+		t.systemd.onTick(now)
+
+		// Run the chaos testing hooks.
+		if t.s.chaos != nil {
+			t.s.chaos.onTick(now)
+		}
+
+		// Persist the traffic accounting.
+		t.s.accounting.onTick(now)
+
+		// Reset the forwarded packet cap on epoch transitions.
+		if t.s.forwardCap != nil {
+			t.s.forwardCap.onTick(now)
+		}
+
+		// Check the free disk space.
+		t.s.disk.onTick(now)
+
+		// Shut down once decommissioning is complete.
+		t.s.decommission.onTick(now)
+
+		// Check the resource budget, and re-evaluate the overload state.
+		t.s.resources.onTick(now)
+		t.s.connLimiter.onTick()
+
+		// Forget the peers that have been behaving.
+		t.s.peerBans.onTick(now)
+
+		// Expire the parked packets.
+		if t.s.parking != nil {
+			t.s.parking.onTick(now)
+		}
+
+		// Run the attack heuristics.
+		if t.s.attackDetector != nil {
+			t.s.attackDetector.onTick(now)
+		}
+
+		// Rotate the log file if needed.
+		if t.s.logRotator != nil {
+			t.s.logRotator.maybeRotate()
+		}
+
 		// TODO: Figure out what needs to be triggered from the top level
 		// server instead of from timers belonging to a sub component.
 
@@ -70,10 +130,19 @@ func (t *periodicTimer) worker() {
 	}
 }
 
+// sinceLastTick returns the time since the timer last ran, which stays low
+// as long as the server is not wedged.
+func (t *periodicTimer) sinceLastTick() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.lastTick)))
+}
+
 func newPeriodicTimer(s *Server) *periodicTimer {
 	t := new(periodicTimer)
 	t.s = s
+	t.lastTick = time.Now().UnixNano()
+	t.systemd = newSystemdNotifier(s)
+	t.epochReport = newEpochReporter(s)
 
-	t.Go(t.worker)
+	t.Go(s.supervise("periodic timer", t.worker))
 	return t
 }
@@ -0,0 +1,93 @@
+// pidfile.go - Katzenpost server DataDir locking.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pidFileName         = "katzenpost.pid"
+	pidLockPollInterval = 250 * time.Millisecond
+)
+
+var errDataDirLocked = errors.New("DataDir is locked")
+
+// lockDataDir takes an exclusive lock on the DataDir by the way of the pid
+// file, so that multiple server instances can not use the same mix keys and
+// replay filters, which would silently break replay protection.
+func (s *Server) lockDataDir() error {
+	p := filepath.Join(s.cfg.Server.DataDir, pidFileName)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("server: failed to open pid file: %v", err)
+	}
+
+	// A replacement process started via a graceful hand off will wait for
+	// the process it is replacing to release the DataDir.
+	var deadline time.Time
+	if os.Getenv(envListenFDs) != "" {
+		timeout := s.cfg.Debug.ListenerDrainTimeout + s.cfg.Debug.ShutdownTimeout
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	for {
+		if err = lockFile(f); err != errDataDirLocked || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(pidLockPollInterval)
+	}
+	if err != nil {
+		defer f.Close()
+		if err == errDataDirLocked {
+			b, _ := ioutil.ReadAll(io.LimitReader(f, 32))
+			return fmt.Errorf("server: DataDir '%v' is in use by pid %v", s.cfg.Server.DataDir, strings.TrimSpace(string(b)))
+		}
+		return fmt.Errorf("server: failed to lock DataDir: %v", err)
+	}
+
+	if err = f.Truncate(0); err == nil {
+		if _, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err == nil {
+			err = f.Sync()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("server: failed to write pid file: %v", err)
+	}
+	s.pidFile = f
+	return nil
+}
+
+// unlockDataDir releases the lock on the DataDir.  The pid file is
+// truncated rather than removed, since a replacement process may already be
+// waiting on the lock.
+func (s *Server) unlockDataDir() {
+	s.pidFileOnce.Do(func() {
+		if s.pidFile == nil {
+			return
+		}
+		s.pidFile.Truncate(0)
+		s.pidFile.Close()
+	})
+}
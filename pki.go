@@ -19,15 +19,20 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	nClient "github.com/katzenpost/authority/nonvoting/client"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
-	"github.com/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/worker"
 	"github.com/katzenpost/server/internal/pkicache"
@@ -35,6 +40,9 @@ import (
 )
 
 type pki struct {
+	lastPublishedEpoch uint64 // Writes MUST use sync/atomic.
+	maxDelay           uint64 // MUST be accessed via sync/atomic.
+
 	sync.RWMutex
 	worker.Worker
 
@@ -42,13 +50,41 @@ type pki struct {
 	log  *logging.Logger
 	impl cpki.Client
 
-	docs               map[uint64]*pkicache.Entry
-	lastPublishedEpoch uint64
-	lastWarnedEpoch    uint64
+	docs              map[uint64]*pkicache.Entry
+	fetchedAt         map[uint64]time.Time
+	lastWarnedEpoch   uint64
+	lastWithheldEpoch uint64
+
+	republishCh chan interface{}
+	fetchCh     chan interface{}
+}
+
+// publishedEpoch returns the most recent epoch that the descriptor was
+// published for.
+func (p *pki) publishedEpoch() uint64 {
+	return atomic.LoadUint64(&p.lastPublishedEpoch)
+}
+
+// forceRepublish makes the worker publish the descriptor again, even if it
+// was already published for the current epoch.
+func (p *pki) forceRepublish() {
+	select {
+	case p.republishCh <- true:
+	default:
+	}
+}
+
+// ForceFetch makes the worker fetch the PKI documents immediately, instead
+// of waiting for the recheck interval, replacing the cached ones if any.
+func (p *pki) ForceFetch() {
+	select {
+	case p.fetchCh <- true:
+	default:
+	}
 }
 
 func (p *pki) startWorker() {
-	p.Go(p.worker)
+	p.Go(p.s.supervise("pki", p.worker))
 }
 
 func (p *pki) worker() {
@@ -88,7 +124,7 @@ func (p *pki) worker() {
 	for {
 		const recheckInterval = 1 * time.Minute
 
-		timerFired := false
+		timerFired, forceFetch := false, false
 		select {
 		case <-p.HaltCh():
 			p.log.Debugf("Terminating gracefully.")
@@ -97,6 +133,12 @@ func (p *pki) worker() {
 			return
 		case <-timer.C:
 			timerFired = true
+		case <-p.republishCh:
+			p.log.Debugf("Forcing descriptor publication.")
+			atomic.StoreUint64(&p.lastPublishedEpoch, 0)
+		case <-p.fetchCh:
+			p.log.Debugf("Forcing PKI fetch.")
+			forceFetch = true
 		}
 		if !timerFired && !timer.Stop() {
 			<-timer.C
@@ -104,14 +146,20 @@ func (p *pki) worker() {
 
 		// Fetch the PKI documents as required.
 		didUpdate := false
-		for _, epoch := range p.documentsToFetch() {
+		for _, epoch := range p.documentsToFetch(forceFetch) {
+			span := p.s.otel.StartSpan("pki.fetch")
+			span.SetAttribute("epoch", strconv.FormatUint(epoch, 10))
 			d, err := p.impl.Get(pkiCtx, epoch)
+			span.End(err)
 			if isCanceled() {
 				// Canceled mid-fetch.
 				return
 			}
 			if err != nil {
 				p.log.Warningf("Failed to fetch PKI for epoch %v: %v", epoch, err)
+				if now, _, _ := p.s.epochNow(); epoch == now {
+					p.s.emitDegradedEvent("no PKI document for the current epoch")
+				}
 				continue
 			}
 
@@ -125,8 +173,10 @@ func (p *pki) worker() {
 			}
 			p.Lock()
 			p.docs[epoch] = ent
+			p.fetchedAt[epoch] = time.Now()
 			p.Unlock()
 			didUpdate = true
+			p.s.emitEpochEvent(EventPKIUpdated, epoch)
 		}
 		if didUpdate {
 			// Dispose of the old PKI documents.
@@ -145,12 +195,40 @@ func (p *pki) worker() {
 		}
 		if err != nil {
 			p.log.Warningf("Failed to post to PKI: %v", err)
+			p.s.emitDegradedEvent("failed to publish the descriptor")
 		}
 
 		timer.Reset(recheckInterval)
 	}
 }
 
+// checkReachability connects to each of the addresses, and returns an error
+// if any of them is unreachable.
+//
+// Note: The connections originate from the server itself, so while this
+// catches listeners that are not bound or are firewalled on the host, it
+// will not catch upstream firewalls, and may fail spuriously behind a NAT
+// that does not support hairpinning.
+func (p *pki) checkReachability(ctx context.Context, addrs []string) error {
+	const dialTimeout = 10 * time.Second
+
+	var unreachable []string
+	for _, addr := range addrs {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			p.log.Errorf("Advertised address '%v' is unreachable: %v", addr, err)
+			unreachable = append(unreachable, addr)
+			continue
+		}
+		conn.Close()
+	}
+	if unreachable != nil {
+		return fmt.Errorf("unreachable addresses: %v", strings.Join(unreachable, ", "))
+	}
+	return nil
+}
+
 func (p *pki) validateCacheEntry(ent *pkicache.Entry) error {
 	// This just does light-weight validation on self, primarily to catch
 	// dumb bugs.  Anything more is somewhat silly because authorities are
@@ -170,7 +248,7 @@ func (p *pki) validateCacheEntry(ent *pkicache.Entry) error {
 }
 
 func (p *pki) pruneDocuments() {
-	now, _, _ := epochtime.Now()
+	now, _, _ := p.s.epochNow()
 
 	p.Lock()
 	defer p.Unlock()
@@ -178,18 +256,39 @@ func (p *pki) pruneDocuments() {
 		if epoch < now-(numMixKeys-1) {
 			p.log.Debugf("Discarding PKI for epoch: %v", epoch)
 			delete(p.docs, epoch)
+			delete(p.fetchedAt, epoch)
 		}
 		if epoch > now+1 {
 			// This should NEVER happen.
 			p.log.Debugf("Far future PKI document exists, clock ran backwards?: %v", epoch)
 		}
 	}
+
+	// Packets may have been created against any of the cached documents,
+	// so the most permissive of the advertised delay bounds applies.
+	var maxDelay uint64
+	for _, ent := range p.docs {
+		if d := ent.Document().MuMaxDelay; d > maxDelay {
+			maxDelay = d
+		}
+	}
+	atomic.StoreUint64(&p.maxDelay, maxDelay)
+}
+
+// maxNodeDelay returns the maximum per-hop delay in milliseconds that the
+// cached PKI documents allow clients to request, or 0 if unknown.
+func (p *pki) maxNodeDelay() uint64 {
+	return atomic.LoadUint64(&p.maxDelay)
 }
 
 func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 	const publishDeadline = 3600 * time.Second
 
-	epoch, _, till := epochtime.Now()
+	if p.s.isDecommissioning() {
+		return nil
+	}
+
+	epoch, _, till := p.s.epochNow()
 	doPublishEpoch := uint64(0)
 	switch p.lastPublishedEpoch {
 	case 0:
@@ -226,6 +325,28 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		doPublishEpoch = epoch
 	}
 
+	// Withhold the descriptor for the next epoch if the forwarded packet
+	// cap was reached, so that the node is not in the next topology.
+	//
+	// Note: This is too late if the descriptor was already published.
+	if fc := p.s.forwardCap; fc != nil && doPublishEpoch > epoch && fc.isWithholding() {
+		if p.lastWithheldEpoch != epoch {
+			p.lastWithheldEpoch = epoch
+			p.log.Warningf("Withholding the descriptor for epoch %v, forwarded packet cap reached.", doPublishEpoch)
+		}
+		return nil
+	}
+
+	// Likewise if the disk is nearly full, as the replay filters would
+	// start failing.
+	if doPublishEpoch > epoch && p.s.disk.isWithholding() {
+		if p.lastWithheldEpoch != epoch {
+			p.lastWithheldEpoch = epoch
+			p.log.Warningf("Withholding the descriptor for epoch %v, low disk space.", doPublishEpoch)
+		}
+		return nil
+	}
+
 	// Note: Why, yes I *could* cache the descriptor and save a trivial amount
 	// of time and CPU, but this is invoked infrequently enough that it's
 	// probably not worth it.
@@ -235,12 +356,17 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		Name:        p.s.cfg.Server.Identifier,
 		IdentityKey: p.s.identityKey.PublicKey(),
 		LinkKey:     p.s.linkKey.PublicKey(),
-		Addresses:   p.s.cfg.Server.Addresses,
+		Addresses:   p.s.listenerAddresses(),
 	}
 	if p.s.cfg.Server.IsProvider {
 		// Only set the layer if the node is a provider.  Otherwise, nodes
 		// shouldn't be self assigning this.
 		desc.Layer = cpki.LayerProvider
+
+		// TODO: Advertise p.s.provider.kaetzchenParams so that clients
+		// can discover the services.  The MixDescriptor in core has no
+		// field to carry them, so for now they are only available via
+		// the KAETZCHEN_LIST management command.
 	}
 	desc.MixKeys = make(map[uint64]*ecdh.PublicKey)
 
@@ -282,34 +408,48 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		return err
 	}
 
+	// Ensure that the advertised addresses are reachable, so that the
+	// entire network is not told to connect to a firewalled port.
+	if !p.s.cfg.Debug.DisableReachabilityCheck {
+		if err := p.checkReachability(pkiCtx, desc.Addresses); err != nil {
+			if p.s.cfg.Debug.RequireReachability {
+				return err
+			}
+			p.log.Warningf("Publishing the descriptor regardless: %v", err)
+		}
+	}
+
 	// Post the descriptor to all the authorities.
+	span := p.s.otel.StartSpan("pki.publish")
+	span.SetAttribute("epoch", strconv.FormatUint(doPublishEpoch, 10))
 	err := p.impl.Post(pkiCtx, doPublishEpoch, p.s.identityKey, desc)
+	span.End(err)
 	if err == nil {
 		p.log.Debugf("Posted descriptor for epoch: %v", doPublishEpoch)
-		p.lastPublishedEpoch = doPublishEpoch
+		atomic.StoreUint64(&p.lastPublishedEpoch, doPublishEpoch)
 	}
 
 	return err
 }
 
-func (p *pki) documentsToFetch() []uint64 {
+func (p *pki) documentsToFetch(force bool) []uint64 {
 	const nextFetchTill = 45 * time.Minute
 
 	ret := make([]uint64, 0, 2)
-	now, _, till := epochtime.Now()
+	now, _, till := p.s.epochNow()
 
 	p.RLock()
 	defer p.RUnlock()
 
 	// Fetch the document for the current epoch if it is missing.
-	if _, ok := p.docs[now]; !ok {
+	if _, ok := p.docs[now]; !ok || force {
 		ret = append(ret, now)
 	}
 
 	// If it is after the time that the next PKI has been generated, fetch
 	// that as well, assuming it is missing.
 	if till < nextFetchTill {
-		if _, ok := p.docs[now+1]; !ok {
+		if _, ok := p.docs[now+1]; !ok || force {
 			ret = append(ret, now+1)
 		}
 	}
@@ -317,6 +457,41 @@ func (p *pki) documentsToFetch() []uint64 {
 	return ret
 }
 
+func (p *pki) hasCurrentDocument() bool {
+	if p.impl == nil {
+		// With no PKI, there is nothing to wait for.
+		return true
+	}
+
+	now, _, _ := p.s.epochNow()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	_, ok := p.docs[now]
+	return ok
+}
+
+// currentDocument returns the cached PKI document for the current epoch, or
+// nil if it has not been fetched yet.
+func (p *pki) currentDocument() *pkicache.Entry {
+	now, _, _ := p.s.epochNow()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.docs[now]
+}
+
+// documentForEpoch returns the cached PKI document for the epoch, or nil if
+// it has not been fetched.
+func (p *pki) documentForEpoch(epoch uint64) *pkicache.Entry {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.docs[epoch]
+}
+
 func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry, uint64, time.Duration) {
 	const pkiEarlyConnectSlack = 30 * time.Minute
 
@@ -324,7 +499,7 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 	//
 	// Note: The ordering is important and should not be changed without
 	// changes to pki.authenticateConnection().
-	now, _, till := epochtime.Now()
+	now, _, till := p.s.epochNow()
 	epochs := make([]uint64, 0, numMixKeys+1)
 	start := now
 	if till < pkiEarlyConnectSlack {
@@ -353,6 +528,12 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 	return s, nowDoc, now, till
 }
 
+// refuseSkewTolerance returns true iff the clock skew tolerance should not
+// be applied to peer authentication, as the local clock is unreliable.
+func (p *pki) refuseSkewTolerance() bool {
+	return p.s.cfg.Debug.RefuseOnDangerousClockSkew && p.s.isDangerousSkew()
+}
+
 func (p *pki) authenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (desc *cpki.MixDescriptor, canSend, isValid bool) {
 	const earlySendSlack = 2 * time.Minute
 
@@ -375,6 +556,14 @@ func (p *pki) authenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (
 	}
 	var nodeID [constants.NodeIDLength]byte
 	copy(nodeID[:], c.AdditionalData)
+	if p.s.peerOverrides.isDenied(&nodeID) {
+		p.log.Debugf("%v: '%v' Denied by the peer overrides.", dirStr, bytesToPrintString(c.AdditionalData))
+		return nil, false, false
+	}
+	if p.s.chaos != nil && p.s.chaos.isPeerDropped(&nodeID) {
+		p.log.Debugf("%v: '%v' Dropped by the chaos hooks.", dirStr, bytesToPrintString(c.AdditionalData))
+		return nil, false, false
+	}
 
 	// Iterate over whatever documents we happen to have for the epochs
 	// [now+1, now, now-1, now-2].
@@ -410,7 +599,7 @@ func (p *pki) authenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (
 			return desc, true, true
 		case now + 1:
 			// The node is listed in the document from the next epoch..
-			if !isOutgoing && till < earlySendSlack {
+			if !isOutgoing && till < earlySendSlack && !p.refuseSkewTolerance() {
 				// And this is an incoming connection, and it is less than
 				// the slack till the transition.
 				//
@@ -439,6 +628,16 @@ func (p *pki) authenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (
 		}
 	}
 
+	// The peer is not (yet) authenticated by the PKI, but the operator may
+	// have allowed it regardless.
+	if m := p.s.peerOverrides.allowedPeer(&nodeID, isOutgoing); m != nil {
+		if !m.LinkKey.Equal(c.PublicKey) {
+			p.log.Warningf("%v: '%v' Allowed peer Public Key mismatch: '%v'", dirStr, bytesToPrintString(c.AdditionalData), c.PublicKey)
+			return
+		}
+		return m, true, true
+	}
+
 	return
 }
 
@@ -465,20 +664,56 @@ func (p *pki) outgoingDestinations() map[[constants.NodeIDLength]byte]*cpki.MixD
 				continue
 			}
 
+			if p.s.peerOverrides.isDenied(&nodeID) {
+				continue
+			}
+
 			// De-duplicate.
 			if _, ok := descMap[nodeID]; !ok {
 				descMap[nodeID] = v
 			}
 		}
 	}
+
+	// Add the peers allowed by the operator that are not listed.
+	for _, v := range p.s.peerOverrides.outgoing() {
+		nodeID := v.IdentityKey.ByteArray()
+		if _, ok := descMap[nodeID]; !ok {
+			descMap[nodeID] = v
+		}
+	}
 	return descMap
 }
 
+func (p *pki) onMgmtDocs(c *thwack.Conn, l string) error {
+	p.RLock()
+	epochs := make([]uint64, 0, len(p.docs))
+	for epoch := range p.docs {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	docs := make([]*pkicache.Entry, 0, len(epochs))
+	for _, epoch := range epochs {
+		docs = append(docs, p.docs[epoch])
+	}
+	p.RUnlock()
+
+	for _, d := range docs {
+		if err := c.Writer().PrintfLine("%v-Epoch:%v Nodes:%v Outgoing:%v Self:%v", thwack.StatusOk, d.Epoch(), d.Len(), len(d.Outgoing()), d.Self() != nil); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
 func newPKI(s *Server) (*pki, error) {
 	p := new(pki)
 	p.s = s
-	p.log = s.logBackend.GetLogger("pki")
+	p.log = s.newLogger("pki")
 	p.docs = make(map[uint64]*pkicache.Entry)
+	p.fetchedAt = make(map[uint64]time.Time)
+	p.republishCh = make(chan interface{}, 1) // See forceRepublish().
+	p.fetchCh = make(chan interface{}, 1)     // See ForceFetch().
 
 	if s.cfg.PKI.Nonvoting != nil {
 		authPk := new(eddsa.PublicKey)
@@ -498,6 +733,18 @@ func newPKI(s *Server) (*pki, error) {
 	}
 	// TODO: Wire in a real PKI implementation in addition to the test one.
 
+	if s.cfg.Management.Enable {
+		const (
+			cmdPKIDocs  = "PKI_DOCS"
+			cmdPKIFetch = "PKI_FETCH"
+		)
+		s.management.RegisterCommand(cmdPKIDocs, p.onMgmtDocs)
+		s.management.RegisterCommand(cmdPKIFetch, func(c *thwack.Conn, l string) error {
+			p.ForceFetch()
+			return c.WriteReply(thwack.StatusOk)
+		})
+	}
+
 	// Note: This does not start the worker immediately since the worker can
 	// make calls into the connector and crypto workers (on PKI updates),
 	// which are initialized after the pki object.
@@ -18,8 +18,11 @@ package server
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/eapache/channels"
 	"github.com/katzenpost/core/constants"
@@ -31,6 +34,7 @@ import (
 	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/config"
 	"github.com/katzenpost/server/spool"
 	"github.com/katzenpost/server/spool/boltspool"
 	"github.com/katzenpost/server/userdb"
@@ -48,6 +52,14 @@ type provider struct {
 	userDB userdb.UserDB
 	spool  spool.Spool
 	log    *logging.Logger
+
+	abuse           *abuseTracker
+	expiry          *accountExpiry
+	tiers           map[string]*config.Tier
+	defaultTier     *config.Tier
+	surbReplay      *surbReplay
+	kaetzchen       map[string]kaetzchen
+	kaetzchenParams map[string]map[string]interface{}
 }
 
 func (p *provider) Halt() {
@@ -62,6 +74,10 @@ func (p *provider) Halt() {
 		p.spool.Close()
 		p.spool = nil
 	}
+	if p.surbReplay != nil {
+		p.surbReplay.halt()
+		p.surbReplay = nil
+	}
 }
 
 func (p *provider) authenticateClient(c *wire.PeerCredentials) bool {
@@ -70,13 +86,47 @@ func (p *provider) authenticateClient(c *wire.PeerCredentials) bool {
 		if len(c.AdditionalData) == sConstants.NodeIDLength {
 			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v' (Probably a peer)", bytesToPrintString(c.AdditionalData), c.PublicKey)
 		} else {
-			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v'", utils.ASCIIBytesToPrintString(c.AdditionalData), c.PublicKey)
+			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v'", p.s.logRedactor.user(c.AdditionalData), c.PublicKey)
 		}
+		return false
+	}
+	if p.expiry != nil && p.expiry.isDisabled(c.AdditionalData) {
+		p.log.Errorf("Authenticate failed: User: '%v' (Disabled for being idle)", p.s.logRedactor.user(c.AdditionalData))
+		return false
+	}
+	p.updateActivity(c.AdditionalData, userdb.MetadataLastSeen)
+	return true
+}
+
+// updateActivity records the time of the user's last activity of the kind
+// specified by the metadata key, at a coarse granularity to avoid a database
+// write per connection or message.
+func (p *provider) updateActivity(u []byte, key string) {
+	const activityGranularity = 1 * time.Hour
+
+	now := time.Now()
+	if b, err := p.userDB.GetMetadata(u, key); err != nil {
+		return
+	} else if b != nil {
+		if last, err := userdb.DecodeTime(b); err == nil && now.Sub(last) < activityGranularity {
+			return
+		}
+	}
+	if err := p.userDB.SetMetadata(u, key, userdb.EncodeTime(now)); err != nil {
+		p.log.Warningf("Failed to update the activity time: User: '%v': %v", p.s.logRedactor.user(u), err)
 	}
-	return isValid
 }
 
 func (p *provider) onPacket(pkt *packet) {
+	// Shed load here rather than letting the backlog grow without bound, as
+	// the provider queue is drained at the rate the spool can be written to.
+	if max := p.s.cfg.Debug.ProviderQueueSize; max > 0 && p.ch.Len() >= max {
+		p.log.Debugf("Dropping packet: %v (Provider queue full)", pkt.id)
+		p.s.accounting.onDrop(dropProviderQueueFull)
+		pkt.dispose()
+		return
+	}
+
 	ch := p.ch.In()
 	ch <- pkt
 }
@@ -99,15 +149,27 @@ func (p *provider) worker() {
 		// Fix the recipient by trimming off the trailing NUL bytes.
 		recipient := bytes.TrimRight(pkt.recipient.ID[:], "\x00")
 
+		// Requests for the auto-responder services are handled internally.
+		if k, ok := p.kaetzchen[string(recipient)]; ok {
+			pkt.trace("deliver", "to kaetzchen")
+			if !pkt.isSURBReply() {
+				p.onKaetzchen(pkt, k, recipient)
+			}
+			pkt.dispose()
+			continue
+		}
+
 		// Ensure the packet is for a valid recipient.
-		if !p.userDB.Exists(recipient) {
-			p.log.Debugf("Dropping packet: %v (Invalid Recipient: '%v')", pkt.id, utils.ASCIIBytesToPrintString(recipient))
+		if !p.userDB.Exists(recipient) || (p.expiry != nil && p.expiry.isDisabled(recipient)) {
+			p.log.Debugf("Dropping packet: %v (Invalid Recipient: '%v')", pkt.id, p.s.logRedactor.user(recipient))
+			p.s.accounting.onDrop(dropInvalidRecipient)
 			pkt.dispose()
 			continue
 		}
 
 		// All of the store operations involve writing to the database which
 		// won't really benefit from concurrency.
+		pkt.trace("deliver", "to local user")
 		if pkt.isSURBReply() {
 			p.onSURBReply(pkt, recipient)
 		} else {
@@ -123,18 +185,38 @@ func (p *provider) worker() {
 func (p *provider) onSURBReply(pkt *packet, recipient []byte) {
 	if len(pkt.payload) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
 		p.log.Debugf("Refusing to store mis-sized SURB-Reply: %v (%v)", pkt.id, len(pkt.payload))
+		p.s.accounting.onDrop(dropMisSized)
 		return
 	}
 
 	// Store the payload in the spool.
+	if p.isOverQuota(recipient) {
+		p.log.Debugf("Refusing to store SURBReply, tier quota reached: %v", pkt.id)
+		p.s.accounting.onDrop(dropSpoolFull)
+		return
+	}
+	if p.s.disk.isRefusingSpool() {
+		p.log.Debugf("Refusing to store SURBReply, low disk space: %v", pkt.id)
+		p.s.accounting.onDrop(dropLowDiskSpace)
+		return
+	}
 	if err := p.spool.StoreSURBReply(recipient, &pkt.surbReply.ID, pkt.payload); err != nil {
 		p.log.Debugf("Failed to store SURBReply: %v (%v)", pkt.id, err)
 	} else {
 		p.log.Debugf("Stored SURBReply: %v", pkt.id)
+		p.onSpooled(recipient)
 	}
 }
 
-func (p *provider) onToUser(pkt *packet, recipient []byte) {
+func (p *provider) onSpooled(recipient []byte) {
+	if p.expiry != nil {
+		p.updateActivity(recipient, userdb.MetadataLastSpooled)
+	}
+}
+
+// parseUserPayload parses the payload of a forward packet destined for a
+// local recipient, returning the user ciphertext and the (optional) SURB.
+func (p *provider) parseUserPayload(pkt *packet) (ct, surb []byte, ok bool) {
 	const (
 		hdrLength    = constants.SphinxPlaintextHeaderLength + sphinx.SURBLength
 		flagsPadding = 0
@@ -145,86 +227,150 @@ func (p *provider) onToUser(pkt *packet, recipient []byte) {
 	// Sanity check the forward packet payload length.
 	if len(pkt.payload) != constants.ForwardPayloadLength {
 		p.log.Debugf("Dropping packet: %v (Invalid payload length: '%v')", pkt.id, len(pkt.payload))
-		return
+		return nil, nil, false
 	}
 
 	// Parse the payload, which should be a valid BlockSphinxPlaintext.
 	b := pkt.payload
 	if len(b) < hdrLength {
 		p.log.Debugf("Dropping packet: %v (Truncated message block)", pkt.id)
-		return
+		return nil, nil, false
 	}
 	if b[1] != reserved {
 		p.log.Debugf("Dropping packet: %v (Invalid message reserved: 0x%02x)", pkt.id, b[1])
-		return
+		return nil, nil, false
 	}
-	ct := b[hdrLength:]
-	var surb []byte
+	ct = b[hdrLength:]
 	switch b[0] {
 	case flagsPadding:
 	case flagsSURB:
 		surb = b[constants.SphinxPlaintextHeaderLength:hdrLength]
 	default:
 		p.log.Debugf("Dropping packet: %v (Invalid message flags: 0x%02x)", pkt.id, b[0])
-		return
+		return nil, nil, false
 	}
 	if len(ct) != constants.UserForwardPayloadLength {
 		p.log.Debugf("Refusing to store mis-sized user payload: %v", len(ct))
+		p.s.accounting.onDrop(dropMisSized)
+		return nil, nil, false
+	}
+	return ct, surb, true
+}
+
+func (p *provider) onToUser(pkt *packet, recipient []byte) {
+	ct, surb, ok := p.parseUserPayload(pkt)
+	if !ok {
 		return
 	}
 
 	// Store the ciphertext in the spool.
+	//
+	// Note: There is no way to return an error to the (anonymous) sender,
+	// so the lack of a SURB-ACK is the only indication that the message was
+	// not stored.
+	if p.isOverQuota(recipient) {
+		p.log.Debugf("Refusing to store message payload, tier quota reached: %v", pkt.id)
+		p.s.accounting.onDrop(dropSpoolFull)
+		return
+	}
+	if p.s.disk.isRefusingSpool() {
+		p.log.Debugf("Refusing to store message payload, low disk space: %v", pkt.id)
+		p.s.accounting.onDrop(dropLowDiskSpace)
+		return
+	}
 	if err := p.spool.StoreMessage(recipient, ct); err != nil {
 		p.log.Debugf("Failed to store message payload: %v (%v)", pkt.id, err)
 		return
 	}
+	p.onSpooled(recipient)
 
 	// Iff there is a SURB, generate a SURB-ACK, and schedule.
 	if surb != nil {
-		if !pkt.isToUser() {
-			p.log.Debugf("Packet has invalid commands for the SURB-ACK: %v", pkt.id)
-			return
-		}
-
-		// Build the SURB-ACK from the SURB.
-		//
-		// TODO/perf: This is a crypto operation and can be made concurrent,
-		// the logical place for this is probably the crypto workers.
 		var ackPayload [constants.ForwardPayloadLength]byte
-		rawAckPkt, firstHop, err := sphinx.NewPacketFromSURB(surb, ackPayload[:])
-		if err != nil {
-			p.log.Debugf("Failed to generate SURB-ACK: %v (%v)", pkt.id, err)
-			return
-		}
+		p.sendViaSURB(pkt, surb, ackPayload[:], "SURB-ACK")
+	} else {
+		p.log.Debugf("Stored Message: %v (No SURB)", pkt.id)
+	}
+}
 
-		// Build the packet structure for the SURB-ACK.
-		ackPkt := newPacket()
-		ackPkt.copyToRaw(rawAckPkt)
-		ackPkt.cmds = make([]commands.RoutingCommand, 0, 2)
+func (p *provider) onKaetzchen(pkt *packet, k kaetzchen, recipient []byte) {
+	ct, surb, ok := p.parseUserPayload(pkt)
+	if !ok {
+		return
+	}
+	if surb == nil {
+		p.log.Debugf("Dropping Kaetzchen request: %v (No SURB)", pkt.id)
+		return
+	}
 
-		nextHopCmd := new(commands.NextNodeHop)
-		copy(nextHopCmd.ID[:], firstHop[:])
-		ackPkt.cmds = append(ackPkt.cmds, nextHopCmd)
-		ackPkt.nextNodeHop = nextHopCmd
+	resp, err := k.onRequest(pkt.id, ct)
+	if err != nil {
+		p.log.Debugf("Kaetzchen '%v' request failed: %v (%v)", utils.ASCIIBytesToPrintString(recipient), pkt.id, err)
+	}
+	if resp == nil {
+		return
+	}
+	if len(resp) > constants.ForwardPayloadLength {
+		p.log.Errorf("Kaetzchen '%v' response is oversized: %v (%v)", utils.ASCIIBytesToPrintString(recipient), pkt.id, len(resp))
+		return
+	}
 
-		nodeDelayCmd := new(commands.NodeDelay)
-		nodeDelayCmd.Delay = pkt.nodeDelay.Delay
-		ackPkt.cmds = append(ackPkt.cmds, nodeDelayCmd)
-		ackPkt.nodeDelay = nodeDelayCmd
+	var respPayload [constants.ForwardPayloadLength]byte
+	copy(respPayload[:], resp)
+	p.sendViaSURB(pkt, surb, respPayload[:], "Kaetzchen response")
+}
 
-		ackPkt.recvAt = pkt.recvAt
-		ackPkt.delay = pkt.delay
-		ackPkt.mustForward = true
+// sendViaSURB sends payload back to the originator of pkt via the SURB
+// included in pkt, by handing it off to the scheduler.
+func (p *provider) sendViaSURB(pkt *packet, surb, payload []byte, what string) {
+	if !pkt.isToUser() {
+		p.log.Debugf("Packet has invalid commands for the %v: %v", what, pkt.id)
+		return
+	}
 
-		// XXX: This should probably fudge the delay to account for processing
-		// time.
+	// Ensure that the SURB hasn't been used before.
+	if p.surbReplay.isReplay(surb) {
+		p.log.Debugf("Dropping %v: %v (SURB replay)", what, pkt.id)
+		p.s.accounting.onDrop(dropSURBReplay)
+		return
+	}
 
-		// Send the SURB-ACK off to the scheduler.
-		p.log.Debugf("Handing off user destined SURB-ACK: %v (Src:%v)", ackPkt.id, pkt.id)
-		p.s.scheduler.onPacket(ackPkt)
-	} else {
-		p.log.Debugf("Stored Message: %v (No SURB)", pkt.id)
+	// Build the packet from the SURB.
+	//
+	// TODO/perf: This is a crypto operation and can be made concurrent,
+	// the logical place for this is probably the crypto workers.
+	rawReplyPkt, firstHop, err := sphinx.NewPacketFromSURB(surb, payload)
+	if err != nil {
+		p.log.Debugf("Failed to generate %v: %v (%v)", what, pkt.id, err)
+		return
 	}
+
+	// Build the packet structure for the reply.
+	replyPkt := newPacket()
+	replyPkt.copyToRaw(rawReplyPkt)
+	replyPkt.cmds = make([]commands.RoutingCommand, 0, 2)
+
+	nextHopCmd := new(commands.NextNodeHop)
+	copy(nextHopCmd.ID[:], firstHop[:])
+	replyPkt.cmds = append(replyPkt.cmds, nextHopCmd)
+	replyPkt.nextNodeHop = nextHopCmd
+
+	nodeDelayCmd := new(commands.NodeDelay)
+	nodeDelayCmd.Delay = pkt.nodeDelay.Delay
+	replyPkt.cmds = append(replyPkt.cmds, nodeDelayCmd)
+	replyPkt.nodeDelay = nodeDelayCmd
+
+	replyPkt.recvAt = pkt.recvAt
+	replyPkt.delay = pkt.delay
+	replyPkt.mustForward = true
+	replyPkt.inheritTrace(pkt)
+
+	// XXX: This should probably fudge the delay to account for processing
+	// time.
+
+	// Send the reply off to the scheduler.
+	p.log.Debugf("Handing off user destined %v: %v (Src:%v)", what, replyPkt.id, pkt.id)
+	p.s.scheduler.onPacket(replyPkt)
 }
 
 func (p *provider) onAddUser(c *thwack.Conn, l string) error {
@@ -271,19 +417,85 @@ func (p *provider) onRemoveUser(c *thwack.Conn, l string) error {
 		return c.WriteReply(thwack.StatusSyntaxError)
 	}
 
-	// Remove the user from the UserDB.
-	if err := p.userDB.Remove([]byte(sp[1])); err != nil {
+	if err := p.doRemoveUser([]byte(sp[1])); err != nil {
 		c.Log().Errorf("Failed to remove user '%v': %v", sp[1], err)
 		return c.WriteReply(thwack.StatusTransactionFailed)
 	}
 
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) removeUser(u []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.doRemoveUser(u)
+}
+
+func (p *provider) doRemoveUser(u []byte) error {
+	// Remove the user from the UserDB.
+	if err := p.userDB.Remove(u); err != nil {
+		return err
+	}
+
 	// Remove the user's spool.
-	if err := p.spool.Remove([]byte(sp[1])); err != nil {
-		// Log an error, but don't return a failed status, because the
-		// user has been obliterated from the UserDB at this point.
-		c.Log().Errorf("Failed to remove spool '%v': %v", sp[1], err)
+	if err := p.spool.Remove(u); err != nil {
+		// Log an error, but don't return a failure, because the user has
+		// been obliterated from the UserDB at this point.
+		p.log.Errorf("Failed to remove spool '%v': %v", p.s.logRedactor.user(u), err)
+	}
+	return nil
+}
+
+func (p *provider) onUserMetadata(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("USER_METADATA invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
 	}
 
+	m, err := p.userDB.Metadata([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("Failed to query metadata of user '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := string(m[k])
+		switch k {
+		case userdb.MetadataCreated, userdb.MetadataLastSeen:
+			if t, err := userdb.DecodeTime(m[k]); err == nil {
+				v = t.UTC().Format(time.RFC3339)
+			}
+		}
+		if err = c.Writer().PrintfLine("%v-%v:%v", thwack.StatusOk, k, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onUserTag(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 3 && len(sp) != 4 {
+		c.Log().Debugf("USER_TAG invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Omitting the value removes the tag.
+	var v []byte
+	if len(sp) == 4 {
+		v = []byte(sp[3])
+	}
+	if err := p.userDB.SetMetadata([]byte(sp[1]), userdb.MetadataTagPrefix+sp[2], v); err != nil {
+		c.Log().Errorf("Failed to set tag of user '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
 	return c.WriteReply(thwack.StatusOk)
 }
 
@@ -291,7 +503,8 @@ func newProvider(s *Server) (*provider, error) {
 	p := new(provider)
 	p.s = s
 	p.ch = channels.NewInfiniteChannel()
-	p.log = s.logBackend.GetLogger("provider")
+	p.log = s.newLogger("provider")
+	p.abuse = newAbuseTracker(s)
 
 	var err error
 	if p.s.cfg.Provider.UserDBBackend == "extern" {
@@ -306,7 +519,18 @@ func newProvider(s *Server) (*provider, error) {
 		}
 	}
 
-	p.spool, err = boltspool.New(p.s.cfg.Provider.SpoolDB)
+	var spoolKey []byte
+	if f := p.s.cfg.Provider.SpoolKeyFile; f != "" {
+		if spoolKey, err = s.loadSpoolKey(f); err != nil {
+			p.userDB.Close()
+			return nil, err
+		}
+		defer utils.ExplicitBzero(spoolKey)
+	}
+	spoolOpts := &boltspool.Options{
+		MasterKey: spoolKey,
+	}
+	p.spool, err = boltspool.NewWithOptions(p.s.cfg.Provider.SpoolDB, spoolOpts)
 	if err != nil {
 		p.userDB.Close()
 		return nil, err
@@ -319,19 +543,72 @@ func newProvider(s *Server) (*provider, error) {
 		return nil, err
 	}
 
+	if p.surbReplay, err = newSURBReplay(s); err != nil {
+		p.spool.Close()
+		p.userDB.Close()
+		return nil, err
+	}
+
+	// Initialize the auto-responder services.
+	p.kaetzchen = make(map[string]kaetzchen)
+	p.kaetzchenParams = make(map[string]map[string]interface{})
+	for _, v := range p.s.cfg.Provider.Kaetzchen {
+		if v.Disable {
+			continue
+		}
+		k, err := newKaetzchen(s, v)
+		if err != nil {
+			p.surbReplay.halt()
+			p.spool.Close()
+			p.userDB.Close()
+			return nil, err
+		}
+		p.kaetzchen[v.Endpoint] = k
+		p.kaetzchenParams[v.Capability] = kaetzchenParameters(v, k)
+		p.log.Noticef("Kaetzchen '%v' enabled at: '%v'", v.Capability, v.Endpoint)
+	}
+
+	// Initialize the account service tiers.
+	p.initTiers()
+
+	// Initialize the idle account expiry.
+	if s.cfg.Provider.AccountExpiry != nil {
+		p.expiry = newAccountExpiry(p)
+	}
+
 	// Wire in the managment related commands.
 	if s.cfg.Management.Enable {
 		const (
-			cmdAddUser    = "ADD_USER"
-			cmdUpdateUser = "UPDATE_USER"
-			cmdRemoveUser = "REMOVE_USER"
+			cmdAddUser      = "ADD_USER"
+			cmdUpdateUser   = "UPDATE_USER"
+			cmdRemoveUser   = "REMOVE_USER"
+			cmdUserMetadata = "USER_METADATA"
+			cmdUserTag      = "USER_TAG"
+			cmdUserExport   = "USER_EXPORT"
+			cmdUserImport   = "USER_IMPORT"
+
+			cmdKaetzchenList = "KAETZCHEN_LIST"
+			cmdAbuseList     = "ABUSE_LIST"
+			cmdAbuseReset    = "ABUSE_RESET"
 		)
 
 		s.management.RegisterCommand(cmdAddUser, p.onAddUser)
 		s.management.RegisterCommand(cmdUpdateUser, p.onUpdateUser)
 		s.management.RegisterCommand(cmdRemoveUser, p.onRemoveUser)
+		s.management.RegisterCommand(cmdUserMetadata, p.onUserMetadata)
+		s.management.RegisterCommand(cmdUserTag, p.onUserTag)
+		s.management.RegisterCommand(cmdUserExport, p.onMgmtUserExport)
+		s.management.RegisterCommand(cmdUserImport, p.onMgmtUserImport)
+		s.management.RegisterCommand(cmdKaetzchenList, p.onMgmtKaetzchenList)
+		s.management.RegisterCommand(cmdAbuseList, p.abuse.onMgmtAbuseList)
+		s.management.RegisterCommand(cmdAbuseReset, p.abuse.onMgmtAbuseReset)
 	}
 
-	p.Go(p.worker)
+	for i := 0; i < s.cfg.Debug.NumProviderWorkers; i++ {
+		p.Go(s.supervise(fmt.Sprintf("provider worker %d", i), p.worker))
+	}
+	if p.expiry != nil {
+		p.Go(s.superviseOptional("account expiry", p.expiry.worker))
+	}
 	return p, nil
 }
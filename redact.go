@@ -0,0 +1,107 @@
+// redact.go - Katzenpost server client log redaction.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/config"
+)
+
+const redactedHashLength = 8
+
+// logRedactor applies the Logging.RedactClients policy to client IP
+// addresses and user identifiers before they are logged.  The hash key is
+// generated at startup and never persisted, so hashes can only be
+// correlated within a single run.
+type logRedactor struct {
+	policy string
+	key    [sha256.Size]byte
+}
+
+func (r *logRedactor) hash(prefix string, b []byte) string {
+	m := hmac.New(sha256.New, r.key[:])
+	m.Write(b)
+	return prefix + hex.EncodeToString(m.Sum(nil)[:redactedHashLength])
+}
+
+// addr returns the loggable representation of the client address addr.
+func (r *logRedactor) addr(addr net.Addr) string {
+	if r.policy == "" {
+		return addr.String()
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		return a.String()
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return "[REDACTED]"
+	}
+
+	switch r.policy {
+	case config.RedactHash:
+		return r.hash("ip-", ip.To16())
+	default:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 8*net.IPv4len)).String() + "/24"
+		}
+		return ip.Mask(net.CIDRMask(48, 8*net.IPv6len)).String() + "/48"
+	}
+}
+
+// user returns the loggable representation of the user identifier u.
+func (r *logRedactor) user(u []byte) string {
+	const truncatedLength = 2
+
+	switch r.policy {
+	case config.RedactHash:
+		return r.hash("user-", u)
+	case config.RedactTruncate:
+		if len(u) > truncatedLength {
+			u = u[:truncatedLength]
+		}
+		return utils.ASCIIBytesToPrintString(u) + "..."
+	default:
+		return utils.ASCIIBytesToPrintString(u)
+	}
+}
+
+func newLogRedactor(policy string) (*logRedactor, error) {
+	r := &logRedactor{policy: policy}
+	if policy == config.RedactHash {
+		if _, err := io.ReadFull(rand.Reader, r.key[:]); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,204 @@
+// resources.go - Katzenpost server resource budget.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/op/go-logging"
+)
+
+const resourceCheckInterval = 5 * time.Second
+
+var errResourcesNotSupported = errors.New("not supported on this platform")
+
+// resourceMonitor periodically checks the memory and CPU usage of the
+// process against the configured budget, so that the node sheds load and
+// logs why, instead of getting OOM-killed with no warning.
+type resourceMonitor struct {
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+
+	lastCheck   time.Time
+	lastCPUTime time.Duration
+	rss         uint64
+	cpu         float64
+	reason      string
+	rssErr      error
+	cpuErr      error
+	isShrinking bool
+}
+
+// overBudgetReason returns why the resource budget is exceeded, or the
+// empty string if it isn't.
+func (m *resourceMonitor) overBudgetReason() string {
+	m.Lock()
+	defer m.Unlock()
+	return m.reason
+}
+
+func (m *resourceMonitor) isEnabled() bool {
+	return m.s.cfg.Debug.MaxRSS > 0 || m.s.cfg.Debug.TargetCPU > 0
+}
+
+func (m *resourceMonitor) onTick(now time.Time) {
+	if !m.isEnabled() || now.Sub(m.lastCheck) < resourceCheckInterval {
+		return
+	}
+	m.check(now)
+}
+
+// memory returns the resident set size of the process, or failing that the
+// memory obtained from the OS by the Go runtime, which is a lower bound.
+func (m *resourceMonitor) memory() (uint64, error) {
+	rss, err := processRSS()
+	if err == nil {
+		return rss, nil
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys, err
+}
+
+// onMeasureError logs a warning when measuring what fails, and a notice once
+// it succeeds again, so that a budget that silently stopped being enforced
+// is visible at runtime.
+func (m *resourceMonitor) onMeasureError(what string, prevErr *error, err error) {
+	switch {
+	case err != nil && *prevErr == nil:
+		m.log.Warningf("Failed to measure the %v: %v", what, err)
+	case err == nil && *prevErr != nil:
+		m.log.Noticef("Measuring the %v works again.", what)
+	}
+	*prevErr = err
+}
+
+func (m *resourceMonitor) check(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	var err error
+	m.rss, err = m.memory()
+	m.onMeasureError("RSS (using the Go runtime memory statistics)", &m.rssErr, err)
+	cpuTime, err := processCPUTime()
+	if err == nil {
+		if !m.lastCheck.IsZero() {
+			wall := now.Sub(m.lastCheck) * time.Duration(runtime.NumCPU())
+			m.cpu = 100 * float64(cpuTime-m.lastCPUTime) / float64(wall)
+		}
+		m.lastCPUTime = cpuTime
+	}
+	m.onMeasureError("CPU utilization", &m.cpuErr, err)
+	m.lastCheck = now
+
+	// Leaving the over budget state requires going 10% below the budget,
+	// so that the node does not flap around it.
+	wasOver := m.reason != ""
+	slack := func(v float64) float64 {
+		if wasOver {
+			return v * 0.9
+		}
+		return v
+	}
+	reason := ""
+	maxRSS, targetCPU := m.s.cfg.Debug.MaxRSS, m.s.cfg.Debug.TargetCPU
+	if maxRSS > 0 && float64(m.rss) > slack(float64(uint64(maxRSS)<<20)) {
+		reason = fmt.Sprintf("RSS %v MiB exceeds %v MiB", m.rss>>20, maxRSS)
+	} else if targetCPU > 0 && m.cpu > slack(float64(targetCPU)) {
+		reason = fmt.Sprintf("CPU utilization %.0f%% exceeds %v%%", m.cpu, targetCPU)
+	}
+	m.reason = reason
+
+	switch {
+	case reason != "" && !wasOver:
+		m.log.Warningf("Resource budget exceeded: %v", reason)
+	case reason == "" && wasOver:
+		m.log.Noticef("Resource usage back within budget: RSS %v MiB, CPU utilization %.0f%%.", m.rss>>20, m.cpu)
+	}
+	if maxRSS > 0 && m.rss > uint64(maxRSS)<<20 && !m.isShrinking {
+		// Shrinking involves disk I/O and a full GC, so it is done in
+		// the background, instead of blocking the periodic timer.
+		m.isShrinking = true
+		go m.s.guard("resource shrink", m.shrink)()
+	}
+}
+
+// shrink releases as much memory as possible, by flushing the replay filter
+// write-back caches and returning the freed memory to the OS.
+func (m *resourceMonitor) shrink() {
+	m.log.Noticef("Shrinking caches to reduce memory usage.")
+	if m.s.mixKeys != nil {
+		m.s.mixKeys.flush()
+	}
+	debug.FreeOSMemory()
+	rss, _ := m.memory()
+
+	m.Lock()
+	defer m.Unlock()
+	m.rss = rss
+	m.isShrinking = false
+}
+
+func (m *resourceMonitor) onMgmtResources(c *thwack.Conn, l string) error {
+	m.Lock()
+	rss, cpu, reason := m.rss, m.cpu, m.reason
+	m.Unlock()
+	if !m.isEnabled() {
+		rss, _ = m.memory()
+	}
+
+	if err := c.Writer().PrintfLine("%v-RSSMiB:%v MaxRSSMiB:%v CPU:%.1f TargetCPU:%v", thwack.StatusOk, rss>>20, m.s.cfg.Debug.MaxRSS, cpu, m.s.cfg.Debug.TargetCPU); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-OverBudget:%v Reason:%v", thwack.StatusOk, reason != "", reason); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newResourceMonitor(s *Server) *resourceMonitor {
+	m := new(resourceMonitor)
+	m.s = s
+	m.log = s.newLogger("resources")
+	// This always measures the RSS once, as that needs to happen before
+	// the process is chrooted on some platforms.
+	_, m.rssErr = processRSS()
+	if m.isEnabled() {
+		if m.rssErr != nil {
+			m.log.Warningf("Measuring the RSS is %v, using the Go runtime memory statistics.", m.rssErr)
+		}
+		if _, m.cpuErr = processCPUTime(); m.cpuErr != nil {
+			m.log.Warningf("Measuring the CPU utilization is %v.", m.cpuErr)
+		}
+		m.check(time.Now())
+	}
+
+	if s.cfg.Management.Enable {
+		const cmdResources = "RESOURCES"
+		s.management.RegisterCommand(cmdResources, m.onMgmtResources)
+	}
+
+	return m
+}
@@ -0,0 +1,82 @@
+// resources_unix.go - Resource usage measurement (Unix).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// statm is the process's /proc/self/statm, which is kept open as /proc is
+// not reachable once the process is chrooted.
+var statm struct {
+	sync.Mutex
+	f *os.File
+}
+
+// processRSS returns the resident set size of the process in bytes.
+func processRSS() (uint64, error) {
+	if runtime.GOOS != "linux" {
+		return 0, errResourcesNotSupported
+	}
+
+	statm.Lock()
+	defer statm.Unlock()
+	if statm.f == nil {
+		f, err := os.Open("/proc/self/statm")
+		if err != nil {
+			return 0, err
+		}
+		statm.f = f
+	}
+
+	// The second field of statm is the number of resident pages.  Reading
+	// from offset 0 regenerates the contents.
+	var b [256]byte
+	n, err := statm.f.ReadAt(b[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	fields := bytes.Fields(b[:n])
+	if len(fields) < 2 {
+		return 0, syscall.EINVAL
+	}
+	pages, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
+
+// processCPUTime returns the total user and system CPU time consumed by the
+// process.
+func processCPUTime() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
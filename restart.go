@@ -0,0 +1,178 @@
+// restart.go - Katzenpost server graceful restart support.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+const (
+	envListenFDs = "LISTEN_FDS"
+	envListenPID = "LISTEN_PID"
+
+	listenFDsStart = 3
+)
+
+// inheritListeners returns the listening sockets passed in by the parent
+// process, as per the systemd socket activation protocol.  LISTEN_PID is
+// optional, so that a server process that execs its replacement does not
+// need to know the child's PID in advance.
+func inheritListeners() ([]net.Listener, error) {
+	s := os.Getenv(envListenFDs)
+	if s == "" {
+		return nil, nil
+	}
+	defer func() {
+		// Don't pass the sockets on to our own children.
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenPID)
+	}()
+
+	if p := os.Getenv(envListenPID); p != "" {
+		if pid, err := strconv.Atoi(p); err != nil || pid != os.Getpid() {
+			return nil, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("server: invalid %v: '%v'", envListenFDs, s)
+	}
+
+	ret := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener:%d", fd))
+		nl, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, v := range ret {
+				v.Close()
+			}
+			return nil, fmt.Errorf("server: invalid inherited listener %v: %v", fd, err)
+		}
+		ret = append(ret, nl)
+	}
+	return ret, nil
+}
+
+// takeInheritedListener returns the inherited listener bound to addr if
+// any, removing it from the set of inherited listeners.
+func (s *Server) takeInheritedListener(addr string) net.Listener {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	for i, nl := range s.inheritedListeners {
+		lAddr, ok := nl.Addr().(*net.TCPAddr)
+		if !ok || lAddr.Port != tcpAddr.Port {
+			continue
+		}
+		if lAddr.IP.Equal(tcpAddr.IP) || (lAddr.IP.IsUnspecified() && tcpAddr.IP.IsUnspecified()) {
+			s.inheritedListeners = append(s.inheritedListeners[:i:i], s.inheritedListeners[i+1:]...)
+			return nl
+		}
+	}
+	return nil
+}
+
+func (s *Server) closeInheritedListeners() {
+	for _, nl := range s.inheritedListeners {
+		s.log.Warningf("Closing unused inherited listener: %v", nl.Addr())
+		nl.Close()
+	}
+	s.inheritedListeners = nil
+}
+
+func (s *Server) listenTCP(addr string) (net.Listener, error) {
+	if nl := s.takeInheritedListener(addr); nl != nil {
+		s.log.Noticef("Using inherited listener for address: %v", addr)
+		return nl, nil
+	}
+
+	var lc net.ListenConfig
+	if s.cfg.Debug.ReusePort {
+		lc.Control = setReusePort
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenerFiles returns duplicates of the server's TCP listening sockets,
+// suitable for passing to a replacement server process via
+// exec.Cmd.ExtraFiles, with LISTEN_FDS set to the number of files.  The
+// caller is responsible for closing the returned files.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	s.listenersLock.RLock()
+	defer s.listenersLock.RUnlock()
+
+	var ret []*os.File
+	for _, l := range s.listeners {
+		if l == nil || l.network != networkTCP {
+			continue
+		}
+		tcpListener, ok := l.l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tcpListener.File()
+		if err != nil {
+			for _, v := range ret {
+				v.Close()
+			}
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// GracefulShutdown hands the server's role over to a replacement process,
+// by ceasing to accept new connections, waiting up to the configured drain
+// timeout for the existing incoming connections to wind down while still
+// forwarding their traffic, and then shutting down.
+func (s *Server) GracefulShutdown() {
+	timeout := time.Duration(s.cfg.Debug.ListenerDrainTimeout) * time.Millisecond
+	s.log.Noticef("Starting graceful hand off, draining listeners for up to %v.", timeout)
+
+	s.listenersLock.RLock()
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		if l == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			l.Drain(timeout)
+		}(l)
+	}
+	s.listenersLock.RUnlock()
+	wg.Wait()
+
+	s.Shutdown()
+}
+
+func (s *Server) onMgmtGracefulShutdown(c *thwack.Conn, l string) error {
+	go s.GracefulShutdown()
+	return c.WriteReply(thwack.StatusOk)
+}
@@ -0,0 +1,186 @@
+// sandbox.go - Katzenpost server process sandboxing.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/katzenpost/server/internal/memlock"
+)
+
+var (
+	errSandboxNotSupported = errors.New("process sandboxing is not supported on this platform")
+	errSyscallFilterTSync  = errors.New("failed to apply the syscall filter to all threads")
+)
+
+func lookupUser(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+func chownTree(root string, uid, gid int) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// dropPrivileges switches to the configured unprivileged user, optionally
+// chrooting to the DataDir first.  It MUST be called once everything that
+// requires privileges (binding the listeners, opening the DataDir) is done.
+func (s *Server) dropPrivileges() error {
+	sbCfg := s.cfg.Sandbox
+	if sbCfg.User == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupUser(sbCfg.User, sbCfg.Group)
+	if err != nil {
+		return fmt.Errorf("server: failed to look up user '%v': %v", sbCfg.User, err)
+	}
+	if euid := os.Geteuid(); euid != 0 {
+		if euid != uid || sbCfg.Chroot {
+			return fmt.Errorf("server: not started as root, can not switch to user '%v'", sbCfg.User)
+		}
+		s.log.Warningf("Not started as root, already running as user '%v'.", sbCfg.User)
+		return nil
+	}
+
+	// Hand the DataDir over to the unprivileged user, so that it can
+	// manage the mix keys, and rotate the logs.
+	d := s.cfg.Server.DataDir
+	if err = chownTree(d, uid, gid); err != nil {
+		return fmt.Errorf("server: failed to change the DataDir ownership: %v", err)
+	}
+	if md := s.mixKeyDir(); md != d {
+		if err = chownTree(md, uid, gid); err != nil {
+			return fmt.Errorf("server: failed to change the MixKeyDir ownership: %v", err)
+		}
+	}
+
+	if sbCfg.Chroot {
+		if err = chroot(d); err != nil {
+			return fmt.Errorf("server: failed to chroot to '%v': %v", d, err)
+		}
+		atomic.StoreUint32(&s.isChrooted, 1)
+		if s.logRotator != nil {
+			s.logRotator.onChroot(d)
+		}
+		s.log.Noticef("Chrooted to: %v", d)
+	}
+	if err = setUser(uid, gid); err != nil {
+		return fmt.Errorf("server: failed to switch to user '%v': %v", sbCfg.User, err)
+	}
+	s.log.Noticef("Switched to user '%v' (uid: %v, gid: %v).", sbCfg.User, uid, gid)
+
+	return nil
+}
+
+// installSandbox installs the syscall filter, if configured.  It MUST be
+// called once the server is fully initialized.
+func (s *Server) installSandbox() error {
+	sbCfg := s.cfg.Sandbox
+	if !sbCfg.SyscallFilter {
+		return nil
+	}
+
+	// The filesystem view (unveil) is restricted to the DataDir, the mix
+	// key directory, the log file, and what is needed for name resolution and TLS.
+	paths := map[string]string{
+		s.dataDir():        "rwc",
+		"/etc/resolv.conf": "r",
+		"/etc/hosts":       "r",
+		"/etc/ssl":         "r",
+	}
+	paths[s.mixKeyDir()] = "rwc"
+	if s.logRotator != nil {
+		s.logRotator.Lock()
+		if s.logRotator.path != "" {
+			paths[filepath.Dir(s.logRotator.path)] = "rwc"
+		}
+		s.logRotator.Unlock()
+	}
+
+	if err := installSyscallFilter(sbCfg.SyscallFilterLogOnly, paths); err != nil {
+		return fmt.Errorf("server: failed to install syscall filter: %v", err)
+	}
+	if sbCfg.SyscallFilterLogOnly {
+		s.log.Warningf("Syscall filter installed in log only mode, violations will NOT be blocked.")
+	} else {
+		s.log.Noticef("Syscall filter installed.")
+	}
+	return nil
+}
+
+// lockKeyMemory locks the memory holding a private key, so that it is never
+// swapped out or included in core dumps.  Failures are not fatal, since the
+// default RLIMIT_MEMLOCK is rather low on some systems.
+func (s *Server) lockKeyMemory(name string, p unsafe.Pointer, size uintptr) {
+	if s.cfg.Sandbox.LockAllMemory {
+		// Redundant, everything is locked already.
+		return
+	}
+	if err := memlock.Lock(p, size); err != nil {
+		s.log.Warningf("Failed to lock %v key memory: %v", name, err)
+	}
+}
+
+// dataDir returns the path of the DataDir, accounting for the chroot if
+// any.
+func (s *Server) dataDir() string {
+	if atomic.LoadUint32(&s.isChrooted) != 0 {
+		return "/"
+	}
+	return s.cfg.Server.DataDir
+}
+
+// mixKeyDir returns the path of the directory holding the mix keys.
+func (s *Server) mixKeyDir() string {
+	if d := s.cfg.Server.MixKeyDir; d != "" && atomic.LoadUint32(&s.isChrooted) == 0 {
+		return d
+	}
+	return s.dataDir()
+}
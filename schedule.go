@@ -17,23 +17,46 @@
 package server
 
 import (
+	"encoding/binary"
 	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	bolt "github.com/coreos/bbolt"
 	"github.com/eapache/channels"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/queue"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/worker"
 	"github.com/op/go-logging"
 )
 
+const (
+	schedulerQueueFile   = "scheduler_queue.db"
+	schedulerQueueBucket = "packets"
+
+	// A saved entry is the civil dispatch time, the next hop, and the
+	// packet.
+	savedEntryHdrLength = 8 + constants.NodeIDLength
+)
+
 type scheduler struct {
+	// Note: qLen and maxDispatchAt are first to guarantee 64 bit alignment.
+	qLen          int64 // MUST be accessed via sync/atomic.
+	maxDispatchAt int64 // MUST be accessed via sync/atomic.
+
 	worker.Worker
 
 	s   *Server
 	ch  *channels.InfiniteChannel
 	log *logging.Logger
+
+	restoreOnce sync.Once
 }
 
 func (sch *scheduler) Halt() {
@@ -69,6 +92,9 @@ func (sch *scheduler) worker() {
 		case <-sch.HaltCh():
 			// Th-th-th-that's all folks.
 			sch.log.Debugf("Terminating gracefully.")
+			if !sch.s.cfg.Debug.DisableQueuePersistence {
+				sch.saveQueue(q)
+			}
 			return
 		case e := <-ch:
 			// New packet from the crypto workers.
@@ -79,22 +105,37 @@ func (sch *scheduler) worker() {
 			pkt := e.(*packet)
 
 			// Ensure the peer is valid by querying the outgoing connection
-			// table.
-			if sch.s.connector.isValidForwardDest(&pkt.nextNodeHop.ID) {
+			// table.  Synthetic packets are never forwarded, so their
+			// next hop is irrelevant.
+			if pkt.isSynthetic || sch.s.connector.isValidForwardDest(&pkt.nextNodeHop.ID) {
 				// If queue limitations are enabled, check to see if there
 				// is a slot for this packet.
 				if max := sch.s.cfg.Debug.SchedulerQueueSize; max > 0 {
 					if q.Len()+1 > max {
 						drop := q.DequeueRandom(mRand).Value.(*packet)
 						sch.log.Debugf("Queue size limit reached, discarding: %v", drop.id)
+						sch.s.accounting.onDrop(dropQueueFull)
 						drop.dispose()
 					}
 				}
 				sch.log.Debugf("Enqueueing packet: %v delta-t: %v", pkt.id, pkt.delay)
-				q.Enqueue(uint64(monotime.Now()+pkt.delay), pkt)
+				pkt.trace("schedule", "next hop %v, delta-t %v", nodeIDToPrintString(&pkt.nextNodeHop.ID), pkt.delay)
+				dispatchAt := monotime.Now() + pkt.delay
+				if int64(dispatchAt) > atomic.LoadInt64(&sch.maxDispatchAt) {
+					atomic.StoreInt64(&sch.maxDispatchAt, int64(dispatchAt))
+				}
+				q.Enqueue(uint64(dispatchAt), pkt)
+			} else if sch.s.parking != nil {
+				// Note: Callee takes ownership.
+				sch.s.parking.park(pkt)
 			} else {
 				sID := nodeIDToPrintString(&pkt.nextNodeHop.ID)
-				sch.log.Debugf("Dropping packet: %v (Next hop is invalid: %v)", pkt.id, sID)
+				reason := dropInvalidNextHop
+				if sch.s.connector.isDelisted(&pkt.nextNodeHop.ID) {
+					reason = dropDelistedNextHop
+				}
+				sch.log.Debugf("Dropping packet: %v (Next hop is invalid: %v, %v)", pkt.id, sID, reason)
+				sch.s.accounting.onDrop(reason)
 				pkt.dispose()
 			}
 		case <-timer.C:
@@ -108,6 +149,8 @@ func (sch *scheduler) worker() {
 			<-timer.C
 		}
 		for {
+			atomic.StoreInt64(&sch.qLen, int64(q.Len()))
+
 			// Peek at the next packet in the queue.
 			e := q.Peek()
 			if e == nil {
@@ -139,7 +182,14 @@ func (sch *scheduler) worker() {
 				// ... unless the deadline has been blown by more than the
 				// configured slack time.
 				sch.log.Debugf("Dropping packet: %v (Deadline blown by %v)", pkt.id, now-dispatchAt)
+				pkt.trace("dispatch", "deadline blown by %v", now-dispatchAt)
+				sch.s.accounting.onDrop(dropDeadlineBlown)
 				pkt.dispose()
+			} else if pkt.isSynthetic {
+				// Load generator packets end their journey here.
+				//
+				// Note: Callee takes ownership.
+				sch.s.loadGen.onDispatch(pkt, now-dispatchAt)
 			} else {
 				// Dispatch the packet to the next hop.  Note that the callee
 				// may still drop the packet, for example if there isn't a
@@ -147,6 +197,7 @@ func (sch *scheduler) worker() {
 				//
 				// Note: Callee takes ownership.
 				pkt.dispatchAt = now
+				pkt.trace("dispatch", "slack %v", now-dispatchAt)
 				sch.s.connector.dispatchPacket(pkt)
 			}
 		}
@@ -155,12 +206,150 @@ func (sch *scheduler) worker() {
 	// NOTREACHED
 }
 
+// saveQueue persists the packets that are still waiting to be dispatched,
+// so that they can be resumed by restoreQueue after a restart.
+func (sch *scheduler) saveQueue(q *queue.PriorityQueue) {
+	if q.Len() == 0 {
+		return
+	}
+
+	f := filepath.Join(sch.s.dataDir(), schedulerQueueFile)
+	db, err := bolt.Open(f, 0600, nil)
+	if err != nil {
+		sch.log.Errorf("Failed to open the scheduler queue file: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// The queue priorities are monotonic timestamps which are meaningless
+	// across restarts, so convert them to the civil time.
+	nowMono, nowCivil := monotime.Now(), time.Now()
+	nSaved := 0
+	if err = db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(schedulerQueueBucket))
+		if err != nil {
+			return err
+		}
+		for e := q.Pop(); e != nil; e = q.Pop() {
+			pkt := (e.Value).(*packet)
+			if pkt.isSynthetic {
+				pkt.dispose()
+				continue
+			}
+			dispatchAt := nowCivil.Add(time.Duration(e.Priority) - nowMono)
+
+			seq, err := bkt.NextSequence()
+			if err != nil {
+				pkt.dispose()
+				return err
+			}
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], seq)
+
+			v := make([]byte, savedEntryHdrLength, savedEntryHdrLength+len(pkt.raw))
+			binary.BigEndian.PutUint64(v, uint64(dispatchAt.UnixNano()))
+			copy(v[8:], pkt.nextNodeHop.ID[:])
+			v = append(v, pkt.raw...)
+			pkt.dispose()
+			if err = bkt.Put(k[:], v); err != nil {
+				return err
+			}
+			nSaved++
+		}
+		return nil
+	}); err != nil {
+		sch.log.Errorf("Failed to save the scheduler queue: %v", err)
+		return
+	}
+	atomic.StoreInt64(&sch.qLen, 0)
+	sch.log.Noticef("Saved %v queued packet(s).", nSaved)
+}
+
+// restoreQueue re-enqueues the packets saved by saveQueue on a previous
+// graceful shutdown, discarding the ones that can no longer be dispatched
+// in time.  It must only be called once the outgoing connection table has
+// been populated, as packets to unknown destinations are dropped.
+func (sch *scheduler) restoreQueue() {
+	if sch.s.cfg.Debug.DisableQueuePersistence {
+		return
+	}
+	sch.restoreOnce.Do(sch.doRestoreQueue)
+}
+
+func (sch *scheduler) doRestoreQueue() {
+	f := filepath.Join(sch.s.dataDir(), schedulerQueueFile)
+	if _, err := os.Lstat(f); err != nil {
+		return
+	}
+	defer os.Remove(f)
+
+	db, err := bolt.Open(f, 0600, nil)
+	if err != nil {
+		sch.log.Errorf("Failed to open the scheduler queue file: %v", err)
+		return
+	}
+	defer db.Close()
+
+	timerSlack := time.Duration(sch.s.cfg.Debug.SchedulerSlack) * time.Millisecond
+	nRestored, nExpired := 0, 0
+	if err = db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(schedulerQueueBucket))
+		if bkt == nil {
+			return nil
+		}
+		now := time.Now()
+		return bkt.ForEach(func(k, v []byte) error {
+			if len(v) < savedEntryHdrLength {
+				return nil
+			}
+			dispatchAt := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+			delay := dispatchAt.Sub(now)
+			if delay < -timerSlack {
+				nExpired++
+				return nil
+			}
+
+			pkt := newPacket()
+			if err := pkt.copyToRaw(v[savedEntryHdrLength:]); err != nil {
+				pkt.dispose()
+				return nil
+			}
+			pkt.nextNodeHop = new(commands.NextNodeHop)
+			copy(pkt.nextNodeHop.ID[:], v[8:savedEntryHdrLength])
+			pkt.delay = delay
+			sch.onPacket(pkt)
+			nRestored++
+			return nil
+		})
+	}); err != nil {
+		sch.log.Errorf("Failed to load the scheduler queue: %v", err)
+	}
+	for i := 0; i < nExpired; i++ {
+		sch.s.accounting.onDrop(dropDeadlineBlown)
+	}
+	sch.log.Noticef("Restored %v queued packet(s), discarded %v expired.", nRestored, nExpired)
+}
+
+// queueLen returns the number of packets waiting to be dispatched.
+func (sch *scheduler) queueLen() int {
+	return int(atomic.LoadInt64(&sch.qLen))
+}
+
+// windowRemaining returns the time left till all of the packets currently
+// waiting to be dispatched are due.
+func (sch *scheduler) windowRemaining() time.Duration {
+	if sch.queueLen() == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&sch.maxDispatchAt)) - monotime.Now()
+}
+
 func newScheduler(s *Server) *scheduler {
 	sch := new(scheduler)
 	sch.s = s
-	sch.log = s.logBackend.GetLogger("scheduler")
+	sch.log = s.newLogger("scheduler")
 	sch.ch = channels.NewInfiniteChannel()
 
-	sch.Go(sch.worker)
+	sch.Go(s.supervise("scheduler", sch.worker))
 	return sch
 }
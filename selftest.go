@@ -0,0 +1,146 @@
+// selftest.go - Katzenpost server end-to-end self-test.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+type selfTestState int
+
+const (
+	selfTestDisabled selfTestState = iota
+	selfTestPending
+	selfTestRunning
+	selfTestPassed
+	selfTestFailed
+)
+
+func (st selfTestState) String() string {
+	switch st {
+	case selfTestDisabled:
+		return "Disabled"
+	case selfTestPending:
+		return "Pending"
+	case selfTestRunning:
+		return "Running"
+	case selfTestPassed:
+		return "Passed"
+	case selfTestFailed:
+		return "Failed"
+	default:
+		return "[Unknown]"
+	}
+}
+
+// selfTest sends a small number of loop packets through random paths once
+// the first PKI document is available, to verify that the node is actually
+// able to send and receive traffic.  The test passes if at least one of the
+// loops returns, since losses may be caused by other nodes.
+type selfTest struct {
+	sync.Mutex
+
+	d   *decoy
+	log *logging.Logger
+
+	state     selfTestState
+	sent      int
+	returned  int
+	done      int
+	isSending bool
+}
+
+// maybeStart starts the self-test if it is pending and the PKI document for
+// the current epoch is available.  It MUST only be called from the decoy
+// worker.
+func (st *selfTest) maybeStart() {
+	ent := st.d.s.pki.currentDocument()
+	if ent == nil {
+		return
+	}
+
+	st.Lock()
+	if st.state != selfTestPending {
+		st.Unlock()
+		return
+	}
+	st.log.Noticef("Starting self-test.")
+	st.state = selfTestRunning
+	st.isSending = true
+	st.Unlock()
+
+	// Note: The lock can't be held while sending, as onDone is called with
+	// the decoy lock held.
+	for i := 0; i < st.d.s.cfg.Debug.SelfTestPackets; i++ {
+		if err := st.d.sendLoop(ent, st.onDone); err != nil {
+			st.log.Warningf("Failed to send self-test packet: %v", err)
+			continue
+		}
+		st.Lock()
+		st.sent++
+		st.Unlock()
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	st.isSending = false
+	if st.done == st.sent {
+		st.finish()
+	}
+}
+
+func (st *selfTest) onDone(returned bool) {
+	st.Lock()
+	defer st.Unlock()
+
+	if returned {
+		st.returned++
+	}
+	if st.done++; st.done == st.sent && !st.isSending {
+		st.finish()
+	}
+}
+
+func (st *selfTest) finish() {
+	if st.returned > 0 {
+		st.state = selfTestPassed
+		st.log.Noticef("Self-test passed: %v/%v packets returned.", st.returned, st.sent)
+		return
+	}
+	st.state = selfTestFailed
+	st.log.Errorf("Self-test FAILED: %v/%v packets returned.", st.returned, st.sent)
+	st.d.s.emitDegradedEvent("self-test failed")
+}
+
+func (st *selfTest) status() (selfTestState, int, int) {
+	st.Lock()
+	defer st.Unlock()
+
+	return st.state, st.sent, st.returned
+}
+
+func newSelfTest(d *decoy) *selfTest {
+	st := new(selfTest)
+	st.d = d
+	st.log = d.s.newLogger("selftest")
+	if d.s.cfg.Debug.SelfTestPackets > 0 {
+		st.state = selfTestPending
+	}
+	return st
+}
@@ -18,22 +18,31 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"git.schwanenlied.me/yawning/aez.git"
 	"github.com/eapache/channels"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
-	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
 	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/logsink"
+	"github.com/katzenpost/server/internal/memlock"
+	"github.com/katzenpost/server/internal/otlp"
 	"github.com/op/go-logging"
 )
 
@@ -41,53 +50,121 @@ import (
 // terminates due to the `GenerateOnly` debug config option.
 var ErrGenerateOnly = errors.New("server: GenerateOnly set")
 
-// Server is a Katzenpost server instance.
+// Server is a Katzenpost server instance.  Multiple instances with distinct
+// configurations (DataDir, addresses, management socket) may run in the same
+// process, for example to run an entire test network in a single binary.
 type Server struct {
 	cfg *config.Config
 
 	identityKey *eddsa.PrivateKey
 	linkKey     *ecdh.PrivateKey
 
-	logBackend *log.Backend
-	log        *logging.Logger
+	linkTLSConfig *tls.Config
+
+	logBackend     *log.Backend
+	logSink        logsink.Sink
+	logSinkBackend logging.LeveledBackend
+	logRotator     *logRotator
+	logRedactor    *logRedactor
+	log            *logging.Logger
 
 	inboundPackets *channels.InfiniteChannel
 
 	scheduler     *scheduler
+	parking       *parking
+	decoy         *decoy
+	loadGen       *loadGen
 	cryptoWorkers []*cryptoWorker
 	periodic      *periodicTimer
 	mixKeys       *mixKeys
 	pki           *pki
 	listeners     []*listener
+	listenersLock sync.RWMutex
+	listenerID    int
 	connector     *connector
 	provider      *provider
+	peerStats     *peerStats
+	peerBans      *peerBans
+	peerOverrides *peerOverrides
+	connLimiter   *connLimiter
 	management    *thwack.Server
 
+	inheritedListeners []net.Listener
+
+	pidFile     *os.File
+	pidFileOnce sync.Once
+
+	identityRotationLock sync.Mutex
+
+	events         eventBus
+	crashes        crashStats
+	workers        supervisor
+	attackDetector *attackDetector
+	chaos          *chaos
+	tracer         *packetTracer
+	otel           *otlp.Exporter
+	alerter        *alerter
+	accounting     *accounting
+	nat            *natTraversal
+	clockSkew      *clockSkew
+	forwardCap     *forwardCap
+	decommission   *decommission
+	disk           *diskMonitor
+	resources      *resourceMonitor
+
+	forwardingPaused uint32 // MUST be accessed via sync/atomic.
+	isDraining       uint32 // MUST be accessed via sync/atomic.
+	isChrooted       uint32 // MUST be accessed via sync/atomic.
+
+	startedAt time.Time
+
 	fatalErrCh chan error
 	haltedCh   chan interface{}
+	haltedOnce sync.Once
 	haltOnce   sync.Once
+	haltStage  atomic.Value
 }
 
 func (s *Server) initDataDir() error {
+	isRelaxed := s.cfg.Server.ContainerMode
+	if err := initDir("DataDir", s.cfg.Server.DataDir, isRelaxed); err != nil {
+		return err
+	}
+	if d := s.cfg.Server.MixKeyDir; d != "" {
+		return initDir("MixKeyDir", d, isRelaxed)
+	}
+	return nil
+}
+
+// initDir ensures that the directory d exists with the appropriate
+// permissions.  If isRelaxed is set, as is the case for volumes mounted by a
+// container runtime which may not be owned by the server, the directory is
+// only required to not be world writable.
+func initDir(name, d string, isRelaxed bool) error {
 	const dirMode = os.ModeDir | 0700
-	d := s.cfg.Server.DataDir
 
 	// Initialize the data directory, by ensuring that it exists (or can be
 	// created), and that it has the appropriate permissions.
 	if fi, err := os.Lstat(d); err != nil {
 		// Directory doesn't exist, create one.
 		if !os.IsNotExist(err) {
-			return fmt.Errorf("server: failed to stat() DataDir: %v", err)
+			return fmt.Errorf("server: failed to stat() %v: %v", name, err)
 		}
 		if err = os.Mkdir(d, dirMode); err != nil {
-			return fmt.Errorf("server: failed to create DataDir: %v", err)
+			return fmt.Errorf("server: failed to create %v: %v", name, err)
 		}
 	} else {
 		if !fi.IsDir() {
-			return fmt.Errorf("server: DataDir '%v' is not a directory", d)
+			return fmt.Errorf("server: %v '%v' is not a directory", name, d)
+		}
+		if isRelaxed {
+			if fi.Mode().Perm()&0002 != 0 {
+				return fmt.Errorf("server: %v '%v' is world writable", name, d)
+			}
+			return nil
 		}
 		if fi.Mode() != dirMode {
-			return fmt.Errorf("server: DataDir '%v' has invalid permissions '%v'", d, fi.Mode())
+			return fmt.Errorf("server: %v '%v' has invalid permissions '%v'", name, d, fi.Mode())
 		}
 	}
 
@@ -102,10 +179,28 @@ func (s *Server) initLogging() error {
 		}
 	}
 
+	// If an external log sink is configured, the loggers handed out by
+	// newLogger are redirected to it, and the regular backend is disabled.
+	//
+	// Note: Components that take the backend directly (the PKI client)
+	// will not log to the external sink.
+	useSink := !s.cfg.Logging.Disable && (s.cfg.Logging.Syslog != nil || s.cfg.Logging.Journald || s.cfg.Logging.Format == config.LogFormatJSON)
+	if useSink {
+		if err := s.initLogSink(); err != nil {
+			return fmt.Errorf("server: failed to initialize log sink: %v", err)
+		}
+	}
+
 	var err error
-	s.logBackend, err = log.New(p, s.cfg.Logging.Level, s.cfg.Logging.Disable)
+	if s.logRedactor, err = newLogRedactor(s.cfg.Logging.RedactClients); err != nil {
+		return err
+	}
+	s.logBackend, err = log.New(p, s.cfg.Logging.Level, s.cfg.Logging.Disable || useSink)
 	if err == nil {
-		s.log = s.logBackend.GetLogger("server")
+		s.log = s.newLogger("server")
+		if !s.cfg.Logging.Disable && p != "" {
+			s.logRotator = newLogRotator(s, p)
+		}
 	}
 	return err
 }
@@ -122,9 +217,49 @@ func (s *Server) IdentityKey() *eddsa.PublicKey {
 	return s.identityKey.PublicKey()
 }
 
-// Shutdown cleanly shuts down a given Server instance.
+// ForcePKIFetch makes the server fetch the PKI documents immediately, for
+// example after the connectivity to the directory authority is restored.
+func (s *Server) ForcePKIFetch() {
+	s.pki.ForceFetch()
+}
+
+// Shutdown cleanly shuts down a given Server instance.  If the shutdown
+// does not complete within the configured deadline, the remaining
+// components are abandoned, and the server is considered terminated.
 func (s *Server) Shutdown() {
-	s.haltOnce.Do(func() { s.halt() })
+	timeout := time.Duration(s.cfg.Debug.ShutdownTimeout) * time.Millisecond
+	s.haltOnce.Do(func() { s.haltWithDeadline(timeout) })
+}
+
+func (s *Server) haltWithDeadline(timeout time.Duration) {
+	doneCh := make(chan interface{})
+	go func() {
+		defer close(doneCh)
+		s.halt()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-doneCh:
+		return
+	case <-timer.C:
+	}
+
+	// Something is wedged, log as much as possible to aid debugging, and
+	// give up on a clean shutdown.
+	stage, _ := s.haltStage.Load().(string)
+	s.log.Errorf("Shutdown timed out after %v, stalled halting: %v", timeout, stage)
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	s.log.Errorf("Goroutine dump:\n%s", buf)
+	s.haltedOnce.Do(func() { close(s.haltedCh) })
+}
+
+func (s *Server) setHaltStage(stage string) {
+	s.log.Debugf("Halting: %v", stage)
+	s.haltStage.Store(stage)
 }
 
 // Wait waits till the server is terminated for any reason.
@@ -138,34 +273,51 @@ func (s *Server) halt() {
 	// together.
 
 	s.log.Noticef("Starting graceful shutdown.")
+	s.emitEvent(EventShuttingDown)
 
 	// Stop the 1 Hz periodic utility timer.
+	s.setHaltStage("periodic timer")
 	if s.periodic != nil {
+		s.periodic.systemd.onStopping()
 		s.periodic.Halt()
 		s.periodic = nil
 	}
 
 	// Stop the management interface.
+	s.setHaltStage("management interface")
 	if s.management != nil {
 		s.management.Halt()
 		s.management = nil
 	}
 
 	// Stop the listener(s), close all incoming connections.
+	s.setHaltStage("listeners")
+	s.listenersLock.Lock()
 	for i, l := range s.listeners {
 		if l != nil {
 			l.Halt() // Closes all connections.
 			s.listeners[i] = nil
 		}
 	}
+	s.listenersLock.Unlock()
+	s.closeInheritedListeners()
 
 	// Close all outgoing connections.
+	s.setHaltStage("connector")
 	if s.connector != nil {
 		s.connector.Halt()
 		// Don't nil this out till after the PKI has been torn down.
 	}
 
+	// Stop the synthetic load generator.
+	s.setHaltStage("load generator")
+	if s.loadGen != nil {
+		s.loadGen.Halt()
+		// Don't nil this out, the scheduler may still hold synthetic packets.
+	}
+
 	// Stop the Sphinx workers.
+	s.setHaltStage("crypto workers")
 	for i, w := range s.cryptoWorkers {
 		if w != nil {
 			w.Halt()
@@ -173,30 +325,70 @@ func (s *Server) halt() {
 		}
 	}
 
+	// Stop the decoy traffic generator.
+	s.setHaltStage("decoy")
+	if s.decoy != nil {
+		s.decoy.Halt()
+		s.decoy = nil
+	}
+
 	// Provider specific cleanup.
+	s.setHaltStage("provider")
 	if s.provider != nil {
 		s.provider.Halt()
 		s.provider = nil
 	}
 
 	// Stop the scheduler.
+	s.setHaltStage("scheduler")
 	if s.scheduler != nil {
 		s.scheduler.Halt()
 		s.scheduler = nil
 	}
 
 	// Stop the PKI interface.
+	s.setHaltStage("pki")
 	if s.pki != nil {
 		s.pki.Halt()
 		s.pki = nil
 		s.connector = nil // PKI calls into the connector.
 	}
 
+	// Stop measuring the clock skew.
+	s.setHaltStage("clock skew")
+	if s.clockSkew != nil {
+		s.clockSkew.Halt()
+		s.clockSkew = nil
+	}
+
+	// Remove the NAT port mappings.
+	s.setHaltStage("nat")
+	if s.nat != nil {
+		s.nat.halt()
+		s.nat = nil
+	}
+
+	// Persist the final traffic accounting.
+	s.setHaltStage("accounting")
+	if s.accounting != nil {
+		s.accounting.halt()
+		s.accounting = nil
+	}
+
 	// Flush and close the mix keys.
+	s.setHaltStage("mix keys")
 	if s.mixKeys != nil {
 		s.mixKeys.Halt()
 		s.mixKeys = nil
 	}
+	s.unlockDataDir()
+
+	// Stop delivering alerts.
+	s.setHaltStage("alerting")
+	if s.alerter != nil {
+		s.alerter.halt()
+		s.alerter = nil
+	}
 
 	// Clean up the top level components.
 	if s.inboundPackets != nil {
@@ -204,10 +396,22 @@ func (s *Server) halt() {
 	}
 	s.linkKey.Reset()
 	s.identityKey.Reset()
+	s.resetLinkTLSKey()
 	close(s.fatalErrCh)
 
+	if s.tracer != nil {
+		s.tracer.close()
+	}
+	if s.otel != nil {
+		s.otel.Close()
+	}
+
 	s.log.Noticef("Shutdown complete.")
-	close(s.haltedCh)
+	s.events.close()
+	if s.logSink != nil {
+		s.logSink.Close()
+	}
+	s.haltedOnce.Do(func() { close(s.haltedCh) })
 }
 
 // New returns a new Server instance parameterized with the specified
@@ -215,6 +419,7 @@ func (s *Server) halt() {
 func New(cfg *config.Config) (*Server, error) {
 	s := new(Server)
 	s.cfg = cfg
+	s.startedAt = time.Now()
 	s.fatalErrCh = make(chan error)
 	s.haltedCh = make(chan interface{})
 
@@ -222,11 +427,35 @@ func New(cfg *config.Config) (*Server, error) {
 	if err := s.initDataDir(); err != nil {
 		return nil, err
 	}
+	if err := s.lockDataDir(); err != nil {
+		return nil, err
+	}
+	isOk := false
+	defer func() {
+		if !isOk {
+			s.unlockDataDir()
+		}
+	}()
 	if err := s.initLogging(); err != nil {
 		return nil, err
 	}
+	if s.cfg.Sandbox.LockAllMemory {
+		if err := memlock.LockAll(); err != nil {
+			s.log.Errorf("Failed to lock memory: %v", err)
+			return nil, err
+		}
+	}
+	if s.cfg.Sandbox.DisableCoreDumps {
+		if err := disableCoreDumps(); err != nil {
+			s.log.Errorf("Failed to disable core dumps: %v", err)
+			return nil, err
+		}
+	}
 
 	s.log.Notice("Katzenpost is still pre-alpha.  DO NOT DEPEND ON IT FOR STRONG SECURITY OR ANONYMITY.")
+	for _, w := range s.cfg.Warnings() {
+		s.log.Warning(w)
+	}
 	if s.cfg.Debug.IsUnsafe() {
 		s.log.Warning("Unsafe Debug configuration options are set.")
 	}
@@ -251,30 +480,73 @@ func New(cfg *config.Config) (*Server, error) {
 			return nil, err
 		}
 		s.identityKey = new(eddsa.PrivateKey)
-		if err = s.identityKey.FromBytes(raw); err != nil {
+		err = s.identityKey.FromBytes(raw)
+		utils.ExplicitBzero(raw)
+		if err != nil {
 			s.log.Errorf("Failed to initialize identity: %v", err)
 			return nil, err
 		}
 	} else {
-		identityPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.private.pem")
-		identityPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.public.pem")
-		if s.identityKey, err = eddsa.Load(identityPrivateKeyFile, identityPublicKeyFile, rand.Reader); err != nil {
+		if err = s.initIdentityKey(); err != nil {
 			s.log.Errorf("Failed to initialize identity: %v", err)
 			return nil, err
 		}
 	}
 	s.log.Noticef("Server identity public key is: %s", s.identityKey.PublicKey())
-	linkKeyFile := filepath.Join(s.cfg.Server.DataDir, "link.private.pem")
-	if s.linkKey, err = ecdh.Load(linkKeyFile, rand.Reader); err != nil {
+	if err = s.initLinkKey(); err != nil {
 		s.log.Errorf("Failed to initialize link key: %v", err)
 		return nil, err
 	}
 	s.log.Noticef("Server link public key is: %s", s.linkKey.PublicKey())
+	s.lockKeyMemory("identity", unsafe.Pointer(s.identityKey), unsafe.Sizeof(*s.identityKey))
+	s.lockKeyMemory("link", unsafe.Pointer(s.linkKey), unsafe.Sizeof(*s.linkKey))
+	if s.cfg.Server.LinkTLS {
+		cert, err := newLinkTLSCertificate(s.identityKey)
+		if err != nil {
+			s.log.Errorf("Failed to generate link TLS certificate: %v", err)
+			return nil, err
+		}
+		s.linkTLSConfig = newLinkTLSServerConfig(cert)
+	}
+	if err = s.validateTransports(); err != nil {
+		s.log.Errorf("Failed to initialize transports: %v", err)
+		return nil, err
+	}
 
 	if s.cfg.Debug.GenerateOnly {
 		return nil, ErrGenerateOnly
 	}
 
+	// Open the packet trace file.
+	if s.cfg.Debug.PacketTraceFraction > 0 {
+		s.log.Warningf("Packet tracing is enabled, traces will reveal traffic patterns.")
+		if s.tracer, err = newPacketTracer(s); err != nil {
+			s.log.Errorf("Failed to initialize packet tracing: %v", err)
+			return nil, err
+		}
+	}
+
+	// Start the OpenTelemetry span exporter.
+	if s.cfg.Tracing != nil {
+		otelLog := s.newLogger("otlp")
+		resource := map[string]string{
+			"service.name":        s.cfg.Tracing.ServiceName,
+			"service.instance.id": s.cfg.Server.Identifier,
+		}
+		s.otel = otlp.New(s.cfg.Tracing.OTLPEndpoint, resource, func(err error) {
+			otelLog.Warningf("Failed to export spans: %v", err)
+		})
+	}
+
+	// Initialize the chaos testing hooks, prior to anything that cares
+	// about the epoch.
+	if s.cfg.Debug.ChaosHooks {
+		if s.chaos, err = newChaos(s); err != nil {
+			s.log.Errorf("Failed to initialize chaos hooks: %v", err)
+			return nil, err
+		}
+	}
+
 	// Load and or generate mix keys.
 	if s.mixKeys, err = newMixKeys(s); err != nil {
 		s.log.Errorf("Failed to initialize mix keys: %v", err)
@@ -282,7 +554,6 @@ func New(cfg *config.Config) (*Server, error) {
 	}
 
 	// Past this point, failures need to call s.Shutdown() to do cleanup.
-	isOk := false
 	defer func() {
 		// Something failed in bringing the server up, past the point where
 		// files are open etc, clean up the partially constructed instance.
@@ -302,6 +573,15 @@ func New(cfg *config.Config) (*Server, error) {
 		s.Shutdown()
 	}()
 
+	// Start delivering alerts, prior to anything that can fail in a way
+	// that warrants one.
+	if s.cfg.Alerting != nil {
+		s.alerter = newAlerter(s)
+	}
+
+	// Start monitoring the free disk space.
+	s.disk = newDiskMonitor(s)
+
 	// Initialize the management interface if enabled.
 	//
 	// Note: This is done first so that other subsystems may register commands.
@@ -311,7 +591,7 @@ func New(cfg *config.Config) (*Server, error) {
 			Addr:        s.cfg.Management.Path,
 			ServiceName: s.cfg.Server.Identifier + " Katzenpost Management Interface",
 			LogModule:   "mgmt",
-			NewLoggerFn: s.logBackend.GetLogger,
+			NewLoggerFn: s.newLogger,
 		}
 		if s.management, err = thwack.New(mgmtCfg); err != nil {
 			s.log.Errorf("Failed to initialize management interface: %v", err)
@@ -323,6 +603,120 @@ func New(cfg *config.Config) (*Server, error) {
 			s.fatalErrCh <- fmt.Errorf("user requested shutdown via mgmt interface")
 			return nil
 		})
+
+		const cmdGracefulShutdown = "GRACEFUL_SHUTDOWN"
+		s.management.RegisterCommand(cmdGracefulShutdown, s.onMgmtGracefulShutdown)
+
+		const (
+			cmdDrain     = "DRAIN"
+			cmdLiveness  = "LIVENESS"
+			cmdReadiness = "READINESS"
+		)
+		s.management.RegisterCommand(cmdDrain, s.onMgmtDrain)
+		s.management.RegisterCommand(cmdLiveness, s.onMgmtLiveness)
+		s.management.RegisterCommand(cmdReadiness, s.onMgmtReadiness)
+
+		const cmdWorkerCrashes = "WORKER_CRASHES"
+		s.management.RegisterCommand(cmdWorkerCrashes, s.onMgmtWorkerCrashes)
+
+		const cmdWorkers = "WORKERS"
+		s.management.RegisterCommand(cmdWorkers, s.onMgmtWorkers)
+
+		const cmdDecommission = "DECOMMISSION"
+		s.management.RegisterCommand(cmdDecommission, func(c *thwack.Conn, l string) error {
+			return s.decommission.onMgmtDecommission(c, l)
+		})
+
+		const (
+			cmdRevokeMixKey = "REVOKE_MIXKEY"
+			cmdMixKeys      = "MIXKEYS"
+		)
+		s.management.RegisterCommand(cmdRevokeMixKey, s.mixKeys.onMgmtRevokeMixKey)
+		s.management.RegisterCommand(cmdMixKeys, s.mixKeys.onMgmtMixKeys)
+		s.registerIdentityRotationCommands()
+
+		const (
+			cmdListenerList   = "LISTENER_LIST"
+			cmdListenerAdd    = "LISTENER_ADD"
+			cmdListenerRemove = "LISTENER_REMOVE"
+		)
+		s.management.RegisterCommand(cmdListenerList, s.onMgmtListenerList)
+		s.management.RegisterCommand(cmdListenerAdd, s.onMgmtListenerAdd)
+		s.management.RegisterCommand(cmdListenerRemove, s.onMgmtListenerRemove)
+
+		const (
+			cmdStatus        = "STATUS"
+			cmdSupportBundle = "SUPPORT_BUNDLE"
+		)
+		s.management.RegisterCommand(cmdStatus, s.onMgmtStatus)
+		s.management.RegisterCommand(cmdSupportBundle, s.onMgmtSupportBundle)
+
+		const (
+			cmdQueueDepths      = "QUEUE_DEPTHS"
+			cmdHealth           = "HEALTH"
+			cmdPauseForwarding  = "PAUSE_FORWARDING"
+			cmdResumeForwarding = "RESUME_FORWARDING"
+		)
+		s.management.RegisterCommand(cmdQueueDepths, s.onMgmtQueueDepths)
+		s.management.RegisterCommand(cmdHealth, s.onMgmtHealth)
+		s.management.RegisterCommand(cmdPauseForwarding, s.onMgmtPauseForwarding)
+		s.management.RegisterCommand(cmdResumeForwarding, s.onMgmtResumeForwarding)
+
+		const cmdDiskSpace = "DISK_SPACE"
+		s.management.RegisterCommand(cmdDiskSpace, s.disk.onMgmtDiskSpace)
+
+		if s.logRotator != nil {
+			const cmdRotateLog = "ROTATE_LOG"
+			s.management.RegisterCommand(cmdRotateLog, s.logRotator.onMgmtRotateLog)
+		}
+
+		if s.chaos != nil {
+			const (
+				cmdAdvanceEpoch = "CHAOS_ADVANCE_EPOCH"
+				cmdSkewClock    = "CHAOS_SKEW_CLOCK"
+				cmdDropPeer     = "CHAOS_DROP_PEER"
+				cmdUndropPeer   = "CHAOS_UNDROP_PEER"
+			)
+			s.management.RegisterCommand(cmdAdvanceEpoch, s.chaos.onMgmtAdvanceEpoch)
+			s.management.RegisterCommand(cmdSkewClock, s.chaos.onMgmtSkewClock)
+			s.management.RegisterCommand(cmdDropPeer, s.chaos.onMgmtDropPeer)
+			s.management.RegisterCommand(cmdUndropPeer, s.chaos.onMgmtUndropPeer)
+		}
+	}
+
+	// Initialize the per-peer statistics.
+	s.peerStats = newPeerStats(s)
+
+	// Initialize the persistent traffic accounting.
+	if s.accounting, err = newAccounting(s); err != nil {
+		s.log.Errorf("Failed to initialize accounting: %v", err)
+		return nil, err
+	}
+
+	s.decommission = newDecommission(s)
+
+	// Initialize the forwarded packet cap.
+	if s.cfg.Debug.MaxForwardPerEpoch > 0 {
+		s.forwardCap = newForwardCap(s)
+	}
+
+	// Initialize the incoming connection limits.
+	s.resources = newResourceMonitor(s)
+	s.connLimiter = newConnLimiter(s)
+	s.peerBans = newPeerBans(s)
+	if s.peerOverrides, err = newPeerOverrides(s); err != nil {
+		s.log.Errorf("Failed to initialize peer overrides: %v", err)
+		return nil, err
+	}
+
+	// Start measuring the clock skew.
+	if !s.cfg.Debug.DisableClockSkewCheck {
+		s.clockSkew = newClockSkew(s)
+	}
+
+	// Initialize the attack heuristics.
+	if !s.cfg.Debug.DisableAttackDetection {
+		s.attackDetector = newAttackDetector(s)
 	}
 
 	// Initialize the PKI interface.
@@ -339,9 +733,16 @@ func New(cfg *config.Config) (*Server, error) {
 		}
 	}
 
-	// Initialize and start the the scheduler.
+	// Initialize and start the the scheduler, and if enabled the parking
+	// for packets to unknown destinations.
+	if s.cfg.Debug.UnknownDestAction == config.UnknownDestPark {
+		s.parking = newParking(s)
+	}
 	s.scheduler = newScheduler(s)
 
+	// Initialize the decoy traffic generator.
+	s.decoy = newDecoy(s)
+
 	// Initialize and start the Sphinx workers.
 	s.inboundPackets = channels.NewInfiniteChannel()
 	s.cryptoWorkers = make([]*cryptoWorker, 0, s.cfg.Debug.NumSphinxWorkers)
@@ -350,19 +751,59 @@ func New(cfg *config.Config) (*Server, error) {
 		s.cryptoWorkers = append(s.cryptoWorkers, w)
 	}
 
+	// Start the synthetic load generator if enabled.
+	if s.cfg.Debug.LoadGenRate > 0 {
+		s.loadGen = newLoadGen(s)
+	}
+
+	// Discover the external address if behind a NAT, prior to publishing
+	// the descriptor.
+	if s.cfg.NAT != nil {
+		s.nat = newNATTraversal(s)
+	}
+
 	// Initialize the outgoing connection manager, and then start the PKI
 	// worker.
-	s.connector = newConnector(s)
+	if s.connector, err = newConnector(s); err != nil {
+		s.log.Errorf("Failed to initialize connector: %v", err)
+		return nil, err
+	}
 	s.pki.startWorker()
 
-	// Bring the listener(s) online.
+	// Bring the listener(s) online, using the sockets inherited from the
+	// previous server process if any.
+	if s.inheritedListeners, err = inheritListeners(); err != nil {
+		s.log.Errorf("Failed to inherit listeners: %v", err)
+		return nil, err
+	}
 	s.listeners = make([]*listener, 0, len(s.cfg.Server.Addresses))
-	for i, addr := range s.cfg.Server.Addresses {
-		l, err := newListener(s, i, addr)
+	for _, addr := range s.cfg.Server.Addresses {
+		l, err := newListener(s, s.listenerID, addr)
 		if err != nil {
 			s.log.Errorf("Failed to spawn listener on address: %v (%v).", addr, err)
 			return nil, err
 		}
+		s.listenerID++
+		s.listeners = append(s.listeners, l)
+	}
+	if pCfg := s.cfg.Provider; pCfg != nil && pCfg.WebSocket != nil {
+		for i, addr := range pCfg.WebSocket.Addresses {
+			l, err := newWebSocketListener(s, i, addr)
+			if err != nil {
+				s.log.Errorf("Failed to spawn WebSocket listener on address: %v (%v).", addr, err)
+				return nil, err
+			}
+			s.listeners = append(s.listeners, l)
+		}
+	}
+	s.closeInheritedListeners()
+	if path := s.cfg.Debug.UnixSocketListener; path != "" {
+		s.log.Warningf("Trusted unix domain socket listener enabled: %v", path)
+		l, err := newUnixListener(s, path)
+		if err != nil {
+			s.log.Errorf("Failed to spawn listener on unix socket: %v (%v).", path, err)
+			return nil, err
+		}
 		s.listeners = append(s.listeners, l)
 	}
 
@@ -376,6 +817,17 @@ func New(cfg *config.Config) (*Server, error) {
 		s.management.Start()
 	}
 
+	// Everything that requires privileges is done.
+	if err = s.dropPrivileges(); err != nil {
+		s.log.Errorf("Failed to drop privileges: %v", err)
+		return nil, err
+	}
+	if err = s.installSandbox(); err != nil {
+		s.log.Errorf("Failed to install sandbox: %v", err)
+		return nil, err
+	}
+
+	s.emitEvent(EventStarted)
 	isOk = true
 	return s, nil
 }
@@ -0,0 +1,65 @@
+// sockopt.go - TCP/IP socket tuning.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/katzenpost/server/config"
+)
+
+var (
+	errUserTimeoutNotSupported = errors.New("TCP_USER_TIMEOUT is not supported on this platform")
+	errReusePortNotSupported   = errors.New("SO_REUSEPORT is not supported on this platform")
+)
+
+// tuneTCPConn applies the configured socket options to a newly established
+// link layer connection, regardless of the direction.
+func tuneTCPConn(conn net.Conn, cfg *config.Debug) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(!cfg.DisableTCPNoDelay); err != nil {
+		return err
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := tcpConn.SetKeepAlivePeriod(time.Duration(cfg.TCPKeepAliveInterval) * time.Millisecond); err != nil {
+		return err
+	}
+	if cfg.TCPSendBufferSize > 0 {
+		if err := tcpConn.SetWriteBuffer(cfg.TCPSendBufferSize); err != nil {
+			return err
+		}
+	}
+	if cfg.TCPReceiveBufferSize > 0 {
+		if err := tcpConn.SetReadBuffer(cfg.TCPReceiveBufferSize); err != nil {
+			return err
+		}
+	}
+	if cfg.TCPUserTimeout > 0 {
+		if err := setTCPUserTimeout(tcpConn, time.Duration(cfg.TCPUserTimeout)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// sockopt_linux.go - TCP/IP socket tuning (Linux).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT from <linux/tcp.h>, which the syscall
+// package does not define.
+const tcpUserTimeout = 0x12
+
+// soReusePort returns SO_REUSEPORT, which the syscall package does not
+// define on all architectures.  MIPS is the odd one out.
+func soReusePort() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0x200
+	}
+	return 0xf
+}
+
+func setReusePort(network, address string, rawConn syscall.RawConn) error {
+	var sErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+	}); err != nil {
+		return err
+	}
+	return sErr
+}
+
+func setTCPUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sErr error
+	if err = rawConn.Control(func(fd uintptr) {
+		ms := int(timeout / time.Millisecond)
+		sErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, ms)
+	}); err != nil {
+		return err
+	}
+	return sErr
+}
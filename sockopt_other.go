@@ -0,0 +1,34 @@
+// sockopt_other.go - TCP/IP socket tuning (non-Linux).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+func setTCPUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return errUserTimeoutNotSupported
+}
+
+func setReusePort(network, address string, rawConn syscall.RawConn) error {
+	return errReusePortNotSupported
+}
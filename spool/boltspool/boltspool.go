@@ -19,13 +19,20 @@
 package boltspool
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/server/spool"
 	"github.com/katzenpost/server/userdb"
 )
@@ -34,27 +41,101 @@ const (
 	usersBucket = "users"
 	msgKey      = "message"
 	surbIDKey   = "surbID"
+	ctKey       = "ciphertext"
+
+	// MasterKeyLength is the length of the spool master key in bytes.
+	MasterKeyLength = 32
+
+	userKeyLabel  = "katzenpost-spool-user-key-v0"
+	keyCheckLabel = "katzenpost-spool-key-check-v0"
 )
 
+// ErrNoKey is the error returned when an encrypted message is read from a
+// spool that was opened without a master key.
+var ErrNoKey = errors.New("spool: message is encrypted, but no master key is set")
+
+// ErrKeyRequired is the error returned when a spool that was previously
+// opened with a master key is opened without one.
+var ErrKeyRequired = errors.New("spool: spool is encrypted, but no master key is set")
+
+// Options are the optional spool parameters.
+type Options struct {
+	// MasterKey is the key used to encrypt newly stored messages at rest,
+	// with per-user keys derived from it.  If nil, messages are stored in
+	// the clear.
+	MasterKey []byte
+}
+
 type boltSpool struct {
-	db *bolt.DB
+	db        *bolt.DB
+	masterKey []byte
+}
+
+// userAEAD returns the AEAD instance used to encrypt the spool of the user u,
+// keyed with a key derived from the master key and the username.
+func (s *boltSpool) userAEAD(u []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, s.masterKey)
+	m.Write([]byte(userKeyLabel))
+	m.Write(u)
+	k := m.Sum(nil)
+	defer utils.ExplicitBzero(k)
+
+	blk, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+func (s *boltSpool) seal(u, msgID, msg []byte) ([]byte, error) {
+	aead, err := s.userAEAD(u)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte{}, u...), msgID...)
+	return aead.Seal(nonce, nonce, msg, ad), nil
+}
+
+func (s *boltSpool) open(u, msgID, ct []byte) ([]byte, error) {
+	if s.masterKey == nil {
+		return nil, ErrNoKey
+	}
+	aead, err := s.userAEAD(u)
+	if err != nil {
+		return nil, err
+	}
+	if len(ct) < aead.NonceSize()+aead.Overhead() {
+		return nil, spool.ErrUndecryptable
+	}
+	nonce, ct := ct[:aead.NonceSize()], ct[aead.NonceSize():]
+	ad := append(append([]byte{}, u...), msgID...)
+	msg, err := aead.Open(nil, nonce, ct, ad)
+	if err != nil {
+		return nil, spool.ErrUndecryptable
+	}
+	return msg, nil
 }
 
 func (s *boltSpool) Close() {
 	s.db.Sync()
 	s.db.Close()
+	utils.ExplicitBzero(s.masterKey)
 }
 
 func (s *boltSpool) StoreMessage(u, msg []byte) error {
 	if len(msg) != constants.UserForwardPayloadLength {
-		return fmt.Errorf("spool: invalid user message size: %d", len(msg))
+		return spool.ErrMessageSize
 	}
 	return s.doStore(u, nil, msg)
 }
 
 func (s *boltSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
 	if len(msg) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
-		return fmt.Errorf("spool: invalid SURBReply message size: %d", len(msg))
+		return spool.ErrMessageSize
 	}
 	if id == nil {
 		return fmt.Errorf("spool: SURBReply is missing ID")
@@ -92,8 +173,17 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 			return err
 		}
 
-		// Store the message and (optional) SURB ID.
-		mBkt.Put([]byte(msgKey), msg)
+		// Store the message and (optional) SURB ID.  The SURB ID is left in
+		// the clear as it is bound to the ciphertext via the message ID.
+		if s.masterKey != nil {
+			ct, err := s.seal(u, msgID[:], msg)
+			if err != nil {
+				return err
+			}
+			mBkt.Put([]byte(ctKey), ct)
+		} else {
+			mBkt.Put([]byte(msgKey), msg)
+		}
 		if id != nil {
 			mBkt.Put([]byte(surbIDKey), id[:])
 		}
@@ -101,6 +191,24 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 	})
 }
 
+func (s *boltSpool) Count(u []byte) (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Grab the user's spool bucket, if any.
+		sBkt := tx.Bucket([]byte(usersBucket)).Bucket(u)
+		if sBkt == nil {
+			return nil
+		}
+
+		cur := sBkt.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
 func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
 	// This uses manual transaction management because there is a trivial
 	// amount of extra work for the `advance == true` case that requires
@@ -167,6 +275,23 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 	mBkt := sBkt.Bucket(mKey)
 	msg = mBkt.Get([]byte(msgKey))
 	surbID = mBkt.Get([]byte(surbIDKey))
+	if msg == nil {
+		// Messages stored while the master key was set are encrypted.
+		if ct := mBkt.Get([]byte(ctKey)); ct != nil {
+			if msg, err = s.open(u, mKey, ct); err != nil {
+				msg, surbID = nil, nil
+				if advance {
+					// The previous entry was delivered, so its removal must
+					// persist even though this one can not be read, or the
+					// spool will be stuck returning the delivered entry.
+					if cErr := tx.Commit(); cErr != nil {
+						err = cErr
+					}
+				}
+				return
+			}
+		}
+	}
 
 	// If we modified the database, commit the transaction.
 	if advance {
@@ -175,6 +300,36 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 	return
 }
 
+func (s *boltSpool) ForEach(u []byte, fn func(msg, surbID []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		// Grab the user's spool bucket, if any.
+		sBkt := tx.Bucket([]byte(usersBucket)).Bucket(u)
+		if sBkt == nil {
+			return nil
+		}
+
+		cur := sBkt.Cursor()
+		for mKey, _ := cur.First(); mKey != nil; mKey, _ = cur.Next() {
+			mBkt := sBkt.Bucket(mKey)
+			msg := mBkt.Get([]byte(msgKey))
+			if msg == nil {
+				ct := mBkt.Get([]byte(ctKey))
+				if ct == nil {
+					continue
+				}
+				var err error
+				if msg, err = s.open(u, mKey, ct); err != nil {
+					return err
+				}
+			}
+			if err := fn(msg, mBkt.Get([]byte(surbIDKey))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (s *boltSpool) Remove(u []byte) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		// Grab the `users` bucket.
@@ -213,16 +368,43 @@ func (s *boltSpool) Vaccum(udb userdb.UserDB) error {
 
 // New creates (or loads) a user message spool with the given file name f.
 func New(f string) (spool.Spool, error) {
+	return NewWithOptions(f, nil)
+}
+
+// NewWithOptions creates (or loads) a user message spool with the given file
+// name f, and options.
+//
+// Note: Per-user encryption keys are derived from the operator's master key
+// rather than the user's registered public key, as the latter is stored on
+// the same disk as the spool and the UserDB interface provides no way to
+// retrieve it.
+func NewWithOptions(f string, opts *Options) (spool.Spool, error) {
 	const (
 		metadataBucket = "metadata"
 		versionKey     = "version"
+		keyCheckKey    = "keyCheck"
 	)
 
 	var err error
+	var keyCheck []byte
+
+	if opts == nil {
+		opts = new(Options)
+	}
 
 	s := new(boltSpool)
+	if opts.MasterKey != nil {
+		if len(opts.MasterKey) != MasterKeyLength {
+			return nil, fmt.Errorf("spool: invalid master key length: %d", len(opts.MasterKey))
+		}
+		s.masterKey = append([]byte{}, opts.MasterKey...)
+		m := hmac.New(sha256.New, s.masterKey)
+		m.Write([]byte(keyCheckLabel))
+		keyCheck = m.Sum(nil)
+	}
 	s.db, err = bolt.Open(f, 0600, nil)
 	if err != nil {
+		utils.ExplicitBzero(s.masterKey)
 		return nil, err
 	}
 
@@ -236,6 +418,22 @@ func New(f string) (spool.Spool, error) {
 			return err
 		}
 
+		// Ensure that the master key is the one that was used previously,
+		// so that a typo'ed key file doesn't render the spool undecryptable,
+		// and that a missing key file doesn't go unnoticed until the users
+		// try to retrieve their messages.
+		b := bkt.Get([]byte(keyCheckKey))
+		switch {
+		case keyCheck == nil:
+			if b != nil {
+				return ErrKeyRequired
+			}
+		case b == nil:
+			bkt.Put([]byte(keyCheckKey), keyCheck)
+		case !hmac.Equal(b, keyCheck):
+			return fmt.Errorf("spool: master key does not match the spool")
+		}
+
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
 			if len(b) != 1 || b[0] != 0 {
@@ -251,6 +449,7 @@ func New(f string) (spool.Spool, error) {
 	}); err != nil {
 		// The struct isn't getting returned so clean up the database.
 		s.db.Close()
+		utils.ExplicitBzero(s.masterKey)
 		return nil, err
 	}
 
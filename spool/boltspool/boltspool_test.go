@@ -17,22 +17,29 @@
 package boltspool
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	bolt "github.com/coreos/bbolt"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 const (
-	testSpool = "spool.db"
-	testUser  = "allan"
+	testSpool          = "spool.db"
+	testEncryptedSpool = "spool-encrypted.db"
+	testSizeSpool      = "spool-size.db"
+	testMixedSpool     = "spool-mixed.db"
+	testCorruptSpool   = "spool-corrupt.db"
+	testUser           = "allan"
 )
 
 var (
@@ -67,6 +74,11 @@ func TestBoltSpool(t *testing.T) {
 		t.Errorf("create tests failed, skipping load test")
 	}
 
+	t.Run("encrypted", doTestEncrypted)
+	t.Run("messageSize", doTestMessageSize)
+	t.Run("mixed", doTestMixed)
+	t.Run("corrupted", doTestCorrupted)
+
 	os.RemoveAll(tmpDir)
 }
 
@@ -93,6 +105,20 @@ func doTestLoad(t *testing.T) {
 	require.NoError(err, "New()")
 	defer s.Close()
 
+	// Iterate over the entries without discard.
+	var msgs, ids [][]byte
+	err = s.ForEach([]byte(testUser), func(msg, surbID []byte) error {
+		msgs = append(msgs, append([]byte{}, msg...))
+		ids = append(ids, append([]byte(nil), surbID...))
+		return nil
+	})
+	require.NoError(err, "ForEach()")
+	require.Len(msgs, 2, "ForEach(): entries")
+	assert.Equal(testMsg, msgs[0], "ForEach(): Message")
+	assert.Nil(ids[0], "ForEach(): Message should have no SURB ID")
+	assert.Equal(testSurbMsg, msgs[1], "ForEach(): SURBReply")
+	assert.Equal(testSurbID[:], ids[1], "ForEach(): SURB ID")
+
 	// Query 0th message without discard.
 	msg, id, remaining, err := s.Get([]byte(testUser), false)
 	assert.NoError(err, "Get(): testMsg")
@@ -123,6 +149,163 @@ func doTestLoad(t *testing.T) {
 	assert.NoError(err, "Delete(u)")
 }
 
+func doTestEncrypted(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	f := filepath.Join(tmpDir, testEncryptedSpool)
+	key := make([]byte, MasterKeyLength)
+	_, err := rand.Read(key)
+	require.NoError(err, "rand.Read(key)")
+
+	s, err := NewWithOptions(f, &Options{MasterKey: key})
+	require.NoError(err, "NewWithOptions()")
+	err = s.StoreMessage([]byte(testUser), testMsg)
+	assert.NoError(err, "StoreMessage()")
+	err = s.StoreSURBReply([]byte(testUser), &testSurbID, testSurbMsg)
+	assert.NoError(err, "StoreSURBReply()")
+	s.Close()
+
+	// The plaintext must not be present in the database file.
+	b, err := ioutil.ReadFile(f)
+	require.NoError(err, "ReadFile()")
+	assert.False(bytes.Contains(b, testMsg), "Plaintext message on disk")
+	assert.False(bytes.Contains(b, testSurbMsg), "Plaintext SURBReply on disk")
+
+	// Opening with the wrong key must fail.
+	badKey := append([]byte{}, key...)
+	badKey[0] ^= 0xff
+	_, err = NewWithOptions(f, &Options{MasterKey: badKey})
+	assert.Error(err, "NewWithOptions(): wrong key")
+
+	// Opening without a key must fail.
+	_, err = New(f)
+	assert.Equal(ErrKeyRequired, err, "New(): encrypted spool")
+
+	s, err = NewWithOptions(f, &Options{MasterKey: key})
+	require.NoError(err, "NewWithOptions(): load")
+	defer s.Close()
+
+	msg, id, remaining, err := s.Get([]byte(testUser), false)
+	assert.NoError(err, "Get(): testMsg")
+	assert.Equal(testMsg, msg, "Decrypted Message")
+	assert.Nil(id, "Message should have no SURB ID")
+	assert.Equal(1, remaining, "Should be 1 since there's more in the queue")
+
+	msg, id, remaining, err = s.Get([]byte(testUser), true)
+	assert.NoError(err, "Get(): testSurbMsg")
+	assert.Equal(testSurbMsg, msg, "Decrypted SURBReply")
+	assert.Equal(testSurbID[:], id, "Loaded SURB ID")
+	assert.Equal(0, remaining, "Should be 0 since the SURBReply is the only entry")
+}
+
+func doTestMessageSize(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s, err := New(filepath.Join(tmpDir, testSizeSpool))
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	err = s.StoreMessage([]byte(testUser), append(testMsg, 0x00))
+	assert.Equal(spool.ErrMessageSize, err, "StoreMessage(): oversized")
+	err = s.StoreMessage([]byte(testUser), testMsg[1:])
+	assert.Equal(spool.ErrMessageSize, err, "StoreMessage(): undersized")
+	err = s.StoreSURBReply([]byte(testUser), &testSurbID, testMsg)
+	assert.Equal(spool.ErrMessageSize, err, "StoreSURBReply(): mis-sized")
+
+	n, err := s.Count([]byte(testUser))
+	require.NoError(err, "Count()")
+	assert.Zero(n, "Count(): nothing stored")
+}
+
+func doTestMixed(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	f := filepath.Join(tmpDir, testMixedSpool)
+	key := make([]byte, MasterKeyLength)
+	_, err := rand.Read(key)
+	require.NoError(err, "rand.Read(key)")
+
+	// Store a message in the clear, followed by an encrypted one.
+	s, err := New(f)
+	require.NoError(err, "New()")
+	err = s.StoreMessage([]byte(testUser), testMsg)
+	assert.NoError(err, "StoreMessage(): clear")
+	s.Close()
+	s, err = NewWithOptions(f, &Options{MasterKey: key})
+	require.NoError(err, "NewWithOptions()")
+	err = s.StoreSURBReply([]byte(testUser), &testSurbID, testSurbMsg)
+	assert.NoError(err, "StoreSURBReply(): encrypted")
+	s.Close()
+
+	// Once a key is set, the spool can not be opened without it.
+	_, err = New(f)
+	assert.Equal(ErrKeyRequired, err, "New(): no key")
+
+	// Both the cleartext and the encrypted entries are readable with the key.
+	s, err = NewWithOptions(f, &Options{MasterKey: key})
+	require.NoError(err, "NewWithOptions(): load")
+	defer s.Close()
+	msg, _, _, err := s.Get([]byte(testUser), false)
+	require.NoError(err, "Get(): clear")
+	assert.Equal(testMsg, msg, "Get(): clear")
+	msg, id, remaining, err := s.Get([]byte(testUser), true)
+	require.NoError(err, "Get(): encrypted")
+	assert.Equal(testSurbMsg, msg, "Get(): encrypted")
+	assert.Equal(testSurbID[:], id, "Get(): SURB ID")
+	assert.Equal(0, remaining, "Get(): remaining")
+}
+
+func doTestCorrupted(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	f := filepath.Join(tmpDir, testCorruptSpool)
+	key := make([]byte, MasterKeyLength)
+	_, err := rand.Read(key)
+	require.NoError(err, "rand.Read(key)")
+
+	s, err := NewWithOptions(f, &Options{MasterKey: key})
+	require.NoError(err, "NewWithOptions()")
+	err = s.StoreMessage([]byte(testUser), testMsg)
+	assert.NoError(err, "StoreMessage()")
+	err = s.StoreSURBReply([]byte(testUser), &testSurbID, testSurbMsg)
+	assert.NoError(err, "StoreSURBReply()")
+	s.Close()
+
+	// Flip a bit in the ciphertext of the first entry.
+	db, err := bolt.Open(f, 0600, nil)
+	require.NoError(err, "bolt.Open()")
+	err = db.Update(func(tx *bolt.Tx) error {
+		sBkt := tx.Bucket([]byte(usersBucket)).Bucket([]byte(testUser))
+		mKey, _ := sBkt.Cursor().First()
+		mBkt := sBkt.Bucket(mKey)
+		ct := append([]byte{}, mBkt.Get([]byte(ctKey))...)
+		ct[len(ct)-1] ^= 0x01
+		return mBkt.Put([]byte(ctKey), ct)
+	})
+	require.NoError(err, "db.Update()")
+	db.Close()
+
+	// The corrupted entry is reported, and discarding it returns the next
+	// entry.
+	s, err = NewWithOptions(f, &Options{MasterKey: key})
+	require.NoError(err, "NewWithOptions(): load")
+	defer s.Close()
+	_, _, _, err = s.Get([]byte(testUser), false)
+	assert.Equal(spool.ErrUndecryptable, err, "Get(): corrupted")
+	msg, id, remaining, err := s.Get([]byte(testUser), true)
+	require.NoError(err, "Get(): advance past corrupted")
+	assert.Equal(testSurbMsg, msg, "Get(): next entry")
+	assert.Equal(testSurbID[:], id, "Get(): SURB ID")
+	assert.Equal(0, remaining, "Get(): remaining")
+	n, err := s.Count([]byte(testUser))
+	require.NoError(err, "Count()")
+	assert.Equal(1, n, "Count(): corrupted entry removed")
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "boltspool_tests")
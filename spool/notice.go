@@ -0,0 +1,133 @@
+// notice.go - Katzenpost server provider generated spool notices.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/sphinx/constants"
+)
+
+// NoticeType is the type of a provider generated notice.
+type NoticeType uint8
+
+const (
+	// NoticeAccountExpiring is the notice queued for users whose account
+	// is about to be disabled for inactivity.  The notice time is when the
+	// account will be disabled.
+	NoticeAccountExpiring NoticeType = 1
+
+	// A notice is the magic, the type, the time, the text length, and the
+	// text, zero padded to the size of a message less the provider's
+	// signature, which comes last.
+	noticeHdrLength = len(noticeMagic) + 1 + 8 + 2
+	noticeSigOffset = constants.UserForwardPayloadLength - eddsa.SignatureSize
+
+	// MaxNoticeTextLength is the maximum length of a notice text in bytes.
+	MaxNoticeTextLength = noticeSigOffset - noticeHdrLength
+)
+
+// noticeMagic prefixes all notices.  Since any sender can put the magic at
+// the start of a message, the prefix alone merely marks a candidate notice,
+// and only the signature tells a genuine one apart from a forgery.
+const noticeMagic = "katzenpost-spool-notice-v0"
+
+// ErrNotNotice is the error returned when decoding a message that is not a
+// provider generated notice.
+var ErrNotNotice = errors.New("spool: message is not a notice")
+
+// ErrBadNoticeSignature is the error returned when decoding a notice that
+// was not signed by the provider, for the recipient.
+var ErrBadNoticeSignature = errors.New("spool: notice signature is invalid")
+
+// Notice is a provider generated notice, stored in a user's spool as a
+// message.
+type Notice struct {
+	// Type is the type of the notice.
+	Type NoticeType
+
+	// Time is the time the notice refers to, with a precision of a second.
+	Time time.Time
+
+	// Text is the human readable text of the notice.
+	Text string
+}
+
+// IsNotice returns true iff the message looks like a provider generated
+// notice.  The notice is only genuine if DecodeNotice succeeds.
+func IsNotice(msg []byte) bool {
+	return bytes.HasPrefix(msg, []byte(noticeMagic))
+}
+
+// noticeSignedMessage returns the message that the signature of the notice
+// body addressed to the user u covers.  Including the recipient prevents a
+// user from passing off a notice they received as addressed to another.
+func noticeSignedMessage(body, u []byte) []byte {
+	return append(append([]byte{}, body...), u...)
+}
+
+// EncodeNotice serializes and signs a notice addressed to the user u, with
+// the provider's identity key, for storage via Spool.StoreMessage.
+func EncodeNotice(n *Notice, u []byte, identityKey *eddsa.PrivateKey) ([]byte, error) {
+	if len(n.Text) > MaxNoticeTextLength {
+		return nil, errors.New("spool: notice text is oversized")
+	}
+
+	b := make([]byte, constants.UserForwardPayloadLength)
+	off := copy(b, noticeMagic)
+	b[off] = byte(n.Type)
+	off++
+	binary.BigEndian.PutUint64(b[off:], uint64(n.Time.Unix()))
+	off += 8
+	binary.BigEndian.PutUint16(b[off:], uint16(len(n.Text)))
+	off += 2
+	copy(b[off:], n.Text)
+	copy(b[noticeSigOffset:], identityKey.Sign(noticeSignedMessage(b[:noticeSigOffset], u)))
+	return b, nil
+}
+
+// DecodeNotice authenticates and deserializes a notice addressed to the
+// user u, stored by the provider with the identity key identityKey.
+func DecodeNotice(msg, u []byte, identityKey *eddsa.PublicKey) (*Notice, error) {
+	if !IsNotice(msg) {
+		return nil, ErrNotNotice
+	}
+	if len(msg) != constants.UserForwardPayloadLength {
+		return nil, errors.New("spool: mis-sized notice")
+	}
+	if !identityKey.Verify(msg[noticeSigOffset:], noticeSignedMessage(msg[:noticeSigOffset], u)) {
+		return nil, ErrBadNoticeSignature
+	}
+
+	n := new(Notice)
+	off := len(noticeMagic)
+	n.Type = NoticeType(msg[off])
+	off++
+	n.Time = time.Unix(int64(binary.BigEndian.Uint64(msg[off:])), 0)
+	off += 8
+	textLen := int(binary.BigEndian.Uint16(msg[off:]))
+	off += 2
+	if textLen > noticeSigOffset-off {
+		return nil, errors.New("spool: truncated notice text")
+	}
+	n.Text = string(msg[off : off+textLen])
+	return n, nil
+}
@@ -0,0 +1,92 @@
+// notice_test.go - Katzenpost server spool notice tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package spool
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotice(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	u := []byte("alice")
+
+	n := &Notice{
+		Type: NoticeAccountExpiring,
+		Time: time.Unix(time.Now().Unix(), 0),
+		Text: "Your account will be disabled for inactivity.",
+	}
+	b, err := EncodeNotice(n, u, identityKey)
+	require.NoError(err, "EncodeNotice()")
+	assert.Len(b, constants.UserForwardPayloadLength, "EncodeNotice(): length")
+	assert.True(IsNotice(b), "IsNotice(): notice")
+
+	n2, err := DecodeNotice(b, u, identityKey.PublicKey())
+	require.NoError(err, "DecodeNotice()")
+	assert.Equal(n, n2, "DecodeNotice(): round trip")
+
+	// Notices are only valid for the recipient, from the provider.
+	_, err = DecodeNotice(b, []byte("bob"), identityKey.PublicKey())
+	assert.Equal(ErrBadNoticeSignature, err, "DecodeNotice(): other user")
+	otherKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	_, err = DecodeNotice(b, u, otherKey.PublicKey())
+	assert.Equal(ErrBadNoticeSignature, err, "DecodeNotice(): other provider")
+
+	// Anyone can send a message that looks like a notice, but can not
+	// forge or alter the signature.
+	forged, err := EncodeNotice(n, u, otherKey)
+	require.NoError(err, "EncodeNotice(): forged")
+	assert.True(IsNotice(forged), "IsNotice(): forged")
+	_, err = DecodeNotice(forged, u, identityKey.PublicKey())
+	assert.Equal(ErrBadNoticeSignature, err, "DecodeNotice(): forged")
+	tampered := append([]byte{}, b...)
+	tampered[len(noticeMagic)+1+8+2] ^= 0x20
+	_, err = DecodeNotice(tampered, u, identityKey.PublicKey())
+	assert.Equal(ErrBadNoticeSignature, err, "DecodeNotice(): tampered")
+	_, err = DecodeNotice(b[:noticeHdrLength], u, identityKey.PublicKey())
+	assert.Error(err, "DecodeNotice(): truncated")
+
+	// Messages are indistinguishable from random.
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	_, err = rand.Read(msg)
+	require.NoError(err, "rand.Read()")
+	assert.False(IsNotice(msg), "IsNotice(): message")
+	_, err = DecodeNotice(msg, u, identityKey.PublicKey())
+	assert.Equal(ErrNotNotice, err, "DecodeNotice(): message")
+
+	n.Text = strings.Repeat("a", MaxNoticeTextLength+1)
+	_, err = EncodeNotice(n, u, identityKey)
+	assert.Error(err, "EncodeNotice(): oversized")
+	n.Text = strings.Repeat("a", MaxNoticeTextLength)
+	b, err = EncodeNotice(n, u, identityKey)
+	require.NoError(err, "EncodeNotice(): maximum size")
+	n2, err = DecodeNotice(b, u, identityKey.PublicKey())
+	require.NoError(err, "DecodeNotice(): maximum size")
+	assert.Equal(n, n2, "DecodeNotice(): maximum size")
+}
@@ -19,10 +19,22 @@
 package spool
 
 import (
+	"errors"
+
 	"github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/server/userdb"
 )
 
+// ErrMessageSize is the error returned when a message can not be stored as
+// it is not of the size that the wire protocol requires for its type, and
+// thus could never be returned to the user in a retrieval response.
+var ErrMessageSize = errors.New("spool: invalid message size")
+
+// ErrUndecryptable is the error returned when the entry at the head of a
+// user's spool is encrypted at rest, and fails to decrypt due to corruption
+// or tampering.
+var ErrUndecryptable = errors.New("spool: failed to decrypt message")
+
 // Spool is the interface provided by all user messgage spool implementations.
 type Spool interface {
 	// StoreMessage stores a message in the user's spool.
@@ -33,8 +45,18 @@ type Spool interface {
 
 	// Get optionally deletes the first entry in a user's spool, and returns
 	// the (new) first entry.  Both messages and SURBReplies may be returned.
+	// If the (new) first entry can not be read, it is left in place, and
+	// may be discarded by calling Get with advance set.
 	Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error)
 
+	// Count returns the number of entries in a user's spool.
+	Count(u []byte) (int, error)
+
+	// ForEach calls fn for each entry in a user's spool in order, without
+	// removing them.  The SURB ID is nil for messages.  The arguments are
+	// only valid for the duration of the call.
+	ForEach(u []byte, fn func(msg, surbID []byte) error) error
+
 	// Remove removes the spool identified by the username from the database.
 	Remove(u []byte) error
 
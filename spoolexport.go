@@ -0,0 +1,188 @@
+// spoolexport.go - Katzenpost provider user spool export and import.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/internal/spoolarchive"
+	"github.com/katzenpost/server/userdb"
+)
+
+// exportUser writes the spool and metadata of the user u to a new archive
+// at path, encrypted with key.
+func (p *provider) exportUser(u []byte, path string, key []byte) error {
+	if !p.userDB.Exists(u) {
+		return userdb.ErrNoSuchUser
+	}
+	m, err := p.userDB.Metadata(u)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	w, err := spoolarchive.NewWriter(f, key, &spoolarchive.Header{User: u, Metadata: m})
+	if err == nil {
+		err = p.spool.ForEach(u, func(msg, surbID []byte) error {
+			return w.Write(&spoolarchive.Entry{Message: msg, SURBID: surbID})
+		})
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// importUser restores the spool and metadata of the user u from the archive
+// at path, encrypted with key.  The user must already exist.  The archive
+// is read and validated in full before the user is modified, so that a
+// damaged archive leaves the user untouched.
+func (p *provider) importUser(u []byte, path string, key []byte) (int, error) {
+	if !p.userDB.Exists(u) {
+		return 0, userdb.ErrNoSuchUser
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	hdr, entries, err := spoolarchive.ReadAll(f, key)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.SURBID == nil {
+			if len(e.Message) != constants.UserForwardPayloadLength {
+				return 0, fmt.Errorf("invalid message length: %d", len(e.Message))
+			}
+		} else {
+			if len(e.SURBID) != sConstants.SURBIDLength {
+				return 0, fmt.Errorf("invalid SURB ID length: %d", len(e.SURBID))
+			}
+			if len(e.Message) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
+				return 0, fmt.Errorf("invalid SURBReply length: %d", len(e.Message))
+			}
+		}
+	}
+
+	// The idle expiry state is specific to the old provider.
+	for k, v := range hdr.Metadata {
+		switch k {
+		case userdb.MetadataDisabled, userdb.MetadataExpiryWarned:
+			continue
+		}
+		if err = p.userDB.SetMetadata(u, k, v); err != nil {
+			return 0, err
+		}
+	}
+
+	for n, e := range entries {
+		if e.SURBID == nil {
+			err = p.spool.StoreMessage(u, e.Message)
+		} else {
+			var id [sConstants.SURBIDLength]byte
+			copy(id[:], e.SURBID)
+			err = p.spool.StoreSURBReply(u, &id, e.Message)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (p *provider) onMgmtUserExport(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 3 || !filepath.IsAbs(sp[2]) {
+		c.Log().Debugf("USER_EXPORT invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Each archive is encrypted with a fresh key, that is handed to the
+	// operator for transfer to the new provider separately from the archive.
+	key := make([]byte, spoolarchive.KeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		c.Log().Errorf("Failed to generate archive key: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	defer utils.ExplicitBzero(key)
+
+	if err := p.exportUser([]byte(sp[1]), sp[2], key); err != nil {
+		c.Log().Errorf("Failed to export user '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	p.log.Noticef("Exported user '%v' to: %v", p.s.logRedactor.user([]byte(sp[1])), sp[2])
+	if err := c.Writer().PrintfLine("%v-Key:%v", thwack.StatusOk, hex.EncodeToString(key)); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onMgmtUserImport(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 4 || !filepath.IsAbs(sp[2]) {
+		c.Log().Debugf("USER_IMPORT invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	key, err := hex.DecodeString(sp[3])
+	if err != nil || len(key) != spoolarchive.KeyLength {
+		c.Log().Errorf("USER_IMPORT invalid key")
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	defer utils.ExplicitBzero(key)
+
+	n, err := p.importUser([]byte(sp[1]), sp[2], key)
+	if err != nil {
+		c.Log().Errorf("Failed to import user '%v' (%v entries imported): %v", sp[1], n, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	p.log.Noticef("Imported user '%v' with %v spool entries from: %v", p.s.logRedactor.user([]byte(sp[1])), n, sp[2])
+	if err = c.Writer().PrintfLine("%v-Entries:%v", thwack.StatusOk, n); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
@@ -0,0 +1,142 @@
+// stats.go - Katzenpost server per-peer statistics.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+)
+
+// peerCounters are the traffic counters for a given peer.  All fields MUST
+// be accessed via sync/atomic.
+type peerCounters struct {
+	pktsSent  uint64
+	bytesSent uint64
+	pktsRecv  uint64
+	bytesRecv uint64
+
+	pktsPadding  uint64
+	bytesPadding uint64
+
+	unwrapFailures uint64
+	replays        uint64
+}
+
+func (pc *peerCounters) onSent(n int) {
+	atomic.AddUint64(&pc.pktsSent, 1)
+	atomic.AddUint64(&pc.bytesSent, uint64(n))
+}
+
+func (pc *peerCounters) onPaddingSent(n int) {
+	atomic.AddUint64(&pc.pktsPadding, 1)
+	atomic.AddUint64(&pc.bytesPadding, uint64(n))
+}
+
+func (pc *peerCounters) onReceived(n int) {
+	atomic.AddUint64(&pc.pktsRecv, 1)
+	atomic.AddUint64(&pc.bytesRecv, uint64(n))
+}
+
+// onUnwrapFailed attributes a packet received from the peer that failed to
+// unwrap, or iff isReplay, was a replay.
+func (pc *peerCounters) onUnwrapFailed(isReplay bool) {
+	if isReplay {
+		atomic.AddUint64(&pc.replays, 1)
+	} else {
+		atomic.AddUint64(&pc.unwrapFailures, 1)
+	}
+}
+
+func (pc *peerCounters) load() peerCounters {
+	return peerCounters{
+		pktsSent:  atomic.LoadUint64(&pc.pktsSent),
+		bytesSent: atomic.LoadUint64(&pc.bytesSent),
+		pktsRecv:  atomic.LoadUint64(&pc.pktsRecv),
+		bytesRecv: atomic.LoadUint64(&pc.bytesRecv),
+
+		pktsPadding:  atomic.LoadUint64(&pc.pktsPadding),
+		bytesPadding: atomic.LoadUint64(&pc.bytesPadding),
+
+		unwrapFailures: atomic.LoadUint64(&pc.unwrapFailures),
+		replays:        atomic.LoadUint64(&pc.replays),
+	}
+}
+
+type peerStats struct {
+	sync.Mutex
+
+	peers map[[constants.NodeIDLength]byte]*peerCounters
+}
+
+func (st *peerStats) get(id *[constants.NodeIDLength]byte) *peerCounters {
+	st.Lock()
+	defer st.Unlock()
+
+	pc, ok := st.peers[*id]
+	if !ok {
+		pc = new(peerCounters)
+		st.peers[*id] = pc
+	}
+	return pc
+}
+
+func (st *peerStats) snapshot() map[[constants.NodeIDLength]byte]peerCounters {
+	st.Lock()
+	defer st.Unlock()
+
+	m := make(map[[constants.NodeIDLength]byte]peerCounters)
+	for id, pc := range st.peers {
+		m[id] = pc.load()
+	}
+	return m
+}
+
+func (st *peerStats) onMgmtPeerStats(c *thwack.Conn, l string) error {
+	m := st.snapshot()
+	ids := make([]string, 0, len(m))
+	byID := make(map[string]peerCounters)
+	for id, pc := range m {
+		s := nodeIDToPrintString(&id)
+		ids = append(ids, s)
+		byID[s] = pc
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		pc := byID[id]
+		if err := c.Writer().PrintfLine("%v-%v PktsSent:%v BytesSent:%v PktsRecv:%v BytesRecv:%v PktsPadding:%v BytesPadding:%v UnwrapFailures:%v Replays:%v", thwack.StatusOk, id, pc.pktsSent, pc.bytesSent, pc.pktsRecv, pc.bytesRecv, pc.pktsPadding, pc.bytesPadding, pc.unwrapFailures, pc.replays); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func newPeerStats(s *Server) *peerStats {
+	st := new(peerStats)
+	st.peers = make(map[[constants.NodeIDLength]byte]*peerCounters)
+
+	if s.cfg.Management.Enable {
+		const cmdPeerStats = "PEER_STATS"
+		s.management.RegisterCommand(cmdPeerStats, st.onMgmtPeerStats)
+	}
+
+	return st
+}
@@ -0,0 +1,270 @@
+// status.go - Katzenpost server runtime status snapshot.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+// Version is the server version, which is expected to be set at build time
+// via `-ldflags "-X github.com/katzenpost/server.Version=..."`.
+var Version = "unknown"
+
+type statusMixKey struct {
+	Epoch     uint64
+	PublicKey string
+}
+
+type statusKeys struct {
+	Identity string
+	Link     string
+	Mix      []statusMixKey
+}
+
+type statusPKIDoc struct {
+	Epoch      uint64
+	Nodes      int
+	Outgoing   int
+	Self       bool
+	AgeSeconds int64
+}
+
+type statusPKI struct {
+	PublishedEpoch uint64
+	Documents      []statusPKIDoc
+}
+
+type statusHealth struct {
+	PKIDocument       bool
+	ForwardingPaused  bool
+	Overloaded        bool
+	OverloadReason    string `json:",omitempty"`
+	Decommissioning   bool
+	ForwardCapReached bool
+	DangerousSkew     bool
+	SelfTest          string
+	Disk              string
+	FailedWorkers     []string `json:",omitempty"`
+}
+
+type statusLink struct {
+	State         string
+	Addr          string `json:",omitempty"`
+	UptimeSeconds int64
+	LastError     string `json:",omitempty"`
+}
+
+type statusPeer struct {
+	ID         string
+	Addresses  []string
+	Links      []statusLink
+	QueueDepth int
+	PktsSent   uint64
+	BytesSent  uint64
+	PktsRecv   uint64
+	BytesRecv  uint64
+
+	UnwrapFailures uint64
+	Replays        uint64
+}
+
+// status is a machine readable snapshot of the server's runtime state.
+type status struct {
+	Version       string
+	GoVersion     string
+	Identifier    string
+	IsProvider    bool
+	StartedAt     time.Time
+	UptimeSeconds int64
+	Epoch         uint64
+	TillNextEpoch int64
+
+	Keys   statusKeys
+	PKI    statusPKI
+	Health statusHealth
+	Queues map[string]int
+	Peers  []statusPeer
+}
+
+func (s *Server) statusSnapshot() *status {
+	now := time.Now()
+	epoch, _, till := s.epochNow()
+	st := &status{
+		Version:       Version,
+		GoVersion:     runtime.Version(),
+		Identifier:    s.cfg.Server.Identifier,
+		IsProvider:    s.cfg.Server.IsProvider,
+		StartedAt:     s.startedAt,
+		UptimeSeconds: int64(now.Sub(s.startedAt) / time.Second),
+		Epoch:         epoch,
+		TillNextEpoch: int64(till / time.Second),
+		Queues:        make(map[string]int),
+	}
+
+	// Key fingerprints.
+	st.Keys.Identity = s.identityKey.PublicKey().String()
+	st.Keys.Link = s.linkKey.PublicKey().String()
+	if s.mixKeys != nil {
+		s.mixKeys.Lock()
+		for e, k := range s.mixKeys.keys {
+			st.Keys.Mix = append(st.Keys.Mix, statusMixKey{e, k.PublicKey().String()})
+		}
+		s.mixKeys.Unlock()
+		sort.Slice(st.Keys.Mix, func(i, j int) bool { return st.Keys.Mix[i].Epoch < st.Keys.Mix[j].Epoch })
+	}
+
+	// PKI documents.
+	if s.pki != nil {
+		st.PKI.PublishedEpoch = s.pki.publishedEpoch()
+		s.pki.RLock()
+		for e, d := range s.pki.docs {
+			st.PKI.Documents = append(st.PKI.Documents, statusPKIDoc{
+				Epoch:      e,
+				Nodes:      d.Len(),
+				Outgoing:   len(d.Outgoing()),
+				Self:       d.Self() != nil,
+				AgeSeconds: int64(now.Sub(s.pki.fetchedAt[e]) / time.Second),
+			})
+		}
+		s.pki.RUnlock()
+		sort.Slice(st.PKI.Documents, func(i, j int) bool { return st.PKI.Documents[i].Epoch < st.PKI.Documents[j].Epoch })
+		st.Health.PKIDocument = s.pki.hasCurrentDocument()
+	}
+
+	// Per-subsystem health.
+	st.Health.ForwardingPaused = s.isForwardingPaused()
+	st.Health.DangerousSkew = s.isDangerousSkew()
+	st.Health.FailedWorkers = s.workers.failedCritical()
+	if s.connLimiter != nil {
+		s.connLimiter.Lock()
+		st.Health.Overloaded = atomic.LoadUint32(&s.connLimiter.isOverloaded) != 0
+		st.Health.OverloadReason = s.connLimiter.overloadReason
+		s.connLimiter.Unlock()
+	}
+	if s.decommission != nil {
+		st.Health.Decommissioning, _ = s.decommission.status()
+	}
+	if s.forwardCap != nil {
+		st.Health.ForwardCapReached = atomic.LoadUint32(&s.forwardCap.isReached) != 0
+	}
+	st.Health.SelfTest = selfTestDisabled.String()
+	if s.decoy != nil {
+		state, _, _ := s.decoy.selfTest.status()
+		st.Health.SelfTest = state.String()
+	}
+	st.Health.Disk = diskOk.String()
+	if s.disk != nil {
+		level, _, _ := s.disk.status()
+		st.Health.Disk = level.String()
+	}
+
+	// Queue depths.
+	if s.inboundPackets != nil {
+		st.Queues["Inbound"] = s.inboundPackets.Len()
+	}
+	if s.scheduler != nil {
+		st.Queues["Scheduler"] = s.scheduler.queueLen()
+	}
+	if s.provider != nil {
+		st.Queues["Provider"] = s.provider.ch.Len()
+	}
+	if s.connector != nil {
+		st.Queues["Outgoing"] = s.connector.queueLen()
+	}
+	if s.parking != nil {
+		st.Queues["Parked"] = s.parking.queueLen()
+	}
+
+	// Outgoing peers.
+	if s.connector != nil {
+		for _, ps := range s.connector.Status() {
+			peer := statusPeer{
+				ID:         nodeIDToPrintString(&ps.ID),
+				Addresses:  ps.Addresses,
+				QueueDepth: ps.QueueDepth,
+				PktsSent:   ps.Stats.pktsSent,
+				BytesSent:  ps.Stats.bytesSent,
+				PktsRecv:   ps.Stats.pktsRecv,
+				BytesRecv:  ps.Stats.bytesRecv,
+
+				UnwrapFailures: ps.Stats.unwrapFailures,
+				Replays:        ps.Stats.replays,
+			}
+			for _, ls := range ps.Links {
+				link := statusLink{
+					State: ls.State.String(),
+					Addr:  ls.Addr,
+				}
+				if !ls.ConnectedAt.IsZero() {
+					link.UptimeSeconds = int64(now.Sub(ls.ConnectedAt) / time.Second)
+				}
+				if ls.LastErr != nil {
+					link.LastError = ls.LastErr.Error()
+				}
+				peer.Links = append(peer.Links, link)
+			}
+			st.Peers = append(st.Peers, peer)
+		}
+	}
+
+	return st
+}
+
+func (s *Server) onMgmtStatus(c *thwack.Conn, l string) error {
+	sp := strings.Fields(l)
+	isJSON := false
+	switch {
+	case len(sp) == 1:
+	case len(sp) == 2 && sp[1] == "--json":
+		isJSON = true
+	default:
+		c.Log().Debugf("STATUS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	st := s.statusSnapshot()
+	if isJSON {
+		b, err := json.Marshal(st)
+		if err != nil {
+			c.Log().Errorf("STATUS failed to serialize: %v", err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+		if err = c.Writer().PrintfLine("%v-%s", thwack.StatusOk, b); err != nil {
+			return err
+		}
+		return c.WriteReply(thwack.StatusOk)
+	}
+
+	if err := c.Writer().PrintfLine("%v-Version:%v GoVersion:%v Identifier:%v Provider:%v Uptime:%v", thwack.StatusOk, st.Version, st.GoVersion, st.Identifier, st.IsProvider, time.Duration(st.UptimeSeconds)*time.Second); err != nil {
+		return err
+	}
+	if err := c.Writer().PrintfLine("%v-Epoch:%v TillNextEpoch:%v PublishedEpoch:%v PKIDocuments:%v Peers:%v", thwack.StatusOk, st.Epoch, time.Duration(st.TillNextEpoch)*time.Second, st.PKI.PublishedEpoch, len(st.PKI.Documents), len(st.Peers)); err != nil {
+		return err
+	}
+	h := st.Health
+	if err := c.Writer().PrintfLine("%v-PKIDocument:%v ForwardingPaused:%v Overloaded:%v Decommissioning:%v ForwardCapReached:%v DangerousSkew:%v SelfTest:%v Disk:%v", thwack.StatusOk, h.PKIDocument, h.ForwardingPaused, h.Overloaded, h.Decommissioning, h.ForwardCapReached, h.DangerousSkew, h.SelfTest, h.Disk); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
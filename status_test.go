@@ -0,0 +1,77 @@
+// status_test.go - Katzenpost server status snapshot tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusSnapshot(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s := newTestIncomingServer(t)
+	s.cfg.Server = &config.Server{
+		Identifier: "status.example.com",
+	}
+
+	st := s.statusSnapshot()
+	assert.Equal("status.example.com", st.Identifier, "statusSnapshot(): Identifier")
+	assert.Equal(s.identityKey.PublicKey().String(), st.Keys.Identity, "statusSnapshot(): identity key")
+	assert.Equal(s.linkKey.PublicKey().String(), st.Keys.Link, "statusSnapshot(): link key")
+	assert.False(st.Health.PKIDocument, "statusSnapshot(): no PKI")
+	assert.False(st.Health.Overloaded, "statusSnapshot(): not overloaded")
+	assert.Equal(diskOk.String(), st.Health.Disk, "statusSnapshot(): no disk monitor")
+	assert.Equal(selfTestDisabled.String(), st.Health.SelfTest, "statusSnapshot(): no self test")
+	assert.Empty(st.Queues, "statusSnapshot(): no queues")
+
+	b, err := json.Marshal(st)
+	require.NoError(err, "json.Marshal()")
+	var health struct {
+		Health map[string]interface{}
+	}
+	require.NoError(json.Unmarshal(b, &health), "json.Unmarshal()")
+	assert.NotContains(health.Health, "OverloadReason", "JSON: OverloadReason omitted when empty")
+	assert.NotContains(health.Health, "FailedWorkers", "JSON: FailedWorkers omitted when empty")
+
+	// The health section reflects the state of the subsystems.
+	atomic.StoreUint32(&s.forwardingPaused, 1)
+	atomic.StoreUint32(&s.connLimiter.isOverloaded, 1)
+	s.connLimiter.overloadReason = "inbound queue depth 2 exceeds 1"
+	s.disk = newTestDiskMonitor(s)
+	atomic.StoreUint32(&s.disk.level, uint32(diskRefuseSpool))
+
+	st = s.statusSnapshot()
+	assert.True(st.Health.ForwardingPaused, "statusSnapshot(): forwarding paused")
+	assert.True(st.Health.Overloaded, "statusSnapshot(): overloaded")
+	assert.Equal(s.connLimiter.overloadReason, st.Health.OverloadReason, "statusSnapshot(): overload reason")
+	assert.Equal(diskRefuseSpool.String(), st.Health.Disk, "statusSnapshot(): disk level")
+
+	b, err = json.Marshal(st)
+	require.NoError(err, "json.Marshal()")
+	health.Health = nil
+	require.NoError(json.Unmarshal(b, &health), "json.Unmarshal()")
+	assert.Equal(true, health.Health["Overloaded"], "JSON: Overloaded")
+	assert.Equal(s.connLimiter.overloadReason, health.Health["OverloadReason"], "JSON: OverloadReason")
+	assert.Equal("RefuseSpool", health.Health["Disk"], "JSON: Disk")
+}
@@ -0,0 +1,193 @@
+// supervisor.go - Katzenpost server worker supervision.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+type workerState int
+
+const (
+	workerRunning workerState = iota
+	workerFailed
+)
+
+func (st workerState) String() string {
+	switch st {
+	case workerRunning:
+		return "Running"
+	case workerFailed:
+		return "Failed"
+	default:
+		return "[Unknown]"
+	}
+}
+
+type supervisedWorker struct {
+	name       string
+	isCritical bool
+	state      workerState
+	restarts   int
+	startedAt  time.Time
+}
+
+// supervisor tracks the long running workers started via supervise and
+// superviseOptional, so that the server can report which are alive, and
+// stop claiming to be ready once a critical worker is gone.
+type supervisor struct {
+	sync.Mutex
+
+	workers map[string]*supervisedWorker
+}
+
+func (sv *supervisor) register(name string, isCritical bool) *supervisedWorker {
+	sv.Lock()
+	defer sv.Unlock()
+
+	if sv.workers == nil {
+		sv.workers = make(map[string]*supervisedWorker)
+	}
+	w := &supervisedWorker{
+		name:       name,
+		isCritical: isCritical,
+		startedAt:  time.Now(),
+	}
+	sv.workers[name] = w
+	return w
+}
+
+func (sv *supervisor) unregister(w *supervisedWorker) {
+	sv.Lock()
+	defer sv.Unlock()
+
+	// A worker with the same name may have been started since.
+	if sv.workers[w.name] == w {
+		delete(sv.workers, w.name)
+	}
+}
+
+func (sv *supervisor) onRestart(w *supervisedWorker) {
+	sv.Lock()
+	defer sv.Unlock()
+
+	w.restarts++
+	w.startedAt = time.Now()
+}
+
+func (sv *supervisor) onFailed(w *supervisedWorker) {
+	sv.Lock()
+	defer sv.Unlock()
+
+	w.state = workerFailed
+}
+
+// failedCritical returns the sorted names of the critical workers that are
+// gone.
+func (sv *supervisor) failedCritical() []string {
+	sv.Lock()
+	defer sv.Unlock()
+
+	var names []string
+	for _, w := range sv.workers {
+		if w.isCritical && w.state == workerFailed {
+			names = append(names, w.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isHealthy returns true iff all of the critical workers are alive.
+func (sv *supervisor) isHealthy() bool {
+	return len(sv.failedCritical()) == 0
+}
+
+func (sv *supervisor) snapshot() []supervisedWorker {
+	sv.Lock()
+	defer sv.Unlock()
+
+	ret := make([]supervisedWorker, 0, len(sv.workers))
+	for _, w := range sv.workers {
+		ret = append(ret, *w)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// supervise wraps a critical long running worker, so that it is restarted up
+// to Debug.MaxWorkerRestarts times if it panics, after which the server is
+// shut down.  The worker MUST be safe to restart.
+func (s *Server) supervise(name string, fn func()) func() {
+	return s.superviseWorker(name, true, fn)
+}
+
+// superviseOptional wraps a long running worker that the server can operate
+// without, so that it is restarted up to Debug.MaxWorkerRestarts times if it
+// panics, after which it is given up on and the server carries on degraded.
+// The worker MUST be safe to restart.
+func (s *Server) superviseOptional(name string, fn func()) func() {
+	return s.superviseWorker(name, false, fn)
+}
+
+func (s *Server) superviseWorker(name string, isCritical bool, fn func()) func() {
+	return func() {
+		w := s.workers.register(name, isCritical)
+		for restarts := 0; s.runRecovered(name, fn); restarts++ {
+			if restarts >= s.cfg.Debug.MaxWorkerRestarts {
+				s.workers.onFailed(w)
+				if isCritical {
+					s.log.Criticalf("Critical worker %v crashed too many times, shutting down.", name)
+					go s.Shutdown()
+				} else {
+					s.log.Errorf("Worker %v crashed too many times, giving up on it.", name)
+					s.emitDegradedEvent("worker " + name + " failed")
+				}
+				return
+			}
+			s.log.Warningf("Restarting worker %v.", name)
+			s.workers.onRestart(w)
+		}
+
+		// The worker returned normally, which only happens when it is
+		// halted.
+		s.workers.unregister(w)
+	}
+}
+
+func (s *Server) onMgmtWorkers(c *thwack.Conn, l string) error {
+	now := time.Now()
+	for _, w := range s.workers.snapshot() {
+		uptime := int64(now.Sub(w.startedAt) / time.Second)
+		if w.state == workerFailed {
+			uptime = 0
+		}
+		if err := c.Writer().PrintfLine("%v-State:%v Critical:%v Restarts:%v UptimeSeconds:%v Name:%v", thwack.StatusOk, w.state, w.isCritical, w.restarts, uptime, w.name); err != nil {
+			return err
+		}
+	}
+	failed := s.workers.failedCritical()
+	if err := c.Writer().PrintfLine("%v-Healthy:%v FailedCritical:%v", thwack.StatusOk, len(failed) == 0, strings.Join(failed, ",")); err != nil {
+		return err
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
@@ -0,0 +1,116 @@
+// supervisor_test.go - Katzenpost server worker supervisor tests.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/katzenpost/server/config"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSupervisorServer(maxRestarts int) *Server {
+	return &Server{
+		cfg: &config.Config{
+			Debug: &config.Debug{
+				MaxWorkerRestarts: maxRestarts,
+			},
+			Sandbox: &config.Sandbox{},
+		},
+		log: logging.MustGetLogger("server"),
+	}
+}
+
+func TestSuperviseOptional(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s := newTestSupervisorServer(2)
+
+	// A worker that keeps crashing is restarted, then given up on.
+	nrRuns := 0
+	s.superviseOptional("crashy", func() {
+		nrRuns++
+		ws := s.workers.snapshot()
+		require.Len(ws, 1, "snapshot(): running")
+		assert.Equal(workerRunning, ws[0].state, "snapshot(): running state")
+		assert.Equal(nrRuns-1, ws[0].restarts, "snapshot(): running restarts")
+		panic("crashy worker")
+	})()
+	assert.Equal(3, nrRuns, "crashing worker runs")
+	ws := s.workers.snapshot()
+	require.Len(ws, 1, "snapshot(): failed")
+	assert.Equal(workerFailed, ws[0].state, "snapshot(): failed state")
+	assert.Equal(2, ws[0].restarts, "snapshot(): failed restarts")
+	assert.Equal(uint64(3), s.crashes.counts["crashy"], "crash count")
+
+	// Optional workers failing does not make the server unhealthy.
+	assert.Empty(s.workers.failedCritical(), "failedCritical(): optional worker")
+	assert.True(s.workers.isHealthy(), "isHealthy(): optional worker")
+	assert.Equal(uint64(4), s.events.counts[EventDegraded], "EventDegraded: 3 panics and giving up")
+
+	// A worker that recovers after a crash is unregistered once it returns.
+	nrRuns = 0
+	s.superviseOptional("flaky", func() {
+		nrRuns++
+		if nrRuns == 1 {
+			panic("flaky worker")
+		}
+	})()
+	assert.Equal(2, nrRuns, "flaky worker runs")
+	ws = s.workers.snapshot()
+	require.Len(ws, 1, "snapshot(): halted worker unregistered")
+	assert.Equal("crashy", ws[0].name, "snapshot(): failed worker kept")
+
+	// Workers that never crash are never restarted.
+	nrRuns = 0
+	s.superviseOptional("steady", func() { nrRuns++ })()
+	assert.Equal(1, nrRuns, "steady worker runs")
+	assert.Len(s.workers.snapshot(), 1, "snapshot(): steady worker unregistered")
+}
+
+func TestSupervisorCritical(t *testing.T) {
+	assert := assert.New(t)
+
+	var sv supervisor
+	assert.True(sv.isHealthy(), "isHealthy(): no workers")
+
+	optional := sv.register("optional", false)
+	critical := sv.register("critical", true)
+	sv.onRestart(critical)
+	assert.True(sv.isHealthy(), "isHealthy(): restarted")
+
+	sv.onFailed(optional)
+	assert.True(sv.isHealthy(), "isHealthy(): optional failed")
+	sv.onFailed(critical)
+	assert.Equal([]string{"critical"}, sv.failedCritical(), "failedCritical(): critical failed")
+	assert.False(sv.isHealthy(), "isHealthy(): critical failed")
+
+	// A replacement worker with the same name is not unregistered by the
+	// previous instance.
+	replacement := sv.register("critical", true)
+	assert.True(sv.isHealthy(), "isHealthy(): critical replaced")
+	sv.unregister(critical)
+	ws := sv.snapshot()
+	assert.Len(ws, 2, "snapshot(): replacement kept")
+	sv.unregister(replacement)
+	ws = sv.snapshot()
+	assert.Len(ws, 1, "snapshot(): replacement unregistered")
+	assert.Equal("optional", ws[0].name, "snapshot(): optional kept")
+}
@@ -0,0 +1,125 @@
+// surbreplay.go - Katzenpost provider SURB replay protection.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"path/filepath"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/op/go-logging"
+)
+
+const (
+	surbReplayFile = "surb_replay.db"
+
+	// surbReplayEpochs is the number of epochs that used SURBs are tracked
+	// for.  A SURB is only usable while the mix keys it was created against
+	// are published, which is at most this many epochs.
+	surbReplayEpochs = 3
+)
+
+// surbReplay tracks the SURBs that the provider has sent replies (SURB-ACKs,
+// Kaetzchen responses) with, so that a captured SURB can not be replayed to
+// elicit multiple reply transmissions.  Used SURBs are stored in a bucket per
+// epoch, that are pruned once the SURBs would no longer be usable.
+type surbReplay struct {
+	sync.Mutex
+
+	s   *Server
+	log *logging.Logger
+	db  *bolt.DB
+
+	lastPruned uint64
+}
+
+// isReplay returns true iff the SURB has been used before, and records it as
+// used otherwise.
+func (r *surbReplay) isReplay(surb []byte) bool {
+	tag := sha512.Sum512_256(surb)
+	epoch, _, _ := r.s.epochNow()
+
+	r.Lock()
+	defer r.Unlock()
+
+	isReplay := false
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		for e := epoch; e > 0 && e+surbReplayEpochs > epoch; e-- {
+			if bkt := tx.Bucket(epochToKey(e)); bkt != nil && bkt.Get(tag[:]) != nil {
+				isReplay = true
+				return nil
+			}
+		}
+
+		bkt, err := tx.CreateBucketIfNotExists(epochToKey(epoch))
+		if err != nil {
+			return err
+		}
+		if err = bkt.Put(tag[:], []byte{}); err != nil {
+			return err
+		}
+		if epoch == r.lastPruned {
+			return nil
+		}
+
+		// Prune the buckets for the epochs that are no longer tracked.
+		var stale [][]byte
+		c := tx.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k)+surbReplayEpochs <= epoch; k, _ = c.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		for _, k := range stale {
+			if err = tx.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		r.lastPruned = epoch
+		return nil
+	}); err != nil {
+		// Failing open here is preferable to not sending SURB-ACKs, since
+		// the packet replay filter still applies.
+		r.log.Warningf("Failed to update the SURB replay filter: %v", err)
+		r.s.emitDegradedEvent("SURB replay filter failure")
+		return false
+	}
+	return isReplay
+}
+
+func (r *surbReplay) halt() {
+	r.db.Sync()
+	r.db.Close()
+}
+
+func newSURBReplay(s *Server) (*surbReplay, error) {
+	r := new(surbReplay)
+	r.s = s
+	r.log = s.newLogger("surb replay")
+
+	var err error
+	f := filepath.Join(s.dataDir(), surbReplayFile)
+	if r.db, err = bolt.Open(f, 0600, nil); err != nil {
+		return nil, err
+	}
+
+	// As with the mix key replay filter's write-back cache, losing the most
+	// recent entries on a system crash is an acceptable trade off for not
+	// doing a fsync() per SURB.  The database is synced on shutdown.
+	r.db.NoSync = true
+	return r, nil
+}
@@ -0,0 +1,214 @@
+// syscallfilter_linux.go - Katzenpost server seccomp-bpf syscall filter.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package server
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs = 38 // PR_SET_NO_NEW_PRIVS
+
+	seccompSetModeFilter   = 1 // SECCOMP_SET_MODE_FILTER
+	seccompFilterFlagTSync = 1 // SECCOMP_FILTER_FLAG_TSYNC
+
+	seccompRetAllow = 0x7fff0000 // SECCOMP_RET_ALLOW
+	seccompRetLog   = 0x7ffc0000 // SECCOMP_RET_LOG
+	seccompRetErrno = 0x00050000 // SECCOMP_RET_ERRNO
+
+	// Offsets into struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// allowedSyscalls is the set of system calls that the server needs once
+// it is initialized, on every supported architecture.  This covers the Go
+// runtime, networking (including runtime listener management), and file
+// access in the DataDir (mix keys, log rotation, spool).
+//
+// Notably absent are the system calls for spawning processes, so Kaetzchen
+// plugins can not be restarted once the filter is installed.
+var allowedSyscalls = []uintptr{
+	// Runtime: memory management.
+	syscall.SYS_BRK,
+	syscall.SYS_MMAP,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MADVISE,
+	syscall.SYS_MINCORE,
+	syscall.SYS_MLOCK,
+	syscall.SYS_MUNLOCK,
+
+	// Runtime: threads, signals, scheduling, time.
+	syscall.SYS_CLONE,
+	syscall.SYS_FUTEX,
+	syscall.SYS_GETTID,
+	syscall.SYS_GETPID,
+	syscall.SYS_TGKILL,
+	syscall.SYS_KILL,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_SETITIMER,
+	syscall.SYS_TIMER_CREATE,
+	syscall.SYS_TIMER_SETTIME,
+	syscall.SYS_TIMER_DELETE,
+	syscall.SYS_PRLIMIT64,
+	syscall.SYS_GETRUSAGE,
+	syscall.SYS_UNAME,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEGID,
+
+	// Runtime: poller.
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_PIPE2,
+	syscall.SYS_EVENTFD2,
+
+	// I/O.
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_CLOSE,
+	syscall.SYS_FCNTL,
+	syscall.SYS_IOCTL,
+	syscall.SYS_DUP,
+	syscall.SYS_DUP3,
+
+	// Networking.
+	syscall.SYS_SOCKET,
+	syscall.SYS_CONNECT,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_BIND,
+	syscall.SYS_LISTEN,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG,
+	syscall.SYS_SHUTDOWN,
+
+	// Files.
+	syscall.SYS_OPENAT,
+	syscall.SYS_FSTAT,
+	syscall.SYS_STATFS,
+	syscall.SYS_LSEEK,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_RENAMEAT,
+	syscall.SYS_MKDIRAT,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_TRUNCATE,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FDATASYNC,
+	syscall.SYS_FLOCK,
+	syscall.SYS_FALLOCATE,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_FACCESSAT,
+	syscall.SYS_FCHMOD,
+	syscall.SYS_FCHMODAT,
+	syscall.SYS_GETCWD,
+}
+
+// sockFprog is struct sock_fprog, which the syscall package defines with
+// architecture dependent padding field names.
+type sockFprog struct {
+	Len    uint16
+	Filter *syscall.SockFilter
+}
+
+func newSyscallFilterProgram(logOnly bool) []syscall.SockFilter {
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jeq := func(k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+
+	denyAction := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	if logOnly {
+		denyAction = seccompRetLog
+	}
+
+	syscalls := append(append([]uintptr{}, allowedSyscalls...), archAllowedSyscalls...)
+	prog := make([]syscall.SockFilter, 0, 4+2*len(syscalls)+1)
+
+	// Reject system calls made with a foreign ABI, as the numbers differ.
+	prog = append(prog, stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch))
+	prog = append(prog, jeq(auditArch, 1, 0))
+	prog = append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, denyAction))
+
+	// Allow the system calls in the allow list, deny everything else.
+	prog = append(prog, stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr))
+	for _, nr := range syscalls {
+		prog = append(prog, jeq(uint32(nr), 0, 1))
+		prog = append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+	}
+	prog = append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, denyAction))
+
+	return prog
+}
+
+// installSyscallFilter installs a seccomp-bpf filter on every thread of the
+// process, that only permits the system calls that the server needs once
+// initialized.  If logOnly is set, disallowed system calls are logged by
+// the kernel (audit) rather than denied.  The paths are unused.
+func installSyscallFilter(logOnly bool, paths map[string]string) error {
+	prog := newSyscallFilterProgram(logOnly)
+	fprog := &sockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	r, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(fprog)))
+	if errno != 0 {
+		return errno
+	}
+	if r != 0 {
+		// With TSYNC, a positive return value is the ID of the thread that
+		// could not be synchronized.
+		return errSyscallFilterTSync
+	}
+	return nil
+}
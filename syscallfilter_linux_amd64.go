@@ -0,0 +1,50 @@
+// syscallfilter_linux_amd64.go - Katzenpost server seccomp-bpf syscall filter (amd64).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "syscall"
+
+const (
+	auditArch  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp = 317
+)
+
+// archAllowedSyscalls is the architecture specific part of the allow list,
+// including the system calls that the syscall package does not define.
+var archAllowedSyscalls = []uintptr{
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_PIPE,
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_ACCESS,
+	syscall.SYS_RENAME,
+	syscall.SYS_UNLINK,
+	syscall.SYS_MKDIR,
+	syscall.SYS_READLINK,
+	syscall.SYS_GETDENTS,
+	316, // renameat2
+	318, // getrandom
+	324, // membarrier
+	332, // statx
+	334, // rseq
+	435, // clone3
+	439, // faccessat2
+	441, // epoll_pwait2
+}
@@ -0,0 +1,38 @@
+// syscallfilter_linux_arm64.go - Katzenpost server seccomp-bpf syscall filter (arm64).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "syscall"
+
+const (
+	auditArch  = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp = syscall.SYS_SECCOMP
+)
+
+// archAllowedSyscalls is the architecture specific part of the allow list,
+// including the system calls that the syscall package does not define.
+var archAllowedSyscalls = []uintptr{
+	syscall.SYS_FSTATAT,
+	syscall.SYS_GETRANDOM,
+	276, // renameat2
+	283, // membarrier
+	291, // statx
+	293, // rseq
+	435, // clone3
+	439, // faccessat2
+	441, // epoll_pwait2
+}
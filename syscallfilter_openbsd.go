@@ -0,0 +1,40 @@
+// syscallfilter_openbsd.go - Katzenpost server pledge/unveil syscall filter.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import "golang.org/x/sys/unix"
+
+// installSyscallFilter restricts the process with pledge(2), permitting only
+// what the server needs once initialized, and unveil(2), limiting
+// filesystem access to the provided paths and permissions.  If logOnly is
+// set, violations return an error instead of killing the process.
+func installSyscallFilter(logOnly bool, paths map[string]string) error {
+	for p, perms := range paths {
+		if err := unix.Unveil(p, perms); err != nil {
+			return err
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		return err
+	}
+
+	promises := "stdio rpath wpath cpath flock inet unix dns"
+	if logOnly {
+		promises += " error"
+	}
+	return unix.Pledge(promises, "")
+}
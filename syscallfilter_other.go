@@ -0,0 +1,25 @@
+// syscallfilter_other.go - Katzenpost server syscall filter (unsupported).
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !openbsd && !(linux && (amd64 || arm64))
+// +build !openbsd
+// +build !linux !amd64,!arm64
+
+package server
+
+func installSyscallFilter(logOnly bool, paths map[string]string) error {
+	return errSandboxNotSupported
+}
@@ -0,0 +1,81 @@
+// systemd.go - Katzenpost server systemd integration.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/katzenpost/server/internal/sdnotify"
+)
+
+// systemdNotifier handles readiness notification and the watchdog, when
+// running under systemd.  It is driven entirely by the periodic timer.
+type systemdNotifier struct {
+	s *Server
+
+	isReady          bool
+	isUnhealthy      bool
+	watchdogInterval time.Duration
+	lastWatchdog     time.Time
+}
+
+func (n *systemdNotifier) notify(state string) {
+	if _, err := sdnotify.Notify(state); err != nil {
+		n.s.log.Warningf("Failed to notify systemd: %v", err)
+	}
+}
+
+func (n *systemdNotifier) onTick(now time.Time) {
+	// The listeners are bound before the periodic timer is started, so the
+	// server is ready as soon as there is a PKI document for this epoch, as
+	// long as none of the critical workers are gone.
+	failed := n.s.workers.failedCritical()
+	if !n.isReady && len(failed) == 0 && n.s.pki.hasCurrentDocument() {
+		n.s.log.Debugf("Notifying systemd of readiness.")
+		n.notify(sdnotify.Ready + "\n" + sdnotify.Status("Running"))
+		n.isReady = true
+	}
+	if len(failed) > 0 && !n.isUnhealthy {
+		n.notify(sdnotify.Status("Failed workers: " + strings.Join(failed, ", ")))
+		n.isUnhealthy = true
+	}
+
+	// Send watchdog keep-alives at half the interval, which is the
+	// recommended rate.
+	if n.watchdogInterval > 0 && now.Sub(n.lastWatchdog) >= n.watchdogInterval/2 {
+		n.notify(sdnotify.Watchdog)
+		n.lastWatchdog = now
+	}
+}
+
+func (n *systemdNotifier) onStopping() {
+	n.notify(sdnotify.Stopping)
+}
+
+func newSystemdNotifier(s *Server) *systemdNotifier {
+	n := new(systemdNotifier)
+	n.s = s
+
+	var err error
+	if n.watchdogInterval, err = sdnotify.WatchdogInterval(); err != nil {
+		s.log.Warningf("Ignoring systemd watchdog: %v", err)
+	} else if n.watchdogInterval > 0 {
+		s.log.Noticef("systemd watchdog enabled, interval: %v", n.watchdogInterval)
+	}
+	return n
+}
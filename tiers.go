@@ -0,0 +1,150 @@
+// tiers.go - Katzenpost provider account service tiers.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/userdb"
+)
+
+// TODO: Restricting Kaetzchen access by tier is not possible, as requests
+// arrive anonymously via the mix network, so the provider has no way to
+// tell which of its users (if any) sent them.
+
+// tierOf returns the service tier of the user u, or nil if the user is only
+// subject to the global limits.
+func (p *provider) tierOf(u []byte) *config.Tier {
+	if p.tiers == nil {
+		return nil
+	}
+	if b, err := p.userDB.GetMetadata(u, userdb.MetadataTier); err == nil && b != nil {
+		if t, ok := p.tiers[string(b)]; ok {
+			return t
+		}
+	}
+	return p.defaultTier
+}
+
+// isOverQuota returns true iff the spool of the user u is at the limit of
+// the user's tier, or the global limit if the tier does not set one.
+func (p *provider) isOverQuota(u []byte) bool {
+	max := p.s.cfg.Provider.MaxUserSpoolMessages
+	if t := p.tierOf(u); t != nil && t.MaxSpoolMessages > 0 {
+		max = t.MaxSpoolMessages
+	}
+	if max <= 0 {
+		return false
+	}
+	n, err := p.spool.Count(u)
+	if err != nil {
+		p.log.Warningf("Failed to query spool size: User: '%v': %v", p.s.logRedactor.user(u), err)
+		return false
+	}
+	return n >= max
+}
+
+// pollRate returns the spool retrieval rate limit of the user u.
+func (p *provider) pollRate(u []byte) int {
+	if t := p.tierOf(u); t != nil && t.PollRate > 0 {
+		return t.PollRate
+	}
+	return p.s.cfg.Debug.ClientPollRate
+}
+
+// sendRate returns the packet send rate limit of the user u, with 0 being
+// unlimited.
+func (p *provider) sendRate(u []byte) int {
+	if t := p.tierOf(u); t != nil {
+		return t.SendRate
+	}
+	return 0
+}
+
+func (p *provider) onMgmtUserTier(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 && len(sp) != 3 {
+		c.Log().Debugf("USER_TIER invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	u := []byte(sp[1])
+
+	// Without a tier name, display the user's tier.
+	if len(sp) == 2 {
+		name := "[None]"
+		if t := p.tierOf(u); t != nil {
+			name = t.Name
+		}
+		if err := c.Writer().PrintfLine("%v-Tier:%v", thwack.StatusOk, name); err != nil {
+			return err
+		}
+		return c.WriteReply(thwack.StatusOk)
+	}
+
+	// Assigning the default tier clears the assignment.
+	var v []byte
+	if name := sp[2]; p.defaultTier == nil || name != p.defaultTier.Name {
+		if _, ok := p.tiers[name]; !ok {
+			c.Log().Errorf("USER_TIER unknown tier '%v'", name)
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		v = []byte(name)
+	}
+	if err := p.userDB.SetMetadata(u, userdb.MetadataTier, v); err != nil {
+		c.Log().Errorf("Failed to set tier of user '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	// Apply the new limits to the existing connections.  The send rate is
+	// picked up when the connections next re-authenticate.
+	p.abuse.setPollRate(u, p.pollRate(u))
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onMgmtTierList(c *thwack.Conn, l string) error {
+	for _, t := range p.s.cfg.Provider.Tiers {
+		isDefault := p.defaultTier == t
+		if err := c.Writer().PrintfLine("%v-Tier:%v MaxSpoolMessages:%v PollRate:%v SendRate:%v Default:%v", thwack.StatusOk, t.Name, t.MaxSpoolMessages, t.PollRate, t.SendRate, isDefault); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) initTiers() {
+	pCfg := p.s.cfg.Provider
+	if len(pCfg.Tiers) == 0 {
+		return
+	}
+
+	p.tiers = make(map[string]*config.Tier)
+	for _, v := range pCfg.Tiers {
+		p.tiers[v.Name] = v
+	}
+	p.defaultTier = p.tiers[pCfg.DefaultTier]
+
+	if p.s.cfg.Management.Enable {
+		const (
+			cmdUserTier = "USER_TIER"
+			cmdTierList = "TIER_LIST"
+		)
+		p.s.management.RegisterCommand(cmdUserTier, p.onMgmtUserTier)
+		p.s.management.RegisterCommand(cmdTierList, p.onMgmtTierList)
+	}
+}
@@ -0,0 +1,95 @@
+// trace.go - Katzenpost server packet tracing.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	mRand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const defaultPacketTraceFile = "packet_trace.log"
+
+var pktTraceID uint64
+
+// packetTracer writes the pipeline journey of a sampled fraction of packets
+// to a separate trace file, for debugging delivery problems.  Each traced
+// packet is assigned a correlation ID, that is carried over to packets
+// derived from it (eg: SURB-ACKs).
+type packetTracer struct {
+	sync.Mutex
+
+	f        *os.File
+	mRand    *mRand.Rand
+	fraction float64
+}
+
+// sample marks pkt for tracing with the configured probability.  It is safe
+// to call on a nil packetTracer.
+func (t *packetTracer) sample(pkt *packet) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	isSampled := t.mRand.Float64() < t.fraction
+	t.Unlock()
+	if isSampled {
+		pkt.traceID = atomic.AddUint64(&pktTraceID, 1)
+		pkt.tracer = t
+	}
+}
+
+func (t *packetTracer) write(id uint64, stage, msg string) {
+	t.Lock()
+	defer t.Unlock()
+
+	fmt.Fprintf(t.f, "%v %016x %v: %v\n", time.Now().UTC().Format(time.RFC3339Nano), id, stage, msg)
+}
+
+func (t *packetTracer) close() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.f.Close()
+}
+
+func newPacketTracer(s *Server) (*packetTracer, error) {
+	p := s.cfg.Debug.PacketTraceFile
+	if p == "" {
+		p = defaultPacketTraceFile
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(s.dataDir(), p)
+	}
+
+	t := new(packetTracer)
+	t.mRand = rand.NewMath()
+	t.fraction = s.cfg.Debug.PacketTraceFraction
+
+	var err error
+	if t.f, err = os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, fmt.Errorf("server: failed to open packet trace file: %v", err)
+	}
+	return t, nil
+}
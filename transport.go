@@ -0,0 +1,93 @@
+// transport.go - Katzenpost server pluggable link transports.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	cpki "github.com/katzenpost/core/pki"
+)
+
+// Transport is a pluggable obfuscation layer that the link protocol can be
+// run under, to help nodes operate in networks that fingerprint or block
+// the native link protocol handshake.
+//
+// On failure, the Wrap methods should return a nil net.Conn and leave conn
+// open, as the caller retains ownership of conn and closes it.
+type Transport interface {
+	// WrapServer wraps a newly accepted connection.
+	WrapServer(conn net.Conn) (net.Conn, error)
+
+	// WrapClient wraps a newly established connection to the peer.
+	WrapClient(conn net.Conn, peer *cpki.MixDescriptor) (net.Conn, error)
+}
+
+var (
+	transportsLock sync.RWMutex
+	transports     = make(map[string]Transport)
+)
+
+// RegisterTransport registers a pluggable transport under name, for use by
+// the Server.AddressTransports and Server.PeerTransports configuration.  It
+// must be called before the Server is created.
+func RegisterTransport(name string, t Transport) error {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+
+	if _, ok := transports[name]; ok {
+		return fmt.Errorf("server: transport '%v' already registered", name)
+	}
+	transports[name] = t
+	return nil
+}
+
+func getTransport(name string) (Transport, error) {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+
+	t, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("server: transport '%v' is not registered", name)
+	}
+	return t, nil
+}
+
+// validateTransports ensures that every transport referred to by the
+// configuration is registered.
+func (s *Server) validateTransports() error {
+	for _, m := range []map[string]string{s.cfg.Server.AddressTransports, s.cfg.Server.PeerTransports} {
+		for _, name := range m {
+			if _, err := getTransport(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// peerTransport returns the transport used to connect to the peer address
+// addr, or nil if the link protocol should be used as is.
+func (s *Server) peerTransport(addr string) Transport {
+	name, ok := s.cfg.Server.PeerTransports[addr]
+	if !ok {
+		return nil
+	}
+	t, _ := getTransport(name) // Validated at startup.
+	return t
+}
@@ -22,13 +22,17 @@ import (
 	"crypto/subtle"
 	"fmt"
 	"sync"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/server/userdb"
 )
 
-const usersBucket = "users"
+const (
+	usersBucket    = "users"
+	userMetaBucket = "user_metadata"
+)
 
 type boltUserDB struct {
 	sync.RWMutex
@@ -90,9 +94,22 @@ func (d *boltUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
 	err := d.db.Update(func(tx *bolt.Tx) error {
 		// Grab the `users` bucket.
 		bkt := tx.Bucket([]byte(usersBucket))
+		isNew := bkt.Get(u) == nil
 
 		// And add or update the user's entry.
-		return bkt.Put(u, k.Bytes())
+		if err := bkt.Put(u, k.Bytes()); err != nil {
+			return err
+		}
+
+		// Record when new users were created.
+		if !isNew {
+			return nil
+		}
+		metaBkt, err := tx.Bucket([]byte(userMetaBucket)).CreateBucketIfNotExists(u)
+		if err != nil {
+			return err
+		}
+		return metaBkt.Put([]byte(userdb.MetadataCreated), userdb.EncodeTime(time.Now()))
 	})
 	if err == nil {
 		k := userToCacheKey(u)
@@ -115,8 +132,14 @@ func (d *boltUserDB) Remove(u []byte) error {
 		// Grab the `users` bucket.
 		bkt := tx.Bucket([]byte(usersBucket))
 
-		// Delete the user's entry.
-		return bkt.Delete(u)
+		// Delete the user's entry, and metadata.
+		if err := bkt.Delete(u); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(userMetaBucket)).DeleteBucket(u); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
 	})
 	if err == nil {
 		k := userToCacheKey(u)
@@ -129,6 +152,79 @@ func (d *boltUserDB) Remove(u []byte) error {
 	return err
 }
 
+func (d *boltUserDB) Users() ([][]byte, error) {
+	var users [][]byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+			users = append(users, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (d *boltUserDB) Metadata(u []byte) (map[string][]byte, error) {
+	if !d.Exists(u) {
+		return nil, userdb.ErrNoSuchUser
+	}
+
+	m := make(map[string][]byte)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(userMetaBucket)).Bucket(u)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			m[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *boltUserDB) GetMetadata(u []byte, key string) ([]byte, error) {
+	if !d.Exists(u) {
+		return nil, userdb.ErrNoSuchUser
+	}
+
+	var v []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket([]byte(userMetaBucket)).Bucket(u); bkt != nil {
+			if b := bkt.Get([]byte(key)); b != nil {
+				v = append([]byte{}, b...)
+			}
+		}
+		return nil
+	})
+	return v, err
+}
+
+func (d *boltUserDB) SetMetadata(u []byte, key string, value []byte) error {
+	if !d.Exists(u) {
+		return userdb.ErrNoSuchUser
+	}
+	if key == "" {
+		return fmt.Errorf("userdb: invalid metadata key")
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.Bucket([]byte(userMetaBucket)).CreateBucketIfNotExists(u)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return bkt.Delete([]byte(key))
+		}
+		return bkt.Put([]byte(key), value)
+	})
+}
+
 func (d *boltUserDB) Close() {
 	d.db.Sync()
 	d.db.Close()
@@ -159,6 +255,9 @@ func New(f string) (userdb.UserDB, error) {
 		if _, err = tx.CreateBucketIfNotExists([]byte(usersBucket)); err != nil {
 			return err
 		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(userMetaBucket)); err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
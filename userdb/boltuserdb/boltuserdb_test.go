@@ -22,13 +22,18 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-const testDB = "userdb.db"
+const (
+	testDB  = "userdb.db"
+	testTag = userdb.MetadataTagPrefix + "tier"
+)
 
 var (
 	tmpDir     string
@@ -68,6 +73,27 @@ func doTestCreate(t *testing.T) {
 	}
 	assert.False(d.Exists([]byte("malory")), "Exists('malory')")
 	assert.False(d.IsValid([]byte("malory"), testUsers["alice"]), "IsValid('malory', k)")
+
+	users, err := d.Users()
+	require.NoError(err, "Users()")
+	assert.Len(users, len(testUsers), "Users()")
+	for _, u := range users {
+		assert.Contains(testUsers, string(u), "Users(): '%s'", u)
+	}
+
+	// Users have their creation time recorded.
+	for u := range testUsers {
+		b, err := d.GetMetadata([]byte(u), userdb.MetadataCreated)
+		require.NoErrorf(err, "GetMetadata(%v, created)", u)
+		created, err := userdb.DecodeTime(b)
+		require.NoErrorf(err, "DecodeTime(%v created)", u)
+		assert.WithinDuration(time.Now(), created, time.Minute, "%v created", u)
+	}
+
+	err = d.SetMetadata([]byte("alice"), testTag, []byte("premium"))
+	require.NoError(err, "SetMetadata('alice', tag)")
+	err = d.SetMetadata([]byte("malory"), testTag, []byte("premium"))
+	assert.Equal(userdb.ErrNoSuchUser, err, "SetMetadata('malory', tag)")
 }
 
 func doTestLoad(t *testing.T) {
@@ -87,6 +113,26 @@ func doTestLoad(t *testing.T) {
 
 	err = d.Add([]byte("alice"), testUsers["alice"], false)
 	assert.Error(err, "Add('alice', k, false)")
+
+	// The metadata persists, and is removed along with the user.
+	m, err := d.Metadata([]byte("alice"))
+	require.NoError(err, "Metadata('alice')")
+	assert.Equal([]byte("premium"), m[testTag], "Metadata('alice'): tag")
+	assert.Contains(m, userdb.MetadataCreated, "Metadata('alice'): created")
+
+	err = d.SetMetadata([]byte("alice"), testTag, nil)
+	require.NoError(err, "SetMetadata('alice', tag, nil)")
+	v, err := d.GetMetadata([]byte("alice"), testTag)
+	require.NoError(err, "GetMetadata('alice', tag)")
+	assert.Nil(v, "GetMetadata('alice', tag) after removal")
+
+	err = d.Remove([]byte("bob"))
+	require.NoError(err, "Remove('bob')")
+	err = d.Add([]byte("bob"), testUsers["bob"], false)
+	require.NoError(err, "Add('bob', k, false) after Remove()")
+	m, err = d.Metadata([]byte("bob"))
+	require.NoError(err, "Metadata('bob')")
+	assert.Len(m, 1, "Metadata('bob') after re-Add()")
 }
 
 func init() {
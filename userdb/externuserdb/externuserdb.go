@@ -65,6 +65,22 @@ func (e ExternAuth) Remove(u []byte) error {
 	return errors.New("Not implemented: External authentication is enabled, you can not modify users")
 }
 
+func (e ExternAuth) Users() ([][]byte, error) {
+	return nil, errors.New("Not implemented: External authentication is enabled, you can not list users")
+}
+
+func (e ExternAuth) Metadata(u []byte) (map[string][]byte, error) {
+	return nil, errors.New("Not implemented: External authentication is enabled, there is no user metadata")
+}
+
+func (e ExternAuth) GetMetadata(u []byte, key string) ([]byte, error) {
+	return nil, errors.New("Not implemented: External authentication is enabled, there is no user metadata")
+}
+
+func (e ExternAuth) SetMetadata(u []byte, key string, value []byte) error {
+	return errors.New("Not implemented: External authentication is enabled, there is no user metadata")
+}
+
 func (e ExternAuth) Close() {
 }
 
@@ -19,12 +19,50 @@
 package userdb
 
 import (
+	"encoding/binary"
+	"errors"
+	"time"
+
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/sphinx/constants"
 )
 
-// MaxUsernameSize is the maximum username length in bytes.
-const MaxUsernameSize = constants.RecipientIDLength
+const (
+	// MaxUsernameSize is the maximum username length in bytes.
+	MaxUsernameSize = constants.RecipientIDLength
+
+	// MetadataCreated is the metadata key holding the time the user was
+	// added, as set by the user database.
+	MetadataCreated = "created"
+
+	// MetadataLastSeen is the metadata key holding the time the user last
+	// authenticated.
+	MetadataLastSeen = "last_seen"
+
+	// MetadataLastSpooled is the metadata key holding the time a message
+	// was last stored in the user's spool.
+	MetadataLastSpooled = "last_spooled"
+
+	// MetadataDisabled is the metadata key holding the time the user was
+	// disabled for being idle.  Disabled users can not authenticate.
+	MetadataDisabled = "disabled"
+
+	// MetadataExpiryWarned is the metadata key holding the time the user
+	// was warned of being disabled for being idle.
+	MetadataExpiryWarned = "expiry_warned"
+
+	// MetadataTier is the metadata key holding the name of the service
+	// tier the user is assigned to.
+	MetadataTier = "tier"
+
+	// MetadataTagPrefix is the prefix of the metadata keys holding the
+	// arbitrary tags set by the operator.
+	MetadataTagPrefix = "tag."
+)
+
+// ErrNoSuchUser is the error returned when attempting to access the metadata
+// of a user that does not exist.
+var ErrNoSuchUser = errors.New("userdb: no such user")
 
 // UserDB is the interface provided by all user database implementations.
 type UserDB interface {
@@ -43,6 +81,36 @@ type UserDB interface {
 	// Remove removes the user identified by the username from the database.
 	Remove([]byte) error
 
+	// Users returns the usernames of all of the users in the database.
+	Users() ([][]byte, error)
+
+	// Metadata returns all of the metadata entries of the user identified
+	// by the username.
+	Metadata([]byte) (map[string][]byte, error)
+
+	// GetMetadata returns the value of the metadata entry with the given
+	// key of the user identified by the username, or nil if not set.
+	GetMetadata([]byte, string) ([]byte, error)
+
+	// SetMetadata sets the metadata entry with the given key of the user
+	// identified by the username.  A nil value removes the entry.
+	SetMetadata([]byte, string, []byte) error
+
 	// Close closes the UserDB instance.
 	Close()
 }
+
+// EncodeTime serializes a time for storage as a metadata value.
+func EncodeTime(t time.Time) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.Unix()))
+	return b[:]
+}
+
+// DecodeTime deserializes a time stored as a metadata value.
+func DecodeTime(b []byte) (time.Time, error) {
+	if len(b) != 8 {
+		return time.Time{}, errors.New("userdb: malformed time")
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(b)), 0), nil
+}
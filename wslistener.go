@@ -0,0 +1,222 @@
+// wslistener.go - Katzenpost server WebSocket listener.
+// Copyright (C) 2017  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/server/config"
+	"golang.org/x/net/websocket"
+)
+
+var errWSListenerClosed = errors.New("websocket listener closed")
+
+// wsConn is a WebSocket connection carrying the wire protocol.
+type wsConn struct {
+	*websocket.Conn
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	closeOnce sync.Once
+	doneCh    chan interface{}
+}
+
+// LocalAddr returns the local network address.  The WebSocket package
+// returns the request URL instead, which is not useful here.
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote network address.  The WebSocket package
+// returns the client supplied Origin instead, which is not useful here.
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Close closes the connection.
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.doneCh) })
+	return err
+}
+
+// admittingListener is a net.Listener that only returns the connections that
+// pass the admission checks, and releases them once they are closed.
+type admittingListener struct {
+	net.Listener
+
+	admit   func(net.Conn) bool
+	release func(net.Addr)
+}
+
+// Accept waits for and returns the next admitted connection.
+func (l *admittingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.admit(conn) {
+			conn.Close()
+			continue
+		}
+		return &admittedConn{Conn: conn, release: l.release}, nil
+	}
+}
+
+// admittedConn is a connection returned by an admittingListener.
+type admittedConn struct {
+	net.Conn
+
+	release   func(net.Addr)
+	closeOnce sync.Once
+}
+
+// Close closes the connection, and releases it.
+func (c *admittedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { c.release(c.RemoteAddr()) })
+	return err
+}
+
+// wsListener is a net.Listener that accepts connections tunneled over
+// WebSocket (optionally over TLS).
+type wsListener struct {
+	l      net.Listener
+	tlsCfg *tls.Config
+	srv    *http.Server
+	connCh chan net.Conn
+
+	closeOnce sync.Once
+	closeCh   chan interface{}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		// The listener worker only terminates on non-temporary net.Errors.
+		return nil, &net.OpError{Op: "accept", Net: "websocket", Addr: l.Addr(), Err: errWSListenerClosed}
+	}
+}
+
+// Close closes the listener.  Already accepted connections are unaffected.
+func (l *wsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+		err = l.srv.Close()
+		l.l.Close() // Redundant once serving, but harmless.
+	})
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *wsListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+func (l *wsListener) onWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	remoteAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		return
+	}
+	conn := &wsConn{
+		Conn:       ws,
+		localAddr:  l.l.Addr(),
+		remoteAddr: remoteAddr,
+		doneCh:     make(chan interface{}),
+	}
+
+	select {
+	case l.connCh <- conn:
+	case <-l.closeCh:
+		return
+	}
+
+	// The WebSocket package closes the connection as soon as the handler
+	// returns, so block till the incoming connection is done with it.
+	<-conn.doneCh
+}
+
+// serve starts serving WebSocket connections, applying admit to the
+// underlying connections before the HTTP server sees them.  Admitted
+// connections are released via release once closed.
+func (l *wsListener) serve(admit func(net.Conn) bool, release func(net.Addr)) {
+	var nl net.Listener = &admittingListener{
+		Listener: l.l,
+		admit:    admit,
+		release:  release,
+	}
+	if l.tlsCfg != nil {
+		nl = tls.NewListener(nl, l.tlsCfg)
+	}
+	go l.srv.Serve(nl)
+}
+
+func newWSListener(cfg *config.WebSocket, addr string, handshakeTimeout time.Duration) (*wsListener, error) {
+	nl, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(wsListener)
+	l.l = nl
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			nl.Close()
+			return nil, err
+		}
+		l.tlsCfg = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	l.connCh = make(chan net.Conn)
+	l.closeCh = make(chan interface{})
+
+	// Clients are authenticated by the wire protocol, and are not browsers,
+	// so do not bother checking the Origin header.
+	wsSrv := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.onWebSocket,
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, wsSrv)
+	l.srv = &http.Server{
+		Handler: mux,
+
+		// Bound the time a connection may sit before the upgrade.  The
+		// upgraded connections are hijacked, and are subject to the wire
+		// protocol's timeouts instead.
+		ReadHeaderTimeout: handshakeTimeout,
+		IdleTimeout:       handshakeTimeout,
+	}
+
+	return l, nil
+}